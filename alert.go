@@ -0,0 +1,103 @@
+/*
+ * alert.go
+ *
+ * A primitive anomaly detector. Every fingerprint keeps a rolling baseline
+ * of its QPS and p95 latency (a moving average over the reports), and when a
+ * report comes in more than -alert-factor times over either one we say so,
+ * and the row carries the alert out to the sinks.
+ *
+ * Brand new fingerprints need a few reports to get a baseline, and ones
+ * with only a handful of queries in a report are too noisy to judge, so
+ * neither can alert. Baselines follow what they see, so something that
+ * stays up stops alerting after a while. That's meant for per interval
+ * numbers; with -cumulative everything moves too slowly to alert much.
+ *
+ * -alert-error-rate alerts on queries where too many come back with an
+ * error, no baseline needed.
+ *
+ * The baselines can be saved and picked up again next time, see
+ * baseline.go.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	ALERT_ALPHA  = 0.2 // weight of each new report in the baseline
+	ALERT_WARMUP = 3   // reports before a fingerprint has a baseline
+)
+
+type alertBaseline struct {
+	qps, p95 float64
+	reports  int
+}
+
+var alertFactor float64    // 0 for no alerts
+var alertErrorRate float64 // likewise, as a fraction of queries
+var alertMinCount uint64
+var baselines map[string]*alertBaseline = make(map[string]*alertBaseline)
+
+// checkAlerts compares each row to its fingerprint's baseline, setting alert
+// on any that are over it (and on the query until the next report, for the
+// API), and then adds the row to the baseline.
+func checkAlerts(rows []reportRow) {
+	for i := range rows {
+		r := &rows[i]
+		r.alert = ""
+		b, ok := baselines[r.query]
+		if !ok {
+			b = &alertBaseline{r.qps, r.p95, 0}
+			baselines[r.query] = b
+		}
+		r.score, r.isNew = b.score(r), b.isNew(r.query)
+		r.alert = b.check(r)
+		b.add(r)
+		if c := qbuf[r.query]; c != nil {
+			c.alert = r.alert
+		}
+	}
+}
+
+// check says what's wrong with a row, if anything.
+func (self *alertBaseline) check(r *reportRow) string {
+	if r.count < alertMinCount {
+		return ""
+	}
+	var why []string
+	if alertErrorRate > 0 && float64(r.errors) >= float64(r.count)*alertErrorRate {
+		why = append(why, fmt.Sprintf("%0.1f%% errors", float64(r.errors)/float64(r.count)*100))
+	}
+	if r.isNew {
+		why = append(why, "new query, not in the -baseline")
+	}
+	if alertFactor <= 0 || self.reports < ALERT_WARMUP {
+		return strings.Join(why, ", ")
+	}
+	if self.qps > 0 && r.qps > self.qps*alertFactor {
+		why = append(why, fmt.Sprintf("qps %0.2f/s is %0.1fx the usual %0.2f/s", r.qps, r.qps/self.qps, self.qps))
+	}
+	if self.p95 > 0 && r.p95 > self.p95*alertFactor {
+		why = append(why, fmt.Sprintf("p95 %0.2fms is %0.1fx the usual %0.2fms", r.p95, r.p95/self.p95, self.p95))
+	}
+	return strings.Join(why, ", ")
+}
+
+func (self *alertBaseline) add(r *reportRow) {
+	self.qps = ALERT_ALPHA*r.qps + (1-ALERT_ALPHA)*self.qps
+	self.p95 = ALERT_ALPHA*r.p95 + (1-ALERT_ALPHA)*self.p95
+	self.reports++
+}
+
+// printAlerts writes a line for every row that's alerting.
+func printAlerts(rows []reportRow) {
+	for _, r := range rows {
+		if r.alert != "" {
+			log.Printf("%sALERT %s: %s: %s%s", COLOR_RED, r.id, r.alert, r.query, COLOR_DEFAULT)
+		}
+	}
+}
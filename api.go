@@ -0,0 +1,421 @@
+/*
+ * api.go
+ *
+ * A small HTTP server for poking at the live numbers with curl or from other
+ * tools, all JSON:
+ *
+ *     /stats                 totals, packet counters and global latencies
+ *     /top?n=20&sort=avg     the top queries, as in the status report
+ *     /fingerprints/<id>     everything about one query, by its queryID
+ *     /connections           the client connections we're tracking
+ *     /processlist           what each of them is doing, see processlist.go
+ *     /tables?n=20&sort=avg  the busiest tables, with -tables
+ *     /clients?n=20&sort=avg the busiest clients, with -client-stats
+ *     /users?n=20&sort=avg   the busiest users, with -user-stats
+ *     /databases?n=20        the busiest databases, with -database-stats
+ *     /self                  how the sniffer itself is doing: memory,
+ *                            goroutines, how much it's tracking and how
+ *                            fast things are coming in
+ *     /debug/pprof/          the usual Go profiles
+ *
+ * Handlers don't touch our state themselves. They hand a function to the
+ * capture loop, which pauses the workers (see workers.go), runs it and
+ * hands back the answer. The profiles are the exception, since
+ * they take a while and only look at the runtime.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var apiRequests chan func()
+
+// What /self saw last time, for rates since then.
+var selfLast struct {
+	at               time.Time
+	packets, queries uint64
+}
+
+type apiQuery struct {
+	ID       string  `json:"id"`
+	Query    string  `json:"query"`
+	Type     int     `json:"type"`
+	Count    uint64  `json:"count"`
+	QPS      float64 `json:"qps"`
+	LifeQPS  float64 `json:"lifetime_qps"`
+	Min      float64 `json:"min_ms"`
+	Avg      float64 `json:"avg_ms"`
+	Max      float64 `json:"max_ms"`
+	Stddev   float64 `json:"stddev_ms"`
+	P50      float64 `json:"p50_ms"`
+	P95      float64 `json:"p95_ms"`
+	P99      float64 `json:"p99_ms"`
+	TTFB     float64 `json:"ttfb_ms"`
+	Bytes    uint64  `json:"bytes"`
+	BytesPer uint64  `json:"bytes_per"`
+	Errors   uint64  `json:"errors"`
+	Alert    string  `json:"alert,omitempty"`
+	Score    float64 `json:"score,omitempty"` // with -baseline
+}
+
+func newAPIQuery(r reportRow) apiQuery {
+	return apiQuery{r.id, r.query, r.ptype, r.count, r.qps, r.lifeqps,
+		r.min, r.avg, r.max, r.stddev, r.p50, r.p95, r.p99, r.ttfb, r.bytes, r.bytesPer, r.errors, r.alert,
+		r.score}
+}
+
+// startAPI serves on addr, or on ln if we've already got a listener.
+func startAPI(addr string, ln net.Listener) {
+	apiRequests = make(chan func())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", apiHandler(apiStats))
+	mux.HandleFunc("/top", apiHandler(apiTop))
+	mux.HandleFunc("/fingerprints/", apiHandler(apiFingerprint))
+	mux.HandleFunc("/connections", apiHandler(apiConnections))
+	mux.HandleFunc("/processlist", apiHandler(apiProcessList))
+	mux.HandleFunc("/tables", apiHandler(apiTables))
+	mux.HandleFunc("/clients", apiHandler(apiClients))
+	mux.HandleFunc("/users", apiHandler(apiUsers))
+	mux.HandleFunc("/databases", apiHandler(apiDatabases))
+	mux.HandleFunc("/self", apiHandler(apiSelf))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// Fail now rather than from inside the goroutine.
+	srv := &http.Server{Addr: addr, Handler: mux}
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			fatalf("Failed to listen on %s: %s", addr, err.Error())
+		}
+	}
+	go srv.Serve(ln)
+}
+
+// serviceAPI runs any other requests that are waiting. The capture loop
+// calls it paused.
+func serviceAPI() {
+	for {
+		select {
+		case f := <-apiRequests:
+			f()
+		default:
+			return
+		}
+	}
+}
+
+// apiHandler runs fn on the capture loop and writes out what it returns. A
+// nil result is a 404.
+func apiHandler(fn func(r *http.Request) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var result interface{}
+		done := make(chan bool)
+		apiRequests <- func() {
+			result = fn(r)
+			close(done)
+		}
+		<-done
+
+		if result == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	}
+}
+
+func apiElapsed() (elapsed, lifetime float64) {
+	lifetime = elapsedSince(start)
+	elapsed = lifetime
+	if !cumulative {
+		elapsed = elapsedSince(intervalStart)
+	}
+	return
+}
+
+func apiStats(r *http.Request) interface{} {
+	elapsed, lifetime := apiElapsed()
+	min, avg, max := calculateTimes(&times)
+	p50, p95, p99 := calculatePercentiles(&times)
+	_, ttfb, _ := calculateTimes(&ttfbTimes)
+	out := map[string]interface{}{
+		"uptime_seconds":   lifetime,
+		"interval_seconds": elapsed,
+		"queries":          scaled(uint64(querycount)),
+		"qps":              float64(scaled(uint64(querycount))) / lifetime,
+		"interval_queries": scaled(uint64(intervalcount)),
+		"interval_qps":     float64(scaled(uint64(intervalcount))) / elapsed,
+		"sample":           sampleRate,
+		"unique_queries":   len(qbuf),
+		"connections":      streamCount(),
+		"packets":          stats.packets.rcvd,
+		"packets_synced":   stats.packets.rcvd_sync,
+		"desyncs":          stats.desyncs,
+		"streams":          stats.streams,
+		"streams_closed":   stats.closed,
+		"streams_expired":  stats.expired,
+		"truncated":        stats.truncated,
+		"overflows":        stats.overflows,
+		"evicted":          stats.evicted,
+		"latency_ms": map[string]float64{
+			"min": min, "avg": avg, "max": max, "p50": p50, "p95": p95, "p99": p99, "ttfb": ttfb,
+		},
+	}
+	if transactionStats {
+		min, avg, max := calculateTimes(&txnStats.times)
+		p50, p95, p99 := calculatePercentiles(&txnStats.times)
+		out["transactions"] = map[string]interface{}{
+			"count":      txnStats.count,
+			"rollbacks":  txnStats.rollbacks,
+			"autocommit": txnStats.autocommit,
+			"time_ms": map[string]float64{
+				"min": min, "avg": avg, "max": max, "p50": p50, "p95": p95, "p99": p99,
+			},
+			"statements_avg": txnStats.statements.mean,
+			"statements_max": txnStats.statements.Max(),
+		}
+	}
+	if iface == nil {
+		// Collecting, see collector.go.
+		return out
+	}
+	if pstats, err := iface.Getstats(); err == nil {
+		out["capture"] = map[string]uint32{
+			"received":             pstats.PacketsReceived,
+			"dropped":              pstats.PacketsDropped,
+			"dropped_by_interface": pstats.PacketsIfDropped,
+			"dropped_by_queue":     uint32(queue.Dropped()),
+		}
+	}
+	return out
+}
+
+// apiTopArgs reads the n and sort arguments for the top N lists.
+func apiTopArgs(r *http.Request) (int, string) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 20
+	}
+	sortby := r.URL.Query().Get("sort")
+	if sortby == "" {
+		sortby = "count"
+	}
+	return n, sortby
+}
+
+func apiTop(r *http.Request) interface{} {
+	n, sortby := apiTopArgs(r)
+	elapsed, lifetime := apiElapsed()
+	rows := buildReport(elapsed, lifetime, sortby, 0)
+	if len(rows) > n {
+		rows = rows[:n]
+	}
+	out := make([]apiQuery, 0, len(rows))
+	for _, row := range rows {
+		out = append(out, newAPIQuery(row))
+	}
+	return out
+}
+
+func apiFingerprint(r *http.Request) interface{} {
+	id := strings.TrimPrefix(r.URL.Path, "/fingerprints/")
+	elapsed, lifetime := apiElapsed()
+	for q, c := range qbuf {
+		if queryID(q) != id {
+			continue
+		}
+		return map[string]interface{}{
+			"query":   newAPIQuery(newReportRow(q, c, elapsed, lifetime)),
+			"total":   c.total,
+			"example": c.example,
+		}
+	}
+	return nil
+}
+
+func apiTables(r *http.Request) interface{} {
+	type apiTable struct {
+		Table  string  `json:"table"`
+		Count  uint64  `json:"count"`
+		QPS    float64 `json:"qps"`
+		Avg    float64 `json:"avg_ms"`
+		Max    float64 `json:"max_ms"`
+		P95    float64 `json:"p95_ms"`
+		Bytes  uint64  `json:"bytes"`
+		Errors uint64  `json:"errors"`
+	}
+	if !tableStats {
+		return nil
+	}
+	rows := apiRollupRows(r, buildTableReport)
+	out := make([]apiTable, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, apiTable{r.query, r.count, r.qps, r.avg, r.max, r.p95, r.bytes, r.errors})
+	}
+	return out
+}
+
+func apiClients(r *http.Request) interface{} {
+	type apiClient struct {
+		Client string  `json:"client"`
+		Count  uint64  `json:"count"`
+		QPS    float64 `json:"qps"`
+		Avg    float64 `json:"avg_ms"`
+		Max    float64 `json:"max_ms"`
+		P95    float64 `json:"p95_ms"`
+		Bytes  uint64  `json:"bytes"`
+		Errors uint64  `json:"errors"`
+	}
+	if !clientStats {
+		return nil
+	}
+	rows := apiRollupRows(r, buildClientReport)
+	out := make([]apiClient, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, apiClient{r.query, r.count, r.qps, r.avg, r.max, r.p95, r.bytes, r.errors})
+	}
+	return out
+}
+
+func apiUsers(r *http.Request) interface{} {
+	type apiUser struct {
+		User      string  `json:"user"`
+		Count     uint64  `json:"count"`
+		QPS       float64 `json:"qps"`
+		Avg       float64 `json:"avg_ms"`
+		Max       float64 `json:"max_ms"`
+		P95       float64 `json:"p95_ms"`
+		Bytes     uint64  `json:"bytes"`
+		Errors    uint64  `json:"errors"`
+		ErrorRate float64 `json:"error_rate"`
+	}
+	if !userStats {
+		return nil
+	}
+	rows := apiRollupRows(r, buildUserReport)
+	out := make([]apiUser, 0, len(rows))
+	for _, r := range rows {
+		rate := 0.0
+		if r.count > 0 {
+			rate = float64(r.errors) / float64(r.count)
+		}
+		out = append(out, apiUser{r.query, r.count, r.qps, r.avg, r.max, r.p95, r.bytes, r.errors, rate})
+	}
+	return out
+}
+
+func apiDatabases(r *http.Request) interface{} {
+	type apiDatabase struct {
+		Database string  `json:"database"`
+		Count    uint64  `json:"count"`
+		QPS      float64 `json:"qps"`
+		Reads    uint64  `json:"reads"`
+		Writes   uint64  `json:"writes"`
+		Avg      float64 `json:"avg_ms"`
+		Max      float64 `json:"max_ms"`
+		P95      float64 `json:"p95_ms"`
+		Bytes    uint64  `json:"bytes"`
+		Errors   uint64  `json:"errors"`
+	}
+	if !databaseStats {
+		return nil
+	}
+	rows := apiRollupRows(r, buildDatabaseReport)
+	out := make([]apiDatabase, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, apiDatabase{r.query, r.count, r.qps, r.reads, r.writes, r.avg, r.max, r.p95, r.bytes,
+			r.errors})
+	}
+	return out
+}
+
+// apiRollupRows builds a report like -tables' for /tables and the like,
+// with n and sort from the request.
+func apiRollupRows(r *http.Request, build func(elapsed, lifetime float64, sortby string) []reportRow) []reportRow {
+	n, sortby := apiTopArgs(r)
+	elapsed, lifetime := apiElapsed()
+	rows := build(elapsed, lifetime, sortby)
+	if len(rows) > n {
+		rows = rows[:n]
+	}
+	return rows
+}
+
+func apiSelf(r *http.Request) interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	// Rates since the last time anyone asked, or since we started.
+	now := time.Now()
+	since, packets, queries := time.Unix(start, 0), uint64(0), uint64(0)
+	if !selfLast.at.IsZero() {
+		since, packets, queries = selfLast.at, selfLast.packets, selfLast.queries
+	}
+	seconds := now.Sub(since).Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+	out := map[string]interface{}{
+		"goroutines":      runtime.NumGoroutine(),
+		"heap_bytes":      mem.HeapAlloc,
+		"heap_objects":    mem.HeapObjects,
+		"sys_bytes":       mem.Sys,
+		"gc_runs":         mem.NumGC,
+		"gc_pause_ns":     mem.PauseTotalNs,
+		"fingerprints":    len(qbuf),
+		"tables":          len(tbuf),
+		"clients":         len(cbuf),
+		"users":           len(ubuf),
+		"databases":       len(dbuf),
+		"streams":         streamCount(),
+		"packets_per_sec": float64(stats.packets.rcvd-packets) / seconds,
+		"queries_per_sec": float64(uint64(querycount)-queries) / seconds,
+		"rate_seconds":    seconds,
+	}
+	selfLast.at, selfLast.packets, selfLast.queries = now, stats.packets.rcvd, uint64(querycount)
+	return out
+}
+
+func apiConnections(r *http.Request) interface{} {
+	type apiConnection struct {
+		Client  string  `json:"client"`
+		User    string  `json:"user"`
+		Schema  string  `json:"database"`
+		Synced  bool    `json:"synced"`
+		Pending int     `json:"pending"`
+		Queries uint64  `json:"queries"`
+		Avg     float64 `json:"avg_ms"`
+		Max     float64 `json:"max_ms"`
+	}
+	out := make([]apiConnection, 0, streamCount())
+	eachStream(func(rs *source) {
+		var avg float64
+		if rs.reqCount > 0 {
+			avg = float64(rs.reqTotal/rs.reqCount) / 1000000
+		}
+		out = append(out, apiConnection{rs.src, rs.user, rs.schema, rs.synced, len(rs.pending),
+			rs.reqCount, avg, float64(rs.reqMax) / 1000000})
+	})
+	return out
+}
+
+func apiProcessList(r *http.Request) interface{} {
+	return processList(processNow())
+}
@@ -0,0 +1,209 @@
+/*
+ * audit.go
+ *
+ * -audit: an append-only log of every request we see answered, for when an
+ * audit trail is required and the server's audit plugin isn't available.
+ * One JSON object per line, with when, who (client, user, database), what
+ * (the command and, for queries, their full text), and how much went each
+ * way.
+ *
+ * Each entry carries the SHA-256 of the one before, and its own hash covers
+ * that, so editing, dropping or reordering entries breaks the chain from
+ * there on. -audit-verify checks a file. It can't stop someone who rewrites
+ * the whole tail of the file, so ship it somewhere else too if that matters.
+ *
+ * Restarting carries on the chain from the end of the existing file.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+const AUDIT_GENESIS = "0000000000000000000000000000000000000000000000000000000000000000"
+
+type auditEntry struct {
+	Seq      uint64  `json:"seq"`
+	Time     string  `json:"time"`
+	Client   string  `json:"client"`
+	Port     int     `json:"port"`
+	User     string  `json:"user"`
+	Database string  `json:"database"`
+	Command  int     `json:"command"`
+	Query    string  `json:"query,omitempty"`
+	Request  uint64  `json:"request_bytes"`
+	Response uint64  `json:"response_bytes"`
+	Duration float64 `json:"duration_ms"`
+	Error    bool    `json:"error"`
+	Prev     string  `json:"prev"`
+}
+
+type auditLog struct {
+	path string
+	file *os.File
+	seq  uint64
+	prev string
+}
+
+var audit *auditLog
+
+func openAudit(path string) *auditLog {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		fatalf("Failed to open %s: %s", path, err.Error())
+	}
+	self := &auditLog{path: path, file: f, prev: AUDIT_GENESIS}
+
+	// Pick up where the file leaves off.
+	last, err := lastLine(f)
+	if err != nil {
+		fatalf("Failed to read %s: %s", path, err.Error())
+	}
+	if len(last) > 0 {
+		var e auditEntry
+		hash, body, ok := splitAuditLine(last)
+		if !ok || json.Unmarshal(body, &e) != nil {
+			fatalf("The last line of %s isn't an audit entry, won't append to it", path)
+		}
+		self.seq, self.prev = e.Seq+1, hash
+	}
+	return self
+}
+
+// lastLine reads the last line of a file, a block at a time from the end.
+func lastLine(f *os.File) ([]byte, error) {
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	var line []byte
+	for pos := end; pos > 0; {
+		n := int64(65536)
+		if n > pos {
+			n = pos
+		}
+		pos -= n
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, pos); err != nil {
+			return nil, err
+		}
+		line = append(buf, line...)
+		trimmed := bytes.TrimRight(line, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+	return bytes.TrimRight(line, "\n"), nil
+}
+
+// auditHash chains an entry on to the one before.
+func auditHash(prev string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// splitAuditLine takes the hash off the end of a line, giving back the
+// entry as it was hashed.
+func splitAuditLine(line []byte) (string, []byte, bool) {
+	i := bytes.LastIndex(line, []byte(`,"hash":"`))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return "", nil, false
+	}
+	hash := string(line[i+9 : len(line)-2])
+	return hash, append(line[:i:i], '}'), true
+}
+
+// Query logs one answered request.
+func (self *auditLog) Query(rs *source, req *pendingRequest, reqtime uint64, failed bool) {
+	host, pnum := splitClient(rs.sender(req))
+	body, _ := json.Marshal(auditEntry{
+		Seq:      self.seq,
+		Time:     req.sent.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		Client:   host,
+		Port:     pnum,
+		User:     rs.user,
+		Database: rs.schema,
+		Command:  req.ptype,
+		Query:    req.raw,
+		Request:  req.bytes,
+		Response: req.rbytes,
+		Duration: float64(reqtime) / 1000000,
+		Error:    failed,
+		Prev:     self.prev,
+	})
+	hash := auditHash(self.prev, body)
+	line := append(body[:len(body)-1], `,"hash":"`+hash+`"}`+"\n"...)
+	if _, err := self.file.Write(line); err != nil {
+		fatalf("Failed to write to %s: %s", self.path, err.Error())
+	}
+	self.seq++
+	self.prev = hash
+}
+
+// Write makes sure everything so far is on disk.
+func (self *auditLog) Write(rows []reportRow, elapsed float64) {
+	self.file.Sync()
+}
+
+func (self *auditLog) Close() {
+	self.file.Sync()
+	self.file.Close()
+}
+
+// verifyAudit checks the chain in an audit log, returning how many entries
+// there are or what's wrong with the first bad one.
+func verifyAudit(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	prev, n := AUDIT_GENESIS, uint64(0)
+	var first uint64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		line = bytes.TrimRight(line, "\n")
+
+		var e auditEntry
+		hash, body, ok := splitAuditLine(line)
+		if !ok || json.Unmarshal(body, &e) != nil {
+			return n, fmt.Errorf("line %d isn't an audit entry", n+1)
+		}
+		if n == 0 {
+			first = e.Seq
+		}
+		switch {
+		case e.Seq != first+n:
+			return n, fmt.Errorf("line %d: entry %d is out of sequence", n+1, e.Seq)
+		case e.Prev != prev:
+			return n, fmt.Errorf("line %d: entry %d doesn't follow on from the one before", n+1, e.Seq)
+		case auditHash(prev, body) != hash:
+			return n, fmt.Errorf("line %d: entry %d has been changed", n+1, e.Seq)
+		}
+		prev = hash
+		n++
+	}
+}
+
+// auditCommand is whether we keep the text of a request in the audit log.
+func auditCommand(ptype int) bool {
+	return ptype == COM_QUERY || ptype == COM_STMT_PREPARE
+}
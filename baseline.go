@@ -0,0 +1,161 @@
+/*
+ * baseline.go
+ *
+ * alert.go's baselines only live as long as we do, and the interesting
+ * moment, right after a release, is when we've just been restarted.
+ * -baseline-save writes them out after every report, and -baseline starts
+ * from a saved set, so a fingerprint that's been seen before is judged
+ * against how it used to be from the first report on. Pointing both at the
+ * same file keeps one learning across runs; keeping a copy from before a
+ * release and using that compares against the old normal instead.
+ *
+ * With -baseline, queries it's never seen are flagged as new until they've
+ * been around long enough to have a baseline of their own, and the report
+ * gets a section scoring the queries by how far over their baseline they
+ * are: the bigger of qps and p95 as a multiple of the usual. Baselines are
+ * kept by the query as counted, so the -f has to match.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// The default -alert-factor with -baseline.
+const BASELINE_FACTOR = 3
+
+// Only scores over this make the report.
+const BASELINE_MIN_SCORE = 1.5
+
+type savedBaseline struct {
+	ID      string  `json:"id"`
+	Query   string  `json:"query"`
+	QPS     float64 `json:"qps"`
+	P95     float64 `json:"p95_ms"`
+	Reports int     `json:"reports"`
+}
+
+type baselineProfile struct {
+	Saved     time.Time       `json:"saved"`
+	Baselines []savedBaseline `json:"baselines"`
+}
+
+var baselining bool               // keeping baselines for -baseline or -baseline-save
+var baselineKnown map[string]bool // what -baseline had, nil without it
+
+// loadBaselines starts the baselines off from a -baseline-save file. One
+// that isn't there yet is an empty one, so the same file can be used for
+// both from the first run.
+func loadBaselines(path string) {
+	baselineKnown = make(map[string]bool)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Info("No baselines yet, starting from scratch", "file", path)
+		return
+	}
+	if err != nil {
+		fatalf("Failed to read %s: %s", path, err.Error())
+	}
+	var profile baselineProfile
+	if err = json.Unmarshal(data, &profile); err != nil {
+		fatalf("%s isn't a baseline file: %s", path, err.Error())
+	}
+	for _, b := range profile.Baselines {
+		baselines[b.Query] = &alertBaseline{b.QPS, b.P95, b.Reports}
+		baselineKnown[b.Query] = true
+	}
+	logger.Info("Loaded baselines", "file", path, "queries", len(profile.Baselines),
+		"saved", profile.Saved.Format(time.RFC3339))
+}
+
+type baselineFile struct {
+	path string
+}
+
+// Write saves every baseline, which checkAlerts has brought up to date by
+// the time the sinks get the report.
+func (self *baselineFile) Write(rows []reportRow, elapsed float64) {
+	profile := baselineProfile{Saved: time.Now().UTC(), Baselines: make([]savedBaseline, 0, len(baselines))}
+	for q, b := range baselines {
+		profile.Baselines = append(profile.Baselines, savedBaseline{queryID(q), q, b.qps, b.p95, b.reports})
+	}
+	sort.Slice(profile.Baselines, func(i, j int) bool { return profile.Baselines[i].QPS > profile.Baselines[j].QPS })
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		fatalf("Failed to encode the baselines: %s", err.Error())
+	}
+
+	// A crash halfway through mustn't lose the lot.
+	tmp := self.path + ".tmp"
+	if err = os.WriteFile(tmp, append(data, '\n'), 0644); err == nil {
+		err = os.Rename(tmp, self.path)
+	}
+	if err != nil {
+		logger.Error("Failed to save the baselines", "file", self.path, "error", err)
+	}
+}
+
+func (self *baselineFile) Close() {}
+
+// isNew says whether -baseline has never seen a query, and it hasn't been
+// around long enough since to have a baseline of its own.
+func (self *alertBaseline) isNew(query string) bool {
+	return baselineKnown != nil && !baselineKnown[query] && self.reports < ALERT_WARMUP
+}
+
+// score is how far over its baseline a row is: the bigger of its qps and
+// p95 as a multiple of the usual, or 0 without a baseline yet.
+func (self *alertBaseline) score(r *reportRow) float64 {
+	if self.reports < ALERT_WARMUP {
+		return 0
+	}
+	var score float64
+	if self.qps > 0 {
+		score = r.qps / self.qps
+	}
+	if self.p95 > 0 && r.p95/self.p95 > score {
+		score = r.p95 / self.p95
+	}
+	return score
+}
+
+// printAnomalies is the -baseline part of the status report: new queries,
+// then the ones furthest over their baselines.
+func printAnomalies(rows []reportRow, displaycount int) {
+	var list []reportRow
+	for _, r := range rows {
+		if r.count >= alertMinCount && (r.isNew || r.score >= BASELINE_MIN_SCORE) {
+			list = append(list, r)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].isNew != list[j].isNew {
+			return list[i].isNew
+		}
+		return list[i].score > list[j].score
+	})
+	log.Printf(" ")
+	log.Printf("%d new queries or over their baselines", len(list))
+	if len(list) == 0 {
+		return
+	}
+	if len(list) > displaycount {
+		list = list[:displaycount]
+	}
+	log.Printf("%8s %10s %10s  %s", "score", "qps", "p95 [ms]", "query")
+	for _, r := range list {
+		score := fmt.Sprintf("%.1fx", r.score)
+		if r.isNew {
+			score = "new"
+		}
+		log.Printf("%8s %10.2f %10.2f  %s", score, r.qps, r.p95, r.query)
+	}
+}
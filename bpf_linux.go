@@ -0,0 +1,391 @@
+/*
+ * bpf_linux.go
+ *
+ * What the eBPF backends share: the bpf(2) syscall, loading programs, maps,
+ * a little assembler for programs too long to count the jumps in by hand,
+ * and reading the BPF ring buffer that the XDP and unix socket programs
+ * fill. There's no libbpf or compiler involved; the programs are put
+ * together instruction by instruction in Go.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// bpf(2) commands
+	BPF_MAP_CREATE          = 0
+	BPF_MAP_LOOKUP_ELEM     = 1
+	BPF_PROG_LOAD           = 5
+	BPF_RAW_TRACEPOINT_OPEN = 17
+	BPF_LINK_CREATE         = 28
+
+	BPF_MAP_TYPE_ARRAY   = 2
+	BPF_MAP_TYPE_RINGBUF = 27
+
+	// eBPF opcode fields
+	BPF_LD     = 0x00
+	BPF_LDX    = 0x01
+	BPF_ST     = 0x02
+	BPF_STX    = 0x03
+	BPF_ALU    = 0x04
+	BPF_JMP    = 0x05
+	BPF_JMP32  = 0x06
+	BPF_ALU64  = 0x07
+	BPF_W      = 0x00
+	BPF_H      = 0x08
+	BPF_B      = 0x10
+	BPF_DW     = 0x18
+	BPF_IMM    = 0x00
+	BPF_ABS    = 0x20
+	BPF_IND    = 0x40
+	BPF_MEM    = 0x60
+	BPF_ATOMIC = 0xc0
+	BPF_K      = 0x00
+	BPF_X      = 0x08
+	BPF_ADD    = 0x00
+	BPF_SUB    = 0x10
+	BPF_AND    = 0x50
+	BPF_LSH    = 0x60
+	BPF_RSH    = 0x70
+	BPF_MOV    = 0xb0
+	BPF_END    = 0xd0
+	BPF_TO_BE  = 0x08
+	BPF_JA     = 0x00
+	BPF_JEQ    = 0x10
+	BPF_JGT    = 0x20
+	BPF_JSET   = 0x40
+	BPF_JNE    = 0x50
+	BPF_JSGT   = 0x60
+	BPF_CALL   = 0x80
+	BPF_EXIT   = 0x90
+	BPF_JLT    = 0xa0
+	BPF_JLE    = 0xb0
+	BPF_JSLE   = 0xd0
+
+	BPF_PSEUDO_MAP_FD    = 1
+	BPF_PSEUDO_MAP_VALUE = 2
+
+	// helper functions
+	BPF_FUNC_ktime_get_ns    = 5
+	BPF_FUNC_ringbuf_reserve = 131
+	BPF_FUNC_ringbuf_submit  = 132
+	BPF_FUNC_ringbuf_discard = 133
+
+	BPF_RINGBUF_BUSY_BIT    = 1 << 31
+	BPF_RINGBUF_DISCARD_BIT = 1 << 30
+	BPF_RINGBUF_HDR_SZ      = 8
+)
+
+// struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high one
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code, dst | src<<4, off, imm}
+}
+
+// bpfAsm puts together a program whose jumps go to labels, for programs
+// too long to count the offsets by hand.
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (self *bpfAsm) emit(insns ...bpfInsn) {
+	self.insns = append(self.insns, insns...)
+}
+
+// jump emits a conditional jump comparing dst with imm (BPF_JA for an
+// unconditional one).
+func (self *bpfAsm) jump(op, dst uint8, imm int32, label string) {
+	self.jumpTo(insn(BPF_JMP|op|BPF_K, dst, 0, 0, imm), label)
+}
+
+// jump32 is jump comparing only the low 32 bits of dst.
+func (self *bpfAsm) jump32(op, dst uint8, imm int32, label string) {
+	self.jumpTo(insn(BPF_JMP32|op|BPF_K, dst, 0, 0, imm), label)
+}
+
+// jumpReg is jump comparing dst with the src register.
+func (self *bpfAsm) jumpReg(op, dst, src uint8, label string) {
+	self.jumpTo(insn(BPF_JMP|op|BPF_X, dst, src, 0, 0), label)
+}
+
+func (self *bpfAsm) jumpTo(jump bpfInsn, label string) {
+	if self.jumps == nil {
+		self.jumps = make(map[int]string)
+	}
+	self.jumps[len(self.insns)] = label
+	self.emit(jump)
+}
+
+func (self *bpfAsm) label(name string) {
+	if self.labels == nil {
+		self.labels = make(map[string]int)
+	}
+	self.labels[name] = len(self.insns)
+}
+
+// loadMap loads a map's fd (or with BPF_PSEUDO_MAP_VALUE, a pointer to its
+// first value), which the kernel swaps for the map when it loads us. It
+// takes two instructions.
+func (self *bpfAsm) loadMap(dst, kind uint8, fd int) {
+	self.emit(insn(BPF_LD|BPF_DW|BPF_IMM, dst, kind, 0, int32(fd)), bpfInsn{})
+}
+
+func (self *bpfAsm) program() []bpfInsn {
+	for at, label := range self.jumps {
+		to, ok := self.labels[label]
+		if !ok {
+			panic("no label " + label)
+		}
+		self.insns[at].off = int16(to - at - 1)
+	}
+	return self.insns
+}
+
+// The helpers we call are GPL only. It's a package variable so its address
+// can't move while the kernel reads it, like a local's could.
+var bpfLicense = []byte("GPL\x00")
+
+// loadProgram hands the program to bpf(BPF_PROG_LOAD) and returns the
+// program fd. Tracing programs say what they attach to with attachType and
+// the function's BTF id; the rest leave them 0.
+//
+// If the verifier rejects the program we load it again with the log turned
+// on, so the error can say why; asking for the log up front would fail a
+// program whose log didn't fit.
+func loadProgram(progType, attachType, attachBtfID uint32, prog []bpfInsn) (int, error) {
+	defer runtime.KeepAlive(prog)
+
+	// union bpf_attr, as used by BPF_PROG_LOAD
+	attr := struct {
+		progType           uint32
+		insnCnt            uint32
+		insns              uint64
+		license            uint64
+		logLevel           uint32
+		logSize            uint32
+		logBuf             uint64
+		kernVersion        uint32
+		progFlags          uint32
+		progName           [16]byte
+		progIfindex        uint32
+		expectedAttachType uint32
+		progBtfFd          uint32
+		funcInfoRecSize    uint32
+		funcInfo           uint64
+		funcInfoCnt        uint32
+		lineInfoRecSize    uint32
+		lineInfo           uint64
+		lineInfoCnt        uint32
+		attachBtfID        uint32
+		_                  [48]byte
+	}{
+		progType:           progType,
+		insnCnt:            uint32(len(prog)),
+		insns:              uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&bpfLicense[0]))),
+		expectedAttachType: attachType,
+		attachBtfID:        attachBtfID,
+	}
+	fd, err := bpf(BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		return fd, nil
+	}
+
+	vlog := make([]byte, 1<<20)
+	attr.logLevel, attr.logSize = 1, uint32(len(vlog))
+	attr.logBuf = uint64(uintptr(unsafe.Pointer(&vlog[0])))
+	if fd, err = bpf(BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err == nil {
+		return fd, nil
+	}
+	end := 0
+	for end < len(vlog) && vlog[end] != 0 {
+		end++
+	}
+	// The verdict is at the end.
+	start := end - 2048
+	if start < 0 {
+		start = 0
+	}
+	return -1, fmt.Errorf("BPF_PROG_LOAD: %s\n%s", err, vlog[start:end])
+}
+
+func createMap(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	// union bpf_attr, as used by BPF_MAP_CREATE
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+		_          [56]byte
+	}{mapType, keySize, valueSize, maxEntries, [56]byte{}}
+	fd, err := bpf(BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("BPF_MAP_CREATE: %s", err)
+	}
+	return fd, nil
+}
+
+// bpf makes the bpf(2) syscall, which the syscall package doesn't know.
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	sysno, ok := map[string]uintptr{
+		"386": 357, "amd64": 321, "arm": 386, "arm64": 280,
+		"ppc64le": 361, "riscv64": 280, "s390x": 351,
+	}[runtime.GOARCH]
+	if !ok {
+		return -1, fmt.Errorf("bpf(2) syscall number unknown on %s", runtime.GOARCH)
+	}
+	fd, _, errno := syscall.Syscall(sysno, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// bpfCounters is an array map of 64 bit counters for the programs to bump,
+// like how many records didn't fit in the ring.
+type bpfCounters struct {
+	fd int
+
+	// BPF_MAP_LOOKUP_ELEM's key and value, here rather than on the stack
+	// where they could move while the kernel has their addresses.
+	key   uint32
+	value uint64
+}
+
+func openCounters(n uint32) (*bpfCounters, error) {
+	fd, err := createMap(BPF_MAP_TYPE_ARRAY, 4, 8, n)
+	if err != nil {
+		return nil, err
+	}
+	return &bpfCounters{fd: fd}, nil
+}
+
+func (self *bpfCounters) get(i uint32) (uint64, error) {
+	self.key = i
+
+	// union bpf_attr, as used by BPF_MAP_LOOKUP_ELEM
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFd: uint32(self.fd),
+		key:   uint64(uintptr(unsafe.Pointer(&self.key))),
+		value: uint64(uintptr(unsafe.Pointer(&self.value)))}
+	if _, err := bpf(BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return 0, fmt.Errorf("BPF_MAP_LOOKUP_ELEM: %s", err)
+	}
+	return self.value, nil
+}
+
+func (self *bpfCounters) Close() {
+	syscall.Close(self.fd)
+}
+
+// bpfRing is a BPF ring buffer map, mapped so we can read the records
+// straight out of it. Each record has an 8 byte header the kernel fills in
+// last, so one with the busy bit set is still being written.
+type bpfRing struct {
+	fd       int
+	size     int
+	page     int
+	consumer []byte // our position, which is ours to write
+	data     []byte // the producer's position, then the ring mapped twice
+	next     uintptr
+	held     bool  // whether we've a record out, which ends at next
+	clock    int64 // add to bpf_ktime_get_ns() for the time of day
+}
+
+// openRing makes a ring buffer of size bytes, a power of 2.
+func openRing(size int) (*bpfRing, error) {
+	fd, err := createMap(BPF_MAP_TYPE_RINGBUF, 0, 0, uint32(size))
+	if err != nil {
+		return nil, err
+	}
+	self := &bpfRing{fd: fd, size: size, page: syscall.Getpagesize()}
+
+	// The rest is read only. The ring is mapped twice over so a record that
+	// wraps around reads as one piece.
+	self.consumer, err = syscall.Mmap(fd, 0, self.page, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err == nil {
+		self.data, err = syscall.Mmap(fd, int64(self.page), self.page+2*size, syscall.PROT_READ, syscall.MAP_SHARED)
+	}
+	if err != nil {
+		self.Close()
+		return nil, fmt.Errorf("mmap: %s", err)
+	}
+
+	var mono syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, 1, uintptr(unsafe.Pointer(&mono)), 0) // CLOCK_MONOTONIC
+	self.clock = time.Now().UnixNano() - mono.Nano()
+	return self, nil
+}
+
+// read returns the next record, waiting up to 100ms for one, or nil if
+// there isn't one yet. The record is only good until the next call, which
+// hands its space back to the kernel.
+func (self *bpfRing) read() []byte {
+	consumer := (*uintptr)(unsafe.Pointer(&self.consumer[0]))
+	producer := (*uintptr)(unsafe.Pointer(&self.data[0]))
+	if self.held {
+		atomic.StoreUintptr(consumer, self.next)
+		self.held = false
+	}
+	for tries := 0; ; {
+		pos := atomic.LoadUintptr(consumer)
+		if pos == atomic.LoadUintptr(producer) {
+			if tries++; tries > 1 {
+				return nil
+			}
+			waitReadable(self.fd)
+			continue
+		}
+
+		rec := self.data[self.page+int(pos&uintptr(self.size-1)):]
+		hdr := atomic.LoadUint32((*uint32)(unsafe.Pointer(&rec[0])))
+		if hdr&BPF_RINGBUF_BUSY_BIT != 0 {
+			// Still being written; it'll be there next time.
+			return nil
+		}
+		size := hdr &^ (BPF_RINGBUF_BUSY_BIT | BPF_RINGBUF_DISCARD_BIT)
+		next := pos + uintptr((size+BPF_RINGBUF_HDR_SZ+7)&^7)
+		if hdr&BPF_RINGBUF_DISCARD_BIT != 0 {
+			atomic.StoreUintptr(consumer, next)
+			continue
+		}
+		self.next, self.held = next, true
+		return rec[BPF_RINGBUF_HDR_SZ : BPF_RINGBUF_HDR_SZ+size]
+	}
+}
+
+// time turns a bpf_ktime_get_ns() timestamp into the time of day.
+func (self *bpfRing) time(ts uint64) time.Time {
+	return time.Unix(0, int64(ts)+self.clock)
+}
+
+func (self *bpfRing) Close() {
+	if self.data != nil {
+		syscall.Munmap(self.data)
+	}
+	if self.consumer != nil {
+		syscall.Munmap(self.consumer)
+	}
+	syscall.Close(self.fd)
+}
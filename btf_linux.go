@@ -0,0 +1,224 @@
+/*
+ * btf_linux.go
+ *
+ * Just enough of a BTF reader for the tracing programs in
+ * capture_unix_linux.go. BTF describes the running kernel's types, and is
+ * in /sys/kernel/btf/vmlinux on kernels built with CONFIG_DEBUG_INFO_BTF.
+ * We need three things from it: the ids of the functions the programs
+ * attach to, where the fields we read sit in the kernel's structs (which
+ * moves about between versions and configs), and a few enum values.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	BTF_MAGIC = 0xeb9f
+
+	BTF_KIND_INT      = 1
+	BTF_KIND_ARRAY    = 3
+	BTF_KIND_STRUCT   = 4
+	BTF_KIND_UNION    = 5
+	BTF_KIND_ENUM     = 6
+	BTF_KIND_TYPEDEF  = 8
+	BTF_KIND_VOLATILE = 9
+	BTF_KIND_CONST    = 10
+	BTF_KIND_RESTRICT = 11
+	BTF_KIND_FUNC     = 12
+	BTF_KIND_PROTO    = 13
+	BTF_KIND_VAR      = 14
+	BTF_KIND_DATASEC  = 15
+	BTF_KIND_DECL_TAG = 17
+	BTF_KIND_TYPE_TAG = 18
+	BTF_KIND_ENUM64   = 19
+)
+
+type btfSpec struct {
+	order   binary.ByteOrder
+	types   []byte
+	strings []byte
+	offs    []int // where each type starts in types, by id; 0 is void
+}
+
+// btfType is the part of struct btf_type every kind has.
+type btfType struct {
+	name     []byte
+	kind     int
+	vlen     int
+	kindFlag bool
+	typ      uint32 // the size, or the type this one refers to
+	extra    []byte // what follows, which depends on the kind
+}
+
+func loadBtf(path string) (*btfSpec, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 24 {
+		return nil, fmt.Errorf("%s: too short for BTF", path)
+	}
+	self := &btfSpec{order: binary.LittleEndian}
+	if self.order.Uint16(raw) != BTF_MAGIC {
+		self.order = binary.BigEndian
+		if self.order.Uint16(raw) != BTF_MAGIC {
+			return nil, fmt.Errorf("%s: not BTF", path)
+		}
+	}
+	hdrLen := self.order.Uint32(raw[4:])
+	typeOff, typeLen := self.order.Uint32(raw[8:]), self.order.Uint32(raw[12:])
+	strOff, strLen := self.order.Uint32(raw[16:]), self.order.Uint32(raw[20:])
+	if uint64(hdrLen)+uint64(typeOff)+uint64(typeLen) > uint64(len(raw)) ||
+		uint64(hdrLen)+uint64(strOff)+uint64(strLen) > uint64(len(raw)) {
+		return nil, fmt.Errorf("%s: BTF sections run past the end", path)
+	}
+	self.types = raw[hdrLen+typeOff : hdrLen+typeOff+typeLen]
+	self.strings = raw[hdrLen+strOff : hdrLen+strOff+strLen]
+
+	// Types are numbered from 1 in the order they come, and how long each
+	// one is depends on its kind, so we have to walk them all.
+	self.offs = []int{0}
+	for pos := 0; pos+12 <= len(self.types); {
+		self.offs = append(self.offs, pos)
+		info := self.order.Uint32(self.types[pos+4:])
+		kind, vlen := int(info>>24&0x1f), int(info&0xffff)
+		pos += 12
+		switch kind {
+		case BTF_KIND_INT, BTF_KIND_VAR, BTF_KIND_DECL_TAG:
+			pos += 4
+		case BTF_KIND_ARRAY:
+			pos += 12
+		case BTF_KIND_STRUCT, BTF_KIND_UNION, BTF_KIND_DATASEC, BTF_KIND_ENUM64:
+			pos += 12 * vlen
+		case BTF_KIND_ENUM, BTF_KIND_PROTO:
+			pos += 8 * vlen
+		}
+	}
+	return self, nil
+}
+
+func (self *btfSpec) str(off uint32) []byte {
+	if int(off) >= len(self.strings) {
+		return nil
+	}
+	s := self.strings[off:]
+	if end := bytes.IndexByte(s, 0); end >= 0 {
+		s = s[:end]
+	}
+	return s
+}
+
+func (self *btfSpec) get(id uint32) btfType {
+	if id == 0 || int(id) >= len(self.offs) {
+		return btfType{}
+	}
+	pos := self.offs[id]
+	info := self.order.Uint32(self.types[pos+4:])
+	return btfType{
+		name:     self.str(self.order.Uint32(self.types[pos:])),
+		kind:     int(info >> 24 & 0x1f),
+		vlen:     int(info & 0xffff),
+		kindFlag: info&(1<<31) != 0,
+		typ:      self.order.Uint32(self.types[pos+8:]),
+		extra:    self.types[pos+12:],
+	}
+}
+
+// find returns the id of the named type of the given kind. Structs that
+// are only declared somewhere have the kind FWD, so don't get in the way.
+func (self *btfSpec) find(kind int, name string) (uint32, error) {
+	for id := 1; id < len(self.offs); id++ {
+		if t := self.get(uint32(id)); t.kind == kind && string(t.name) == name {
+			return uint32(id), nil
+		}
+	}
+	return 0, fmt.Errorf("no %s in the kernel's BTF", name)
+}
+
+// resolve follows typedefs and qualifiers down to the type underneath.
+func (self *btfSpec) resolve(id uint32) btfType {
+	for {
+		t := self.get(id)
+		switch t.kind {
+		case BTF_KIND_TYPEDEF, BTF_KIND_VOLATILE, BTF_KIND_CONST, BTF_KIND_RESTRICT, BTF_KIND_TYPE_TAG:
+			id = t.typ
+		default:
+			return t
+		}
+	}
+}
+
+// offsetof returns the byte offset of a struct's field, looking inside
+// the anonymous structs and unions the kernel likes to wrap them in. The
+// field can be a path into structs within the struct, like a.b.
+func (self *btfSpec) offsetof(structName, field string) (int32, error) {
+	id, err := self.find(BTF_KIND_STRUCT, structName)
+	if err != nil {
+		return 0, err
+	}
+	t, bits := self.get(id), uint32(0)
+	for _, name := range strings.Split(field, ".") {
+		offset, typ, ok := self.member(t, name)
+		if !ok {
+			return 0, fmt.Errorf("no %s.%s in the kernel's BTF", structName, field)
+		}
+		t, bits = self.resolve(typ), bits+offset
+	}
+	return int32(bits / 8), nil
+}
+
+// member finds a field's offset in bits, and its type.
+func (self *btfSpec) member(t btfType, field string) (uint32, uint32, bool) {
+	if t.kind != BTF_KIND_STRUCT && t.kind != BTF_KIND_UNION {
+		return 0, 0, false
+	}
+	for i := 0; i < t.vlen; i++ {
+		m := t.extra[i*12:]
+		name := self.str(self.order.Uint32(m))
+		typ, offset := self.order.Uint32(m[4:]), self.order.Uint32(m[8:])
+		if t.kindFlag {
+			// The top byte is the width of a bitfield.
+			offset &= 0xffffff
+		}
+		if string(name) == field {
+			return offset, typ, true
+		}
+		if len(name) == 0 {
+			if bits, typ, ok := self.member(self.resolve(typ), field); ok {
+				return offset + bits, typ, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// enumValue returns the value of one of an enum's names.
+func (self *btfSpec) enumValue(enumName, name string) (int64, error) {
+	for id := 1; id < len(self.offs); id++ {
+		t := self.get(uint32(id))
+		if string(t.name) != enumName || (t.kind != BTF_KIND_ENUM && t.kind != BTF_KIND_ENUM64) {
+			continue
+		}
+		for i := 0; i < t.vlen; i++ {
+			if t.kind == BTF_KIND_ENUM {
+				v := t.extra[i*8:]
+				if string(self.str(self.order.Uint32(v))) == name {
+					return int64(int32(self.order.Uint32(v[4:]))), nil
+				}
+			} else {
+				v := t.extra[i*12:]
+				if string(self.str(self.order.Uint32(v))) == name {
+					return int64(uint64(self.order.Uint32(v[8:]))<<32 | uint64(self.order.Uint32(v[4:]))), nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no %s in the kernel's BTF", name)
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"github.com/akrennmair/gopcap"
+)
+
+type afpacketSource struct{}
+
+func openAfpacket(device string, fanout int) (*afpacketSource, error) {
+	return nil, errors.New("AF_PACKET capture is only available on Linux")
+}
+
+func (self *afpacketSource) NextEx() (*pcap.Packet, int32) {
+	return nil, -1
+}
+
+func (self *afpacketSource) Getstats() (*pcap.Stat, error) {
+	return nil, errors.New("not supported")
+}
+
+func (self *afpacketSource) Close() {
+}
@@ -0,0 +1,26 @@
+//go:build !386
+// +build !386
+
+/*
+ * capture_afpacket_sockopt_linux.go
+ *
+ * The syscall package has no getsockopt for a struct, so Getstats makes the
+ * call itself. linux/386 has no getsockopt syscall of its own and goes
+ * through socketcall instead, see capture_afpacket_sockopt_linux_386.go.
+ */
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func getsockopt(fd, level, name int, val unsafe.Pointer, vallen *uint32) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(val), uintptr(unsafe.Pointer(vallen)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
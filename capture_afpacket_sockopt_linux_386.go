@@ -0,0 +1,26 @@
+/*
+ * capture_afpacket_sockopt_linux_386.go
+ *
+ * getsockopt for linux/386, where the socket calls all go through
+ * socketcall(2).
+ */
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// From linux/net.h.
+const SOCKETCALL_GETSOCKOPT = 15
+
+func getsockopt(fd, level, name int, val unsafe.Pointer, vallen *uint32) error {
+	args := [5]uintptr{uintptr(fd), uintptr(level), uintptr(name), uintptr(val), uintptr(unsafe.Pointer(vallen))}
+	_, _, errno := syscall.Syscall(syscall.SYS_SOCKETCALL, SOCKETCALL_GETSOCKOPT,
+		uintptr(unsafe.Pointer(&args)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+ * capture_ebpf_linux.go
+ *
+ * An eBPF flavoured AF_PACKET backend. We load a small socket filter program
+ * into the kernel that only accepts IPv4 TCP segments on our port which carry
+ * a payload or close the connection (FIN or RST, like portFilter), and attach
+ * it to the TPACKET_V3 socket. Everything else (bare ACKs, other traffic) is
+ * dropped before it is ever copied into the ring, which is where most of our
+ * CPU goes on a busy 10G database host.
+ *
+ * This is a socket filter. Packets still take the normal path up through
+ * the kernel to AF_PACKET and reach us through the same TPACKET_V3 ring;
+ * the filter only decides which ones get copied in. -capture xdp (see
+ * capture_xdp_linux.go) filters at the driver instead, and saves more.
+ *
+ * The program is tiny, so it's assembled by hand here rather than pulling in
+ * a compiler toolchain; the bpf(2) plumbing is in bpf_linux.go.
+ */
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	BPF_PROG_TYPE_SOCKET_FILTER = 1
+	SO_ATTACH_BPF               = 50
+)
+
+// mysqlFilterProgram builds the socket filter. Registers: r6 holds the skb
+// (required by the legacy packet loads), r7 the IP header length, r8 the
+// TCP segment length which we whittle down to the payload length.
+func mysqlFilterProgram(port uint16) []bpfInsn {
+	p := int32(port)
+	return []bpfInsn{
+		insn(BPF_ALU64|BPF_MOV|BPF_X, 6, 1, 0, 0),      // r6 = skb
+		insn(BPF_LD|BPF_ABS|BPF_H, 0, 0, 0, 12),        // r0 = ethertype
+		insn(BPF_JMP|BPF_JNE|BPF_K, 0, 0, 25, 0x0800),  // not IPv4 -> drop
+		insn(BPF_LD|BPF_ABS|BPF_B, 0, 0, 0, 23),        // r0 = ip proto
+		insn(BPF_JMP|BPF_JNE|BPF_K, 0, 0, 23, 6),       // not TCP -> drop
+		insn(BPF_LD|BPF_ABS|BPF_H, 0, 0, 0, 20),        // r0 = frag offset
+		insn(BPF_JMP|BPF_JSET|BPF_K, 0, 0, 21, 0x1fff), // fragment -> drop
+		insn(BPF_LD|BPF_ABS|BPF_B, 0, 0, 0, 14),        // r0 = ver/ihl
+		insn(BPF_ALU64|BPF_AND|BPF_K, 0, 0, 0, 0x0f),
+		insn(BPF_ALU64|BPF_LSH|BPF_K, 0, 0, 0, 2),
+		insn(BPF_ALU64|BPF_MOV|BPF_X, 7, 0, 0, 0), // r7 = ip header len
+		insn(BPF_LD|BPF_ABS|BPF_H, 0, 0, 0, 16),   // r0 = ip total len
+		insn(BPF_ALU64|BPF_MOV|BPF_X, 8, 0, 0, 0),
+		insn(BPF_ALU64|BPF_SUB|BPF_X, 8, 7, 0, 0), // r8 = tcp segment len
+		insn(BPF_LD|BPF_IND|BPF_H, 0, 7, 0, 14),   // r0 = src port
+		insn(BPF_JMP|BPF_JEQ|BPF_K, 0, 0, 2, p),
+		insn(BPF_LD|BPF_IND|BPF_H, 0, 7, 0, 16),  // r0 = dst port
+		insn(BPF_JMP|BPF_JNE|BPF_K, 0, 0, 10, p), // neither -> drop
+		insn(BPF_LD|BPF_IND|BPF_B, 0, 7, 0, 26),  // r0 = tcp data offset
+		insn(BPF_ALU64|BPF_RSH|BPF_K, 0, 0, 0, 4),
+		insn(BPF_ALU64|BPF_LSH|BPF_K, 0, 0, 0, 2),
+		insn(BPF_ALU64|BPF_SUB|BPF_X, 8, 0, 0, 0),      // r8 = payload len
+		insn(BPF_JMP|BPF_JSGT|BPF_K, 8, 0, 3, 0),       // any payload -> keep
+		insn(BPF_LD|BPF_IND|BPF_B, 0, 7, 0, 27),        // r0 = tcp flags
+		insn(BPF_JMP|BPF_JSET|BPF_K, 0, 0, 1, 0x05),    // FIN or RST -> keep
+		insn(BPF_JMP|BPF_JSLE|BPF_K, 8, 0, 2, 0),       // empty -> drop
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 0, 0, 0, 0xffff), // keep the whole packet
+		insn(BPF_JMP|BPF_EXIT, 0, 0, 0, 0),
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 0, 0, 0, 0), // drop
+		insn(BPF_JMP|BPF_EXIT, 0, 0, 0, 0),
+	}
+}
+
+// openEbpf is openAfpacket plus our in-kernel filter.
+func openEbpf(device string, fanout int) (*afpacketSource, error) {
+	afp, err := openAfpacket(device, fanout)
+	if err != nil {
+		return nil, err
+	}
+
+	prog, err := loadSocketFilter(mysqlFilterProgram(port))
+	if err != nil {
+		afp.Close()
+		return nil, err
+	}
+	err = syscall.SetsockoptInt(afp.fd, syscall.SOL_SOCKET, SO_ATTACH_BPF, prog)
+	syscall.Close(prog) // the socket holds its own reference now
+	if err != nil {
+		afp.Close()
+		return nil, fmt.Errorf("SO_ATTACH_BPF: %s", err)
+	}
+	return afp, nil
+}
+
+// loadSocketFilter loads a program to attach to a socket with SO_ATTACH_BPF.
+func loadSocketFilter(prog []bpfInsn) (int, error) {
+	return loadProgram(BPF_PROG_TYPE_SOCKET_FILTER, 0, 0, prog)
+}
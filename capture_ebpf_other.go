@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func openEbpf(device string, fanout int) (*afpacketSource, error) {
+	return nil, errors.New("eBPF capture is only available on Linux")
+}
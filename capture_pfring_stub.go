@@ -0,0 +1,26 @@
+//go:build !pfring
+// +build !pfring
+
+package main
+
+import (
+	"errors"
+	"github.com/akrennmair/gopcap"
+)
+
+type pfringSource struct{}
+
+func openPfring(device, filter string, cluster int, snaplen int) (*pfringSource, error) {
+	return nil, errors.New("not built with PF_RING support (use -tags pfring)")
+}
+
+func (self *pfringSource) NextEx() (*pcap.Packet, int32) {
+	return nil, -1
+}
+
+func (self *pfringSource) Getstats() (*pcap.Stat, error) {
+	return nil, errors.New("not supported")
+}
+
+func (self *pfringSource) Close() {
+}
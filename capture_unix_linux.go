@@ -0,0 +1,608 @@
+/*
+ * capture_unix_linux.go
+ *
+ * Capturing MySQL over its unix socket, which never goes near a network
+ * interface, so none of the other backends can see it. Instead tracing
+ * programs watch the kernel's sock_send_length and sock_recv_length
+ * tracepoints, which every send and receive on a socket goes past: a send
+ * on one of ours gets copied into a BPF ring buffer, and a receive that
+ * finds the other end gone is the connection closing. They're BTF
+ * tracepoints, so the kernel needs CONFIG_DEBUG_INFO_BTF, but they don't
+ * need kprobes or the function tracer, which locked down kernels refuse.
+ *
+ * Only sockets on our path count: the server's end of a connection shares
+ * the listening socket's address, and the client's end is connected to it.
+ * Which of the two did the sending tells a request from a response.
+ *
+ * The tracepoint doesn't say where the data came from, so a third program
+ * on sys_enter notes the buffer each write() and sendto() is sending from,
+ * by thread, for the send to pick up. MySQL and its clients send that way.
+ * Sends made any other way (sendmsg(), writev(), sendfile()) and ones too
+ * big for the biggest record come through with their length but no data,
+ * and get counted as truncated like a packet cut short by the snaplen.
+ * Every write() on the host goes past that program, so it's kept short.
+ *
+ * The rest of the sniffer only knows TCP, so we make each send into a TCP
+ * frame over loopback, from a made up client port to -P, and a close into
+ * a FIN. Every client is 127.0.0.1 as far as -clients and the reports go.
+ * A client that sends COM_QUIT and hangs up doesn't leave the server
+ * anything to receive, so we take the COM_QUIT as the close.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/akrennmair/gopcap"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	BPF_PROG_TYPE_TRACING = 26
+	BPF_TRACE_RAW_TP      = 23
+
+	BPF_MAP_TYPE_LRU_HASH = 9
+
+	BPF_FUNC_map_lookup_elem      = 1
+	BPF_FUNC_map_update_elem      = 2
+	BPF_FUNC_map_delete_elem      = 3
+	BPF_FUNC_get_current_pid_tgid = 14
+	BPF_FUNC_probe_read_user      = 112
+	BPF_FUNC_probe_read_kernel    = 113
+
+	UNIX_RING_SIZE  = 1 << 25 // bytes of ring buffer
+	UNIX_RECORD_HDR = 32      // timestamp, connection, length, caplen, direction
+	UNIX_THREADS    = 1 << 14 // threads we can remember the buffer of at once
+
+	// What a record's for
+	UNIX_RESPONSE = 0
+	UNIX_REQUEST  = 1
+	UNIX_CLOSE    = 2
+
+	// Where the programs keep things on the stack
+	UNIX_SLOT_PTR   = -8
+	UNIX_SLOT_LEN   = -16
+	UNIX_SLOT_PEER  = -24
+	UNIX_SLOT_DIR   = -32
+	UNIX_SLOT_TOTAL = -40
+	UNIX_SLOT_KEY   = -48
+	UNIX_SLOT_COUNT = -56
+	UNIX_SLOT_NAME  = -184 // up to 128 bytes of struct sockaddr_un
+)
+
+// The sizes of record we reserve, like xdpFrameSizes.
+var unixDataSizes = []int32{256, 4096, 32768, 262144}
+
+// The syscalls that send from one buffer, and some that send without one,
+// which mustn't pick up a buffer noted for an earlier write(). regs says
+// where in struct pt_regs the buffer and its length are, as a field and an
+// offset from it.
+var unixSyscalls = map[string]struct {
+	single, other []int32
+	regs          [2]string
+	offset        [2]int32
+}{
+	"amd64": {[]int32{1, 44}, []int32{20, 40, 46, 275, 296, 307, 328, 426},
+		[2]string{"si", "dx"}, [2]int32{0, 0}},
+	"arm64": {[]int32{64, 206}, []int32{66, 70, 71, 76, 211, 269, 287, 426},
+		[2]string{"regs", "regs"}, [2]int32{8, 16}},
+}
+
+// unixLayout is what the programs need to know about the running kernel,
+// from its BTF.
+type unixLayout struct {
+	send, recv, sysEnter uint32 // the tracepoints' BTF ids
+
+	family   int32 // struct sock
+	sockType int32
+	addr     int32 // struct unix_sock
+	peer     int32
+	addrLen  int32 // struct unix_address
+	addrName int32
+	buf      int32 // struct pt_regs
+	count    int32
+}
+
+type unixSource struct {
+	ring     *bpfRing
+	dropped  *bpfCounters
+	buffers  int // the LRU hash of the buffer each thread's sending from
+	links    []int
+	conns    map[uint64]uint16 // the client port we made up for each connection
+	nextPort uint16
+	quit     *pcap.Packet // a close to hand over next
+	received uint32
+}
+
+// openUnix attaches our programs and maps the ring buffer they fill. path
+// has to be the path the server's socket was bound to, as the server has
+// it (SHOW VARIABLES LIKE 'socket'), or @name for an abstract socket.
+func openUnix(path string) (*unixSource, error) {
+	calls, ok := unixSyscalls[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("unix socket capture isn't supported on %s", runtime.GOARCH)
+	}
+	want, err := unixAddress(path)
+	if err != nil {
+		return nil, err
+	}
+	btf, err := loadBtf("/sys/kernel/btf/vmlinux")
+	if err != nil {
+		return nil, fmt.Errorf("the kernel's BTF: %s", err)
+	}
+	layout, err := unixLayoutFrom(btf)
+	if err != nil {
+		return nil, err
+	}
+
+	self := &unixSource{buffers: -1, conns: make(map[uint64]uint16), nextPort: 1024}
+	if self.ring, err = openRing(UNIX_RING_SIZE); err != nil {
+		return nil, err
+	}
+	if self.dropped, err = openCounters(1); err != nil {
+		self.Close()
+		return nil, err
+	}
+	if self.buffers, err = createMap(BPF_MAP_TYPE_LRU_HASH, 8, 16, UNIX_THREADS); err != nil {
+		self.Close()
+		return nil, err
+	}
+	err = self.attach(layout.sysEnter, unixBufferProgram(layout, calls.single, calls.other, self.buffers))
+	if err == nil {
+		err = self.attach(layout.send, unixSendProgram(layout, want, self.ring.fd, self.dropped.fd, self.buffers))
+	}
+	if err == nil {
+		err = self.attach(layout.recv, unixCloseProgram(layout, want, self.ring.fd, self.dropped.fd))
+	}
+	if err != nil {
+		self.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+// unixAddress is what the kernel keeps as the address of a socket bound to
+// path: the struct sockaddr_un, as long as it needs to be. A path has its
+// NUL on the end, an abstract name starts with one instead.
+func unixAddress(path string) ([]byte, error) {
+	name := append([]byte(path), 0)
+	if len(path) > 0 && path[0] == '@' {
+		name = append([]byte{0}, path[1:]...)
+	}
+	if len(path) == 0 || len(name) > 108 {
+		return nil, fmt.Errorf("bad unix socket path %q", path)
+	}
+	addr := make([]byte, 2, 2+len(name))
+	*(*uint16)(unsafe.Pointer(&addr[0])) = syscall.AF_UNIX
+	return append(addr, name...), nil
+}
+
+func unixLayoutFrom(btf *btfSpec) (*unixLayout, error) {
+	calls := unixSyscalls[runtime.GOARCH]
+	self := &unixLayout{}
+	var err error
+	tracepoint := func(dst *uint32, name string) {
+		if err == nil {
+			*dst, err = btf.find(BTF_KIND_TYPEDEF, "btf_trace_"+name)
+		}
+	}
+	field := func(dst *int32, structName, name string) {
+		if err == nil {
+			*dst, err = btf.offsetof(structName, name)
+		}
+	}
+	// sock_send_length and sock_recv_length are from Linux 6.3 on.
+	tracepoint(&self.send, "sock_send_length")
+	tracepoint(&self.recv, "sock_recv_length")
+	tracepoint(&self.sysEnter, "sys_enter")
+	field(&self.family, "sock", "__sk_common.skc_family")
+	field(&self.sockType, "sock", "sk_type")
+	field(&self.addr, "unix_sock", "addr")
+	field(&self.peer, "unix_sock", "peer")
+	field(&self.addrLen, "unix_address", "len")
+	field(&self.addrName, "unix_address", "name")
+	field(&self.buf, "pt_regs", calls.regs[0])
+	field(&self.count, "pt_regs", calls.regs[1])
+	self.buf += calls.offset[0]
+	self.count += calls.offset[1]
+	return self, err
+}
+
+// attach loads a program for the BTF tracepoint with the given id. Like
+// the XDP programs' links, the fd we get back keeps it attached.
+func (self *unixSource) attach(btfID uint32, prog []bpfInsn) error {
+	fd, err := loadProgram(BPF_PROG_TYPE_TRACING, BPF_TRACE_RAW_TP, btfID, prog)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// union bpf_attr, as used by BPF_RAW_TRACEPOINT_OPEN
+	attr := struct {
+		name   uint64
+		progFd uint32
+		_      [20]byte
+	}{progFd: uint32(fd)}
+	link, err := bpf(BPF_RAW_TRACEPOINT_OPEN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return fmt.Errorf("BPF_RAW_TRACEPOINT_OPEN: %s", err)
+	}
+	self.links = append(self.links, link)
+	return nil
+}
+
+// unixBufferProgram builds the program on sys_enter, whose arguments are
+// the syscall's registers and number, that notes the buffer a write() or
+// sendto() is sending from, by thread. The value is the buffer at fp-16
+// and its length at fp-8.
+func unixBufferProgram(l *unixLayout, single, other []int32, buffers int) []bpfInsn {
+	a := &bpfAsm{}
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 6, 1, 0, 0),
+		insn(BPF_LDX|BPF_MEM|BPF_DW, 7, 6, 8, 0)) // r7 = syscall
+	for _, nr := range single {
+		a.jump(BPF_JEQ, 7, nr, "single")
+	}
+	for _, nr := range other {
+		a.jump(BPF_JEQ, 7, nr, "other")
+	}
+	a.jump(BPF_JA, 0, 0, "exit")
+
+	a.label("single")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_DW, 1, 6, 0, 0), // r1 = regs
+		insn(BPF_LDX|BPF_MEM|BPF_DW, 2, 1, int16(l.buf), 0),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 10, 2, -16, 0),
+		insn(BPF_LDX|BPF_MEM|BPF_DW, 2, 1, int16(l.count), 0),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 10, 2, -8, 0),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_get_current_pid_tgid),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 10, 0, -24, 0))
+	a.loadMap(1, BPF_PSEUDO_MAP_FD, buffers)
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 2, 10, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 2, 0, 0, -24),
+		insn(BPF_ALU64|BPF_MOV|BPF_X, 3, 10, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 3, 0, 0, -16),
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 4, 0, 0, 0),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_map_update_elem))
+	a.jump(BPF_JA, 0, 0, "exit")
+
+	a.label("other")
+	a.emit(insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_get_current_pid_tgid),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 10, 0, -24, 0))
+	a.loadMap(1, BPF_PSEUDO_MAP_FD, buffers)
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 2, 10, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 2, 0, 0, -24),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_map_delete_elem))
+
+	a.label("exit")
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_K, 0, 0, 0, 0),
+		insn(BPF_JMP|BPF_EXIT, 0, 0, 0, 0))
+	return a.program()
+}
+
+// readKernel emits a bpf_probe_read_kernel() of size bytes at src+off onto
+// the stack at slot, going to fail if it can't be read (like a NULL
+// pointer).
+func readKernel(a *bpfAsm, slot int16, size int32, src uint8, off int32, fail string) {
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 3, src, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 3, 0, 0, off),
+		insn(BPF_ALU64|BPF_MOV|BPF_X, 1, 10, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 1, 0, 0, int32(slot)),
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, size),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_probe_read_kernel))
+	a.jump(BPF_JNE, 0, 0, fail)
+}
+
+// unixConnection emits the part the send and close programs start with:
+// which end of which connection the struct sock in the first argument is.
+// It leaves the connection (the client's struct sock, which both ends
+// agree on) in r9, and stores the direction unless it's a close. Sockets
+// that aren't ours go to "exit".
+//
+// Registers: r6 holds the context, r7 the socket, r8 the address we're
+// looking at.
+func unixConnection(a *bpfAsm, l *unixLayout, want []byte, close bool) {
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_DW, 7, 6, 0, 0))
+	a.jump(BPF_JEQ, 7, 0, "exit")
+	readKernel(a, UNIX_SLOT_LEN, 2, 7, l.family, "exit")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_H, 0, 10, UNIX_SLOT_LEN, 0))
+	a.jump(BPF_JNE, 0, syscall.AF_UNIX, "exit")
+	readKernel(a, UNIX_SLOT_LEN, 2, 7, l.sockType, "exit")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_H, 0, 10, UNIX_SLOT_LEN, 0))
+	a.jump(BPF_JNE, 0, syscall.SOCK_STREAM, "exit")
+
+	// Our own address is the server's, so we're its end and this is a
+	// response. The connection's the peer.
+	unixMatch(a, l, want, 7, "notown")
+	readKernel(a, UNIX_SLOT_PEER, 8, 7, l.peer, "exit")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_DW, 9, 10, UNIX_SLOT_PEER, 0))
+	if !close {
+		a.emit(insn(BPF_ST|BPF_MEM|BPF_DW, 10, 0, UNIX_SLOT_DIR, UNIX_RESPONSE))
+	}
+	a.jump(BPF_JA, 0, 0, "have")
+
+	// Otherwise our peer's address being the server's makes us the client.
+	a.label("notown")
+	readKernel(a, UNIX_SLOT_PEER, 8, 7, l.peer, "exit")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_DW, 9, 10, UNIX_SLOT_PEER, 0))
+	a.jump(BPF_JEQ, 9, 0, "exit")
+	unixMatch(a, l, want, 9, "exit")
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 9, 7, 0, 0))
+	if !close {
+		a.emit(insn(BPF_ST|BPF_MEM|BPF_DW, 10, 0, UNIX_SLOT_DIR, UNIX_REQUEST))
+	}
+
+	a.label("have")
+	a.jump(BPF_JEQ, 9, 0, "exit")
+}
+
+// unixMatch emits a comparison of the address of the struct unix_sock in
+// sk with want, carrying on if it's the same and going to nomatch if not.
+func unixMatch(a *bpfAsm, l *unixLayout, want []byte, sk uint8, nomatch string) {
+	readKernel(a, UNIX_SLOT_PTR, 8, sk, l.addr, nomatch)
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_DW, 8, 10, UNIX_SLOT_PTR, 0))
+	a.jump(BPF_JEQ, 8, 0, nomatch) // not bound to anything
+	readKernel(a, UNIX_SLOT_LEN, 4, 8, l.addrLen, nomatch)
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_W, 0, 10, UNIX_SLOT_LEN, 0))
+	a.jump32(BPF_JNE, 0, int32(len(want)), nomatch)
+	readKernel(a, UNIX_SLOT_NAME, int32(len(want)), 8, l.addrName, nomatch)
+	i := 0
+	for ; i+4 <= len(want); i += 4 {
+		a.emit(insn(BPF_LDX|BPF_MEM|BPF_W, 0, 10, int16(UNIX_SLOT_NAME+i), 0))
+		a.jump32(BPF_JNE, 0, *(*int32)(unsafe.Pointer(&want[i])), nomatch)
+	}
+	for ; i < len(want); i++ {
+		a.emit(insn(BPF_LDX|BPF_MEM|BPF_B, 0, 10, int16(UNIX_SLOT_NAME+i), 0))
+		a.jump32(BPF_JNE, 0, int32(want[i]), nomatch)
+	}
+}
+
+// unixSendProgram builds the program on sock_send_length, whose arguments
+// are the socket, what the send returned and its flags, that copies what
+// was sent into the ring from the buffer unixBufferProgram noted.
+//
+// Registers, after unixConnection: r7 the record, r8 the length we copy
+// and r9 the connection.
+func unixSendProgram(l *unixLayout, want []byte, ring, counters, buffers int) []bpfInsn {
+	a := &bpfAsm{}
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 6, 1, 0, 0))
+	unixConnection(a, l, want, false)
+
+	// The send returns an int, so only the low half of the register is
+	// ours.
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_DW, 8, 6, 8, 0))
+	a.jump32(BPF_JSLE, 8, 0, "exit")
+	a.emit(insn(BPF_ALU|BPF_MOV|BPF_X, 8, 8, 0, 0),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 10, 8, UNIX_SLOT_TOTAL, 0))
+
+	// Take the thread's buffer, which only counts for this send.
+	a.emit(insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_get_current_pid_tgid),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 10, 0, UNIX_SLOT_KEY, 0))
+	a.loadMap(1, BPF_PSEUDO_MAP_FD, buffers)
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 2, 10, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 2, 0, 0, UNIX_SLOT_KEY),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_map_lookup_elem))
+	a.jump(BPF_JEQ, 0, 0, "nodata")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_DW, 1, 0, 0, 0),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 10, 1, UNIX_SLOT_PTR, 0),
+		insn(BPF_LDX|BPF_MEM|BPF_DW, 1, 0, 8, 0),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 10, 1, UNIX_SLOT_COUNT, 0))
+	a.loadMap(1, BPF_PSEUDO_MAP_FD, buffers)
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 2, 10, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 2, 0, 0, UNIX_SLOT_KEY),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_map_delete_elem),
+		insn(BPF_LDX|BPF_MEM|BPF_DW, 1, 10, UNIX_SLOT_COUNT, 0))
+	a.jumpReg(BPF_JGT, 8, 1, "nodata") // sent more than the buffer held
+
+	// Too big for a record and we can't tell where the data starts.
+	last := unixDataSizes[len(unixDataSizes)-1]
+	a.jump(BPF_JGT, 8, last, "nodata")
+	a.jump(BPF_JLT, 8, 1, "exit")
+	for i, size := range unixDataSizes {
+		a.label(fmt.Sprintf("size%d", i))
+		if size != last {
+			a.jump(BPF_JGT, 8, size, fmt.Sprintf("size%d", i+1))
+		}
+		unixReserve(a, ring, size+UNIX_RECORD_HDR)
+		a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 1, 7, 0, 0),
+			insn(BPF_ALU64|BPF_ADD|BPF_K, 1, 0, 0, UNIX_RECORD_HDR),
+			insn(BPF_ALU64|BPF_MOV|BPF_X, 2, 8, 0, 0),
+			insn(BPF_LDX|BPF_MEM|BPF_DW, 3, 10, UNIX_SLOT_PTR, 0),
+			insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_probe_read_user))
+		a.jump(BPF_JNE, 0, 0, "submit")
+		a.emit(insn(BPF_STX|BPF_MEM|BPF_W, 7, 8, 20, 0)) // caplen
+		a.jump(BPF_JA, 0, 0, "submit")
+	}
+
+	a.label("nodata")
+	unixReserve(a, ring, UNIX_RECORD_HDR)
+	a.jump(BPF_JA, 0, 0, "submit")
+	unixTail(a, counters)
+	return a.program()
+}
+
+// unixCloseProgram builds the program on sock_recv_length, whose arguments
+// are the same as the send's. A receive that gets nothing found the other
+// end hung up.
+func unixCloseProgram(l *unixLayout, want []byte, ring, counters int) []bpfInsn {
+	a := &bpfAsm{}
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 6, 1, 0, 0),
+		insn(BPF_LDX|BPF_MEM|BPF_DW, 0, 6, 8, 0))
+	a.jump32(BPF_JNE, 0, 0, "exit")
+	a.emit(insn(BPF_ST|BPF_MEM|BPF_DW, 10, 0, UNIX_SLOT_TOTAL, 0),
+		insn(BPF_ST|BPF_MEM|BPF_DW, 10, 0, UNIX_SLOT_DIR, UNIX_CLOSE))
+	unixConnection(a, l, want, true)
+	unixReserve(a, ring, UNIX_RECORD_HDR)
+	a.jump(BPF_JA, 0, 0, "submit")
+	unixTail(a, counters)
+	return a.program()
+}
+
+// unixReserve emits reserving a record of size bytes into r7 and filling
+// in its header, with no data yet.
+func unixReserve(a *bpfAsm, ring int, size int32) {
+	a.loadMap(1, BPF_PSEUDO_MAP_FD, ring)
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, size),
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 3, 0, 0, 0),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_ringbuf_reserve))
+	a.jump(BPF_JEQ, 0, 0, "full")
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 7, 0, 0, 0),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_ktime_get_ns),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 7, 0, 0, 0),
+		insn(BPF_STX|BPF_MEM|BPF_DW, 7, 9, 8, 0),
+		insn(BPF_LDX|BPF_MEM|BPF_DW, 1, 10, UNIX_SLOT_TOTAL, 0),
+		insn(BPF_STX|BPF_MEM|BPF_W, 7, 1, 16, 0),
+		insn(BPF_ST|BPF_MEM|BPF_W, 7, 0, 20, 0),
+		insn(BPF_LDX|BPF_MEM|BPF_DW, 1, 10, UNIX_SLOT_DIR, 0),
+		insn(BPF_STX|BPF_MEM|BPF_W, 7, 1, 24, 0),
+		insn(BPF_ST|BPF_MEM|BPF_W, 7, 0, 28, 0))
+}
+
+// unixTail emits the ends the send and close programs share: submitting
+// the record in r7, counting one that didn't fit, and returning.
+func unixTail(a *bpfAsm, counters int) {
+	a.label("submit")
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 1, 7, 0, 0),
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, 0),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_ringbuf_submit))
+	a.jump(BPF_JA, 0, 0, "exit")
+
+	a.label("full")
+	a.loadMap(1, BPF_PSEUDO_MAP_VALUE, counters)
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, 1),
+		insn(BPF_STX|BPF_ATOMIC|BPF_DW, 1, 2, 0, BPF_ADD))
+
+	a.label("exit")
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_K, 0, 0, 0, 0),
+		insn(BPF_JMP|BPF_EXIT, 0, 0, 0, 0))
+}
+
+// NextEx mimics pcap's NextEx: it returns a packet and 1, or nil and 0 if
+// nothing showed up before the poll timeout.
+func (self *unixSource) NextEx() (*pcap.Packet, int32) {
+	if pkt := self.quit; pkt != nil {
+		self.quit = nil
+		self.received++
+		return pkt, 1
+	}
+	for {
+		body := self.ring.read()
+		if body == nil {
+			return nil, 0
+		}
+		if len(body) < UNIX_RECORD_HDR {
+			continue
+		}
+		ts := *(*uint64)(unsafe.Pointer(&body[0]))
+		conn := *(*uint64)(unsafe.Pointer(&body[8]))
+		total := *(*uint32)(unsafe.Pointer(&body[16]))
+		caplen := *(*uint32)(unsafe.Pointer(&body[20]))
+		dir := *(*uint32)(unsafe.Pointer(&body[24]))
+		if caplen > uint32(len(body)-UNIX_RECORD_HDR) {
+			caplen = uint32(len(body) - UNIX_RECORD_HDR)
+		}
+		payload := body[UNIX_RECORD_HDR : UNIX_RECORD_HDR+caplen]
+
+		client, ok := self.conns[conn]
+		if dir == UNIX_CLOSE {
+			// Both ends can see the other go, and the second has
+			// nothing left to say.
+			if !ok {
+				continue
+			}
+			delete(self.conns, conn)
+		} else if !ok {
+			client = self.clientPort()
+			self.conns[conn] = client
+		}
+
+		pkt := unixPacket(self.ring.time(ts), client, dir, total, payload)
+		if dir == UNIX_REQUEST && total == 5 && caplen == 5 && payload[4] == COM_QUIT {
+			self.quit = unixPacket(pkt.Time, client, UNIX_CLOSE, 0, nil)
+			delete(self.conns, conn)
+		}
+		self.received++
+		return pkt, 1
+	}
+}
+
+// clientPort makes up a port for a new connection, staying off ours.
+func (self *unixSource) clientPort() uint16 {
+	for {
+		p := self.nextPort
+		self.nextPort++
+		if self.nextPort == 0 {
+			self.nextPort = 1024
+		}
+		if p != port {
+			return p
+		}
+	}
+}
+
+// unixPacket dresses up a send as a TCP segment over loopback between the
+// client port and ours, or a close as a FIN. total is how much was sent,
+// however much of it we have.
+func unixPacket(ts time.Time, client uint16, dir, total uint32, payload []byte) *pcap.Packet {
+	frame := make([]byte, 54+len(payload))
+	frame[12], frame[13] = 0x08, 0x00 // IPv4
+
+	ip := frame[14:]
+	ip[0] = 0x45
+	if size := 40 + total; size <= 0xffff {
+		// Left 0 when it's too big, like with segmentation offload.
+		ip[2], ip[3] = byte(size>>8), byte(size)
+	}
+	ip[6] = 0x40 // don't fragment
+	ip[8], ip[9] = 64, 6
+	copy(ip[12:], []byte{127, 0, 0, 1, 127, 0, 0, 1})
+
+	tcp := ip[20:]
+	src, dst := client, port
+	if dir == UNIX_RESPONSE {
+		src, dst = port, client
+	}
+	tcp[0], tcp[1], tcp[2], tcp[3] = byte(src>>8), byte(src), byte(dst>>8), byte(dst)
+	tcp[12] = 0x50
+	tcp[13] = 0x18 // PSH, ACK
+	if dir == UNIX_CLOSE {
+		tcp[13] = TCP_FIN | 0x10
+	}
+	tcp[14], tcp[15] = 0xff, 0xff
+	copy(tcp[20:], payload)
+
+	return &pcap.Packet{
+		Time:   ts,
+		Caplen: uint32(len(frame)),
+		Len:    54 + total,
+		Data:   frame,
+		Type:   pcap.LINKTYPE_ETHERNET,
+	}
+}
+
+// Getstats reports the sends we've read and the ones that didn't fit in the
+// ring.
+func (self *unixSource) Getstats() (*pcap.Stat, error) {
+	dropped, err := self.dropped.get(0)
+	if err != nil {
+		return nil, err
+	}
+	return &pcap.Stat{PacketsReceived: self.received, PacketsDropped: uint32(dropped)}, nil
+}
+
+func (self *unixSource) Close() {
+	for _, link := range self.links {
+		syscall.Close(link)
+	}
+	self.links = nil
+	if self.dropped != nil {
+		self.dropped.Close()
+	}
+	if self.ring != nil {
+		self.ring.Close()
+	}
+	if self.buffers >= 0 {
+		syscall.Close(self.buffers)
+	}
+}
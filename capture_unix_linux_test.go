@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A few queries over a unix socket, seen by the tracing programs and
+// counted like any other capture, then COM_QUIT to hang up. Loading
+// programs needs root.
+func TestUnixSocket(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	path := filepath.Join(t.TempDir(), "mysqld.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	saved := stats
+	defer func() { stats = saved }()
+	parseFormat("#q")
+	resetAll()
+	src, err := openUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 1024)
+		for {
+			n, err := c.Read(buf)
+			if err != nil || buf[4] == COM_QUIT {
+				return
+			}
+			if n > 4 {
+				c.Write([]byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")))
+			}
+		}
+	}()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	for i := 0; i < 5; i++ {
+		c.Write([]byte(mysqlPacket(0, "\x03select 1")))
+		c.Read(buf)
+	}
+	c.Write([]byte(mysqlPacket(0, "\x01")))
+	c.Close()
+
+	w := newWorker()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		pkt, _ := src.NextEx()
+		if pkt == nil {
+			continue
+		}
+		if age := time.Since(pkt.Time); age < 0 || age > time.Minute {
+			t.Errorf("Expected the time of day on the packet, got %v", pkt.Time)
+		}
+		handlePacket(w, pkt)
+	}
+	if q := qbuf["select ?"]; q == nil || q.count != 5 || q.times.Count() != 5 || len(w.streams) != 0 {
+		t.Errorf("Expected 5 queries answered and the connection closed, got %+v and %v", q, w.streams)
+	}
+	if st, err := src.Getstats(); err != nil || st.PacketsDropped != 0 || st.PacketsReceived != 12 {
+		t.Errorf("Expected the queries, answers, COM_QUIT and its close and no drops, got %+v (%v)", st, err)
+	}
+}
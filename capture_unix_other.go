@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"github.com/akrennmair/gopcap"
+)
+
+type unixSource struct{}
+
+func openUnix(path string) (*unixSource, error) {
+	return nil, errors.New("unix socket capture is only available on Linux")
+}
+
+func (self *unixSource) NextEx() (*pcap.Packet, int32) {
+	return nil, -1
+}
+
+func (self *unixSource) Getstats() (*pcap.Stat, error) {
+	return nil, errors.New("not supported")
+}
+
+func (self *unixSource) Close() {
+}
@@ -0,0 +1,304 @@
+/*
+ * capture_xdp_linux.go
+ *
+ * The XDP capture backend. An XDP program on the interface's receive path,
+ * where the driver hands packets over before the kernel's done anything
+ * with them, and a TCX program on its transmit path look at every packet.
+ * The ones that are IPv4 TCP on our port and carry a payload or close the
+ * connection (FIN or RST, like portFilter) get copied into a BPF ring
+ * buffer, and the rest carry on untouched. We map the ring buffer and read
+ * the frames straight out of it, so there's no AF_PACKET socket, no copy of
+ * anything we don't want and no per-packet syscall.
+ *
+ * On loopback every packet is received as well as sent, so the XDP program
+ * sees them all on its own and there's no TCX program. Loopback and most
+ * virtual interfaces run XDP in the kernel's generic mode, which is slower
+ * than a driver that does it natively but still saves the copies.
+ *
+ * An interface takes only one XDP program, so only one sniffer can use this
+ * on it at a time. If the ring buffer fills up, packets are dropped in the
+ * kernel and counted; Getstats reports them like AF_PACKET's drops.
+ *
+ * Like the socket filter in capture_ebpf_linux.go, the programs are
+ * assembled by hand.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/akrennmair/gopcap"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	BPF_PROG_TYPE_SCHED_CLS = 3
+	BPF_PROG_TYPE_XDP       = 6
+
+	BPF_XDP        = 37
+	BPF_TCX_EGRESS = 47
+
+	XDP_FLAGS_SKB_MODE = 1 << 1
+
+	XDP_PASS = 2
+	TCX_NEXT = -1
+
+	BPF_FUNC_skb_load_bytes   = 26
+	BPF_FUNC_xdp_get_buff_len = 188
+	BPF_FUNC_xdp_load_bytes   = 189
+
+	XDP_RING_SIZE  = 1 << 25 // bytes of ring buffer
+	XDP_RECORD_HDR = 16      // our header in each record: timestamp, caplen, len
+)
+
+// The sizes of record we reserve. The verifier wants a constant size, so
+// the programs pick the smallest of these the frame fits in; anything
+// longer than the last (loopback's 64K MTU plus an Ethernet header) is
+// cut short, and we count it as truncated.
+var xdpFrameSizes = []int32{240, 1520, 9216, 65552}
+
+type xdpSource struct {
+	ring     *bpfRing
+	dropped  *bpfCounters // how many frames didn't fit in the ring
+	links    []int        // keeping the programs attached
+	received uint32
+}
+
+// openXdp attaches our programs to the named interface and maps the ring
+// buffer they fill.
+func openXdp(device string) (*xdpSource, error) {
+	ifc, err := net.InterfaceByName(device)
+	if err != nil {
+		return nil, err
+	}
+	self := &xdpSource{}
+	if self.ring, err = openRing(XDP_RING_SIZE); err != nil {
+		return nil, err
+	}
+	if self.dropped, err = openCounters(1); err != nil {
+		self.Close()
+		return nil, err
+	}
+
+	// Drivers that do XDP can still turn it down, when the interface is
+	// set up in a way they can't do it with (like virtio_net with offloads
+	// on), and then generic mode will have to do.
+	xdp := xdpCaptureProgram(port, self.ring.fd, self.dropped.fd, true)
+	if err = self.attach(BPF_PROG_TYPE_XDP, xdp, ifc.Index, BPF_XDP, 0); err != nil {
+		err = self.attach(BPF_PROG_TYPE_XDP, xdp, ifc.Index, BPF_XDP, XDP_FLAGS_SKB_MODE)
+	}
+	if err == nil && ifc.Flags&net.FlagLoopback == 0 {
+		err = self.attach(BPF_PROG_TYPE_SCHED_CLS, xdpCaptureProgram(port, self.ring.fd, self.dropped.fd, false),
+			ifc.Index, BPF_TCX_EGRESS, 0)
+	}
+	if err != nil {
+		self.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+// attach loads a program and links it to the interface. The link is what
+// keeps it there, so closing the link takes it off again.
+func (self *xdpSource) attach(progType uint32, prog []bpfInsn, ifindex int, attachType, flags uint32) error {
+	fd, err := loadProgram(progType, 0, 0, prog)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// union bpf_attr, as used by BPF_LINK_CREATE
+	attr := struct {
+		progFd     uint32
+		ifindex    uint32
+		attachType uint32
+		flags      uint32
+		_          [32]byte
+	}{progFd: uint32(fd), ifindex: uint32(ifindex), attachType: attachType, flags: flags}
+	link, err := bpf(BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return fmt.Errorf("BPF_LINK_CREATE (attach type %d): %s", attachType, err)
+	}
+	self.links = append(self.links, link)
+	return nil
+}
+
+// xdpCaptureProgram builds the program that copies our frames into the
+// ring: for XDP if xdp is set, otherwise for TCX. They differ only in how
+// they read the frame and what they return.
+//
+// Registers: r6 holds the context, r7 the IP header length and later the
+// record, r8 the TCP segment length which we whittle down to the payload
+// length and later the frame's length on the wire, and r9 the frame length
+// we copy. The headers are read onto the stack: Ethernet and IP at fp-64,
+// TCP at fp-24.
+func xdpCaptureProgram(port uint16, ring, counters int, xdp bool) []bpfInsn {
+	loadBytes, ret := int32(BPF_FUNC_skb_load_bytes), int32(TCX_NEXT)
+	if xdp {
+		loadBytes, ret = BPF_FUNC_xdp_load_bytes, XDP_PASS
+	}
+	p := int32(port)
+	a := &bpfAsm{}
+
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 6, 1, 0, 0)) // r6 = ctx
+	if xdp {
+		a.emit(insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_xdp_get_buff_len),
+			insn(BPF_ALU64|BPF_MOV|BPF_X, 9, 0, 0, 0)) // r9 = frame len
+	} else {
+		a.emit(insn(BPF_LDX|BPF_MEM|BPF_W, 9, 6, 0, 0)) // r9 = skb->len
+	}
+
+	// Ethernet and IP headers
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 1, 6, 0, 0),
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, 0),
+		insn(BPF_ALU64|BPF_MOV|BPF_X, 3, 10, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 3, 0, 0, -64),
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 4, 0, 0, 34),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, loadBytes))
+	a.jump(BPF_JNE, 0, 0, "pass")                      // too short
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_H, 0, 10, -52, 0), // r0 = ethertype
+		insn(BPF_ALU|BPF_END|BPF_TO_BE, 0, 0, 0, 16))
+	a.jump(BPF_JNE, 0, 0x0800, "pass")                 // not IPv4
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_B, 0, 10, -41, 0)) // r0 = ip proto
+	a.jump(BPF_JNE, 0, 6, "pass")                      // not TCP
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_H, 0, 10, -44, 0), // r0 = frag offset
+		insn(BPF_ALU|BPF_END|BPF_TO_BE, 0, 0, 0, 16))
+	a.jump(BPF_JSET, 0, 0x1fff, "pass")                // fragment
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_B, 7, 10, -50, 0), // r7 = ver/ihl
+		insn(BPF_ALU64|BPF_AND|BPF_K, 7, 0, 0, 0x0f),
+		insn(BPF_ALU64|BPF_LSH|BPF_K, 7, 0, 0, 2),  // r7 = ip header len
+		insn(BPF_LDX|BPF_MEM|BPF_H, 8, 10, -48, 0), // r8 = ip total len
+		insn(BPF_ALU|BPF_END|BPF_TO_BE, 8, 0, 0, 16),
+		insn(BPF_ALU64|BPF_SUB|BPF_X, 8, 7, 0, 0)) // r8 = tcp segment len
+
+	// TCP header
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 1, 6, 0, 0),
+		insn(BPF_ALU64|BPF_MOV|BPF_X, 2, 7, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 2, 0, 0, 14),
+		insn(BPF_ALU64|BPF_MOV|BPF_X, 3, 10, 0, 0),
+		insn(BPF_ALU64|BPF_ADD|BPF_K, 3, 0, 0, -24),
+		insn(BPF_ALU64|BPF_MOV|BPF_K, 4, 0, 0, 20),
+		insn(BPF_JMP|BPF_CALL, 0, 0, 0, loadBytes))
+	a.jump(BPF_JNE, 0, 0, "pass")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_H, 0, 10, -24, 0), // r0 = src port
+		insn(BPF_ALU|BPF_END|BPF_TO_BE, 0, 0, 0, 16))
+	a.jump(BPF_JEQ, 0, p, "ours")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_H, 0, 10, -22, 0), // r0 = dst port
+		insn(BPF_ALU|BPF_END|BPF_TO_BE, 0, 0, 0, 16))
+	a.jump(BPF_JNE, 0, p, "pass")
+	a.label("ours")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_B, 0, 10, -12, 0), // r0 = tcp data offset
+		insn(BPF_ALU64|BPF_RSH|BPF_K, 0, 0, 0, 4),
+		insn(BPF_ALU64|BPF_LSH|BPF_K, 0, 0, 0, 2),
+		insn(BPF_ALU64|BPF_SUB|BPF_X, 8, 0, 0, 0)) // r8 = payload len
+	a.jump(BPF_JSGT, 8, 0, "keep")
+	a.emit(insn(BPF_LDX|BPF_MEM|BPF_B, 0, 10, -11, 0)) // r0 = tcp flags
+	a.jump(BPF_JSET, 0, 0x05, "keep")                  // FIN or RST
+	a.jump(BPF_JA, 0, 0, "pass")
+
+	// Into the ring with it, cut down to the biggest record if need be.
+	last := xdpFrameSizes[len(xdpFrameSizes)-1]
+	a.label("keep")
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 8, 9, 0, 0)) // r8 = frame len
+	a.jump(BPF_JLE, 9, last, "short")
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_K, 9, 0, 0, last))
+	a.label("short")
+	a.jump(BPF_JLT, 9, 1, "pass")
+	for i, size := range xdpFrameSizes {
+		a.label(fmt.Sprintf("size%d", i))
+		if size != last {
+			a.jump(BPF_JGT, 9, size, fmt.Sprintf("size%d", i+1))
+		}
+		a.loadMap(1, BPF_PSEUDO_MAP_FD, ring)
+		a.emit(insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, size+XDP_RECORD_HDR),
+			insn(BPF_ALU64|BPF_MOV|BPF_K, 3, 0, 0, 0),
+			insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_ringbuf_reserve))
+		a.jump(BPF_JEQ, 0, 0, "full")
+		a.emit(insn(BPF_ALU64|BPF_MOV|BPF_X, 7, 0, 0, 0), // r7 = record
+			insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_ktime_get_ns),
+			insn(BPF_STX|BPF_MEM|BPF_DW, 7, 0, 0, 0),
+			insn(BPF_STX|BPF_MEM|BPF_W, 7, 9, 8, 0),
+			insn(BPF_STX|BPF_MEM|BPF_W, 7, 8, 12, 0),
+			insn(BPF_ALU64|BPF_MOV|BPF_X, 1, 6, 0, 0),
+			insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, 0),
+			insn(BPF_ALU64|BPF_MOV|BPF_X, 3, 7, 0, 0),
+			insn(BPF_ALU64|BPF_ADD|BPF_K, 3, 0, 0, XDP_RECORD_HDR),
+			insn(BPF_ALU64|BPF_MOV|BPF_X, 4, 9, 0, 0),
+			insn(BPF_JMP|BPF_CALL, 0, 0, 0, loadBytes),
+			insn(BPF_ALU64|BPF_MOV|BPF_X, 1, 7, 0, 0),
+			insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, 0))
+		a.jump(BPF_JNE, 0, 0, fmt.Sprintf("discard%d", i))
+		a.emit(insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_ringbuf_submit))
+		a.jump(BPF_JA, 0, 0, "pass")
+		a.label(fmt.Sprintf("discard%d", i))
+		a.emit(insn(BPF_JMP|BPF_CALL, 0, 0, 0, BPF_FUNC_ringbuf_discard))
+		a.jump(BPF_JA, 0, 0, "pass")
+	}
+
+	// The ring's full, so count it as dropped.
+	a.label("full")
+	a.loadMap(1, BPF_PSEUDO_MAP_VALUE, counters)
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_K, 2, 0, 0, 1),
+		insn(BPF_STX|BPF_ATOMIC|BPF_DW, 1, 2, 0, BPF_ADD))
+
+	a.label("pass")
+	a.emit(insn(BPF_ALU64|BPF_MOV|BPF_K, 0, 0, 0, ret),
+		insn(BPF_JMP|BPF_EXIT, 0, 0, 0, 0))
+	return a.program()
+}
+
+// NextEx mimics pcap's NextEx: it returns a packet and 1, or nil and 0 if
+// nothing showed up before the poll timeout.
+func (self *xdpSource) NextEx() (*pcap.Packet, int32) {
+	for {
+		body := self.ring.read()
+		if body == nil {
+			return nil, 0
+		}
+		if len(body) < XDP_RECORD_HDR {
+			continue
+		}
+		ts := *(*uint64)(unsafe.Pointer(&body[0]))
+		caplen := *(*uint32)(unsafe.Pointer(&body[8]))
+		wirelen := *(*uint32)(unsafe.Pointer(&body[12]))
+		if caplen > uint32(len(body)-XDP_RECORD_HDR) {
+			caplen = uint32(len(body) - XDP_RECORD_HDR)
+		}
+		// The kernel reuses the space once we move on.
+		data := make([]byte, caplen)
+		copy(data, body[XDP_RECORD_HDR:])
+		self.received++
+		return &pcap.Packet{
+			Time:   self.ring.time(ts),
+			Caplen: caplen,
+			Len:    wirelen,
+			Data:   data,
+			Type:   pcap.LINKTYPE_ETHERNET,
+		}, 1
+	}
+}
+
+// Getstats reports the frames we've read and the ones that didn't fit in
+// the ring.
+func (self *xdpSource) Getstats() (*pcap.Stat, error) {
+	dropped, err := self.dropped.get(0)
+	if err != nil {
+		return nil, err
+	}
+	return &pcap.Stat{PacketsReceived: self.received, PacketsDropped: uint32(dropped)}, nil
+}
+
+func (self *xdpSource) Close() {
+	for _, link := range self.links {
+		syscall.Close(link)
+	}
+	self.links = nil
+	if self.dropped != nil {
+		self.dropped.Close()
+	}
+	if self.ring != nil {
+		self.ring.Close()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// A few queries over loopback, through the XDP program and the ring buffer
+// and counted like any other capture. Loading programs needs root.
+func TestXdp(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port = uint16(ln.Addr().(*net.TCPAddr).Port)
+	saved := stats
+	defer func() { port, stats = 3306, saved }()
+	parseFormat("#q")
+	resetAll()
+	src, err := openXdp("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 1024)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				return
+			}
+			c.Write([]byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")))
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	for i := 0; i < 5; i++ {
+		c.Write([]byte(mysqlPacket(0, "\x03select 1")))
+		c.Read(buf)
+	}
+	c.Close()
+
+	w := newWorker()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		pkt, _ := src.NextEx()
+		if pkt == nil {
+			continue
+		}
+		if age := time.Since(pkt.Time); age < 0 || age > time.Minute {
+			t.Errorf("Expected the time of day on the packet, got %v", pkt.Time)
+		}
+		handlePacket(w, pkt)
+	}
+	if q := qbuf["select ?"]; q == nil || q.count != 5 || q.times.Count() != 5 || len(w.streams) != 0 {
+		t.Errorf("Expected 5 queries answered and the connection closed, got %+v and %v", q, w.streams)
+	}
+	if st, err := src.Getstats(); err != nil || st.PacketsDropped != 0 || st.PacketsReceived < 10 {
+		t.Errorf("Expected at least the queries and answers and no drops, got %+v (%v)", st, err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"github.com/akrennmair/gopcap"
+)
+
+type xdpSource struct{}
+
+func openXdp(device string) (*xdpSource, error) {
+	return nil, errors.New("XDP capture is only available on Linux")
+}
+
+func (self *xdpSource) NextEx() (*pcap.Packet, int32) {
+	return nil, -1
+}
+
+func (self *xdpSource) Getstats() (*pcap.Stat, error) {
+	return nil, errors.New("not supported")
+}
+
+func (self *xdpSource) Close() {
+}
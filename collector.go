@@ -0,0 +1,301 @@
+/*
+ * collector.go
+ *
+ * Fleet-wide numbers without reading sixty reports. Each sniffer runs with
+ * -agent collector:port and, at every status report, sends what it counted
+ * that interval: every query's counts and latency histograms, as one line
+ * of JSON. The collector is the same binary run with -collect :port instead
+ * of sniffing. It adds up what the agents send as if it had seen all the
+ * traffic itself, so the status report, -http, -tui and the other sinks
+ * all work on the whole fleet.
+ *
+ * Agents send interval numbers, so they can't run -cumulative (the
+ * collector can). With -sample they say so and the collector scales their
+ * counts up, latency histograms included, so the percentiles stay the
+ * same and the counts agree. Sending happens in the background, one report
+ * at a time. Like Graphite, an agent that can't reach the collector logs it
+ * and tries again next report, and a report that comes up while the last
+ * one is still trying is dropped; either way that interval is lost.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	AGENT_TIMEOUT = 5 * time.Second
+	AGENT_QUEUE   = 64 // reports waiting on the collector's main loop
+)
+
+type agentHistogram struct {
+	Buckets map[int]uint64 `json:"buckets"` // only the ones in use
+	Count   uint64         `json:"count"`
+	Sum     uint64         `json:"sum"`
+	Min     uint64         `json:"min"`
+	Max     uint64         `json:"max"`
+	Mean    float64        `json:"mean"`
+	M2      float64        `json:"m2"`
+}
+
+type agentQuery struct {
+	Query  string         `json:"query"`
+	Type   int            `json:"type"`
+	SType  string         `json:"stype,omitempty"`
+	Write  bool           `json:"write,omitempty"`
+	Star   bool           `json:"star,omitempty"`
+	Count  uint64         `json:"count"`
+	Bytes  uint64         `json:"bytes"`
+	Errors uint64         `json:"errors"`
+	Times  agentHistogram `json:"times"`
+	TTFB   agentHistogram `json:"ttfb"`
+}
+
+type agentReport struct {
+	Host     string         `json:"host"`
+	Interval float64        `json:"interval"`
+	Sample   float64        `json:"sample"`
+	Queries  []agentQuery   `json:"queries"`
+	Times    agentHistogram `json:"times"`
+	TTFB     agentHistogram `json:"ttfb"`
+}
+
+func toAgentHistogram(h *histogram) agentHistogram {
+	out := agentHistogram{Buckets: make(map[int]uint64), Count: h.count, Sum: h.sum,
+		Min: h.min, Max: h.max, Mean: h.mean, M2: h.m2}
+	h.each(func(i int, n uint64) {
+		out.Buckets[i] = n
+	})
+	return out
+}
+
+func fromAgentHistogram(a *agentHistogram) *histogram {
+	h := &histogram{count: a.Count, sum: a.Sum, min: a.Min, max: a.Max, mean: a.Mean, m2: a.M2}
+	for i, c := range a.Buckets {
+		if i >= 0 && i < HIST_BUCKETS && c != 0 {
+			h.add(i, c)
+		}
+	}
+	return h
+}
+
+// scaleHistogram makes h look like it saw 1/sample times as much. The
+// buckets are rounded as they add up, so they still come to the count.
+func scaleHistogram(h *histogram, sample float64) {
+	var seen, scaled uint64
+	for _, row := range h.rows {
+		if row == nil {
+			continue
+		}
+		for j, c := range row {
+			seen += c
+			next := uint64(float64(seen)/sample + 0.5)
+			row[j] = next - scaled
+			scaled = next
+		}
+	}
+	h.count = uint64(float64(h.count)/sample + 0.5)
+	h.sum = uint64(float64(h.sum)/sample + 0.5)
+	h.m2 /= sample
+}
+
+// The agent end.
+
+type agentSink struct {
+	addr    string
+	host    string
+	conn    net.Conn    // the sender's
+	queue   chan []byte // room for one, the report being sent
+	done    chan bool
+	dropped int
+}
+
+func openAgent(addr, host string) *agentSink {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		fatalf("Bad -agent address %s: %s", addr, err.Error())
+	}
+	if cumulative {
+		fatalf("-agent sends interval numbers, it can't be -cumulative")
+	}
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	self := &agentSink{addr: addr, host: host, queue: make(chan []byte, 1), done: make(chan bool)}
+	go self.sender()
+	return self
+}
+
+func (self *agentSink) Write(rows []reportRow, elapsed float64) {
+	report := agentReport{Host: self.host, Interval: elapsed, Sample: sampleRate,
+		Times: toAgentHistogram(&times), TTFB: toAgentHistogram(&ttfbTimes)}
+	for q, c := range qbuf {
+		if c.count == 0 {
+			continue
+		}
+		report.Queries = append(report.Queries, agentQuery{q, c.ptype, c.stype, c.write, c.star,
+			c.count, c.bytes, c.errors, toAgentHistogram(&c.times), toAgentHistogram(&c.ttfb)})
+	}
+	line, err := json.Marshal(report)
+	if err != nil {
+		fatalf("Failed to encode agent report: %s", err.Error())
+	}
+	select {
+	case self.queue <- append(line, '\n'):
+	default:
+		self.dropped++
+		logger.Warn("Dropped a report, still trying to send the last one to the collector", "addr", self.addr,
+			"dropped", self.dropped)
+	}
+}
+
+// sender gets the reports to the collector, connecting as needed.
+func (self *agentSink) sender() {
+	for line := range self.queue {
+		var err error
+		if self.conn == nil {
+			if self.conn, err = net.DialTimeout("tcp", self.addr, AGENT_TIMEOUT); err != nil {
+				logger.Warn("Failed to reach the collector", "addr", self.addr, "err", err)
+				self.conn = nil
+				continue
+			}
+		}
+		self.conn.SetWriteDeadline(time.Now().Add(AGENT_TIMEOUT))
+		if _, err = self.conn.Write(line); err != nil {
+			logger.Warn("Failed to send to the collector", "addr", self.addr, "err", err)
+			self.conn.Close()
+			self.conn = nil
+		}
+	}
+	if self.conn != nil {
+		self.conn.Close()
+	}
+	close(self.done)
+}
+
+// Close sends the last report, if there's one waiting.
+func (self *agentSink) Close() {
+	close(self.queue)
+	<-self.done
+}
+
+// The collector end.
+
+type collectorSink struct {
+	addr    string
+	reports chan agentReport
+	agents  map[string]time.Time // when we last heard from each
+	heard   map[string]bool      // ... this interval
+}
+
+var collector *collectorSink
+
+func openCollector(addr string) *collectorSink {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatalf("Failed to listen on %s: %s", addr, err.Error())
+	}
+	self := &collectorSink{
+		addr:    ln.Addr().String(),
+		reports: make(chan agentReport, AGENT_QUEUE),
+		agents:  make(map[string]time.Time),
+		heard:   make(map[string]bool),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				logger.Warn("Failed to accept an agent", "err", err)
+				continue
+			}
+			go self.read(conn)
+		}
+	}()
+	return self
+}
+
+// read decodes an agent's reports and hands them to the main loop.
+func (self *collectorSink) read(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var report agentReport
+		if err := dec.Decode(&report); err != nil {
+			return
+		}
+		self.reports <- report
+	}
+}
+
+// merge adds one agent's report to our numbers. The main loop calls it
+// paused.
+func (self *collectorSink) merge(report agentReport) {
+	self.agents[report.Host] = time.Now()
+	self.heard[report.Host] = true
+
+	sampled := report.Sample > 0 && report.Sample < 1
+	scale := func(n uint64) uint64 {
+		if !sampled {
+			return n
+		}
+		return uint64(float64(n)/report.Sample + 0.5)
+	}
+	hist := func(a *agentHistogram) *histogram {
+		h := fromAgentHistogram(a)
+		if sampled {
+			scaleHistogram(h, report.Sample)
+		}
+		return h
+	}
+	for i := range report.Queries {
+		q := &report.Queries[i]
+		qdata, ok := qbuf[q.Query]
+		if !ok {
+			if maxFingerprints > 0 && len(qbuf) >= maxFingerprints {
+				evictFingerprints()
+			}
+			qdata = &queryData{stype: q.SType, write: q.Write, star: q.Star}
+			qbuf[q.Query] = qdata
+		}
+		count := scale(q.Count)
+		querycount += int(count)
+		intervalcount += int(count)
+		qdata.last = querycount
+		qdata.ptype = q.Type
+		qdata.count += count
+		qdata.total += count
+		qdata.bytes += scale(q.Bytes)
+		qdata.errors += scale(q.Errors)
+		qdata.times.Merge(hist(&q.Times))
+		qdata.ttfb.Merge(hist(&q.TTFB))
+	}
+	times.Merge(hist(&report.Times))
+	ttfbTimes.Merge(hist(&report.TTFB))
+}
+
+// Write says who we heard from, and who's gone quiet.
+func (self *collectorSink) Write(rows []reportRow, elapsed float64) {
+	var quiet []string
+	for host := range self.agents {
+		if !self.heard[host] {
+			quiet = append(quiet, host)
+		}
+	}
+	sort.Strings(quiet)
+	line := ""
+	if len(quiet) > 0 {
+		line = ", nothing from " + strings.Join(quiet, ", ")
+	}
+	log.Printf("%sFleet: %d agents reporting%s%s", COLOR_WHITE, len(self.heard), line, COLOR_DEFAULT)
+	self.heard = make(map[string]bool)
+}
+
+func (self *collectorSink) Close() {
+}
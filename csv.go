@@ -0,0 +1,80 @@
+/*
+ * csv.go
+ *
+ * Writes each status report out as CSV, one row per query, so the numbers
+ * can go straight into a spreadsheet or get loaded into a database. The
+ * columns are fixed; add new ones at the end so old loaders keep working.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"time"
+)
+
+var csvColumns = []string{
+	"time", "interval", "query", "type", "count", "qps", "lifetime_qps",
+	"min_ms", "avg_ms", "max_ms", "stddev_ms", "p50_ms", "p95_ms", "p99_ms",
+	"ttfb_ms", "bytes", "bytes_per", "alert",
+}
+
+type csvReport struct {
+	path   string
+	file   *os.File
+	writer *csv.Writer
+}
+
+// openCSV creates the file (or uses stdout for "-") and writes the header.
+func openCSV(path string) *csvReport {
+	self := &csvReport{path: path, file: os.Stdout}
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fatalf("Failed to create %s: %s", path, err.Error())
+		}
+		self.file = f
+	}
+	self.writer = csv.NewWriter(self.file)
+	self.writer.Write(csvColumns)
+	self.flush()
+	return self
+}
+
+// Write adds one report's worth of rows. elapsed is the length of the
+// interval in seconds.
+func (self *csvReport) Write(rows []reportRow, elapsed float64) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	interval := strconv.FormatFloat(elapsed, 'f', 0, 64)
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+
+	for _, r := range rows {
+		self.writer.Write([]string{
+			now, interval, r.query, strconv.Itoa(r.ptype),
+			strconv.FormatUint(r.count, 10),
+			strconv.FormatFloat(r.qps, 'f', 2, 64),
+			strconv.FormatFloat(r.lifeqps, 'f', 2, 64),
+			ms(r.min), ms(r.avg), ms(r.max), ms(r.stddev),
+			ms(r.p50), ms(r.p95), ms(r.p99), ms(r.ttfb),
+			strconv.FormatUint(r.bytes, 10), strconv.FormatUint(r.bytesPer, 10),
+			r.alert,
+		})
+	}
+	self.flush()
+}
+
+// We can be killed at any time, so don't sit on anything.
+func (self *csvReport) flush() {
+	self.writer.Flush()
+	if err := self.writer.Error(); err != nil {
+		fatalf("Failed to write to %s: %s", self.path, err.Error())
+	}
+}
+
+func (self *csvReport) Close() {
+	if self.file != os.Stdout {
+		self.file.Close()
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * daemon.go
+ *
+ * Bits for running as a service. Under systemd or runit, stay in the
+ * foreground and use -log and -pidfile as needed. Otherwise -daemon starts
+ * us again in the background, in our own session, and returns once it looks
+ * like we got going (or with the exit code if we didn't).
+ *
+ * With -log everything we'd print goes to the one file, and SIGHUP reopens
+ * it so logrotate can move it out from under us.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DAEMON_ENV  = "MYSQL_SNIFFER_DAEMON" // set in the background copy
+	DAEMON_WAIT = 2 * time.Second        // how long it gets to fail before we call it started
+)
+
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+var logfile *logFile
+
+// openLog sends the log to a file, reopening it on SIGHUP.
+func openLog(path string) *logFile {
+	self := &logFile{path: path}
+	if err := self.reopen(); err != nil {
+		fatalf("Failed to open %s: %s", path, err.Error())
+	}
+	log.SetOutput(self)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := self.reopen(); err != nil {
+				logger.Warn("Failed to reopen the log, carrying on with the old one", "path", path, "err", err)
+			}
+		}
+	}()
+	return self
+}
+
+func (self *logFile) reopen() error {
+	f, err := os.OpenFile(self.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	self.mu.Lock()
+	old := self.file
+	self.file = f
+	self.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (self *logFile) Write(p []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.file.Write(p)
+}
+
+// writePidfile records our pid, unless something that's still running
+// already has.
+func writePidfile(path string) {
+	if data, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			fatalf("Already running as pid %d, according to %s", pid, path)
+		}
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		fatalf("Failed to write %s: %s", path, err.Error())
+	}
+}
+
+// daemonize starts another copy of us in the background and exits, unless
+// we're that copy.
+func daemonize() {
+	if os.Getenv(DAEMON_ENV) != "" {
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fatalf("Failed to find ourselves to start in the background: %s", err.Error())
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fatalf("Failed to open %s: %s", os.DevNull, err.Error())
+	}
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), DAEMON_ENV+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		fatalf("Failed to start in the background: %s", err.Error())
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case <-exited:
+		fmt.Fprintf(os.Stderr, "Exited with %d right after starting, see the -log for why\n",
+			cmd.ProcessState.ExitCode())
+		os.Exit(cmd.ProcessState.ExitCode())
+	case <-time.After(DAEMON_WAIT):
+	}
+	fmt.Fprintf(os.Stderr, "Running in the background as pid %d\n", cmd.Process.Pid)
+	os.Exit(0)
+}
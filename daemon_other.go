@@ -0,0 +1,29 @@
+//go:build !unix
+
+/*
+ * daemon_other.go
+ *
+ * Outside unix there are no sessions to leave, and the background copy
+ * carries on after we exit anyway, so -daemon just starts it without a
+ * console to talk to.
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// On Windows, finding a process opens it, which fails once it's gone.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+func detach(cmd *exec.Cmd) {
+}
@@ -0,0 +1,168 @@
+/*
+ * decap.go
+ *
+ * Link layer and tunnel unwrapping. Mirrored traffic (AWS VPC Traffic
+ * Mirroring, switch SPAN over GRE, Cisco ERSPAN, ...) arrives wrapped in an outer IP packet
+ * and we have to dig the original frame out before we can look at it.
+ */
+
+package main
+
+import (
+	"github.com/akrennmair/gopcap"
+)
+
+const (
+	AF_INET     = 2
+	DLT_RAW_BSD = 12 // DLT_RAW on most BSDs, before LINKTYPE_RAW existed
+
+	ETHERTYPE_IPV4    = 0x0800
+	ETHERTYPE_VLAN    = 0x8100
+	ETHERTYPE_QINQ    = 0x88a8
+	ETHERTYPE_TEB     = 0x6558 // transparent Ethernet bridging, i.e. an Ethernet frame
+	ETHERTYPE_ERSPAN2 = 0x88be // ERSPAN type I and II
+	ETHERTYPE_ERSPAN3 = 0x22eb
+	IPPROTO_UDP       = 17
+	IPPROTO_GRE       = 47
+	VXLAN_HDRLEN      = 8
+	UDP_HDRLEN        = 8
+	GRE_FLAG_CSUM     = 0x8000
+	GRE_FLAG_KEY      = 0x2000
+	GRE_FLAG_SEQ      = 0x1000
+	MAX_TUNNEL_NEST   = 4
+
+	ERSPAN2_HDRLEN    = 8
+	ERSPAN3_HDRLEN    = 12
+	ERSPAN3_SUBHDRLEN = 8 // platform specific subheader, present if O is set
+)
+
+// linkToIP finds the IPv4 header in a captured frame of the given datalink
+// type. Returns nil for anything we can't handle.
+func linkToIP(linktype int, frame []byte) []byte {
+	switch linktype {
+	case pcap.LINKTYPE_ETHERNET:
+		return ethernetToIP(frame)
+
+	case pcap.LINKTYPE_NULL, pcap.LINKTYPE_LOOP:
+		// BSD loopback: a 4 byte address family. DLT_NULL stores it in the
+		// capturing host's byte order, DLT_LOOP in network order, so just
+		// accept AF_INET either way round.
+		if len(frame) < 4 {
+			return nil
+		}
+		if !(frame[0] == AF_INET && frame[3] == 0) && !(frame[0] == 0 && frame[3] == AF_INET) {
+			return nil
+		}
+		return unwrapIP(frame[4:], 0)
+
+	case pcap.LINKTYPE_LINUX_SLL:
+		// Linux "any" device cooked header, protocol in the last 2 bytes.
+		if len(frame) < 16 || frame[14] != 0x08 || frame[15] != 0x00 {
+			return nil
+		}
+		return unwrapIP(frame[16:], 0)
+
+	case pcap.LINKTYPE_RAW, DLT_RAW_BSD:
+		if len(frame) < 1 || frame[0]>>4 != 4 {
+			return nil
+		}
+		return unwrapIP(frame, 0)
+	}
+	return nil
+}
+
+// ethernetToIP walks an Ethernet frame down to its IPv4 header, skipping any
+// VLAN tags. Returns nil if there's no IPv4 in here.
+func ethernetToIP(frame []byte) []byte {
+	return ethernetToIPDepth(frame, 0)
+}
+
+func ethernetToIPDepth(frame []byte, depth int) []byte {
+	if len(frame) < 14 {
+		return nil
+	}
+	etype := uint16(frame[12])<<8 | uint16(frame[13])
+	pos := 14
+	for etype == ETHERTYPE_VLAN || etype == ETHERTYPE_QINQ {
+		if len(frame) < pos+4 {
+			return nil
+		}
+		etype = uint16(frame[pos+2])<<8 | uint16(frame[pos+3])
+		pos += 4
+	}
+	if etype != ETHERTYPE_IPV4 {
+		return nil
+	}
+	return unwrapIP(frame[pos:], depth)
+}
+
+// unwrapIP returns the innermost IPv4 packet. If decapsulation is off, or
+// this isn't a tunnel we know, that's just the packet we were given.
+func unwrapIP(ip []byte, depth int) []byte {
+	if !decap || depth >= MAX_TUNNEL_NEST || len(ip) < 20 {
+		return ip
+	}
+	ihl := int(ip[0]&0x0F) * 4
+	if len(ip) < ihl {
+		return nil
+	}
+	payload := ip[ihl:]
+
+	switch ip[9] {
+	case IPPROTO_UDP:
+		if len(payload) < UDP_HDRLEN+VXLAN_HDRLEN {
+			return ip
+		}
+		dstPort := uint16(payload[2])<<8 | uint16(payload[3])
+		if dstPort != vxlanPort {
+			return ip
+		}
+		return ethernetToIPDepth(payload[UDP_HDRLEN+VXLAN_HDRLEN:], depth+1)
+
+	case IPPROTO_GRE:
+		if len(payload) < 4 {
+			return nil
+		}
+		flags := uint16(payload[0])<<8 | uint16(payload[1])
+		proto := uint16(payload[2])<<8 | uint16(payload[3])
+		pos := 4
+		for _, flag := range []uint16{GRE_FLAG_CSUM, GRE_FLAG_KEY, GRE_FLAG_SEQ} {
+			if flags&flag != 0 {
+				pos += 4
+			}
+		}
+		if len(payload) < pos {
+			return nil
+		}
+		switch proto {
+		case ETHERTYPE_IPV4:
+			return unwrapIP(payload[pos:], depth+1)
+		case ETHERTYPE_TEB:
+			return ethernetToIPDepth(payload[pos:], depth+1)
+		case ETHERTYPE_ERSPAN2:
+			// Type I has no ERSPAN header at all; type II is told apart by
+			// having a GRE sequence number.
+			if flags&GRE_FLAG_SEQ != 0 {
+				pos += ERSPAN2_HDRLEN
+			}
+			if len(payload) < pos {
+				return nil
+			}
+			return ethernetToIPDepth(payload[pos:], depth+1)
+		case ETHERTYPE_ERSPAN3:
+			if len(payload) < pos+ERSPAN3_HDRLEN {
+				return nil
+			}
+			if payload[pos+11]&0x01 != 0 {
+				pos += ERSPAN3_SUBHDRLEN
+			}
+			pos += ERSPAN3_HDRLEN
+			if len(payload) < pos {
+				return nil
+			}
+			return ethernetToIPDepth(payload[pos:], depth+1)
+		}
+		return nil
+	}
+	return ip
+}
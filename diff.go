@@ -0,0 +1,277 @@
+/*
+ * diff.go
+ *
+ * -save-report keeps the latest status report in a file as JSON, every
+ * query in it with the same fields as /top. With -cumulative that's the
+ * whole run, and reading a file with -r, rates are over the time the
+ * capture covers rather than however long it took us to read.
+ *
+ *     mysql-sniffer diff [-d 15] [-min-count 10] before after [flags]
+ *
+ * compares two of them, for before and after a deploy: the queries that
+ * showed up or went away, and the ones whose rate or latency moved the
+ * most. Queries are matched up by their text as counted, so both sides need
+ * the same -f, and one without #s (the default) or every new connection is
+ * a new query: -f '#q' is usually what you want.
+ *
+ * Either side can be a capture file instead, which gets run through another
+ * copy of us with -r, -cumulative, -f '#q' and any flags after the files
+ * (-P, a different -f, ...).
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type savedReport struct {
+	Taken   time.Time  `json:"taken"`
+	Seconds float64    `json:"seconds"`
+	Queries []apiQuery `json:"queries"`
+}
+
+type reportFile struct {
+	path string
+}
+
+func (self *reportFile) Write(rows []reportRow, elapsed float64) {
+	report := savedReport{Taken: time.Now().UTC(), Seconds: elapsed, Queries: make([]apiQuery, 0, len(rows))}
+	span := digestTo.Sub(digestFrom).Seconds()
+	if offline && span >= 1 {
+		report.Seconds = span
+	}
+	for _, r := range rows {
+		q := newAPIQuery(r)
+		q.QPS = float64(q.Count) / report.Seconds
+		report.Queries = append(report.Queries, q)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fatalf("Failed to encode the report: %s", err.Error())
+	}
+
+	// Whoever's reading it should never see half a report.
+	tmp := self.path + ".tmp"
+	if err = os.WriteFile(tmp, append(data, '\n'), 0644); err == nil {
+		err = os.Rename(tmp, self.path)
+	}
+	if err != nil {
+		logger.Error("Failed to save the report", "file", self.path, "error", err)
+	}
+}
+
+func (self *reportFile) Close() {}
+
+// loadReport reads a -save-report file.
+func loadReport(path string) (*savedReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report savedReport
+	if err = json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("%s isn't a saved report: %s", path, err.Error())
+	}
+	return &report, nil
+}
+
+// isReportFile says whether path is a -save-report file rather than a
+// capture, going by its first few bytes; captures can be huge.
+func isReportFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b == '{', nil
+		}
+	}
+}
+
+// reportFor loads a saved report, or makes one from a capture file.
+func reportFor(path string, args []string) (*savedReport, error) {
+	report, err := isReportFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if report {
+		return loadReport(path)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "mysql-sniffer-diff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	saved := filepath.Join(dir, "report.json")
+	cmd := exec.Command(self, append([]string{"-r", path, "-cumulative", "-save-report", saved,
+		"-color", "never", "-f", "#q"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("reading %s: %s\n%s", path, err.Error(), stderr.String())
+	}
+	return loadReport(saved)
+}
+
+// A query's numbers on either side, either of which can be missing.
+type queryDiff struct {
+	query         string
+	before, after *apiQuery
+}
+
+// change is how much after differs from before, as a fraction of before.
+func change(before, after float64) float64 {
+	if before == 0 {
+		return math.Inf(1)
+	}
+	return (after - before) / before
+}
+
+func formatChange(c float64) string {
+	if math.IsInf(c, 1) {
+		return "new"
+	}
+	return fmt.Sprintf("%+.1f%%", c*100)
+}
+
+// diffReports pairs up the queries in two reports by fingerprint, in no
+// particular order.
+func diffReports(before, after *savedReport) []queryDiff {
+	byID := make(map[string]*queryDiff)
+	var diffs []*queryDiff
+	add := func(q *apiQuery, after bool) {
+		d, ok := byID[q.ID]
+		if !ok {
+			d = &queryDiff{query: q.Query}
+			byID[q.ID] = d
+			diffs = append(diffs, d)
+		}
+		if after {
+			d.after = q
+		} else {
+			d.before = q
+		}
+	}
+	for i := range before.Queries {
+		add(&before.Queries[i], false)
+	}
+	for i := range after.Queries {
+		add(&after.Queries[i], true)
+	}
+	out := make([]queryDiff, len(diffs))
+	for i, d := range diffs {
+		out[i] = *d
+	}
+	return out
+}
+
+// printDiff is the diff report: what's new, what's gone, and the biggest
+// moves in rate and average latency among queries seen at least mincount
+// times on both sides.
+func printDiff(before, after *savedReport, displaycount int, mincount uint64) {
+	diffs := diffReports(before, after)
+	var added, gone, both []queryDiff
+	for _, d := range diffs {
+		switch {
+		case d.before == nil:
+			added = append(added, d)
+		case d.after == nil:
+			gone = append(gone, d)
+		case d.before.Count >= mincount && d.after.Count >= mincount:
+			both = append(both, d)
+		}
+	}
+	log.Printf("Before: %d queries over %.0fs, after: %d queries over %.0fs", len(before.Queries), before.Seconds,
+		len(after.Queries), after.Seconds)
+
+	section := func(title, header string, list []queryDiff, less func(a, b *queryDiff) bool,
+		line func(d *queryDiff) string) {
+		if len(list) == 0 {
+			return
+		}
+		sort.Slice(list, func(i, j int) bool { return less(&list[i], &list[j]) })
+		log.Printf(" ")
+		log.Printf("%s", title)
+		log.Printf("%s  query", header)
+		for i := 0; i < len(list) && i < displaycount; i++ {
+			log.Printf("%s  %s", line(&list[i]), list[i].query)
+		}
+	}
+	qpsMove := func(d *queryDiff) float64 { return math.Abs(d.after.QPS - d.before.QPS) }
+	timeMove := func(d *queryDiff) float64 { return math.Abs(d.after.Avg - d.before.Avg) }
+
+	section(fmt.Sprintf("%d new queries", len(added)), fmt.Sprintf("%12s %12s", "qps", "avg [ms]"), added,
+		func(a, b *queryDiff) bool { return a.after.QPS > b.after.QPS },
+		func(d *queryDiff) string { return fmt.Sprintf("%12.2f %12.2f", d.after.QPS, d.after.Avg) })
+	section(fmt.Sprintf("%d queries gone", len(gone)), fmt.Sprintf("%12s %12s", "qps", "avg [ms]"), gone,
+		func(a, b *queryDiff) bool { return a.before.QPS > b.before.QPS },
+		func(d *queryDiff) string { return fmt.Sprintf("%12.2f %12.2f", d.before.QPS, d.before.Avg) })
+	section("Biggest changes in rate", fmt.Sprintf("%12s %12s %10s", "qps before", "qps after", "change"), both,
+		func(a, b *queryDiff) bool { return qpsMove(a) > qpsMove(b) },
+		func(d *queryDiff) string {
+			return fmt.Sprintf("%12.2f %12.2f %10s", d.before.QPS, d.after.QPS, formatChange(change(d.before.QPS, d.after.QPS)))
+		})
+	section("Biggest changes in latency", fmt.Sprintf("%12s %12s %10s %12s", "avg before", "avg after", "change",
+		"p95 after"), both,
+		func(a, b *queryDiff) bool { return timeMove(a) > timeMove(b) },
+		func(d *queryDiff) string {
+			return fmt.Sprintf("%12.2f %12.2f %10s %12.2f", d.before.Avg, d.after.Avg,
+				formatChange(change(d.before.Avg, d.after.Avg)), d.after.P95)
+		})
+}
+
+// runDiff is mysql-sniffer diff.
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	displaycount := flags.Int("d", 15, "Show this many queries in each section")
+	mincount := flags.Uint64("min-count", 10, "Only compare queries seen at least this many times on both sides")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [options] before after [flags for capture files]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	log.SetPrefix("")
+	log.SetFlags(0)
+
+	var reports [2]*savedReport
+	for i, path := range flags.Args()[:2] {
+		report, err := reportFor(path, flags.Args()[2:])
+		if err != nil {
+			fatalf("%s", err.Error())
+		}
+		reports[i] = report
+	}
+	printDiff(reports[0], reports[1], *displaycount, *mincount)
+}
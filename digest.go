@@ -0,0 +1,198 @@
+/*
+ * digest.go
+ *
+ * A report in the style of pt-query-digest, for people who already know how
+ * to read one: an overall summary, a profile of the queries ranked by total
+ * response time, and then a section per query with its numbers, a latency
+ * distribution and an example.
+ *
+ * Rates here come from the capture timestamps rather than the wall clock,
+ * so they make sense when reading a file with -r.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The longest example query we hang on to for each fingerprint.
+const DIGEST_EXAMPLE_MAX = 4096
+
+var digest bool = false
+
+// Capture time span of what's in the report.
+var digestFrom, digestTo time.Time
+
+func digestSeen(ts time.Time) {
+	if digestFrom.IsZero() || ts.Before(digestFrom) {
+		digestFrom = ts
+	}
+	if ts.After(digestTo) {
+		digestTo = ts
+	}
+}
+
+// digestTime formats nanoseconds the way pt-query-digest does.
+func digestTime(ns float64) string {
+	switch {
+	case ns == 0:
+		return "0"
+	case ns < 1000000:
+		return fmt.Sprintf("%.0fus", ns/1000)
+	case ns < 1000000000:
+		return fmt.Sprintf("%.0fms", ns/1000000)
+	}
+	return fmt.Sprintf("%.0fs", ns/1000000000)
+}
+
+// digestSize formats a byte count with a k/M/G suffix.
+func digestSize(n float64) string {
+	for _, unit := range []string{"", "k", "M", "G"} {
+		if n < 1024 || unit == "G" {
+			if unit == "" {
+				return fmt.Sprintf("%.0f", n)
+			}
+			return fmt.Sprintf("%.2f%s", n, unit)
+		}
+		n /= 1024
+	}
+	return ""
+}
+
+// digestDistribution draws the per-decade latency histogram.
+func digestDistribution(h *histogram) []string {
+	labels := []string{"  1us", " 10us", "100us", "  1ms", " 10ms", "100ms", "   1s", " 10s+"}
+	var counts [8]uint64
+	h.each(func(i int, c uint64) {
+		lo, hi := histRange(i)
+		v := lo + (hi-lo)/2
+		d := 0
+		for limit := uint64(10000); d < len(counts)-1 && v >= limit; limit *= 10 {
+			d++
+		}
+		counts[d] += c
+	})
+
+	var most uint64
+	for _, c := range counts {
+		if c > most {
+			most = c
+		}
+	}
+	lines := make([]string, len(labels))
+	for i, c := range counts {
+		bar := 0
+		if most > 0 {
+			bar = int((c*64 + most - 1) / most)
+		}
+		lines[i] = "# " + labels[i] + "  " + strings.Repeat("#", bar)
+	}
+	return lines
+}
+
+// digestRow lays out one attribute's numbers under digestHeader. pct is
+// left blank in the overall section.
+func digestRow(name string, pct string, total string, h *histogram, format func(float64) string) string {
+	return fmt.Sprintf("# %-12s %3s %7s %7s %7s %7s %7s %7s %7s", name, pct, total,
+		format(float64(h.Min())), format(float64(h.Max())), format(float64(h.Mean())),
+		format(float64(h.Quantile(0.95))), format(h.Stddev()), format(float64(h.Quantile(0.5))))
+}
+
+func digestHeader() {
+	log.Printf("# %-12s %3s %7s %7s %7s %7s %7s %7s %7s", "Attribute", "pct", "total",
+		"min", "max", "avg", "95%", "stddev", "median")
+	log.Printf("# ============ === ======= ======= ======= ======= ======= ======= =======")
+}
+
+// printDigest writes out the report for the top displaycount queries.
+func printDigest(displaycount int) {
+	type entry struct {
+		query string
+		c     *queryData
+	}
+	var entries []entry
+	var count, bytes uint64
+	for q, c := range qbuf {
+		if c.count == 0 {
+			continue
+		}
+		entries = append(entries, entry{q, c})
+		count += c.count
+		bytes += c.bytes
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].c.times.Sum() > entries[j].c.times.Sum()
+	})
+
+	span := digestTo.Sub(digestFrom).Seconds()
+	if span < 1 {
+		span = 1
+	}
+	total := float64(times.Sum())
+
+	log.Printf("")
+	log.Printf("# Current date: %s", time.Now().Format(time.ANSIC))
+	log.Printf("# Overall: %d total, %d unique, %.2f QPS, %.2fx concurrency",
+		count, len(entries), float64(count)/span, total/1000000000/span)
+	if !digestFrom.IsZero() {
+		log.Printf("# Time range: %s to %s", digestFrom.Format("2006-01-02T15:04:05"),
+			digestTo.Format("2006-01-02T15:04:05"))
+	}
+	digestHeader()
+	log.Printf("%s", digestRow("Exec time", "", digestTime(total), &times, digestTime))
+	log.Printf("# %-12s %3s %7s", "Bytes", "", digestSize(float64(bytes)))
+
+	if len(entries) > displaycount {
+		entries = entries[:displaycount]
+	}
+
+	log.Printf("")
+	log.Printf("# Profile")
+	log.Printf("# Rank Query ID           Response time  Calls  R/Call V/M   Item")
+	log.Printf("# ==== ================== ============== ====== ====== ===== ====")
+	for i, e := range entries {
+		sum := float64(e.c.times.Sum()) / 1000000000
+		pct := 0.0
+		if total > 0 {
+			pct = sum * 1000000000 / total * 100
+		}
+		rcall := float64(e.c.times.Mean()) / 1000000000
+		vm := 0.0
+		if rcall > 0 {
+			vm = e.c.times.Variance() / 1e18 / rcall
+		}
+		item := clip(e.query, 40)
+		log.Printf("# %4d 0x%-16s %8.4f %5.1f%% %6d %6.4f %5.2f %s",
+			i+1, queryID(e.query), sum, pct, e.c.count, rcall, vm, item)
+	}
+
+	for i, e := range entries {
+		c := e.c
+		log.Printf("")
+		log.Printf("# Query %d: %.2f QPS, %.2fx concurrency, ID 0x%s",
+			i+1, float64(c.count)/span, float64(c.times.Sum())/1000000000/span, queryID(e.query))
+		digestHeader()
+		log.Printf("# %-12s %3.0f %7d", "Count", float64(c.count)/float64(count)*100, c.count)
+		tpct := 0.0
+		if total > 0 {
+			tpct = float64(c.times.Sum()) / total * 100
+		}
+		log.Printf("%s", digestRow("Exec time", fmt.Sprintf("%3.0f", tpct),
+			digestTime(float64(c.times.Sum())), &c.times, digestTime))
+		log.Printf("# %-12s %3.0f %7s", "Bytes", float64(c.bytes)/float64(bytes)*100, digestSize(float64(c.bytes)))
+		log.Printf("# Query_time distribution")
+		for _, line := range digestDistribution(&c.times) {
+			log.Printf("%s", line)
+		}
+		if c.example != "" {
+			log.Printf("%s\\G", c.example)
+		} else {
+			log.Printf("%s\\G", e.query)
+		}
+	}
+}
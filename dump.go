@@ -0,0 +1,57 @@
+/*
+ * dump.go
+ *
+ * Writes the packets we actually parsed back out to a pcap file, so an
+ * interesting window of traffic can be kept around and looked at again with
+ * -r or in Wireshark.
+ */
+
+package main
+
+import (
+	"github.com/akrennmair/gopcap"
+	"os"
+)
+
+type packetDumper struct {
+	path     string
+	file     *os.File
+	writer   *pcap.Writer
+	linktype int
+}
+
+// Write appends a packet to the file, creating it on first use so we know
+// what datalink type to put in the header. A pcap file can only hold one
+// datalink type, so packets of any other type are skipped.
+func (self *packetDumper) Write(pkt *pcap.Packet) {
+	if self.writer == nil {
+		f, err := os.Create(self.path)
+		if err != nil {
+			fatalf("Failed to create %s: %s", self.path, err.Error())
+		}
+		w, err := pcap.NewWriter(f, &pcap.FileHeader{
+			MagicNumber:  0xa1b2c3d4,
+			VersionMajor: 2,
+			VersionMinor: 4,
+			SnapLen:      65535,
+			Network:      uint32(pkt.Type),
+		})
+		if err != nil {
+			fatalf("Failed to write to %s: %s", self.path, err.Error())
+		}
+		self.file, self.writer, self.linktype = f, w, pkt.Type
+	}
+
+	if pkt.Type != self.linktype {
+		return
+	}
+	if err := self.writer.Write(pkt); err != nil {
+		fatalf("Failed to write to %s: %s", self.path, err.Error())
+	}
+}
+
+func (self *packetDumper) Close() {
+	if self.file != nil {
+		self.file.Close()
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * elastic.go
+ *
+ * Indexes every query we time into Elasticsearch (or OpenSearch) with the
+ * bulk API, one document each, into daily indices. An index template is put
+ * in place first so the fields get sensible types for Kibana.
+ *
+ * Documents are batched up and handed to a goroutine to send, so a slow
+ * cluster doesn't hold up the capture. If it falls too far behind whole
+ * batches get dropped, and we say so.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ELASTIC_TIMEOUT = 10 * time.Second
+	ELASTIC_BATCH   = 1000 // documents per bulk request
+	ELASTIC_QUEUE   = 16   // batches waiting to be sent
+)
+
+const elasticTemplate = `{
+	"index_patterns": ["%s-*"],
+	"template": {
+		"mappings": {
+			"properties": {
+				"@timestamp":     {"type": "date"},
+				"query":          {"type": "keyword", "ignore_above": 8191,
+				                   "fields": {"text": {"type": "text"}}},
+				"query_id":       {"type": "keyword"},
+				"command":        {"type": "integer"},
+				"duration_ms":    {"type": "double"},
+				"ttfb_ms":        {"type": "double"},
+				"request_bytes":  {"type": "long"},
+				"response_bytes": {"type": "long"},
+				"client_ip":      {"type": "ip"},
+				"client_port":    {"type": "integer"},
+				"server_port":    {"type": "integer"}
+			}
+		}
+	}
+}`
+
+type elasticSink struct {
+	url     string
+	index   string
+	client  *http.Client
+	batch   bytes.Buffer
+	count   int
+	queue   chan []byte
+	done    chan bool
+	dropped int
+}
+
+var elastic *elasticSink
+
+func openElastic(url, index string) *elasticSink {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		fatalf("Bad -elastic URL %s: expected an http(s) URL", url)
+	}
+	self := &elasticSink{
+		url:    strings.TrimSuffix(url, "/"),
+		index:  index,
+		client: &http.Client{Timeout: ELASTIC_TIMEOUT},
+		queue:  make(chan []byte, ELASTIC_QUEUE),
+		done:   make(chan bool),
+	}
+
+	tmpl := fmt.Sprintf(elasticTemplate, index)
+	if err := self.request("PUT", "/_index_template/"+index, "application/json", []byte(tmpl)); err != nil {
+		logger.Warn("Failed to install Elasticsearch index template", "url", self.url, "err", err)
+	}
+
+	go self.sender()
+	return self
+}
+
+// Event adds a document for one completed query.
+func (self *elasticSink) Event(rs *source, req *pendingRequest, reqtime uint64) {
+	if req.qdata == nil {
+		return
+	}
+	action, _ := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": self.index + "-" + req.sent.UTC().Format("2006.01.02")},
+	})
+	doc, _ := json.Marshal(queryEvent(rs, req, reqtime))
+	self.batch.Write(action)
+	self.batch.WriteByte('\n')
+	self.batch.Write(doc)
+	self.batch.WriteByte('\n')
+
+	self.count++
+	if self.count >= ELASTIC_BATCH {
+		self.flush()
+	}
+}
+
+// queryEvent is the document for one completed query. -nats publishes the
+// same thing.
+func queryEvent(rs *source, req *pendingRequest, reqtime uint64) map[string]interface{} {
+	host, pnum := splitClient(rs.sender(req))
+	event := map[string]interface{}{
+		"@timestamp":     req.sent.UTC().Format(time.RFC3339Nano),
+		"query":          req.query,
+		"query_id":       queryID(req.text),
+		"command":        req.ptype,
+		"duration_ms":    float64(reqtime) / 1000000,
+		"ttfb_ms":        float64(req.ttfb) / 1000000,
+		"request_bytes":  req.bytes,
+		"response_bytes": req.rbytes,
+		"client_ip":      host,
+		"client_port":    pnum,
+		"server_port":    port,
+	}
+	if req.tags != nil {
+		event["tags"] = req.tags
+	}
+	return event
+}
+
+// flush hands the current batch to the sender.
+func (self *elasticSink) flush() {
+	if self.count == 0 {
+		return
+	}
+	body := make([]byte, self.batch.Len())
+	copy(body, self.batch.Bytes())
+	self.batch.Reset()
+	select {
+	case self.queue <- body:
+	default:
+		self.dropped += self.count
+	}
+	self.count = 0
+}
+
+func (self *elasticSink) sender() {
+	for body := range self.queue {
+		if err := self.request("POST", "/_bulk", "application/x-ndjson", body); err != nil {
+			logger.Warn("Failed to index into Elasticsearch", "url", self.url, "err", err)
+		}
+	}
+	close(self.done)
+}
+
+// request sends one request and checks the response, including the per
+// document errors the bulk API reports with a 200.
+func (self *elasticSink) request(method, path, ctype string, body []byte) error {
+	req, err := http.NewRequest(method, self.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ctype)
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error json.RawMessage `json:"error"`
+		} `json:"items"`
+		Error json.RawMessage `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s", resp.Status, result.Error)
+	}
+	if result.Errors {
+		for _, item := range result.Items {
+			for _, r := range item {
+				if len(r.Error) > 0 {
+					return fmt.Errorf("document rejected: %s", r.Error)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Write sends whatever's built up at every status report.
+func (self *elasticSink) Write(rows []reportRow, elapsed float64) {
+	self.flush()
+	if self.dropped > 0 {
+		logger.Warn("Dropped Elasticsearch documents, the cluster isn't keeping up", "documents", self.dropped)
+		self.dropped = 0
+	}
+}
+
+// Close sends anything left and waits for it to go out.
+func (self *elasticSink) Close() {
+	self.flush()
+	close(self.queue)
+	<-self.done
+}
@@ -0,0 +1,146 @@
+/*
+ * export.go
+ *
+ * -export-sql writes the queries we see out as a plain .sql file, for
+ * grabbing a realistic sample of the workload to try locally:
+ *
+ *     mysql -h 127.0.0.1 shop < sample.sql
+ *
+ * By default it's the first of each kind, going by the cleaned up query in
+ * each database, so a busy server gives a file of every different thing it
+ * was asked once; -export-sql-all writes every one, in the order they came
+ * in. A USE goes in whenever the database changes from the last one written.
+ * There's no USE for no database, so a query from a connection without one
+ * runs in whichever database the one before it used.
+ *
+ * Each statement ends with a ; as usual, or on a line of its own when the
+ * query ends in a -- or # comment that would swallow it. Bodies with ;s of
+ * their own, like CREATE PROCEDURE, get a DELIMITER around them the way
+ * mysqldump does it.
+ *
+ * Only text queries (COM_QUERY) are written, after -only, -match, -ignore
+ * and the client filters, as the client sent them with their real values. Be
+ * careful where the file goes, and what you run it against: writes are in
+ * there too.
+ */
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+type sqlExporter struct {
+	path   string
+	file   *os.File
+	out    *bufio.Writer
+	all    bool
+	schema string          // the last USE we wrote
+	seen   map[string]bool // database and cleaned up query, without -export-sql-all
+}
+
+var exporter *sqlExporter
+
+// openExporter truncates the file, or uses stdout for "-".
+func openExporter(path string, all bool) *sqlExporter {
+	if protocol == PROTO_POSTGRES {
+		fatalf("-export-sql only knows MySQL queries")
+	}
+	self := &sqlExporter{path: path, file: os.Stdout, all: all}
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fatalf("Failed to create %s: %s", path, err.Error())
+		}
+		self.file = f
+	}
+	if !all {
+		self.seen = make(map[string]bool)
+	}
+	self.out = bufio.NewWriter(self.file)
+	return self
+}
+
+// Query writes a query out, if it's one we're keeping. Call it with the
+// state locked.
+func (self *sqlExporter) Query(rs *source, query []byte) {
+	q := strings.TrimRight(string(query), "; \t\r\n")
+	if strings.TrimSpace(q) == "" {
+		return
+	}
+	if !self.all {
+		key := rs.schema + "\x00" + cleanupQuery([]byte(q))
+		if self.seen[key] {
+			return
+		}
+		self.seen[key] = true
+	}
+
+	var b strings.Builder
+	if rs.schema != "" && rs.schema != self.schema {
+		b.WriteString("USE `" + strings.ReplaceAll(rs.schema, "`", "``") + "`;\n")
+		self.schema = rs.schema
+	}
+	semicolons, comment := statementEnd([]byte(q))
+	switch {
+	case semicolons:
+		delimiter := ";;"
+		for _, d := range []string{"$$", "//"} {
+			if !strings.Contains(q, delimiter) {
+				break
+			}
+			delimiter = d
+		}
+		b.WriteString("DELIMITER " + delimiter + "\n" + q + "\n" + delimiter + "\nDELIMITER ;\n")
+	case comment:
+		b.WriteString(q + "\n;\n")
+	default:
+		b.WriteString(q + ";\n")
+	}
+	if _, err := self.out.WriteString(b.String()); err != nil {
+		fatalf("Failed to write to %s: %s", self.path, err.Error())
+	}
+}
+
+// statementEnd says whether a query has a ; of its own outside of quotes
+// and comments, and whether it ends in a comment that runs to the end of
+// the line.
+func statementEnd(query []byte) (semicolons, comment bool) {
+	for i := 0; i < len(query); {
+		if n := scanComment(query[i:]); n > 0 {
+			comment = query[i] != '/' && i+n == len(query)
+			i += n
+			continue
+		}
+		switch c := query[i]; c {
+		case '\'', '"', '`':
+			i++
+			for i < len(query) && query[i] != c {
+				if query[i] == '\\' && c != '`' {
+					i++
+				}
+				i++
+			}
+		case ';':
+			semicolons = true
+		}
+		i++
+	}
+	return semicolons, comment
+}
+
+// Write gets what we have onto the disk after each report.
+func (self *sqlExporter) Write(rows []reportRow, elapsed float64) {
+	if err := self.out.Flush(); err != nil {
+		fatalf("Failed to write to %s: %s", self.path, err.Error())
+	}
+}
+
+func (self *sqlExporter) Close() {
+	self.out.Flush()
+	if self.file != os.Stdout {
+		self.file.Close()
+	}
+}
@@ -0,0 +1,58 @@
+//go:build sqlparser
+// +build sqlparser
+
+/*
+ * fingerprint_parser.go
+ *
+ * -fingerprint parser: canonicalize queries by running them through a real
+ * SQL parser (Vitess's, by way of github.com/xwb1989/sqlparser) and printing
+ * them back out with every literal replaced by ?. It's a lot slower than the
+ * tokenizer, but knows the grammar, so subqueries, odd literals and quoting
+ * all come out right. Only built with -tags sqlparser.
+ *
+ * The parser prints queries its own way (lower case keywords, backticks
+ * only where needed), so fingerprints won't match ones from the tokenizer.
+ * Anything it can't parse, which is mostly vendor syntax it doesn't know,
+ * falls back to the tokenizer. Of -keep-literals, only LIMIT and OFFSET mean
+ * anything here, and either one keeps both.
+ */
+
+package main
+
+import (
+	"github.com/xwb1989/sqlparser"
+)
+
+const parserAvailable = true
+
+func parseFingerprint(query []byte) (string, bool) {
+	stmt, err := sqlparser.Parse(string(query))
+	if err != nil {
+		return "", false
+	}
+	buf := sqlparser.NewTrackedBuffer(func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		switch node := node.(type) {
+		case *sqlparser.SQLVal:
+			buf.WriteString("?")
+		case sqlparser.ValTuple:
+			// IN (1, 2, 3) and IN (4, 5) are the same query.
+			for _, expr := range node {
+				if _, ok := expr.(*sqlparser.SQLVal); !ok {
+					node.Format(buf)
+					return
+				}
+			}
+			buf.WriteString("(?+)")
+		case *sqlparser.Limit:
+			if keepLiterals["limit"] || keepLiterals["offset"] {
+				buf.WriteString(sqlparser.String(node))
+				return
+			}
+			node.Format(buf)
+		default:
+			node.Format(buf)
+		}
+	})
+	buf.Myprintf("%v", stmt)
+	return buf.String(), true
+}
@@ -0,0 +1,10 @@
+//go:build !sqlparser
+// +build !sqlparser
+
+package main
+
+const parserAvailable = false
+
+func parseFingerprint(query []byte) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,129 @@
+/*
+ * graphite.go
+ *
+ * Pushes each status report to Graphite over the Carbon plaintext protocol
+ * ("path value timestamp" lines on TCP). Queries don't make good metric
+ * names, so each one goes under its queryID.
+ *
+ * If Carbon goes away we log it and try again at the next report; losing
+ * some points is better than losing the sniffer. The sending happens in a
+ * goroutine so a slow Carbon can't hold up the capture, and reports that
+ * pile up behind it past GRAPHITE_QUEUE are dropped.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	GRAPHITE_TIMEOUT = 5 * time.Second
+	GRAPHITE_QUEUE   = 4 // reports waiting to be sent
+)
+
+type graphiteSink struct {
+	addr    string
+	prefix  string
+	conn    net.Conn // the sender's
+	queue   chan []byte
+	done    chan bool
+	dropped int
+}
+
+func openGraphite(addr, prefix string) *graphiteSink {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		fatalf("Bad -graphite address %s: %s", addr, err.Error())
+	}
+	self := &graphiteSink{addr: addr, prefix: strings.TrimSuffix(prefix, "."),
+		queue: make(chan []byte, GRAPHITE_QUEUE), done: make(chan bool)}
+	go self.sender()
+	return self
+}
+
+func (self *graphiteSink) Write(rows []reportRow, elapsed float64) {
+	if self.dropped > 0 {
+		logger.Warn("Dropped reports, Graphite isn't keeping up", "addr", self.addr, "reports", self.dropped)
+		self.dropped = 0
+	}
+
+	var buf bytes.Buffer
+	now := time.Now().Unix()
+	metric := func(name string, v float64) {
+		fmt.Fprintf(&buf, "%s.%s %g %d\n", self.prefix, name, v, now)
+	}
+
+	count := intervalcount
+	if cumulative {
+		count = querycount
+	}
+	metric("queries.count", float64(count))
+	metric("queries.qps", float64(count)/elapsed)
+	gmin, gavg, gmax := calculateTimes(&times)
+	gp50, gp95, gp99 := calculatePercentiles(&times)
+	metric("latency.min_ms", gmin)
+	metric("latency.avg_ms", gavg)
+	metric("latency.max_ms", gmax)
+	metric("latency.p50_ms", gp50)
+	metric("latency.p95_ms", gp95)
+	metric("latency.p99_ms", gp99)
+
+	alerts := 0
+	for _, r := range rows {
+		id := "query." + r.id + "."
+		metric(id+"count", float64(r.count))
+		metric(id+"qps", r.qps)
+		metric(id+"avg_ms", r.avg)
+		metric(id+"max_ms", r.max)
+		metric(id+"p95_ms", r.p95)
+		metric(id+"p99_ms", r.p99)
+		metric(id+"bytes", float64(r.bytes))
+		if r.alert != "" {
+			alerts++
+			metric(id+"alert", 1)
+		}
+	}
+	if alertFactor > 0 {
+		metric("queries.alerts", float64(alerts))
+	}
+
+	select {
+	case self.queue <- buf.Bytes():
+	default:
+		self.dropped++
+	}
+}
+
+// sender gets the reports to Carbon, connecting as needed.
+func (self *graphiteSink) sender() {
+	for data := range self.queue {
+		if self.conn == nil {
+			conn, err := net.DialTimeout("tcp", self.addr, GRAPHITE_TIMEOUT)
+			if err != nil {
+				logger.Warn("Failed to connect to Graphite", "addr", self.addr, "err", err)
+				continue
+			}
+			self.conn = conn
+		}
+		self.conn.SetWriteDeadline(time.Now().Add(GRAPHITE_TIMEOUT))
+		if _, err := self.conn.Write(data); err != nil {
+			logger.Warn("Failed to send to Graphite", "addr", self.addr, "err", err)
+			self.conn.Close()
+			self.conn = nil
+		}
+	}
+	if self.conn != nil {
+		self.conn.Close()
+	}
+	close(self.done)
+}
+
+// Close waits for anything queued to go out.
+func (self *graphiteSink) Close() {
+	close(self.queue)
+	<-self.done
+}
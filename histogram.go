@@ -0,0 +1,200 @@
+/*
+ * histogram.go
+ *
+ * A streaming latency histogram in the spirit of HdrHistogram. Values are
+ * bucketed log-linearly: every power of two is split into HIST_SUB_BUCKETS
+ * linear slices, so any recorded value is known to within ~3% no matter how
+ * many we've seen. Count, sum, min and max are kept exactly, and so is the
+ * variance (by Welford's method, since the sum of squared nanoseconds
+ * overflows quickly).
+ *
+ * Every fingerprint has a couple of these, so the buckets come a power of
+ * two's row at a time, as values land in it. Queries mostly stay within a
+ * few powers of two, so that's a few hundred bytes each rather than all
+ * HIST_BUCKETS counters. Since the rows are shared, copying a histogram
+ * doesn't copy the counts; Merge into an empty one instead.
+ */
+
+package main
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	HIST_SUB_BITS    = 5
+	HIST_SUB_BUCKETS = 1 << HIST_SUB_BITS
+	HIST_BUCKETS     = (65 - HIST_SUB_BITS) * HIST_SUB_BUCKETS
+)
+
+type histogram struct {
+	rows  []*[HIST_SUB_BUCKETS]uint64 // up to the highest in use, nil if unused
+	count uint64
+	sum   uint64
+	min   uint64
+	max   uint64
+	mean  float64 // running mean and sum of squared deviations
+	m2    float64
+}
+
+// histIndex maps a value to its bucket. Small values get a bucket each;
+// above that we keep the top HIST_SUB_BITS+1 significant bits.
+func histIndex(v uint64) int {
+	if v < HIST_SUB_BUCKETS {
+		return int(v)
+	}
+	shift := bits.Len64(v) - HIST_SUB_BITS - 1
+	return (shift+1)*HIST_SUB_BUCKETS + int(v>>uint(shift)) - HIST_SUB_BUCKETS
+}
+
+// histRange returns the smallest and largest values that land in a bucket.
+func histRange(i int) (uint64, uint64) {
+	if i < HIST_SUB_BUCKETS {
+		return uint64(i), uint64(i)
+	}
+	shift := uint(i/HIST_SUB_BUCKETS - 1)
+	m := uint64(i%HIST_SUB_BUCKETS + HIST_SUB_BUCKETS)
+	return m << shift, (m+1)<<shift - 1
+}
+
+// add counts n more values in bucket i.
+func (self *histogram) add(i int, n uint64) {
+	row := i / HIST_SUB_BUCKETS
+	for len(self.rows) <= row {
+		self.rows = append(self.rows, nil)
+	}
+	if self.rows[row] == nil {
+		self.rows[row] = new([HIST_SUB_BUCKETS]uint64)
+	}
+	self.rows[row][i%HIST_SUB_BUCKETS] += n
+}
+
+// each calls fn for every bucket with anything in it, in order.
+func (self *histogram) each(fn func(i int, n uint64)) {
+	for r, row := range self.rows {
+		if row == nil {
+			continue
+		}
+		for j, n := range row {
+			if n != 0 {
+				fn(r*HIST_SUB_BUCKETS+j, n)
+			}
+		}
+	}
+}
+
+func (self *histogram) Record(v uint64) {
+	self.add(histIndex(v), 1)
+	if self.count == 0 || v < self.min {
+		self.min = v
+	}
+	if v > self.max {
+		self.max = v
+	}
+	self.count++
+	self.sum += v
+
+	delta := float64(v) - self.mean
+	self.mean += delta / float64(self.count)
+	self.m2 += delta * (float64(v) - self.mean)
+}
+
+func (self *histogram) Count() uint64 {
+	return self.count
+}
+
+func (self *histogram) Sum() uint64 {
+	return self.sum
+}
+
+func (self *histogram) Min() uint64 {
+	return self.min
+}
+
+func (self *histogram) Max() uint64 {
+	return self.max
+}
+
+func (self *histogram) Mean() uint64 {
+	if self.count == 0 {
+		return 0
+	}
+	return self.sum / self.count // integer division
+}
+
+// Variance is the population variance of everything recorded.
+func (self *histogram) Variance() float64 {
+	if self.count == 0 {
+		return 0
+	}
+	return self.m2 / float64(self.count)
+}
+
+func (self *histogram) Stddev() float64 {
+	return math.Sqrt(self.Variance())
+}
+
+// Quantile returns the value at quantile q (0..1), to within the bucket
+// resolution. We report the middle of the bucket, kept inside the range of
+// values actually seen.
+func (self *histogram) Quantile(q float64) uint64 {
+	if self.count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(self.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint64
+	v := self.max
+	found := false
+	self.each(func(i int, n uint64) {
+		seen += n
+		if found || seen < rank {
+			return
+		}
+		lo, hi := histRange(i)
+		v, found = lo+(hi-lo)/2, true
+	})
+	if v < self.min {
+		v = self.min
+	}
+	if v > self.max {
+		v = self.max
+	}
+	return v
+}
+
+// Merge adds everything recorded in other, as if it had been recorded here.
+// The variance merges by Chan et al.'s version of Welford.
+func (self *histogram) Merge(other *histogram) {
+	if other.count == 0 {
+		return
+	}
+	other.each(self.add)
+	if self.count == 0 || other.min < self.min {
+		self.min = other.min
+	}
+	if other.max > self.max {
+		self.max = other.max
+	}
+	n := float64(self.count + other.count)
+	delta := other.mean - self.mean
+	self.m2 += other.m2 + delta*delta*float64(self.count)*float64(other.count)/n
+	self.mean += delta * float64(other.count) / n
+	self.count += other.count
+	self.sum += other.sum
+}
+
+// Reset forgets everything, but keeps the rows for the next lot, which
+// usually lands in the same ones.
+func (self *histogram) Reset() {
+	for _, row := range self.rows {
+		if row != nil {
+			*row = [HIST_SUB_BUCKETS]uint64{}
+		}
+	}
+	*self = histogram{rows: self.rows}
+}
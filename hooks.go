@@ -0,0 +1,137 @@
+/*
+ * hooks.go
+ *
+ * Hooks get a look at every query before we count it, for the site
+ * specific things that don't belong in here: redacting something our
+ * cleanup doesn't catch, pulling a tenant out of a comment, dropping
+ * traffic only you know is noise. Each one can rewrite the query, add tags
+ * (which go out with -elastic and -nats), or drop it, and they run in the
+ * order given to -hook.
+ *
+ * A hook is compiled in by calling registerHook from an init function in a
+ * file of its own, or built as a Go plugin (go build -buildmode=plugin, on
+ * platforms that have them) that exports
+ *
+ *     func Hook(query *string, attrs map[string]string) bool
+ *
+ * and loaded with -hook-plugin. attrs starts out with client, user,
+ * database and command; anything else a hook puts there becomes a tag.
+ *
+ * With -workers hooks get called from several goroutines at once.
+ */
+
+package main
+
+import (
+	"fmt"
+	"plugin"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A queryHook returns false to drop the query.
+type queryHook func(query *string, attrs map[string]string) bool
+
+var registeredHooks = make(map[string]queryHook)
+var queryHooks []queryHook
+
+// What attrs starts with, and so aren't tags.
+var hookInputs = map[string]bool{"client": true, "user": true, "database": true, "command": true}
+
+func registerHook(name string, hook queryHook) {
+	registeredHooks[name] = hook
+}
+
+// setupHooks turns -hook and -hook-plugin into the chain.
+func setupHooks(names, plugins string) error {
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		hook, ok := registeredHooks[name]
+		if !ok {
+			known := make([]string, 0, len(registeredHooks))
+			for name := range registeredHooks {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown hook %s, expected one of: %s", name, strings.Join(known, ", "))
+		}
+		queryHooks = append(queryHooks, hook)
+	}
+	for _, path := range strings.Split(plugins, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		p, err := plugin.Open(path)
+		if err != nil {
+			return err
+		}
+		sym, err := p.Lookup("Hook")
+		if err != nil {
+			return err
+		}
+		hook, ok := sym.(func(*string, map[string]string) bool)
+		if !ok {
+			return fmt.Errorf("%s: Hook is a %T, expected func(*string, map[string]string) bool", path, sym)
+		}
+		queryHooks = append(queryHooks, hook)
+	}
+	return nil
+}
+
+// runHooks passes a query down the chain, returning what's left of it and
+// any tags, or false if a hook dropped it.
+func runHooks(rs *source, ptype int, pdata []byte) ([]byte, map[string]string, bool) {
+	query := string(pdata)
+	attrs := map[string]string{
+		"client": rs.client(), "user": rs.user, "database": rs.schema, "command": strconv.Itoa(ptype),
+	}
+	for _, hook := range queryHooks {
+		if !hook(&query, attrs) {
+			return pdata, nil, false
+		}
+	}
+	var tags map[string]string
+	for k, v := range attrs {
+		if hookInputs[k] {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[k] = v
+	}
+	return []byte(query), tags, true
+}
+
+// comment-tags: the key='value' pairs in a comment at the start or end of
+// the query, the way sqlcommenter and friends write them, become tags.
+var commentTag = regexp.MustCompile(`([A-Za-z_][\w.-]*)\s*=\s*'([^']*)'`)
+
+func commentTags(query *string, attrs map[string]string) bool {
+	q := strings.TrimRight(strings.TrimSpace(*query), ";")
+	var comment string
+	switch {
+	case strings.HasPrefix(q, "/*"):
+		if end := strings.Index(q, "*/"); end > 0 {
+			comment = q[2:end]
+		}
+	case strings.HasSuffix(q, "*/"):
+		if begin := strings.LastIndex(q, "/*"); begin >= 0 {
+			comment = q[begin+2 : len(q)-2]
+		}
+	}
+	for _, m := range commentTag.FindAllStringSubmatch(comment, -1) {
+		if !hookInputs[m[1]] {
+			attrs[m[1]] = m[2]
+		}
+	}
+	return true
+}
+
+func init() {
+	registerHook("comment-tags", commentTags)
+}
@@ -0,0 +1,119 @@
+/*
+ * latency.go
+ *
+ * -latency-histogram draws the distribution of query times under the
+ * report, a bar for each step of 1, 2 and 5 times a power of ten, so a
+ * second hump (a cache miss, a lock wait, a slow replica) shows up where an
+ * average or a p99 would hide it:
+ *
+ *     Query times, 12034 queries
+ *        100us - 200us  |##########                              |   2210  18.4%
+ *        200us - 500us  |########################################|   8840  73.5%
+ *        500us - 1ms    |                                        |     12   0.1%
+ *          1ms - 2ms    |                                        |      0   0.0%
+ *          2ms - 5ms    |####                                    |    972   8.1%
+ *
+ * -latency-histogram-top N draws one for each of the top N queries too. The
+ * histograms only keep values to within a few percent, so a query right on
+ * a step can land either side of it.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const HIST_BAR_WIDTH = 40
+
+var latencyHistogram bool
+var latencyHistogramTop int
+
+// latencySteps are where the bars start, in nanoseconds: 1us, 2us, 5us,
+// 10us and so on up to 100s.
+var latencySteps = func() []uint64 {
+	steps := []uint64{0}
+	for p := uint64(1000); p <= 100000000000; p *= 10 {
+		steps = append(steps, p, 2*p, 5*p)
+	}
+	return steps
+}()
+
+// latencyLabel formats a step for humans: 500us, 2ms, 10s.
+func latencyLabel(ns uint64) string {
+	switch {
+	case ns < 1000000:
+		return fmt.Sprintf("%dus", ns/1000)
+	case ns < 1000000000:
+		return fmt.Sprintf("%dms", ns/1000000)
+	}
+	return fmt.Sprintf("%ds", ns/1000000000)
+}
+
+// histogramLines draws h, a line per step from the fastest to the slowest
+// anything landed in.
+func histogramLines(h *histogram) []string {
+	if h.Count() == 0 {
+		return nil
+	}
+	counts := make([]uint64, len(latencySteps))
+	h.each(func(i int, c uint64) {
+		lo, hi := histRange(i)
+		mid := lo + (hi-lo)/2
+		step := len(latencySteps) - 1
+		for step > 0 && latencySteps[step] > mid {
+			step--
+		}
+		counts[step] += c
+	})
+
+	first, last := -1, 0
+	var most uint64
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		if c > most {
+			most = c
+		}
+	}
+
+	var lines []string
+	for i := first; i <= last; i++ {
+		from, to := "0", "+"
+		if i > 0 {
+			from = latencyLabel(latencySteps[i])
+		}
+		if i < len(latencySteps)-1 {
+			to = latencyLabel(latencySteps[i+1])
+		}
+		bar := int((counts[i]*HIST_BAR_WIDTH + most - 1) / most)
+		lines = append(lines, fmt.Sprintf("%7s - %-6s |%-*s| %8d %5.1f%%", from, to, HIST_BAR_WIDTH,
+			strings.Repeat("#", bar), counts[i], float64(counts[i])/float64(h.Count())*100))
+	}
+	return lines
+}
+
+// printLatencyHistograms is the -latency-histogram part of the status
+// report: everything, and with -latency-histogram-top the top queries.
+func printLatencyHistograms(rows []reportRow) {
+	print := func(title string, h *histogram) {
+		log.Printf(" ")
+		log.Printf("%s, %d queries", title, h.Count())
+		for _, line := range histogramLines(h) {
+			log.Printf("%s", line)
+		}
+	}
+	print("Query times", &times)
+	for i := 0; i < latencyHistogramTop && i < len(rows); i++ {
+		if c, ok := qbuf[rows[i].query]; ok {
+			print(fmt.Sprintf("Times for %s", clip(rows[i].query, 100)), &c.times)
+		}
+	}
+}
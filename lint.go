@@ -0,0 +1,185 @@
+/*
+ * lint.go
+ *
+ * Spots queries with habits worth knowing about, from their cleaned up
+ * text. Each fingerprint gets checked the first time we see it.
+ *
+ * SELECT * (or t.*) breaks when columns get added or moved and drags back
+ * more than anyone needed. -select-star puts a section in the report listing
+ * the queries doing it.
+ *
+ * An UPDATE or DELETE with no WHERE hits every row in the table, and is
+ * usually somebody's very bad day. -no-where logs each one as it goes by,
+ * with who sent it, and -no-where-alert sends them to -webhook too. Like
+ * MySQL's sql_safe_updates, a LIMIT lets it off.
+ *
+ * -max-response-bytes watches the other direction: queries pulling back
+ * more than they should, which can look fine on latency right up until the
+ * app falls over. Each query over gets logged once a report, with its full
+ * text and the client, and the report says how many there were.
+ */
+
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// Words that can come between SELECT and the first column.
+var selectModifiers = map[string]bool{
+	"select": true, "all": true, "distinct": true, "distinctrow": true, "high_priority": true,
+	"straight_join": true, "sql_small_result": true, "sql_big_result": true, "sql_buffer_result": true,
+	"sql_cache": true, "sql_no_cache": true, "sql_calc_found_rows": true,
+}
+
+var (
+	selectStarReport bool
+	noWhere          bool
+	noWhereAlert     bool
+)
+
+type bigResponses struct {
+	max     uint64
+	seen    map[string]bool // queries logged this report
+	count   int
+	biggest uint64
+}
+
+var bigresponses *bigResponses
+
+func openBigResponses(max uint64) *bigResponses {
+	self := &bigResponses{max: max}
+	self.reset()
+	return self
+}
+
+func (self *bigResponses) reset() {
+	self.seen = make(map[string]bool)
+	self.count, self.biggest = 0, 0
+}
+
+// usesSelectStar says whether any SELECT in a query asks for all the columns,
+// rather than COUNT(*) or a multiplication.
+func usesSelectStar(query string) bool {
+	tokens := tableTokens(query)
+	for i := 1; i < len(tokens); i++ {
+		if tokens[i] != "*" {
+			continue
+		}
+		prev := strings.ToLower(tokens[i-1])
+		if selectModifiers[prev] || prev == "," {
+			return true
+		}
+		// t.* but not a.b * c
+		if prev == "." && i >= 2 && isIdentifier(tokens[i-2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingWhere says whether an UPDATE or DELETE would hit the whole table.
+// WHEREs in subqueries and comments don't count.
+func missingWhere(query []byte) bool {
+	switch statementType(query) {
+	case "UPDATE", "DELETE":
+	default:
+		return false
+	}
+	tokens := tableTokens(cleanupQuery(query))
+	depth := 0
+	for i := 0; i < len(tokens); i++ {
+		switch strings.ToLower(tokens[i]) {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case "/":
+			if i+1 < len(tokens) && tokens[i+1] == "*" {
+				for i += 2; i+1 < len(tokens) && !(tokens[i] == "*" && tokens[i+1] == "/"); i++ {
+				}
+				i++
+			}
+		case "where", "limit":
+			if depth == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkWhere logs (and maybe alerts on) a write without a WHERE.
+func checkWhere(rs *source, query []byte) {
+	if !missingWhere(query) {
+		return
+	}
+	user := rs.user
+	if user == "" {
+		user = "(unknown)"
+	}
+	text := validUTF8(clip(string(query), 1024))
+	logger.Warn(statementType(query)+" without WHERE", "client", rs.client(), "user", user, "query", text)
+	if noWhereAlert && webhook != nil {
+		webhook.Add(webhookAlert{Kind: "no_where", ID: queryID(cleanupQuery(query)), Query: text,
+			Message: statementType(query) + " without WHERE", Client: rs.client(), User: rs.user})
+	}
+}
+
+// Query logs a completed query whose response was over the limit.
+func (self *bigResponses) Query(rs *source, req *pendingRequest) {
+	if req.qdata == nil || req.rbytes <= self.max {
+		return
+	}
+	self.count++
+	if req.rbytes > self.biggest {
+		self.biggest = req.rbytes
+	}
+	if self.seen[req.text] {
+		return
+	}
+	self.seen[req.text] = true
+	text := req.raw
+	if text == "" {
+		text = req.text
+	}
+	user := rs.user
+	if user == "" {
+		user = "(unknown)"
+	}
+	logger.Warn("Large response", "bytes", req.rbytes, "id", queryID(req.text), "client", rs.sender(req), "user", user,
+		"query", validUTF8(clip(text, 1024)))
+}
+
+func (self *bigResponses) Write(rows []reportRow, elapsed float64) {
+	if self.count > 0 {
+		log.Printf("%s%d responses over %d bytes from %d queries, the biggest %d bytes%s", COLOR_YELLOW,
+			self.count, self.max, len(self.seen), self.biggest, COLOR_DEFAULT)
+	}
+	self.reset()
+}
+
+func (self *bigResponses) Close() {
+}
+
+// printSelectStar is the -select-star section of the report.
+func printSelectStar(rows []reportRow, displaycount int) {
+	var star []reportRow
+	var count uint64
+	for _, r := range rows {
+		if r.selectStar {
+			star = append(star, r)
+			count += r.count
+		}
+	}
+	log.Printf(" ")
+	log.Printf("%d queries using SELECT *, run %d times", len(star), count)
+	if len(star) == 0 {
+		return
+	}
+	if len(star) > displaycount {
+		star = star[:displaycount]
+	}
+	printTable(tableColumns, star)
+}
@@ -0,0 +1,52 @@
+/*
+ * logging.go
+ *
+ * The report is what we're for, and goes out through the log package the
+ * way it always has. Everything else, from failing to reach Graphite to
+ * spotting a suspicious query, is a diagnostic, and goes through slog with
+ * a level so it can be filtered, and as JSON with -log-format json for
+ * anything that wants to read it. In JSON mode the report moves to stdout
+ * (unless there's a -log), so stderr is nothing but JSON.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// Until setupLogging, text on stderr.
+var logger *slog.Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+func setupLogging(level, format string) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		fatalf("Unknown -log-level %s, expected debug, info, warn or error", level)
+	}
+	var out io.Writer = os.Stderr
+	if logfile != nil {
+		out = logfile
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(out, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(out, opts))
+		if logfile == nil {
+			log.SetOutput(os.Stdout)
+		}
+	default:
+		fatalf("Unknown -log-format %s, expected text or json", format)
+	}
+}
+
+// fatalf is log.Fatalf for diagnostics.
+func fatalf(format string, args ...interface{}) {
+	logger.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
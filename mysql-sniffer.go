@@ -5,10 +5,6 @@
  * diagnostic information on the realtime queries your database is handling.
  *
  * FIXME: this assumes IPv4.
- * FIXME: tokenizer doesn't handle negative numbers or floating points.
- * FIXME: canonicalizer should collapse "IN (?,?,?,?)" and "VALUES (?,?,?,?)"
- * FIXME: tokenizer breaks on '"' or similarly embedded quotes
- * FIXME: tokenizer parses numbers in words wrong, i.e. s2compiled -> s?compiled
  *
  * written by Mark Smith <mark@qq.is>
  *
@@ -21,14 +17,25 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/akrennmair/gopcap"
+	"hash/fnv"
+	"io"
 	"log"
-	"math/rand"
+	"net"
+	"os"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -37,12 +44,27 @@ const (
 	TOKEN_NUMBER     = 2
 	TOKEN_WHITESPACE = 3
 	TOKEN_OTHER      = 4
-
-	// Internal tuning
-	TIME_BUCKETS = 10000
+	TOKEN_COMMENT    = 5
 
 	// MySQL packet types
-	COM_QUERY = 3
+	COM_QUIT                = 1
+	COM_INIT_DB             = 2
+	COM_QUERY               = 3
+	COM_PROCESS_INFO        = 10
+	COM_CHANGE_USER         = 17
+	COM_STMT_PREPARE        = 22
+	COM_STMT_EXECUTE        = 23
+	COM_STMT_SEND_LONG_DATA = 24
+	COM_STMT_CLOSE          = 25
+	COM_STMT_FETCH          = 28
+	COM_RESET_CONNECTION    = 31
+
+	// TCP flags we care about
+	TCP_FIN = 0x01
+	TCP_RST = 0x04
+
+	// How often we look for connections gone idle for -stream-timeout
+	STREAM_SWEEP = 10 * time.Second
 
 	// These are used for formatting outputs
 	F_NONE = iota
@@ -50,6 +72,14 @@ const (
 	F_ROUTE
 	F_SOURCE
 	F_SOURCEIP
+	F_DATABASE
+	F_TABLE
+	F_STATEMENT
+	F_USER
+
+	// Requests we'll let a client have outstanding before deciding we've
+	// lost track of the stream
+	MAX_PIPELINE = 64
 )
 
 // ANSI colors
@@ -65,9 +95,39 @@ type packet struct {
 	data    []byte
 }
 
+// A formatOp is one piece of the -f format: an F_XXXXXX token to fill in,
+// or with F_NONE some text to copy.
+type formatOp struct {
+	token int
+	text  string
+}
+
+// packetSource is anything we can pull captured packets from. It's shaped
+// after pcap's NextEx so a *pcap.Pcap satisfies it directly.
+type packetSource interface {
+	NextEx() (*pcap.Packet, int32)
+	Getstats() (*pcap.Stat, error)
+	Close()
+}
+
+// pcapSource wraps a libpcap handle so its packets are tagged with the
+// handle's datalink type, which libpcap doesn't do for us.
+type pcapSource struct {
+	*pcap.Pcap
+	linktype int
+}
+
+func (self *pcapSource) NextEx() (*pcap.Packet, int32) {
+	pkt, rv := self.Pcap.NextEx()
+	if pkt != nil {
+		pkt.Type = self.linktype
+	}
+	return pkt, rv
+}
+
 type sortable struct {
 	value float64
-	line  string
+	row   reportRow
 }
 type sortableSlice []sortable
 
@@ -76,39 +136,163 @@ type source struct {
 	srcip     string
 	synced    bool
 	reqbuffer []byte
-	resbuffer []byte
-	reqSent   *time.Time
-	reqTimes  [TIME_BUCKETS]uint64
-	qbytes    uint64
-	qdata     *queryData
-	qtext     string
+	resp      responseParser   // parsing the response to pending[0]
+	pending   []pendingRequest // requests waiting on a response, oldest first
+	reqCount  uint64           // requests timed, their total and the longest, in ns
+	reqTotal  uint64
+	reqMax    uint64
+	qdata     *queryData // the most recent request
+	user      string     // who the client logged in as, if we saw it
+	schema    string     // the database in use, as far as we know
+	last      time.Time  // the last packet either way
+	pg        *pgSession // with -protocol postgres
+	proxied   string     // who the current request is really from, with -proxy
+	since     time.Time  // when we first saw it
+	queries   uint64     // requests it's sent
+	bytes     uint64     // both ways
+	lastQuery string     // the text of the last request we counted
+
+	// With -transactions, see transactions.go.
+	txn    *transaction // the one it's in
+	manual bool         // after SET autocommit=0
+
+	recordID uint64 // its number in the -record file, 0 until it's in there
+}
+
+// reset forgets everything in flight, for when we've lost our place in the
+// stream.
+func (self *source) reset() {
+	self.reqbuffer = nil
+	self.resp.reset()
+	self.pending = nil
+	self.synced = false
+}
+
+type pendingRequest struct {
+	sent   time.Time
+	ptype  int
+	text   string
+	query  string // the cleaned up query, if we're exporting events
+	raw    string // the query as sent, with -slow-log
+	bytes  uint64
+	ttfb   uint64
+	rbytes uint64            // response bytes so far
+	qdata  *queryData        // nil for requests we don't report on
+	rollup []*queryData      // what else it's counted under, like its tables with -tables
+	txn    *transaction      // what a COMMIT or ROLLBACK ends, with -transactions
+	tags   map[string]string // from -hook
+	client string            // who it's really from, with -proxy
 }
 
 type queryData struct {
-	ptype int
-	count uint64
-	bytes uint64
-	times [TIME_BUCKETS]uint64
+	ptype  int
+	count  uint64 // this interval, unless we're cumulative
+	total  uint64 // since we started
+	bytes  uint64
+	errors uint64    // error responses
+	last   int       // querycount when we last saw it, for -max-fingerprints
+	times  histogram // until the end of the response
+	ttfb   histogram // until the first byte of the response
+
+	example string     // the first query we saw, for -digest
+	stype   string     // statement type, for COM_QUERY
+	inLists *histogram // IN list lengths, with -in-lengths
+	rows    *histogram // rows per VALUES, likewise
+	write   bool       // whether it changes anything
+	star    bool       // whether it does SELECT *
+	alert   string     // from the last report, with -alert-factor
+
+	// With -database-stats, the statements this interval that read or wrote.
+	reads, writes uint64
+}
+
+// One line of the status report. Times are in milliseconds.
+type reportRow struct {
+	query            string
+	id               string
+	ptype            int
+	count            uint64
+	qps, lifeqps     float64
+	min, avg, max    float64
+	stddev           float64
+	p50, p95, p99    float64
+	ttfb             float64
+	bytes, bytesPer  uint64
+	errors           uint64
+	inAvg, inMax     uint64 // IN list lengths, with -in-lengths
+	rowsAvg, rowsMax uint64 // rows per VALUES, likewise
+	reads, writes    uint64 // statements, with -database-stats
+	write            bool
+	selectStar       bool
+	alert            string  // why it's over its baseline, with -alert-factor
+	score            float64 // how far over, with -baseline
+	isNew            bool    // whether -baseline has never seen it
+}
+
+// Somewhere other than the terminal to send each status report.
+type reportSink interface {
+	Write(rows []reportRow, elapsed float64)
+	Close()
 }
 
 var start int64 = UnixNow()
+var intervalStart int64 = start
 var qbuf map[string]*queryData = make(map[string]*queryData)
+var tbuf map[string]*queryData = make(map[string]*queryData) // per table, with -tables
+var tableStats bool
 var querycount int
-var chmap map[string]*source = make(map[string]*source)
+var intervalcount int
+var cumulative bool = false
 var verbose bool = false
 var noclean bool = false
-var format []interface{}
+var format []formatOp // what -f asks for, see parseFormat
 var port uint16
 var iscolor bool = false
-var times [TIME_BUCKETS]uint64
+var termWidth int // 0 if we're not writing to a terminal
+var slowMs float64
+
+// Queries under any of these are left out of the report.
+var minCount uint64
+var minAvgMs float64
+var minBytes uint64
+
+var inLengths bool
+var stripComments bool
+var keepHints bool
+var keepLiterals map[string]bool // lower case keywords whose literals we leave alone
+var matchQuery *regexp.Regexp    // -match
+var ignoreQuery *regexp.Regexp   // -ignore
+var onlyClasses map[string]bool  // -only, nil for everything
+var useParser bool               // -fingerprint parser
+var maxQueryLen int              // -max-query-len, 0 for no limit
+var maxFingerprints int          // -max-fingerprints, 0 for no limit
+var times histogram
+var ttfbTimes histogram
+var iface packetSource
+var clients []*net.IPNet
+var excludeClients []*net.IPNet
+var sampleRate float64 = 1 // -sample, the fraction of connections we track
+var streamTimeout time.Duration
+var maxRequestBuffer int
+var decap bool = false
+var dumper *packetDumper
+var sinks []reportSink
+var dumpQueriesOnly bool = false
+var onQuery func(rs *source, query []byte, ts time.Time) // every COM_QUERY, for replay
+var vxlanPort uint16
 
 var stats struct {
 	packets struct {
 		rcvd      uint64
 		rcvd_sync uint64
 	}
-	desyncs uint64
-	streams uint64
+	desyncs   uint64
+	streams   uint64
+	truncated uint64
+	overflows uint64 // requests too big for -max-request-buffer
+	closed    uint64 // streams we saw end
+	expired   uint64 // streams we gave up on after -stream-timeout
+	evicted   uint64 // queries forgotten for -max-fingerprints
 }
 
 func UnixNow() int64 {
@@ -116,26 +300,364 @@ func UnixNow() int64 {
 }
 
 func main() {
-	var lport *int = flag.Int("P", 3306, "MySQL port to use")
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		runDiff(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+
+	var lport *int = flag.Int("P", 3306, "MySQL port to use (5432 with -protocol postgres)")
+	var protocolname *string = flag.String("protocol", "mysql", "Wire protocol to decode: mysql, or postgres")
 	var lfilter *string = flag.String("F", "", "extra tcpdump filter rule")
 	var eth *string = flag.String("i", "eth0", "Interface to sniff")
 	var period *int = flag.Int("t", 10, "Seconds between outputting status")
+	var runfor *int = flag.Int("T", 0, "Stop after this many seconds with a final report (0 to run until interrupted)")
+	var maxcount *int = flag.Int("count", 0, "Stop after this many queries with a final report (0 for no limit)")
 	var displaycount *int = flag.Int("d", 15, "Display this many queries in status updates")
 	var doverbose *bool = flag.Bool("v", false, "Print every query received (spammy)")
 	var nocleanquery *bool = flag.Bool("n", false, "no clean queries")
-	var formatstr *string = flag.String("f", "#s:#q", "Format for output aggregation")
-	var sortby *string = flag.String("s", "count", "Sort by: count, max, avg, maxbytes, avgbytes")
+	var formatstr *string = flag.String("f", "#s:#q", "Format for output aggregation: #s source, #i source IP, #r route, #q query, #d database, #t table, #c statement type, #u user")
+	var sortby *string = flag.String("s", "count", "Sort by: "+strings.Join(sortKeys, ", "))
+	flag.StringVar(sortby, "sort", "count", "Same as -s")
 	var cutoff *int = flag.Int("c", 0, "Only show queries over count/second")
-	var coloroff *bool = flag.Bool("y", false, "open the color when print queries")
+	var lmincount *uint64 = flag.Uint64("min-count", 0, "Only show queries seen at least this many times")
+	var lminavg *float64 = flag.Float64("min-avg-ms", 0, "Only show queries averaging at least this many ms")
+	var lminbytes *uint64 = flag.Uint64("min-bytes", 0, "Only show queries moving at least this many bytes")
+	var dostripcomments *bool = flag.Bool("strip-comments", false, "Strip comments from queries before aggregating them")
+	var dokeephints *bool = flag.Bool("keep-hints", true, "With -strip-comments, keep optimizer hints and route comments")
+	var keepliterals *string = flag.String("keep-literals", "", "Keep the literals after these keywords (comma separated, e.g. limit,offset)")
+	var routeprefix *string = flag.String("route-prefix", "", "Only comments starting with this are routes for #r (e.g. route=), and they can be anywhere")
+	var matchstr *string = flag.String("match", "", "Only count queries whose cleaned up text matches this regexp")
+	var ignorestr *string = flag.String("ignore", "", "Don't count queries whose cleaned up text matches this regexp (e.g. '(?i)^(select \\?|show status)')")
+	var onlystr *string = flag.String("only", "", "Only count these kinds of query (comma separated): reads, writes, ddl, other")
+	var fingerprint *string = flag.String("fingerprint", "tokens", "How to canonicalize queries: tokens (fast), parser (needs -tags sqlparser)")
+	var dotables *bool = flag.Bool("tables", false, "Also keep stats per table, and report the busiest")
+	var doinlengths *bool = flag.Bool("in-lengths", false, "Keep track of how long each query's IN lists and VALUES rows are")
+	var coloroff *bool = flag.Bool("y", false, "open the color when print queries (same as -color always)")
+	var colormode *string = flag.String("color", "auto", "Color the output: auto, always, never")
+	var lslowms *float64 = flag.Float64("slow-ms", 100, "Latency (ms) at which a query counts as slow, for colors and -slow-log")
+	var documulative *bool = flag.Bool("cumulative", false, "Accumulate stats since start instead of per status interval")
+	var capture *string = flag.String("capture", "pcap", "Capture backend: pcap, afpacket, ebpf (afpacket with an in-kernel socket filter), xdp (filtered in XDP and TCX into a BPF ring buffer), unix (the server's unix socket, with BPF tracepoints), pfring")
+	var unixsocket *string = flag.String("unix-socket", "/var/run/mysqld/mysqld.sock", "The server's unix socket for -capture unix, as the server has it (SHOW VARIABLES LIKE 'socket'), or @name for an abstract one")
+	var fanout *int = flag.Int("fanout", 0, "AF_PACKET fanout group (or PF_RING cluster) id, 0 to disable")
+	var snaplen *int = flag.Int("snaplen", 65535, "Bytes of each packet to capture")
+	var bufsize *int = flag.Int("buffer-size", 0, "libpcap's kernel buffer in MB, bigger to drop less on bursts (0 for its default)")
+	var pcaptimeout *int = flag.Int("pcap-timeout", 0, "How long (ms) libpcap waits for more packets before handing over what it has (0 to wait for a full buffer)")
+	var lowlatency *bool = flag.Bool("low-latency", false, "Have libpcap hand over what it has every millisecond, the shortest -pcap-timeout, for lower latency at the cost of more wakeups")
+	var readfile *string = flag.String("r", "", "Read packets from a pcap/pcapng file instead of sniffing")
+	var writefile *string = flag.String("w", "", "Write the packets we parse to this pcap file")
+	var writequeries *bool = flag.Bool("w-queries", false, "Only write packets carrying COM_QUERY with -w")
+	var clientstr *string = flag.String("client", "", "Only track these clients (comma separated IPs/CIDRs)")
+	var dodecap *bool = flag.Bool("decap", false, "Unwrap VXLAN/GRE/ERSPAN tunneled (mirrored) traffic")
+	var lvxlanport *int = flag.Int("vxlan-port", 4789, "UDP port carrying VXLAN when using -decap")
+	var csvfile *string = flag.String("csv", "", "Also write each status report as CSV to this file (- for stdout)")
+	var recordfile *string = flag.String("record", "", "Record every query, with when, which connection and which database, to this file for mysql-sniffer replay")
+	var exportsql *string = flag.String("export-sql", "", "Write the first query of each kind, with USE for its database, to this .sql file (- for stdout)")
+	var exportall *bool = flag.Bool("export-sql-all", false, "Write every query with -export-sql, not just the first of each kind")
+	var savereport *string = flag.String("save-report", "", "Also keep the latest status report in this file as JSON, for mysql-sniffer diff")
+	var timeseriesfile *string = flag.String("timeseries", "", "Also write a line of totals (qps, reads, writes, latency, bytes) per interval to this file (- for stdout)")
+	var graphiteaddr *string = flag.String("graphite", "", "Send each status report to this Graphite/Carbon host:port")
+	var graphiteprefix *string = flag.String("graphite-prefix", "mysql-sniffer", "Prefix for Graphite metric names")
+	var otlpendpoint *string = flag.String("otlp", "", "Export metrics to this OTLP/HTTP collector (e.g. http://localhost:4318)")
+	var otlpspans *bool = flag.Bool("otlp-spans", false, "Also export a span per query with -otlp")
+	var dodigest *bool = flag.Bool("digest", false, "Report in the style of pt-query-digest, ranked by total response time")
+	var storefile *string = flag.String("store", "", "Append each status report to this SQLite database")
+	var elasticurl *string = flag.String("elastic", "", "Index every query into Elasticsearch/OpenSearch at this URL (user:pass@ for auth)")
+	var elasticindex *string = flag.String("elastic-index", "mysql-sniffer", "Prefix for the daily Elasticsearch indices")
+	var redisurl *string = flag.String("redis", "", "Add each status report to counters in Redis (redis://[:pass@]host:port[/db])")
+	var redisprefix *string = flag.String("redis-prefix", "mysql-sniffer", "Prefix for Redis keys")
+	var redisttl *int = flag.Int("redis-ttl", 86400, "Seconds Redis keys live without an update")
+	var natsurl *string = flag.String("nats", "", "Publish every query to this NATS server (nats://[user:pass@]host:port)")
+	var natssubject *string = flag.String("nats-subject", "mysql-sniffer.queries", "Subject to publish queries on with -nats")
+	var natsjetstream *bool = flag.Bool("nats-jetstream", false, "Ask JetStream to ack every message published with -nats")
+	var slowlogfile *string = flag.String("slow-log", "", "Log the full text of every query taking -slow-ms or longer to this file (- for stdout)")
+	var lalertfactor *float64 = flag.Float64("alert-factor", 0, "Alert when a query's qps or p95 goes this many times over its usual (0 for never)")
+	var lalertmin *uint64 = flag.Uint64("alert-min-count", 20, "Only alert on queries seen at least this many times in the interval")
+	var lalerterrors *float64 = flag.Float64("alert-error-rate", 0, "Alert when this fraction of a query's executions fail, e.g. 0.05 (0 for never)")
+	var baselinefile *string = flag.String("baseline", "", "Start from the query baselines saved in this file, and flag queries it's never seen (-alert-factor defaults to 3)")
+	var baselinesave *string = flag.String("baseline-save", "", "Save the query baselines to this file after every report, for -baseline")
+	var webhookurl *string = flag.String("webhook", "", "POST alerts to this URL as JSON (Slack compatible)")
+	var webhookformat *string = flag.String("webhook-format", "json", "Webhook body: json, or pagerduty (Events API v2, to PagerDuty unless -webhook says otherwise)")
+	var webhookkey *string = flag.String("webhook-key", "", "PagerDuty routing key for -webhook-format pagerduty")
+	var webhookslow *float64 = flag.Float64("webhook-slow-ms", 0, "Also alert on queries taking this many ms or more (0 for never)")
+	var dosecurity *bool = flag.Bool("security", false, "Log queries that look like SQL injection, and who sent them")
+	var auditfile *string = flag.String("audit", "", "Append every request to this hash-chained audit log")
+	var auditverify *string = flag.String("audit-verify", "", "Check the hash chain in this audit log and exit")
+	var doselectstar *bool = flag.Bool("select-star", false, "Also report the queries using SELECT *")
+	var doprocesslist *bool = flag.Bool("processlist", false, "Also report every connection, like SHOW PROCESSLIST")
+	var doclientstats *bool = flag.Bool("client-stats", false, "Also report the busiest clients, by IP")
+	var doclientports *bool = flag.Bool("client-stats-ports", false, "With -client-stats, count each IP:port on its own")
+	var douserstats *bool = flag.Bool("user-stats", false, "Also report the busiest MySQL users")
+	var dodatabasestats *bool = flag.Bool("database-stats", false, "Also report each database's traffic, read/write mix and latency")
+	var dotransactions *bool = flag.Bool("transactions", false, "Also report transaction counts, times and rollbacks")
+	var dolatencyhist *bool = flag.Bool("latency-histogram", false, "Also draw a histogram of query times")
+	var latencyhisttop *int = flag.Int("latency-histogram-top", 0, "With -latency-histogram, draw one for each of this many top queries too")
+	var donowhere *bool = flag.Bool("no-where", false, "Log every UPDATE or DELETE without a WHERE (or LIMIT), and who sent it")
+	var donowherealert *bool = flag.Bool("no-where-alert", false, "Also send -no-where's finds to -webhook")
+	var maxresponse *uint64 = flag.Uint64("max-response-bytes", 0, "Log queries whose responses are bigger than this, with who asked (0 for never)")
+	var lsample *float64 = flag.Float64("sample", 1, "Only track this fraction of connections (e.g. 0.1), scaling counts up to match")
+	var lmaxquerylen *int = flag.Int("max-query-len", 0, "Cut the query text we keep and show to this many characters (0 for no limit)")
+	var dodaemon *bool = flag.Bool("daemon", false, "Run in the background (use -log, or the output goes nowhere)")
+	var pidfile *string = flag.String("pidfile", "", "Write our pid to this file, and refuse to start if it names one still running")
+	var logpath *string = flag.String("log", "", "Write the report and everything else we'd print to this file, reopened on SIGHUP")
+	var runas *string = flag.String("run-as", "", "Switch to this user[:group] once the capture is open")
+	var lmaxfingerprints *int = flag.Int("max-fingerprints", 0, "Remember at most this many queries, forgetting the least recently seen (0 for no limit)")
+	var lstreamtimeout *int = flag.Int("stream-timeout", 3600, "Forget connections idle for this many seconds (0 for never)")
+	var lmaxreqbuf *int = flag.Int("max-request-buffer", 4<<20, "Give up on requests bigger than this many bytes, per connection (0 for no limit)")
+	var loglevel *string = flag.String("log-level", "info", "Least important diagnostics to log: debug, info, warn or error")
+	var logformat *string = flag.String("log-format", "text", "Diagnostics as text or json (json puts the report on stdout)")
+	var queuesize *int = flag.Int("queue", 65536, "Packets to hold between capture and processing before dropping them")
+	var hooknames *string = flag.String("hook", "", "Run queries through these compiled in hooks first (comma separated, e.g. comment-tags)")
+	var hookplugins *string = flag.String("hook-plugin", "", "... and these Go plugins exporting a Hook (comma separated .so files)")
+	var scriptfile *string = flag.String("script", "", "Run queries through this Lua script's query(q) (needs -tags lua)")
+	var agentaddr *string = flag.String("agent", "", "Send each status report's numbers to the -collect collector at this host:port")
+	var agentname *string = flag.String("agent-name", "", "What to call this sniffer with -agent (default the hostname)")
+	var collectaddr *string = flag.String("collect", "", "Don't sniff, add up what -agent sniffers send to this address (e.g. :7070)")
+	var doproxy *bool = flag.Bool("proxy", false, "Behind ProxySQL/Vitess: put queries down to the client a comment in them names")
+	var proxykeys *string = flag.String("proxy-keys", "client_ip,client_addr,remote_addr,client", "Comment keys naming the client for -proxy")
+	var nworkers *int = flag.Int("workers", 1, "Goroutines to parse packets on, sharing out the connections")
+	var httpaddr *string = flag.String("http", "", "Serve live statistics as JSON on this address (e.g. :8080)")
+	var dotui *bool = flag.Bool("tui", false, "Full screen, top-like view instead of the status report")
+	var exclientstr *string = flag.String("exclude-client", "", "Never track these clients (comma separated IPs/CIDRs)")
 	flag.Parse()
 
+	if *auditverify != "" {
+		n, err := verifyAudit(*auditverify)
+		if err != nil {
+			fatalf("%s is bad after %d good entries: %s", *auditverify, n, err.Error())
+		}
+		log.Printf("%s: %d entries, chain intact", *auditverify, n)
+		return
+	}
+
+	if *dodaemon {
+		if *dotui {
+			fatalf("-tui can't run in the background")
+		}
+		daemonize()
+	}
+	if *logpath != "" {
+		logfile = openLog(*logpath)
+	}
+	setupLogging(*loglevel, *logformat)
+	if *pidfile != "" {
+		writePidfile(*pidfile)
+		defer os.Remove(*pidfile)
+	}
+
 	verbose = *doverbose
+	cumulative = *documulative
+	digest = *dodigest
 	noclean = *nocleanquery
 	port = uint16(*lport)
+	switch *protocolname {
+	case "mysql":
+	case "postgres":
+		protocol = PROTO_POSTGRES
+		portSet := false
+		flag.Visit(func(f *flag.Flag) { portSet = portSet || f.Name == "P" })
+		if !portSet {
+			port = 5432
+		}
+	default:
+		fatalf("Unknown -protocol %s, expected mysql or postgres", *protocolname)
+	}
+	decap = *dodecap
+	dumpQueriesOnly = *writequeries
+	if *writefile != "" {
+		dumper = &packetDumper{path: *writefile}
+		defer dumper.Close()
+	}
+	vxlanPort = uint16(*lvxlanport)
+	if *csvfile != "" {
+		sinks = append(sinks, openCSV(*csvfile))
+	}
+	if *baselinesave != "" {
+		sinks = append(sinks, &baselineFile{path: *baselinesave})
+	}
+	if *recordfile != "" {
+		recorder = openRecorder(*recordfile)
+		sinks = append(sinks, recorder)
+	}
+	if *exportsql != "" {
+		exporter = openExporter(*exportsql, *exportall)
+		sinks = append(sinks, exporter)
+	}
+	if *savereport != "" {
+		sinks = append(sinks, &reportFile{path: *savereport})
+	}
+	if *timeseriesfile != "" {
+		sinks = append(sinks, openTimeseries(*timeseriesfile))
+	}
+	if *graphiteaddr != "" {
+		sinks = append(sinks, openGraphite(*graphiteaddr, *graphiteprefix))
+	}
+	if *storefile != "" {
+		store, err := openStore(*storefile)
+		if err != nil {
+			fatalf("Failed to open %s: %s", *storefile, err.Error())
+		}
+		sinks = append(sinks, store)
+	}
+	if *elasticurl != "" {
+		elastic = openElastic(*elasticurl, *elasticindex)
+		sinks = append(sinks, elastic)
+	}
+	if *redisurl != "" {
+		sinks = append(sinks, openRedis(*redisurl, *redisprefix, *redisttl))
+	}
+	if *natsurl != "" {
+		nats = openNats(*natsurl, *natssubject, *natsjetstream)
+		sinks = append(sinks, nats)
+	}
+	if *slowlogfile != "" {
+		slowlog = openSlowLog(*slowlogfile)
+		sinks = append(sinks, slowlog)
+	}
+	if *webhookurl != "" || *webhookformat == "pagerduty" {
+		webhook = openWebhook(*webhookurl, *webhookformat, *webhookkey, *webhookslow)
+		sinks = append(sinks, webhook)
+	}
+	if *dosecurity {
+		security = openSecurity()
+		sinks = append(sinks, security)
+	}
+	if *maxresponse > 0 {
+		bigresponses = openBigResponses(*maxresponse)
+		sinks = append(sinks, bigresponses)
+	}
+	if *auditfile != "" {
+		audit = openAudit(*auditfile)
+		sinks = append(sinks, audit)
+	}
+	if *otlpendpoint != "" {
+		otel = openOtel(*otlpendpoint, *otlpspans)
+		sinks = append(sinks, otel)
+	}
+	if *agentaddr != "" {
+		sinks = append(sinks, openAgent(*agentaddr, *agentname))
+	}
+	defer func() {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+	}()
 	parseFormat(*formatstr)
-	rand.Seed(time.Now().UnixNano())
 
-	iscolor = *coloroff
+	var err error
+	if clients, err = parseClientList(*clientstr); err != nil {
+		fatalf("Bad -client list: %s", err.Error())
+	}
+	if excludeClients, err = parseClientList(*exclientstr); err != nil {
+		fatalf("Bad -exclude-client list: %s", err.Error())
+	}
+
+	slowMs = *lslowms
+	minCount, minAvgMs, minBytes = *lmincount, *lminavg, *lminbytes
+	alertFactor, alertMinCount, alertErrorRate = *lalertfactor, *lalertmin, *lalerterrors
+	baselining = *baselinefile != "" || *baselinesave != ""
+	if *baselinefile != "" {
+		loadBaselines(*baselinefile)
+		if alertFactor == 0 {
+			alertFactor = BASELINE_FACTOR
+		}
+	}
+	inLengths = *doinlengths
+	tableStats = *dotables
+	selectStarReport = *doselectstar
+	processListReport = *doprocesslist
+	transactionStats = *dotransactions
+	clientStats = *doclientstats || *doclientports
+	clientPorts = *doclientports
+	userStats = *douserstats
+	databaseStats = *dodatabasestats
+	latencyHistogram = *dolatencyhist
+	latencyHistogramTop = *latencyhisttop
+	if latencyHistogramTop < 0 {
+		fatalf("-latency-histogram-top can't be negative")
+	}
+	offline = *readfile != ""
+	if *lsample <= 0 || *lsample > 1 {
+		fatalf("-sample must be more than 0 and at most 1")
+	}
+	sampleRate = *lsample
+	maxQueryLen = *lmaxquerylen
+	maxFingerprints = *lmaxfingerprints
+	streamTimeout = time.Duration(*lstreamtimeout) * time.Second
+	maxRequestBuffer = *lmaxreqbuf
+	noWhere, noWhereAlert = *donowhere || *donowherealert, *donowherealert
+	if noWhereAlert && webhook == nil {
+		fatalf("-no-where-alert needs a -webhook")
+	}
+	stripComments, keepHints = *dostripcomments, *dokeephints
+	keepLiterals = parseKeywords(*keepliterals)
+	routePrefix = *routeprefix
+	proxyAware, proxyKeys = *doproxy, parseKeywords(*proxykeys)
+	if err := setupHooks(*hooknames, *hookplugins); err != nil {
+		fatalf("Bad -hook: %s", err.Error())
+	}
+	if *scriptfile != "" {
+		script, err := openScript(*scriptfile)
+		if err != nil {
+			fatalf("Failed to load -script %s: %s", *scriptfile, err.Error())
+		}
+		queryHooks = append(queryHooks, script.hook)
+		sinks = append(sinks, script)
+	}
+	if *matchstr != "" {
+		if matchQuery, err = regexp.Compile(*matchstr); err != nil {
+			fatalf("Bad -match regexp: %s", err.Error())
+		}
+	}
+	if *onlystr != "" {
+		onlyClasses = parseKeywords(*onlystr)
+		for class := range onlyClasses {
+			switch class {
+			case "reads", "writes", "ddl", "other":
+			default:
+				fatalf("Unknown -only %s, expected reads, writes, ddl or other", class)
+			}
+		}
+	}
+	if *ignorestr != "" {
+		if ignoreQuery, err = regexp.Compile(*ignorestr); err != nil {
+			fatalf("Bad -ignore regexp: %s", err.Error())
+		}
+	}
+	switch *fingerprint {
+	case "tokens":
+	case "parser":
+		if !parserAvailable {
+			fatalf("-fingerprint parser: not built with SQL parser support (use -tags sqlparser)")
+		}
+		useParser = true
+	default:
+		fatalf("Unknown -fingerprint %s, expected tokens or parser", *fingerprint)
+	}
+	if inLengths {
+		n := len(tableColumns)
+		tableColumns = append(append(tableColumns[:n-1:n-1], inListColumns...), tableColumns[n-1])
+	}
+	if !validSortKey(*sortby) {
+		fatalf("Unknown sort key %s, expected one of: %s", *sortby, strings.Join(sortKeys, ", "))
+	}
+	switch *colormode {
+	case "always":
+		iscolor = true
+	case "never":
+		iscolor = false
+	case "auto":
+		iscolor = logfile == nil && isTerminal(os.Stderr)
+	default:
+		fatalf("Unknown -color mode: %s", *colormode)
+	}
+	iscolor = iscolor || *coloroff
+	if logfile == nil && isTerminal(os.Stderr) {
+		_, termWidth = termSize(os.Stderr)
+	}
 	if !iscolor {
 		COLOR_RED = ""
 		COLOR_GREEN = ""
@@ -148,290 +670,1337 @@ func main() {
 	log.SetPrefix("")
 	log.SetFlags(0)
 
-	log.Printf("Initializing MySQL sniffing on %s:%d...", *eth, port)
-	iface, err := pcap.Openlive(*eth, 1024, false, 0)
-	if iface == nil || err != nil {
-		msg := "unknown error"
+	switch {
+	case *collectaddr != "":
+		logger.Info("Collecting from agents", "addr", *collectaddr)
+	case *readfile != "":
+		logger.Info("Reading MySQL traffic", "port", port, "file", *readfile)
+	default:
+		logger.Info("Initializing MySQL sniffing", "interface", *eth, "port", port)
+	}
+	switch {
+	case *collectaddr != "":
+		// See collector.go; the agents do the sniffing.
+		collector = openCollector(*collectaddr)
+		sinks = append(sinks, collector)
+	case *readfile != "":
+		iface = openOffline(*readfile, *lfilter)
+	case *capture == "pcap":
+		iface = openPcap(*eth, *lfilter, *snaplen, *bufsize, *pcaptimeout, *lowlatency)
+	case *capture == "afpacket" || *capture == "ebpf":
+		if len(*lfilter) > 0 {
+			fatalf("Extra filter rules are not supported with %s capture", *capture)
+		}
+		if decap && *capture == "ebpf" {
+			fatalf("Tunnel decapsulation is not supported with ebpf capture")
+		}
+		open := openAfpacket
+		if *capture == "ebpf" {
+			open = openEbpf
+		}
+		afp, err := open(*eth, *fanout)
 		if err != nil {
-			msg = err.Error()
+			fatalf("Failed to open %s capture: %s", *capture, err.Error())
+		}
+		iface = afp
+	case *capture == "xdp":
+		if len(*lfilter) > 0 {
+			fatalf("Extra filter rules are not supported with xdp capture")
+		}
+		if decap {
+			fatalf("Tunnel decapsulation is not supported with xdp capture")
 		}
-		log.Fatalf("Failed to open device: %s", msg)
+		xdp, err := openXdp(*eth)
+		if err != nil {
+			fatalf("Failed to open xdp capture: %s", err.Error())
+		}
+		iface = xdp
+	case *capture == "unix":
+		if len(*lfilter) > 0 {
+			fatalf("Extra filter rules are not supported with unix capture")
+		}
+		unix, err := openUnix(*unixsocket)
+		if err != nil {
+			fatalf("Failed to open unix capture: %s", err.Error())
+		}
+		iface = unix
+	case *capture == "pfring":
+		pfr, err := openPfring(*eth, portFilter(*lfilter), *fanout, *snaplen)
+		if err != nil {
+			fatalf("Failed to open PF_RING: %s", err.Error())
+		}
+		iface = pfr
+	default:
+		fatalf("Unknown capture backend: %s", *capture)
+	}
+	var packets chan *pcap.Packet
+	if iface != nil {
+		queue = startCapture(iface, *queuesize, *readfile != "")
+		packets = queue.packets
+		defer func() {
+			if queue.stop() {
+				iface.Close()
+			}
+		}()
+	}
+	var reports chan agentReport
+	if collector != nil {
+		reports = collector.reports
 	}
 
-	set_filters := fmt.Sprintf("tcp port %d", port)
-	if len(*lfilter) > 0 {
-		set_filters = set_filters + " and " + *lfilter
+	if ln := sdListener(); ln != nil || *httpaddr != "" {
+		startAPI(*httpaddr, ln)
 	}
-	err = iface.Setfilter(set_filters)
-	if err != nil {
-		log.Fatalf("Failed to set port filter: %s", err.Error())
+	if *runas != "" {
+		dropPrivileges(*runas)
+	}
+	if *dotui {
+		startTUI(*sortby)
+		defer func() {
+			if tui != nil {
+				tui.stop()
+			}
+		}()
+	}
+	watchSignals()
+	sdStart()
+	startWorkers(*nworkers)
+	captureLoop(packets, reports, time.Duration(*runfor)*time.Second, *maxcount, *period, func() {
+		pause()
+		handleStatusUpdate(*displaycount, *sortby, *cutoff)
+		resume()
+	})
+
+	// Let the workers finish what they've got; the rest is all ours.
+	stopWorkers()
+	sdNotify("STOPPING=1")
+	switch {
+	case stopping():
+		// The last word, so every query we have and not just the top few.
+		if tui != nil {
+			tui.stop()
+			tui = nil
+		}
+		if !verbose {
+			handleStatusUpdate(len(qbuf), *sortby, 0)
+		}
+	case *readfile != "" && !verbose:
+		// Files run out; give a report on everything we read.
+		handleStatusUpdate(*displaycount, *sortby, *cutoff)
+	}
+}
+
+// captureLoop hands out packets to the workers and agents' reports to the
+// collector until the packets run out or something calls stop, with a
+// report every period seconds. -T and -count (runfor and maxcount, 0 for
+// no limit) call stop themselves.
+func captureLoop(packets chan *pcap.Packet, reports chan agentReport, runfor time.Duration, maxcount, period int, statusUpdate func()) {
+	if runfor > 0 {
+		timer := time.AfterFunc(runfor, stop)
+		defer timer.Stop()
 	}
+	tick := time.NewTicker(CAPTURE_TICK)
+	defer tick.Stop()
 
 	last := UnixNow()
-	var pkt *pcap.Packet = nil
-	var rv int32 = 0
+	report := func() {
+		last = UnixNow()
+		statusUpdate()
+	}
 
-	for rv = 0; rv >= 0; {
-		for pkt, rv = iface.NextEx(); pkt != nil; pkt, rv = iface.NextEx() {
-			handlePacket(pkt)
+	// SIGUSR1 and SIGUSR2, see signals.go.
+	serviceSignals := func() {
+		if requested(&reportRequested) {
+			report()
+		}
+		if requested(&resetRequested) {
+			pause()
+			resetAll()
+			resume()
+			logger.Info("Counters reset")
+		}
+	}
+
+	var npackets uint64
+	for running := true; running && !stopping(); {
+		select {
+		case pkt, ok := <-packets:
+			if !ok {
+				running = false
+				break
+			}
+			dispatch(pkt)
+			npackets++
+			if maxcount > 0 {
+				stateMu.Lock()
+				if querycount >= maxcount {
+					stop()
+				}
+				stateMu.Unlock()
+			}
 
 			// simple output printer... this should be super fast since we expect that a
 			// system like this will have relatively few unique queries once they're
 			// canonicalized.
-			if !verbose && querycount%1000 == 0 && last < UnixNow()-int64(*period) {
-				last = UnixNow()
-				handleStatusUpdate(*displaycount, *sortby, *cutoff)
+			if !verbose && npackets%1000 == 0 && last < UnixNow()-int64(period) {
+				report()
+			}
+		case r := <-reports:
+			pause()
+			collector.merge(r)
+			resume()
+			if last < UnixNow()-int64(period) {
+				report()
+			}
+		case f := <-apiRequests:
+			pause()
+			f()
+			serviceAPI()
+			resume()
+		case <-tick.C:
+			if tui != nil {
+				pause()
+				tui.service()
+				resume()
 			}
 		}
+		serviceSignals()
+		sdWatchdog()
 	}
 }
 
-func calculateTimes(timings *[TIME_BUCKETS]uint64) (fmin, favg, fmax float64) {
-	var counts, total, min, max, avg uint64 = 0, 0, 0, 0, 0
-	has_min := false
-	for _, val := range *timings {
-		if val == 0 {
-			// Queries should never take 0 nanoseconds. We are using 0 as a
-			// trigger to mean 'uninitialized reading'.
-			continue
+// openOffline reads a capture file. Classic pcap goes through libpcap so the
+// usual filters apply; pcapng gets our own reader.
+func openOffline(path, lfilter string) packetSource {
+	f, err := os.Open(path)
+	if err != nil {
+		fatalf("Failed to open file: %s", err.Error())
+	}
+	var magic [4]byte
+	_, err = io.ReadFull(f, magic[:])
+	f.Close()
+	if err != nil {
+		fatalf("Failed to read file: %s", err.Error())
+	}
+
+	if binary.LittleEndian.Uint32(magic[:]) == PCAPNG_SHB {
+		if len(lfilter) > 0 {
+			fatalf("Extra filter rules are not supported for pcapng files")
 		}
-		if val < min || !has_min {
-			has_min = true
-			min = val
+		src, err := openPcapng(path)
+		if err != nil {
+			fatalf("Failed to open file: %s", err.Error())
+		}
+		return src
+	}
+
+	handle, err := pcap.Openoffline(path)
+	if handle == nil || err != nil {
+		msg := "unknown error"
+		if err != nil {
+			msg = err.Error()
+		}
+		fatalf("Failed to open file: %s", msg)
+	}
+	if err = handle.Setfilter(portFilter(lfilter)); err != nil {
+		fatalf("Failed to set port filter: %s", err.Error())
+	}
+	return &pcapSource{handle, handle.Datalink()}
+}
+
+// openPcap opens the device with libpcap and installs our port filter plus
+// any extra rule the user gave us.
+//
+// On Linux libpcap hands packets over a kernel buffer block at a time, and
+// with no timeout a quiet interface can sit on a block for a long while;
+// with a big buffer and a long timeout it copes with bursts best.
+func openPcap(eth, lfilter string, snaplen, bufsize, timeout int, lowLatency bool) *pcapSource {
+	timeout, err := pcapTimeout(bufsize, timeout, lowLatency)
+	if err != nil {
+		fatalf("%s", err.Error())
+	}
+	iface, err := pcap.Create(eth)
+	if iface == nil || err != nil {
+		msg := "unknown error"
+		if err != nil {
+			msg = err.Error()
 		}
-		if val > max {
-			max = val
+		fatalf("Failed to open device: %s", msg)
+	}
+	if err = iface.SetSnapLen(int32(snaplen)); err == nil {
+		err = iface.SetPromisc(false)
+	}
+	if err == nil {
+		err = iface.SetReadTimeout(int32(timeout))
+	}
+	if err == nil && bufsize > 0 {
+		err = iface.SetBufferSize(int32(bufsize) << 20)
+	}
+	if err != nil {
+		fatalf("Failed to set up device: %s", err.Error())
+	}
+	if err = iface.Activate(); err != nil {
+		fatalf("Failed to open device: %s", err.Error())
+	}
+
+	err = iface.Setfilter(portFilter(lfilter))
+	if err != nil {
+		fatalf("Failed to set port filter: %s", err.Error())
+	}
+	return &pcapSource{iface, iface.Datalink()}
+}
+
+// pcapTimeout checks the libpcap tuning flags and works out the read
+// timeout. gopcap doesn't have pcap_set_immediate_mode, so -low-latency is
+// just the shortest timeout there is: the block still waits for that
+// millisecond, or to fill, rather than each packet going straight up.
+func pcapTimeout(bufsize, timeout int, lowLatency bool) (int, error) {
+	if bufsize < 0 || timeout < 0 {
+		return 0, fmt.Errorf("-buffer-size and -pcap-timeout can't be negative")
+	}
+	if lowLatency {
+		if timeout > 0 {
+			return 0, fmt.Errorf("-low-latency and -pcap-timeout don't mix")
 		}
-		counts++
-		total += val
+		timeout = 1
+	}
+	return timeout, nil
+}
+
+// portFilter builds the BPF expression selecting our traffic. Most packets on
+// the wire are bare ACKs, so we have the kernel drop anything whose TCP
+// payload (IP total length minus both header lengths) is empty, except the
+// FINs and RSTs that tell us a connection is over.
+func portFilter(lfilter string) string {
+	set_filters := fmt.Sprintf("tcp port %d and "+
+		"((((ip[2:2] - ((ip[0]&0xf)<<2)) - ((tcp[12]&0xf0)>>2)) != 0) or "+
+		"(tcp[tcpflags] & (tcp-fin|tcp-rst) != 0))", port)
+	if decap {
+		// We can't see inside tunnels from here, so take all of them and sort
+		// it out in userspace.
+		set_filters = fmt.Sprintf("(%s) or udp port %d or ip proto 47",
+			set_filters, vxlanPort)
 	}
-	if counts > 0 {
-		avg = total / counts // integer division
+	if len(lfilter) > 0 {
+		set_filters = "(" + set_filters + ") and " + lfilter
 	}
-	return float64(min) / 1000000, float64(avg) / 1000000,
-		float64(max) / 1000000
+	return set_filters
+}
+
+// matchesPort does the job of the "tcp port N" BPF filter: it accepts
+// frames carrying IPv4 TCP to or from our port.
+func matchesPort(linktype int, data []byte) bool {
+	ip := linkToIP(linktype, data)
+	if len(ip) < 20 || ip[9] != 6 {
+		return false
+	}
+	pos := int(ip[0]&0x0F) * 4
+	if len(ip) < pos+4 {
+		return false
+	}
+	srcPort := uint16(ip[pos])<<8 + uint16(ip[pos+1])
+	dstPort := uint16(ip[pos+2])<<8 + uint16(ip[pos+3])
+	return srcPort == port || dstPort == port
+}
+
+// calculateTimes returns the min/avg/max of a histogram in milliseconds.
+func calculateTimes(timings *histogram) (fmin, favg, fmax float64) {
+	return float64(timings.Min()) / 1000000, float64(timings.Mean()) / 1000000,
+		float64(timings.Max()) / 1000000
+}
+
+// calculatePercentiles returns the p50/p95/p99 of a histogram in milliseconds.
+func calculatePercentiles(timings *histogram) (p50, p95, p99 float64) {
+	return float64(timings.Quantile(0.50)) / 1000000,
+		float64(timings.Quantile(0.95)) / 1000000,
+		float64(timings.Quantile(0.99)) / 1000000
+}
+
+// calculateSpread returns the standard deviation of a histogram in
+// milliseconds and its variance in milliseconds squared.
+func calculateSpread(timings *histogram) (stddev, variance float64) {
+	return timings.Stddev() / 1000000, timings.Variance() / 1000000000000
+}
+
+// elapsedSince returns the seconds since a start time, never less than one
+// so rates stay finite.
+func elapsedSince(t int64) float64 {
+	elapsed := float64(UnixNow() - t)
+	if elapsed < 1 {
+		return 1
+	}
+	return elapsed
 }
 
 func handleStatusUpdate(displaycount int, sortby string, cutoff int) {
-	elapsed := float64(UnixNow() - start)
+	lifetime := elapsedSince(start)
+	elapsed := lifetime
+	if !cumulative {
+		elapsed = elapsedSince(intervalStart)
+	}
+
+	rows := buildReport(elapsed, lifetime, sortby, cutoff)
+	if alertFactor > 0 || alertErrorRate > 0 || baselining {
+		checkAlerts(rows)
+	}
+	for _, sink := range sinks {
+		sink.Write(rows, elapsed)
+	}
+	sdStatus(elapsed)
 
+	// The TUI draws for itself.
+	if tui == nil {
+		if digest {
+			printDigest(displaycount)
+		} else {
+			printStatus(rows, elapsed, lifetime, displaycount)
+			if selectStarReport {
+				printSelectStar(rows, displaycount)
+			}
+			printAlerts(rows)
+			if baselineKnown != nil {
+				printAnomalies(rows, displaycount)
+			}
+			if tableStats {
+				printTables(buildTableReport(elapsed, lifetime, sortby), displaycount)
+			}
+			if clientStats {
+				printClients(buildClientReport(elapsed, lifetime, sortby), displaycount)
+			}
+			if userStats {
+				printUsers(buildUserReport(elapsed, lifetime, sortby), displaycount)
+			}
+			if databaseStats {
+				printDatabases(buildDatabaseReport(elapsed, lifetime, sortby), displaycount)
+			}
+			if processListReport {
+				printProcessList(displaycount)
+			}
+			if transactionStats {
+				printTransactions(elapsed)
+			}
+			if latencyHistogram {
+				printLatencyHistograms(rows)
+			}
+		}
+	}
+
+	if !cumulative {
+		resetInterval()
+	}
+}
+
+// printStatus is our usual report: some totals and the top displaycount
+// queries in a table.
+func printStatus(rows []reportRow, elapsed, lifetime float64, displaycount int) {
 	// print status bar
 	log.Printf("\n")
 	log.SetFlags(log.Ldate | log.Ltime)
-	log.Printf("%s%d total queries, %0.2f per second%s", COLOR_RED, querycount,
-		float64(querycount)/elapsed, COLOR_DEFAULT)
+	total, interval := scaled(uint64(querycount)), scaled(uint64(intervalcount))
+	if cumulative {
+		log.Printf("%s%d total queries, %0.2f per second%s", COLOR_RED, total,
+			float64(total)/lifetime, COLOR_DEFAULT)
+	} else {
+		log.Printf("%s%d queries this interval, %0.2f per second / %d total queries, %0.2f per second%s",
+			COLOR_RED, interval, float64(interval)/elapsed, total,
+			float64(total)/lifetime, COLOR_DEFAULT)
+	}
 	log.SetFlags(0)
+	if sampleRate < 1 {
+		log.Printf("Sampling %0.2f%% of connections, counts are scaled up to match", sampleRate*100)
+	}
 
-	log.Printf("%d packets (%0.2f%% on synchronized streams) / %d desyncs / %d streams",
-		stats.packets.rcvd, float64(stats.packets.rcvd_sync)/float64(stats.packets.rcvd)*100,
-		stats.desyncs, stats.streams)
+	if collector == nil {
+		if pstats, err := iface.Getstats(); err == nil {
+			log.Printf("%d packets captured / %d dropped by kernel / %d dropped by interface / %d dropped by us",
+				pstats.PacketsReceived, pstats.PacketsDropped, pstats.PacketsIfDropped, queue.Dropped())
+		}
+		log.Printf("%d packets (%0.2f%% on synchronized streams) / %d desyncs / %d streams open (%d seen) / %d truncated / %d overflowed",
+			stats.packets.rcvd, float64(stats.packets.rcvd_sync)/float64(stats.packets.rcvd)*100,
+			stats.desyncs, streamCount(), stats.streams, stats.truncated, stats.overflows)
+	}
 
 	// global timing values
 	gmin, gavg, gmax := calculateTimes(&times)
-	log.Printf("%0.2fms min / %0.2fms avg / %0.2fms max query times", gmin, gavg, gmax)
-	log.Printf("%d unique results in this filter", len(qbuf))
+	gp50, gp95, gp99 := calculatePercentiles(&times)
+	gsd, _ := calculateSpread(&times)
+	log.Printf("%0.2fms min / %0.2fms avg / %0.2fms max / %0.2fms stddev / %0.2fms p50 / %0.2fms p95 / %0.2fms p99 query times",
+		gmin, gavg, gmax, gsd, gp50, gp95, gp99)
+	_, gttfb, _ := calculateTimes(&ttfbTimes)
+	log.Printf("%0.2fms avg time to first byte", gttfb)
+	if stats.evicted > 0 {
+		log.Printf("%d unique results in this filter, %d forgotten to stay under -max-fingerprints",
+			len(qbuf), stats.evicted)
+	} else {
+		log.Printf("%d unique results in this filter", len(qbuf))
+	}
+	if reads, writes, other := workloadMix(); reads+writes > 0 {
+		log.Printf("%d reads / %d writes / %d other, %0.1f%% writes", reads, writes, other,
+			float64(writes)/float64(reads+writes)*100)
+	}
 	log.Printf(" ")
-	log.Printf("%s [total]           %s  [ms]   [ms]   [ms]    %s [total]%s",
-		COLOR_YELLOW, COLOR_YELLOW, COLOR_GREEN, COLOR_DEFAULT)
-	log.Printf("%s count     %sqps     %s  min    avg    max       %sbytes         per      type  %sqry",
-		COLOR_YELLOW, COLOR_CYAN, COLOR_YELLOW, COLOR_GREEN, COLOR_DEFAULT)
 
+	if len(rows) < displaycount {
+		displaycount = len(rows)
+	}
+	printTable(tableColumns, rows[:displaycount])
+}
+
+// printTables is the -tables report, the busiest tables by the same measure
+// as the queries.
+func printTables(rows []reportRow, displaycount int) {
+	printRollup(tableStatColumns, rows, displaycount)
+}
+
+func printRollup(columns []tableColumn, rows []reportRow, displaycount int) {
+	if len(rows) < displaycount {
+		displaycount = len(rows)
+	}
+	log.Printf(" ")
+	printTable(columns, rows[:displaycount])
+}
+
+// queryID is a short checksum of a query's text, done the same way as
+// pt-query-digest: the last 16 hex digits of its MD5. It only depends on the
+// text, so with -f #q it's the same on any host and across restarts.
+func queryID(query string) string {
+	sum := md5.Sum([]byte(query))
+	return strings.ToUpper(hex.EncodeToString(sum[8:]))
+}
+
+// newReportRow works out the numbers for one query.
+func newReportRow(q string, c *queryData, elapsed, lifetime float64) reportRow {
+	r := reportRow{query: q, id: queryID(q), ptype: c.ptype, count: scaled(c.count), bytes: scaled(c.bytes),
+		errors: scaled(c.errors), write: c.write, selectStar: c.star, alert: c.alert, reads: scaled(c.reads),
+		writes: scaled(c.writes)}
+	r.qps = float64(r.count) / elapsed
+	r.lifeqps = float64(scaled(c.total)) / lifetime
+	r.min, r.avg, r.max = calculateTimes(&c.times)
+	r.p50, r.p95, r.p99 = calculatePercentiles(&c.times)
+	r.stddev, _ = calculateSpread(&c.times)
+	if c.inLists != nil {
+		r.inAvg, r.inMax = c.inLists.Mean(), c.inLists.Max()
+	}
+	if c.rows != nil {
+		r.rowsAvg, r.rowsMax = c.rows.Mean(), c.rows.Max()
+	}
+	_, r.ttfb, _ = calculateTimes(&c.ttfb)
+	if c.count > 0 {
+		r.bytesPer = uint64(float64(c.bytes) / float64(c.count))
+	}
+	return r
+}
+
+// A column of the status table: two header lines, then how to format a row.
+type tableColumn struct {
+	name, unit string
+	cell       func(r *reportRow) string
+}
+
+var tableColumns = []tableColumn{
+	{"count", "[total]", func(r *reportRow) string { return fmt.Sprint(r.count) }},
+	{"qps", "", func(r *reportRow) string { return fmt.Sprintf("%.2f/s", r.qps) }},
+	{"qps", "[life]", func(r *reportRow) string { return fmt.Sprintf("%.2f/s", r.lifeqps) }},
+	{"min", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.min) }},
+	{"avg", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.avg) }},
+	{"max", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.max) }},
+	{"sd", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.stddev) }},
+	{"p50", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.p50) }},
+	{"p95", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.p95) }},
+	{"p99", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.p99) }},
+	{"ttfb", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.ttfb) }},
+	{"bytes", "[total]", func(r *reportRow) string { return fmt.Sprint(r.bytes) }},
+	{"per", "", func(r *reportRow) string { return fmt.Sprint(r.bytesPer) }},
+	{"err", "", func(r *reportRow) string { return fmt.Sprint(r.errors) }},
+	{"type", "", func(r *reportRow) string { return fmt.Sprint(r.ptype) }},
+	{"id", "", func(r *reportRow) string { return r.id }},
+	{"qry", "", func(r *reportRow) string { return r.query }},
+}
+
+// The -tables report, where the "query" is the table name.
+var tableStatColumns = []tableColumn{
+	{"count", "[total]", func(r *reportRow) string { return fmt.Sprint(r.count) }},
+	{"qps", "", func(r *reportRow) string { return fmt.Sprintf("%.2f/s", r.qps) }},
+	{"avg", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.avg) }},
+	{"max", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.max) }},
+	{"p95", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.2f", r.p95) }},
+	{"time", "[ms]", func(r *reportRow) string { return fmt.Sprintf("%.0f", r.avg*float64(r.count)) }},
+	{"bytes", "[total]", func(r *reportRow) string { return fmt.Sprint(r.bytes) }},
+	{"err", "", func(r *reportRow) string { return fmt.Sprint(r.errors) }},
+	{"table", "", func(r *reportRow) string { return r.query }},
+}
+
+// With -in-lengths these go in before the query.
+var inListColumns = []tableColumn{
+	{"in", "[avg/max]", func(r *reportRow) string {
+		if r.inMax == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d/%d", r.inAvg, r.inMax)
+	}},
+	{"rows", "[avg/max]", func(r *reportRow) string {
+		if r.rowsMax == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d/%d", r.rowsAvg, r.rowsMax)
+	}},
+}
+
+// printTable lays out the status table with each column as wide as it needs
+// to be, cut off at the edge of the terminal. Slow queries are red and writes
+// yellow, if we're doing colors.
+func printTable(columns []tableColumn, rows []reportRow) {
+	last := len(columns) - 1
+	widths := make([]int, len(columns))
+	cells := make([][]string, len(rows))
+	for j, col := range columns {
+		widths[j] = len(col.name)
+		if len(col.unit) > widths[j] {
+			widths[j] = len(col.unit)
+		}
+	}
+	for i := range rows {
+		cells[i] = make([]string, len(columns))
+		for j, col := range columns {
+			cells[i][j] = col.cell(&rows[i])
+			if j != last && len(cells[i][j]) > widths[j] {
+				widths[j] = len(cells[i][j])
+			}
+		}
+	}
+
+	layout := func(fields []string) string {
+		line := ""
+		for j, f := range fields {
+			if j == last {
+				line += f
+			} else {
+				line += fmt.Sprintf("%*s  ", widths[j], f)
+			}
+		}
+		if termWidth > 0 {
+			line = clip(line, termWidth)
+		}
+		return line
+	}
+
+	var names, units []string
+	for _, col := range columns {
+		names, units = append(names, col.name), append(units, col.unit)
+	}
+	log.Printf("%s%s%s", COLOR_YELLOW, layout(units), COLOR_DEFAULT)
+	log.Printf("%s%s%s", COLOR_YELLOW, layout(names), COLOR_DEFAULT)
+	for i, r := range rows {
+		color := ""
+		if slowMs > 0 && r.avg >= slowMs {
+			color = COLOR_RED
+		} else if r.write {
+			color = COLOR_YELLOW
+		}
+		if color == "" {
+			log.Printf("%s", layout(cells[i]))
+		} else {
+			log.Printf("%s%s%s", color, layout(cells[i]), COLOR_DEFAULT)
+		}
+	}
+}
+
+// statementType sorts a query into SELECT, INSERT, UPDATE, DELETE, DDL or
+// OTHER by its first word.
+func statementType(query []byte) string {
+	query = bytes.TrimLeft(query, " \t\r\n(")
+	if i := bytes.IndexAny(query, " \t\r\n("); i >= 0 {
+		query = query[:i]
+	}
+	switch strings.ToLower(string(query)) {
+	case "select":
+		return "SELECT"
+	case "insert", "replace", "load":
+		return "INSERT"
+	case "update":
+		return "UPDATE"
+	case "delete":
+		return "DELETE"
+	case "create", "alter", "drop", "truncate", "rename":
+		return "DDL"
+	}
+	return "OTHER"
+}
+
+// isWrite guesses whether a query changes anything from its first word.
+func isWrite(query []byte) bool {
+	switch statementType(query) {
+	case "SELECT", "OTHER":
+		return false
+	}
+	return true
+}
+
+// statementClass is what -only goes by: reads, writes, ddl or other.
+func statementClass(query []byte) string {
+	switch statementType(query) {
+	case "SELECT":
+		return "reads"
+	case "INSERT", "UPDATE", "DELETE":
+		return "writes"
+	case "DDL":
+		return "ddl"
+	}
+	return "other"
+}
+
+// workloadMix counts up the reads and writes in the report.
+func workloadMix() (reads, writes, other uint64) {
+	for _, c := range qbuf {
+		switch {
+		case c.stype == "SELECT":
+			reads += c.count
+		case c.write:
+			writes += c.count
+		default:
+			other += c.count
+		}
+	}
+	return scaled(reads), scaled(writes), scaled(other)
+}
+
+// Things the report can be sorted by.
+var sortKeys = []string{"count", "qps", "avg", "max", "p95", "p99", "stddev",
+	"bytes", "maxbytes", "avgbytes", "errors"}
+
+func validSortKey(key string) bool {
+	for _, k := range sortKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sortValue picks the number a row gets sorted on. Anything we don't know
+// sorts by count.
+func sortValue(r *reportRow, sortby string) float64 {
+	switch sortby {
+	case "qps":
+		return r.qps
+	case "avg":
+		return r.avg
+	case "max":
+		return r.max
+	case "p95":
+		return r.p95
+	case "p99":
+		return r.p99
+	case "stddev":
+		return r.stddev
+	case "bytes", "maxbytes":
+		return float64(r.bytes)
+	case "avgbytes":
+		return float64(r.bytesPer)
+	case "errors":
+		return float64(r.errors)
+	}
+	return float64(r.count)
+}
+
+// buildReport works out the numbers for every query seen this interval (or
+// ever, if we're cumulative) over the cutoff and the -min-* thresholds, sorted by the chosen column
+// from the top down.
+func buildReport(elapsed, lifetime float64, sortby string, cutoff int) []reportRow {
 	// we cheat so badly here...
 	var tmp sortableSlice = make(sortableSlice, 0, len(qbuf))
 	for q, c := range qbuf {
-		qps := float64(c.count) / elapsed
-		if qps < float64(cutoff) {
+		if c.count == 0 {
+			// Nothing this interval.
+			continue
+		}
+		r := newReportRow(q, c, elapsed, lifetime)
+		if r.qps < float64(cutoff) || r.count < minCount || r.avg < minAvgMs || r.bytes < minBytes {
 			continue
 		}
 
-		qmin, qavg, qmax := calculateTimes(&c.times)
-		bavg := uint64(float64(c.bytes) / float64(c.count))
+		tmp = append(tmp, sortable{sortValue(&r, sortby), r})
+	}
+	return sortRows(tmp)
+}
 
-		sorted := float64(c.count)
-		if sortby == "avg" {
-			sorted = qavg
-		} else if sortby == "max" {
-			sorted = qmax
-		} else if sortby == "maxbytes" {
-			sorted = float64(c.bytes)
-		} else if sortby == "avgbytes" {
-			sorted = float64(bavg)
-		}
+// buildTableReport is buildReport for the -tables stats. The thresholds are
+// for queries, so they don't apply.
+func buildTableReport(elapsed, lifetime float64, sortby string) []reportRow {
+	return buildRollupReport(tbuf, elapsed, lifetime, sortby)
+}
 
-		tmp = append(tmp, sortable{sorted, fmt.Sprintf(
-			"%s%6d  %s%7.2f/s  %s%6.2f %6.2f %6.2f  %s%8dbytes %7dbytes %3d   %s%s%s",
-			COLOR_YELLOW, c.count, COLOR_CYAN, qps, COLOR_YELLOW, qmin, qavg, qmax,
-			COLOR_GREEN, c.bytes, bavg, c.ptype, COLOR_WHITE, q, COLOR_DEFAULT)})
+// buildRollupReport is buildReport for anything else we count queries
+// under, like tables or clients.
+func buildRollupReport(buf map[string]*queryData, elapsed, lifetime float64, sortby string) []reportRow {
+	var tmp sortableSlice = make(sortableSlice, 0, len(buf))
+	for name, c := range buf {
+		if c.count == 0 {
+			continue
+		}
+		r := newReportRow(name, c, elapsed, lifetime)
+		tmp = append(tmp, sortable{sortValue(&r, sortby), r})
 	}
+	return sortRows(tmp)
+}
+
+func sortRows(tmp sortableSlice) []reportRow {
 	sort.Sort(tmp)
 
-	// now print top to bottom, since our sorted list is sorted backwards
-	// from what we want
-	if len(tmp) < displaycount {
-		displaycount = len(tmp)
+	// our sorted list is sorted backwards from what we want
+	rows := make([]reportRow, len(tmp))
+	for i := range tmp {
+		rows[i] = tmp[len(tmp)-1-i].row
 	}
-	for i := 1; i <= displaycount; i++ {
-		log.Printf(tmp[len(tmp)-i].line)
+	return rows
+}
+
+// resetInterval starts a new reporting interval, clearing everything but the
+// lifetime counters.
+func resetInterval() {
+	intervalStart = UnixNow()
+	intervalcount = 0
+	digestFrom, digestTo = time.Time{}, time.Time{}
+	times.Reset()
+	ttfbTimes.Reset()
+	resetTransactions()
+	forgetIdleClients()
+	for _, buf := range []map[string]*queryData{qbuf, tbuf, cbuf, ubuf, dbuf} {
+		for _, c := range buf {
+			c.count, c.bytes, c.errors, c.reads, c.writes = 0, 0, 0, 0, 0
+			c.times.Reset()
+			c.ttfb.Reset()
+			if c.inLists != nil {
+				c.inLists.Reset()
+			}
+			if c.rows != nil {
+				c.rows.Reset()
+			}
+		}
 	}
 }
 
-// Do something with a packet for a source.
-func processPacket(rs *source, request bool, data []byte) {
+// resetAll forgets everything we've counted, as if we'd just started.
+func resetAll() {
+	start = UnixNow()
+	querycount = 0
+	qbuf = make(map[string]*queryData)
+	tbuf = make(map[string]*queryData)
+	cbuf = make(map[string]*queryData)
+	ubuf = make(map[string]*queryData)
+	dbuf = make(map[string]*queryData)
+	resetInterval()
+}
+
+// Do something with a packet for a source. Latencies are measured between
+// the capture timestamps, so they don't include any time the packet spent
+// waiting for us.
+//
+// It says whether it counted a query (COM_QUERY), for -w-queries.
+func processPacket(rs *source, request bool, data []byte, ts time.Time) (counted bool) {
 	//		log.Printf("[%s] request=%t, got %d bytes", rs.src, request,
 	//			len(data))
 
+	rs.bytes += uint64(len(data))
+	stateMu.Lock()
 	stats.packets.rcvd++
+	if digest || offline {
+		digestSeen(ts)
+	}
 	if rs.synced {
 		stats.packets.rcvd_sync++
 	}
+	stateMu.Unlock()
+
+	// The synchronization logic: if we're not presently, then we want to
+	// keep going until we are capable of carving off of a request/query.
+	if !rs.synced {
+		if !request {
+			rs.reset()
+			return
+		}
+		rs.synced = true
+	}
+
+	if !request {
+		processResponse(rs, data, ts)
+		return
+	}
+
+	// Clients are allowed to send several requests without waiting for the
+	// answers (pipelining), and a request can span segments, so carve off
+	// everything that's complete and keep the rest for next time.
+	if protocol == PROTO_POSTGRES {
+		rs.reqbuffer = append(rs.reqbuffer, data...)
+		return processPgRequests(rs, ts)
+	}
+	// Usually there's nothing left over and the packet is whole requests,
+	// so carve them straight out of it rather than copying it first.
+	buf := data
+	if len(rs.reqbuffer) > 0 {
+		rs.reqbuffer = append(rs.reqbuffer, data...)
+		buf = rs.reqbuffer
+	}
+	for {
+		trackSession(rs, buf)
+		ptype, pdata := carvePacket(&buf)
+		// No (full) packet detected yet. Continue on our way, unless we'd
+		// be waiting on more than we're willing to hold.
+		if ptype == -1 {
+			if requestTooBig(buf) {
+				stateMu.Lock()
+				stats.overflows++
+				stateMu.Unlock()
+				rs.reset()
+				return
+			}
+			// Keep the rest, reusing the buffer we have.
+			rs.reqbuffer = append(rs.reqbuffer[:0], buf...)
+			return
+		}
+		//log.Printf("xxxxxx: type: %d, qtext: %s", ptype, string(pdata))
+		if processRequest(rs, ptype, pdata, ts) && ptype == COM_QUERY {
+			counted = true
+		}
+	}
+}
+
+// processRequest handles one request packet, queueing it up to be matched
+// with its response. It says whether it counted it.
+func processRequest(rs *source, ptype int, pdata []byte, ts time.Time) bool {
+	// skip invalid type, see src/include/my_command.h
+	if ptype > 32 {
+		return false
+	}
+
+	// Working out what the query is only needs the request, and it's most
+	// of the work, so do it before taking the lock (see workers.go).
+	req := pendingRequest{sent: ts, ptype: ptype}
+	plen := uint64(len(pdata))
+	rs.queries++
+	rs.proxied = ""
+	if proxyAware && sqlCommand(ptype) {
+		rs.proxied = proxyClient(pdata)
+		req.client = rs.proxied
+	}
+	// skip not COM_FILED_LIST status, and zero length queries
+	wanted := ptype != 4 && plen != 0
+	if wanted && len(queryHooks) > 0 && (sqlCommand(ptype) || ptype == COM_STMT_PREPARE) {
+		pdata, req.tags, wanted = runHooks(rs, ptype, pdata)
+	}
+	wanted = wanted && queryWanted(ptype, pdata)
+	var tables []string
+	var lists, rows []int
+	if wanted {
+		req.text = queryText(rs, pdata)
+		req.bytes = plen
+		if (otel != nil && otel.spans) || elastic != nil || nats != nil {
+			req.query = cleanupQuery(pdata)
+		}
+		if (slowlog != nil || bigresponses != nil) && sqlCommand(ptype) {
+			req.raw = string(pdata)
+		}
+		if tableStats && sqlCommand(ptype) {
+			tables = queryTables(cleanupQuery(pdata))
+		}
+		if inLengths && sqlCommand(ptype) {
+			// This canonicalizes the query a second time, but only when
+			// asked to.
+			_, lists, rows = canonicalQuery(pdata)
+		}
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	// A long line of unanswered requests means we've lost track of the
+	// responses somewhere. Start over.
+	if len(rs.pending) >= MAX_PIPELINE {
+		//				log.Printf("[%s] too many pipelined requests?", rs.src)
+		stats.desyncs++
+		rs.reset()
+		rs.synced = true
+	}
 
-	var ptype int = -1
-	var pdata []byte
+	// Everything gets looked at, whatever we're counting.
+	if security != nil && sqlCommand(ptype) {
+		security.Check(rs, pdata)
+	}
+	if noWhere && sqlCommand(ptype) {
+		checkWhere(rs, pdata)
+	}
+	if onQuery != nil && ptype == COM_QUERY {
+		onQuery(rs, pdata, ts)
+	}
+	if recorder != nil && ptype == COM_QUERY {
+		recorder.Record(rs, pdata, ts)
+	}
+	if transactionStats {
+		trackTransaction(rs, &req, pdata, ts)
+	}
+	if audit != nil {
+		req.bytes = plen
+		if auditCommand(ptype) {
+			req.raw = string(pdata)
+		}
+	}
+
+	if wanted {
+		req.qdata = recordQuery(rs, req.text, ptype, plen)
+		rs.lastQuery = req.text
+		if req.qdata.count == 1 && sqlCommand(ptype) {
+			req.qdata.stype = statementType(pdata)
+			req.qdata.write = isWrite(pdata)
+			req.qdata.star = usesSelectStar(cleanupQuery(pdata))
+		}
+		if tableStats && sqlCommand(ptype) {
+			req.rollup = recordTables(tables, plen)
+		}
+		if clientStats {
+			req.rollup = append(req.rollup, recordClient(rs, plen))
+		}
+		if userStats {
+			req.rollup = append(req.rollup, recordRollup(ubuf, userName(rs), plen))
+		}
+		if databaseStats {
+			req.rollup = append(req.rollup, recordDatabase(rs, ptype, pdata, plen))
+		}
+		if inLengths && sqlCommand(ptype) {
+			recordLengths(&req.qdata.inLists, lists)
+			recordLengths(&req.qdata.rows, rows)
+		}
+		if digest && req.qdata.example == "" {
+			req.qdata.example = truncateExample(validUTF8(clip(string(pdata), DIGEST_EXAMPLE_MAX)), len(pdata))
+		}
+		if exporter != nil && ptype == COM_QUERY {
+			exporter.Query(rs, pdata)
+		}
+	}
+
+	// Even the requests we don't report on get answered, and we have to
+	// keep our place in line.
+	if expectsResponse(ptype) {
+		rs.pending = append(rs.pending, req)
+		if len(rs.pending) == 1 {
+			rs.resp.start(ptype)
+		}
+	}
+	return wanted
+}
+
+// queryWanted says whether a query gets past -only, and -match and -ignore
+// going by its cleaned up text.
+func queryWanted(ptype int, pdata []byte) bool {
+	if onlyClasses != nil && (!sqlCommand(ptype) || !onlyClasses[statementClass(pdata)]) {
+		return false
+	}
+	if matchQuery == nil && ignoreQuery == nil {
+		return true
+	}
+	q := cleanupQuery(pdata)
+	if matchQuery != nil && !matchQuery.MatchString(q) {
+		return false
+	}
+	return ignoreQuery == nil || !ignoreQuery.MatchString(q)
+}
+
+// recordLengths adds list lengths to a histogram, making it if need be.
+func recordLengths(h **histogram, lengths []int) {
+	if len(lengths) == 0 {
+		return
+	}
+	if *h == nil {
+		*h = &histogram{}
+	}
+	for _, n := range lengths {
+		(*h).Record(uint64(n))
+	}
+}
+
+// queryText converts a request into whatever format the user wants. The
+// pieces are worked out first and then put together in one go, so the text
+// is only allocated once, and a format that's a single token (just #q,
+// usually) isn't copied at all.
+func queryText(rs *source, pdata []byte) string {
+	// #q and #t both want the cleaned up query; only do it once.
+	var cleaned string
+	var done bool
+	clean := func() string {
+		if !done {
+			cleaned, done = cleanupQuery(pdata), true
+		}
+		return cleaned
+	}
+
+	var space [16]string
+	pieces := space[:0]
+	for _, op := range format {
+		switch op.token {
+		case F_NONE:
+			pieces = append(pieces, op.text)
+		case F_QUERY:
+			pieces = append(pieces, truncateQuery(clean()))
+		case F_ROUTE:
+			// See route.go for what we're looking for.
+			if route, start, _ := findRoute(string(pdata)); start >= 0 {
+				pieces = append(pieces, route)
+			} else {
+				pieces = append(pieces, "(unknown) ", clean())
+			}
+		case F_SOURCE:
+			pieces = append(pieces, rs.client())
+		case F_SOURCEIP:
+			pieces = append(pieces, rs.clientIP())
+		case F_USER:
+			if rs.user == "" {
+				pieces = append(pieces, "(unknown)")
+			} else {
+				pieces = append(pieces, rs.user)
+			}
+		case F_STATEMENT:
+			pieces = append(pieces, statementType(pdata))
+		case F_TABLE:
+			pieces = append(pieces, queryTable(clean()))
+		case F_DATABASE:
+			if rs.schema == "" {
+				pieces = append(pieces, "(none)")
+			} else {
+				pieces = append(pieces, rs.schema)
+			}
+		default:
+			fatalf("Unknown F_XXXXXX int in format string")
+		}
+	}
+	if len(pieces) == 1 {
+		return validUTF8(pieces[0])
+	}
 
-	if request {
-		// If we still have response buffer, we're in some weird state and
-		// didn't successfully process the response.
-		if rs.resbuffer != nil {
-			//				log.Printf("[%s] possibly pipelined request? %d bytes",
-			//					rs.src, len(rs.resbuffer))
-			stats.desyncs++
-			rs.resbuffer = nil
-			rs.synced = false
-		}
-		rs.reqbuffer = data
-		ptype, pdata = carvePacket(&rs.reqbuffer)
-	} else {
-		// FIXME: For now we're not doing anything with response data, just using the first packet
-		// after a query to determine latency.
-		rs.resbuffer = nil
-		ptype, pdata = 0, data
+	n := 0
+	for _, p := range pieces {
+		n += len(p)
 	}
+	var text strings.Builder
+	text.Grow(n)
+	for _, p := range pieces {
+		text.WriteString(p)
+	}
+	return validUTF8(text.String())
+}
 
-	//log.Printf("xxxxxx: type: %d, qtext: %s", ptype, string(pdata))
-	// The synchronization logic: if we're not presently, then we want to
-	// keep going until we are capable of carving off of a request/query.
-	if !rs.synced {
-		//if !(request && ptype == COM_QUERY) {
-		if !(request) {
-			rs.reqbuffer, rs.resbuffer = nil, nil
-			return
+// recordQuery counts a request against its fingerprint.
+func recordQuery(rs *source, text string, ptype int, plen uint64) *queryData {
+	querycount++
+	intervalcount++
+
+	qdata, ok := qbuf[text]
+	if !ok {
+		if maxFingerprints > 0 && len(qbuf) >= maxFingerprints {
+			evictFingerprints()
 		}
-		rs.synced = true
+		qdata = &queryData{}
+		qbuf[text] = qdata
 	}
-	//log.Printf("[%s] request=%b ptype=%d plen=%d", rs.src, request, ptype, len(pdata))
+	qdata.last = querycount
+	qdata.count++
+	qdata.total++
+	qdata.bytes += plen
+	qdata.ptype = ptype
+	rs.qdata = qdata
+	return qdata
+}
 
-	// No (full) packet detected yet. Continue on our way.
-	if ptype == -1 {
+// evictFingerprints makes room in qbuf by forgetting the queries we've gone
+// longest without seeing. It clears a tenth at a time so we're not sorting
+// everything for every new query.
+func evictFingerprints() {
+	keep := maxFingerprints - maxFingerprints/10 - 1
+	if len(qbuf) <= keep {
 		return
 	}
-	// skip not COM_FILED_LIST status
-	if ptype == 4 {
-		return
+	texts := make([]string, 0, len(qbuf))
+	for q := range qbuf {
+		texts = append(texts, q)
 	}
-	// skip invalid type, see src/include/my_command.h
-	if ptype > 32 {
-		return
+	sort.Slice(texts, func(i, j int) bool { return qbuf[texts[i]].last < qbuf[texts[j]].last })
+	for _, q := range texts[:len(texts)-keep] {
+		delete(qbuf, q)
+		delete(baselines, q)
+		stats.evicted++
 	}
-	plen := uint64(len(pdata))
-	// skip zero lengh query
-	if plen == 0 {
-		return
+}
+
+// recordTables counts a query against every table it uses.
+func recordTables(names []string, plen uint64) []*queryData {
+	var tables []*queryData
+	for _, name := range names {
+		tables = append(tables, recordRollup(tbuf, name, plen))
 	}
+	return tables
+}
 
-	// If this is a response then we want to record the timing and
-	// store it with this channel so we can keep track of that.
-	var reqtime uint64
-	if !request {
-		// Keep adding the bytes we're getting, since this is probably still part of
-		// an earlier response
-		if rs.reqSent == nil {
-			if rs.qdata != nil {
-				rs.qdata.bytes += plen
+// recordRollup counts a query under name in a rollup like tbuf, for the
+// response to be timed against too.
+func recordRollup(buf map[string]*queryData, name string, plen uint64) *queryData {
+	c, ok := buf[name]
+	if !ok {
+		c = &queryData{ptype: COM_QUERY}
+		buf[name] = c
+	}
+	c.count++
+	c.total++
+	c.bytes += plen
+	return c
+}
+
+// processResponse matches response bytes up with the requests waiting on
+// them, oldest first, and records the timings as each one completes.
+func processResponse(rs *source, data []byte, ts time.Time) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for len(data) > 0 && len(rs.pending) > 0 {
+		req := &rs.pending[0]
+
+		// The first bytes back give us the time to first byte...
+		if rs.resp.first {
+			req.ttfb = latency(req.sent, ts)
+			ttfbTimes.Record(req.ttfb)
+			if req.qdata != nil {
+				req.qdata.ttfb.Record(req.ttfb)
+			}
+			for _, t := range req.rollup {
+				t.ttfb.Record(req.ttfb)
 			}
+		}
+
+		// ...but the query isn't over until the whole result is in.
+		done, n := rs.resp.feed(data)
+		req.rbytes += uint64(n)
+		if req.qdata != nil {
+			req.qdata.bytes += uint64(n)
+		}
+		for _, t := range req.rollup {
+			t.bytes += uint64(n)
+		}
+		data = data[n:]
+		if !done {
 			return
 		}
-		reqtime = uint64(time.Since(*rs.reqSent).Nanoseconds())
+		reqtime := latency(req.sent, ts)
 
 		// We keep track of per-source, global, and per-query timings.
-		randn := rand.Intn(TIME_BUCKETS)
-		rs.reqTimes[randn] = reqtime
-		times[randn] = reqtime
-		if rs.qdata != nil {
-			// This should never fail but it has. Probably because of a
-			// race condition I need to suss out, or sharing between
-			// two different goroutines. :(
-			rs.qdata.times[randn] = reqtime
-			rs.qdata.bytes += plen
-		}
-		rs.reqSent = nil
+		rs.reqCount++
+		rs.reqTotal += reqtime
+		if reqtime > rs.reqMax {
+			rs.reqMax = reqtime
+		}
+		times.Record(reqtime)
+		if req.qdata != nil {
+			req.qdata.times.Record(reqtime)
+			if rs.resp.failed {
+				req.qdata.errors++
+			}
+		}
+		for _, t := range req.rollup {
+			t.times.Record(reqtime)
+			if rs.resp.failed {
+				t.errors++
+			}
+		}
+		if req.txn != nil {
+			// A COMMIT that fails (a deadlock, say) rolled back.
+			req.txn.rollback = req.txn.rollback || rs.resp.failed
+			endTransaction(req.txn, ts)
+		}
+		if otel != nil {
+			otel.Span(rs, req, ts)
+		}
+		if elastic != nil {
+			elastic.Event(rs, req, reqtime)
+		}
+		if nats != nil {
+			nats.Event(rs, req, reqtime)
+		}
+		if slowlog != nil {
+			slowlog.Query(rs, req, reqtime)
+		}
+		if webhook != nil {
+			webhook.Slow(rs, req, reqtime)
+		}
+		if bigresponses != nil {
+			bigresponses.Query(rs, req)
+		}
+		if audit != nil {
+			audit.Query(rs, req, reqtime, rs.resp.failed)
+		}
+		if tui != nil {
+			tui.sample(rs, req, ts, reqtime)
+		}
 
-		return
-	}
+		// If we're in diry mode, just dump statistics from this one.
+		if verbose && req.qdata != nil {
+			log.SetFlags(log.Ldate | log.Lmicroseconds)
+			p50, p95, p99 := calculatePercentiles(&req.qdata.times)
+			sd, variance := calculateSpread(&req.qdata.times)
+			log.Printf("  %s%s %s## %sid: %s, type: %d, bytes: %d, time: %0.2f, p50/p95/p99: %0.2f/%0.2f/%0.2f, stddev: %0.2f, var: %0.2f%s\n",
+				COLOR_CYAN, req.text, COLOR_RED, COLOR_YELLOW, queryID(req.text), req.ptype, req.bytes, float64(reqtime)/1000000,
+				p50, p95, p99, sd, variance, COLOR_DEFAULT)
+		}
 
-	// This is for sure a request, so let's count it as one.
-	if rs.reqSent != nil {
-		//			log.Printf("[%s] ...sending two requests without a response?",
-		//				rs.src)
+		// Shuffle the rest down rather than reslicing, so the queue reuses
+		// its space instead of growing a new one every so often. That
+		// moves what req points at.
+		ptype := req.ptype
+		left := copy(rs.pending, rs.pending[1:])
+		rs.pending[left] = pendingRequest{}
+		rs.pending = rs.pending[:left]
+		if protocol == PROTO_POSTGRES && rs.resp.failed && ptype == COM_STMT_EXECUTE {
+			rs.pending = pgSkipToSync(rs.pending)
+		}
+		if len(rs.pending) > 0 {
+			rs.resp.start(rs.pending[0].ptype)
+		}
 	}
-	tnow := time.Now()
-	rs.reqSent = &tnow
 
-	// Convert this request into whatever format the user wants.
-	querycount++
-	var text string
-
-	for _, item := range format {
-		switch item.(type) {
-		case int:
-			switch item.(int) {
-			case F_NONE:
-				log.Fatalf("F_NONE in format string")
-			case F_QUERY:
-				text += cleanupQuery(pdata)
-			case F_ROUTE:
-				// Routes are in the query like:
-				//     SELECT /* hostname:route */ FROM ...
-				// We remove the hostname so routes can be condensed.
-				parts := strings.SplitN(string(pdata), " ", 5)
-				if len(parts) >= 4 && parts[1] == "/*" && parts[3] == "*/" {
-					if strings.Contains(parts[2], ":") {
-						text += strings.SplitN(parts[2], ":", 2)[1]
-					} else {
-						text += parts[2]
-					}
-				} else {
-					text += "(unknown) " + cleanupQuery(pdata)
-				}
-			case F_SOURCE:
-				text += rs.src
-			case F_SOURCEIP:
-				text += rs.srcip
-			default:
-				log.Fatalf("Unknown F_XXXXXX int in format string")
-			}
-		case string:
-			text += item.(string)
-		default:
-			log.Fatalf("Unknown type in format string")
-		}
+	if len(data) == 0 {
+		return
 	}
-	qdata, ok := qbuf[text]
-	if !ok {
-		qdata = &queryData{}
-		qbuf[text] = qdata
+	// Nobody's waiting on this, but keep adding the bytes we're getting,
+	// since it's probably still part of an earlier response.
+	if rs.qdata != nil {
+		rs.qdata.bytes += uint64(len(data))
 	}
-	qdata.count++
-	qdata.bytes += plen
-	qdata.ptype = ptype
-	rs.qtext, rs.qdata, rs.qbytes = text, qdata, plen
+	// The server doesn't answer half a request, so whatever is left in the
+	// request buffer wasn't one.
+	rs.reqbuffer = nil
+}
 
-	// If we're in diry mode, just dump statistics from this one.
-	if verbose {
-		log.SetFlags(log.Ldate | log.Lmicroseconds)
-		log.Printf("  %s%s %s## %stype: %d, bytes: %d, time: %0.2f%s\n", COLOR_CYAN, rs.qtext, COLOR_RED,
-			COLOR_YELLOW, ptype, rs.qbytes, float64(reqtime)/1000000, COLOR_DEFAULT)
+// requestTooBig says whether the partial request we're holding is, or says
+// it will be, over -max-request-buffer. Either it really is that big or
+// we're out of step and reading a length out of the middle of something,
+// and both ways we're better off dropping it and waiting to resync.
+func requestTooBig(buf []byte) bool {
+	if maxRequestBuffer <= 0 {
+		return false
 	}
+	if len(buf) > maxRequestBuffer {
+		return true
+	}
+	if len(buf) >= 3 {
+		size := int(buf[0]) | int(buf[1])<<8 | int(buf[2])<<16
+		return size+4 > maxRequestBuffer
+	}
+	return false
+}
 
+// latency is the time between two capture timestamps in nanoseconds. With
+// fanout or several interfaces the packets can be stamped slightly out of
+// order, so never go below zero.
+func latency(from, to time.Time) uint64 {
+	d := to.Sub(from)
+	if d < 0 {
+		return 0
+	}
+	return uint64(d.Nanoseconds())
 }
 
 // carvePacket tries to pull a packet out of a slice of bytes. If so, it removes
@@ -508,59 +2077,229 @@ func carvePacket(buf *[]byte) (int, []byte) {
 // extract the data... we have to figure out where it is, which means extracting data
 // from the various headers until we get the location we want.  this is crude, but
 // functional and it should be fast.
-func handlePacket(pkt *pcap.Packet) {
-	// Ethernet frame has 14 bytes of stuff to ignore, so we start our root position here
-	var pos byte = 14
+//
+// The worker's lock is held, so its streams are all ours (see workers.go).
+func handlePacket(w *worker, pkt *pcap.Packet) {
+	// Find the (innermost) IPv4 header, skipping the link layer header and
+	// any VLAN tags or tunnels wrapped around it.
+	ip := linkToIP(pkt.Type, pkt.Data)
+	if len(ip) < 20 || ip[9] != 6 {
+		return
+	}
+	// Short frames get padded, and a bare FIN mustn't look like data. (The
+	// total length is 0 on outgoing packets with segmentation offload.)
+	if total := int(ip[2])<<8 | int(ip[3]); total >= 20 && total < len(ip) {
+		ip = ip[:total]
+	}
+
+	if streamTimeout > 0 && pkt.Time.Sub(w.lastSweep) >= STREAM_SWEEP {
+		expireStreams(w, pkt.Time)
+		w.lastSweep = pkt.Time
+	}
 
 	// Grab the src IP address of this packet from the IP header.
-	srcIP := pkt.Data[pos+12 : pos+16]
-	dstIP := pkt.Data[pos+16 : pos+20]
+	srcIP := ip[12:16]
+	dstIP := ip[16:20]
 
 	// The IP frame has the header length in bits 4-7 of byte 0 (relative).
-	pos += pkt.Data[pos] & 0x0F * 4
+	pos := int(ip[0]&0x0F) * 4
+	if len(ip) < pos+20 {
+		return
+	}
 
 	// Grab the source port from the TCP header.
-	srcPort := uint16(pkt.Data[pos])<<8 + uint16(pkt.Data[pos+1])
-	dstPort := uint16(pkt.Data[pos+2])<<8 + uint16(pkt.Data[pos+3])
+	srcPort := uint16(ip[pos])<<8 + uint16(ip[pos+1])
+	dstPort := uint16(ip[pos+2])<<8 + uint16(ip[pos+3])
+	closing := ip[pos+13]&(TCP_FIN|TCP_RST) != 0
 
 	// The TCP frame has the data offset in bits 4-7 of byte 12 (relative).
-	pos += byte(pkt.Data[pos+12]) >> 4 * 4
+	pos += int(ip[pos+12]>>4) * 4
+	if len(ip) < pos {
+		return
+	}
 
-	// If this is a 0-length payload, do nothing. (Any way to change our filter
-	// to only dump packets with data?)
-	if len(pkt.Data[pos:]) <= 0 {
+	// If this is a 0-length payload, do nothing, unless it's the end.
+	if len(ip[pos:]) <= 0 && !closing {
 		return
 	}
 
 	// This is either an inbound or outbound packet. Determine by seeing which
 	// end contains our port. Either way, we want to put this on the channel of
 	// the remote end.
-	var src string
+	// The key is built on the stack; we only make a string of it for a
+	// connection we haven't seen before.
+	var keybuf [21]byte
+	var key []byte
+	var clientIP net.IP
 	var request bool = false
 	if srcPort == port {
-		src = fmt.Sprintf("%d.%d.%d.%d:%d", dstIP[0], dstIP[1], dstIP[2],
-			dstIP[3], dstPort)
-		//log.Printf("response to %s", src)
+		clientIP = net.IP(dstIP)
+		key = appendAddr(keybuf[:0], dstIP, dstPort)
+		//log.Printf("response to %s", key)
 	} else if dstPort == port {
-		src = fmt.Sprintf("%d.%d.%d.%d:%d", srcIP[0], srcIP[1], srcIP[2],
-			srcIP[3], srcPort)
+		clientIP = net.IP(srcIP)
+		key = appendAddr(keybuf[:0], srcIP, srcPort)
 		request = true
-		//log.Printf("request from %s", src)
+		//log.Printf("request from %s", key)
 	} else {
-		log.Fatalf("got packet src = %d, dst = %d", srcPort, dstPort)
+		// Not ours; this happens with tunneled traffic, where the outer
+		// filter can't see the inner ports.
+		return
+	}
+
+	// Ignore clients the user isn't interested in (or explicitly doesn't
+	// want, like monitoring and backup hosts) before we start tracking
+	// any state for them.
+	if len(clients) > 0 && !matchesClient(clients, clientIP) {
+		return
+	}
+	if matchesClient(excludeClients, clientIP) {
+		return
+	}
+
+	// With -sample, most connections never get looked at.
+	if sampleRate < 1 && !sampleConnection(string(key), srcIP, dstIP) {
+		return
 	}
 
 	// Get the data structure for this source, then do something.
-	rs, ok := chmap[src]
+	rs, ok := w.streams[string(key)]
+	if !ok && len(ip[pos:]) == 0 {
+		// The end of something we weren't following.
+		return
+	}
 	if !ok {
+		src := string(key)
 		srcip := src[0:strings.Index(src, ":")]
-		rs = &source{src: src, srcip: srcip, synced: false}
+		rs = &source{src: src, srcip: srcip, synced: false, since: pkt.Time}
+		stateMu.Lock()
 		stats.streams++
-		chmap[src] = rs
+		stateMu.Unlock()
+		w.streams[src] = rs
+	}
+	rs.last = pkt.Time
+	if closing {
+		// Either end hanging up is the end of the conversation; anything
+		// still to come is just the other side saying goodbye.
+		defer func() {
+			delete(w.streams, rs.src)
+			stateMu.Lock()
+			stats.closed++
+			if rs.txn != nil {
+				// The server rolls back whatever was open.
+				rs.txn.rollback = true
+				endTransaction(rs.txn, pkt.Time)
+			}
+			stateMu.Unlock()
+		}()
+	}
+
+	// A packet cut short by the snaplen would leave a hole in the stream, and
+	// carving across it produces garbage. Throw the buffers away and wait to
+	// resync on the next request instead.
+	if pkt.Caplen < pkt.Len {
+		stateMu.Lock()
+		stats.truncated++
+		stateMu.Unlock()
+		rs.reset()
+		return
 	}
 
 	// Now with a source, process the packet.
-	processPacket(rs, request, pkt.Data[pos:])
+	counted := processPacket(rs, request, ip[pos:], pkt.Time)
+
+	if dumper != nil && (!dumpQueriesOnly || counted) {
+		stateMu.Lock()
+		dumper.Write(pkt)
+		stateMu.Unlock()
+	}
+}
+
+// appendAddr appends ip:port, the way we name a connection, to buf.
+func appendAddr(buf []byte, ip []byte, port uint16) []byte {
+	for i, b := range ip[:4] {
+		if i > 0 {
+			buf = append(buf, '.')
+		}
+		buf = strconv.AppendUint(buf, uint64(b), 10)
+	}
+	buf = append(buf, ':')
+	return strconv.AppendUint(buf, uint64(port), 10)
+}
+
+// expireStreams forgets a worker's connections we haven't seen a packet on
+// for -stream-timeout, since we won't always see them end.
+func expireStreams(w *worker, now time.Time) {
+	for src, rs := range w.streams {
+		if now.Sub(rs.last) > streamTimeout {
+			delete(w.streams, src)
+			stateMu.Lock()
+			stats.expired++
+			stateMu.Unlock()
+		}
+	}
+}
+
+// parseClientList turns "10.4.0.0/16,192.168.1.10" into a list of networks.
+// Bare addresses are treated as a single host.
+func parseClientList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// sampleConnection decides whether -sample tracks a connection, by a hash
+// of its addresses so every packet of it gets the same answer. The server
+// port is always ours, so the client's address and port and the two IPs
+// cover the 4-tuple, whichever way the packet is going.
+func sampleConnection(client string, ip1, ip2 []byte) bool {
+	h := fnv.New32a()
+	h.Write([]byte(client))
+	if bytes.Compare(ip1, ip2) > 0 {
+		ip1, ip2 = ip2, ip1
+	}
+	h.Write(ip1)
+	h.Write(ip2)
+	return float64(h.Sum32()) < sampleRate*(1<<32)
+}
+
+// scaled turns a count from the connections we sample into an estimate for
+// all of them.
+func scaled(n uint64) uint64 {
+	if sampleRate >= 1 {
+		return n
+	}
+	return uint64(float64(n)/sampleRate + 0.5)
+}
+
+func matchesClient(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // scans forward in the query given the current type and returns when we encounter
@@ -568,121 +2307,475 @@ func handlePacket(pkt *pcap.Packet) {
 // the type of it.
 func scanToken(query []byte) (length int, thistype int) {
 	if len(query) < 1 {
-		log.Fatalf("scanToken called with empty query")
+		fatalf("scanToken called with empty query")
 	}
 
 	//no clean queries
 	if verbose && noclean {
 		return len(query), TOKEN_OTHER
 	}
+	if stripComments {
+		if n := scanComment(query); n > 0 {
+			return n, TOKEN_COMMENT
+		}
+	}
 	// peek at the first byte, then loop
 	b := query[0]
 	switch {
 	case b == 39 || b == 34: // '"
-		started_with := b
-		escaped := false
+		// MySQL lets you escape anything with a backslash, or put the
+		// quote in by doubling it. The other quote needs nothing.
 		for i := 1; i < len(query); i++ {
 			switch query[i] {
-			case started_with:
-				if escaped {
-					escaped = false
+			case 92:
+				i++
+			case b:
+				if i+1 < len(query) && query[i+1] == b {
+					i++
 					continue
 				}
 				return i + 1, TOKEN_QUOTE
-			case 92:
-				escaped = true
-			default:
-				escaped = false
 			}
 		}
 		return len(query), TOKEN_QUOTE
 
-	case b >= 48 && b <= 57: // 0-9
-		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] >= 48 && query[i] <= 57: // 0-9
-				// do nothing
-			default:
-				return i, TOKEN_NUMBER
-			}
+	case b == 48 && len(query) > 2 && (query[1]|0x20 == 'x' || query[1]|0x20 == 'b'): // 0x1F, 0b101
+		i := 2
+		for i < len(query) && isHexDigit(query[i]) {
+			i++
 		}
-		return len(query), TOKEN_NUMBER
+		if w := scanWord(query); w > i {
+			return w, TOKEN_WORD
+		}
+		if i > 2 {
+			return i, TOKEN_NUMBER
+		}
+		return scanNumber(query), TOKEN_NUMBER
 
-	case b == 32 || (b >= 9 && b <= 13): // whitespace
-		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] == 32 || (query[i] >= 9 && query[i] <= 13):
-				// Eat all whitespace
-			default:
-				return i, TOKEN_WHITESPACE
-			}
+	case isDigit(b) || (b == 46 && len(query) > 1 && isDigit(query[1])): // 0-9, or .5
+		// Identifiers can start with digits too, like 2fa_codes.
+		n := scanNumber(query)
+		if w := scanWord(query); w > n {
+			return w, TOKEN_WORD
 		}
-		return len(query), TOKEN_WHITESPACE
+		return n, TOKEN_NUMBER
 
-	case (b >= 65 && b <= 90) || (b >= 97 && b <= 122): // a-zA-Z
+	case b == 96: // `quoted identifier`, kept as it is; `` is a backtick inside one
 		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] >= 48 && query[i] <= 57:
-				// Numbers, allow.
-			case (query[i] >= 65 && query[i] <= 90) || (query[i] >= 97 && query[i] <= 122):
-				// Letters, allow.
-			case query[i] == 36 || query[i] == 95:
-				// $ and _
-			default:
-				return i, TOKEN_WORD
+			if query[i] != 96 {
+				continue
 			}
+			if i+1 < len(query) && query[i+1] == 96 {
+				i++
+				continue
+			}
+			return i + 1, TOKEN_WORD
 		}
 		return len(query), TOKEN_WORD
 
+	case (b|0x20 == 'x' || b|0x20 == 'b') && len(query) > 1 && query[1] == 39: // X'1F', b'101'
+		if end := bytes.IndexByte(query[2:], 39); end >= 0 {
+			return end + 3, TOKEN_QUOTE
+		}
+		return len(query), TOKEN_QUOTE
+
+	case spaceLen(query) > 0: // whitespace, including the Unicode kinds
+		i := 0
+		for i < len(query) {
+			n := spaceLen(query[i:])
+			if n == 0 {
+				break
+			}
+			i += n
+		}
+		return i, TOKEN_WHITESPACE
+
+	case isIdentChar(b): // letters, $ and _ (and anything not ASCII)
+		return scanWord(query), TOKEN_WORD
+
 	default: // everything else
 		return 1, TOKEN_OTHER
 	}
 
 	// shouldn't get here
-	log.Fatalf("scanToken failure: [%s]", query)
+	fatalf("scanToken failure: [%s]", query)
 	return
 }
 
+func isDigit(b byte) bool {
+	return b >= 48 && b <= 57
+}
+
+// Good enough for binary literals too.
+func isHexDigit(b byte) bool {
+	return isDigit(b) || (b|0x20 >= 'a' && b|0x20 <= 'f')
+}
+
+// scanComment returns the length of the comment at the start of query, or 0
+// if there isn't one: # or -- to the end of the line, or /* to */.
+func scanComment(query []byte) int {
+	switch {
+	case query[0] == '#' || bytes.HasPrefix(query, []byte("--")) &&
+		(len(query) == 2 || query[2] == 32 || (query[2] >= 9 && query[2] <= 13)):
+		if i := bytes.IndexByte(query, '\n'); i >= 0 {
+			return i
+		}
+		return len(query)
+	case bytes.HasPrefix(query, []byte("/*")):
+		if i := bytes.Index(query[2:], []byte("*/")); i >= 0 {
+			return i + 4
+		}
+		return len(query)
+	}
+	return 0
+}
+
+// keepComment decides whether a comment survives -strip-comments. Version
+// comments (/*! ... */) are really code, and with -keep-hints so are optimizer
+// hints (/*+ ... */) and the route comment (see route.go).
+func keepComment(comment []byte, before []string) bool {
+	if bytes.HasPrefix(comment, []byte("/*!")) {
+		return true
+	}
+	if !keepHints {
+		return false
+	}
+	if bytes.HasPrefix(comment, []byte("/*+")) {
+		return true
+	}
+	_, route := routeComment(string(comment), len(before) == 2 && before[1] == " ")
+	return route
+}
+
+// scanWord returns the length of the identifier (or keyword) at the start of
+// query.
+func scanWord(query []byte) int {
+	i := 0
+	for i < len(query) && isIdentChar(query[i]) {
+		if query[i] >= utf8.RuneSelf {
+			// A whole character at a time, and they aren't all letters.
+			r, size := utf8.DecodeRune(query[i:])
+			if unicode.IsSpace(r) {
+				break
+			}
+			i += size
+			continue
+		}
+		i++
+	}
+	return i
+}
+
+// spaceLen is the length of the whitespace character at the start of query,
+// or 0 if it isn't one. Some clients like to send a no-break space.
+func spaceLen(query []byte) int {
+	b := query[0]
+	if b == 32 || (b >= 9 && b <= 13) {
+		return 1
+	}
+	if b >= utf8.RuneSelf {
+		if r, size := utf8.DecodeRune(query); unicode.IsSpace(r) {
+			return size
+		}
+	}
+	return 0
+}
+
+// truncateQuery cuts a query down to -max-query-len characters. Queries the
+// same up to there end up counted together, however long they were.
+func truncateQuery(q string) string {
+	if !queryTooLong(q) {
+		return q
+	}
+	return clip(q, maxQueryLen) + "..."
+}
+
+// truncateExample is truncateQuery for an example of one query, which can
+// say how long it was.
+func truncateExample(q string, size int) string {
+	if !queryTooLong(q) {
+		return q
+	}
+	return fmt.Sprintf("%s... (%d bytes)", clip(q, maxQueryLen), size)
+}
+
+func queryTooLong(q string) bool {
+	return maxQueryLen > 0 && len(q) > maxQueryLen && utf8.RuneCountInString(q) > maxQueryLen
+}
+
+// validUTF8 replaces anything that isn't UTF-8 (a latin1 client, binary
+// data) so that everything we print and export is.
+func validUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return strings.ToValidUTF8(s, "\uFFFD")
+}
+
+// scanNumber returns the length of the number at the start of query: digits,
+// maybe a decimal point and more digits, and maybe an exponent.
+func scanNumber(query []byte) int {
+	digits := func(i int) int {
+		for i < len(query) && isDigit(query[i]) {
+			i++
+		}
+		return i
+	}
+	i := digits(0)
+	if i < len(query) && query[i] == 46 { // .
+		i = digits(i + 1)
+	}
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		j := i + 1
+		if j < len(query) && (query[j] == '+' || query[j] == '-') {
+			j++
+		}
+		if j < len(query) && isDigit(query[j]) {
+			i = digits(j)
+		}
+	}
+	return i
+}
+
+// Words after which a - or + can only be a sign.
+var signKeywords = map[string]bool{
+	"select": true, "where": true, "and": true, "or": true, "not": true, "by": true,
+	"when": true, "then": true, "else": true, "in": true, "values": true, "set": true,
+	"like": true, "between": true, "limit": true, "offset": true, "interval": true,
+	"return": true, "having": true, "on": true, "is": true,
+}
+
+// dropSign takes a - or + off the end of the tokens if it's the sign of the
+// number that comes next rather than arithmetic, so -1 and 1 look the same.
+func dropSign(tokens []string) []string {
+	last := len(tokens) - 1
+	if last < 0 || (tokens[last] != "-" && tokens[last] != "+") {
+		return tokens
+	}
+	prev := last - 1
+	for prev >= 0 && tokens[prev] == " " {
+		prev--
+	}
+	if prev < 0 {
+		return tokens[:last]
+	}
+	switch p := tokens[prev]; {
+	case p == "?" || p == ")":
+		return tokens
+	case len(p) == 1 && !isIdentChar(p[0]):
+		return tokens[:last]
+	case isKeyword(signKeywords, p):
+		return tokens[:last]
+	}
+	return tokens
+}
+
+// parseKeywords turns a comma separated list of keywords into a set.
+func parseKeywords(list string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.Split(list, ",") {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			words[w] = true
+		}
+	}
+	return words
+}
+
 func cleanupQuery(query []byte) string {
-	// iterate until we hit the end of the query...
-	var qspace []string
+	if useParser && !(verbose && noclean) {
+		if q, ok := parseFingerprint(query); ok {
+			return validUTF8(condenseRoute(q))
+		}
+	}
+	return validUTF8(canonicalize(query, nil, nil))
+}
+
+// canonicalQuery does the work for cleanupQuery, and also returns how long
+// each IN list it collapsed was and how many rows each VALUES had.
+func canonicalQuery(query []byte) (string, []int, []int) {
+	var lists, rows []int
+	q := canonicalize(query, &lists, &rows)
+	return q, lists, rows
+}
+
+// Token slices for canonicalize to reuse. Workers call it at the same time,
+// so they come from a pool.
+var tokenPool = sync.Pool{New: func() interface{} { return new([]string) }}
+
+// canonicalize is canonicalQuery, only keeping the lengths if it's given
+// somewhere to put them. It's run on every query, so it tries not to
+// allocate: one copy of the query, which every token is a piece of, and one
+// for the result.
+func canonicalize(query []byte, lists, rows *[]int) string {
+	text := string(query)
+	qp := tokenPool.Get().(*[]string)
+	qspace := (*qp)[:0]
+	keep := false // after one of the -keep-literals keywords
 	for i := 0; i < len(query); {
 		length, toktype := scanToken(query[i:])
 
 		switch toktype {
 		case TOKEN_WORD, TOKEN_OTHER:
-			qspace = append(qspace, string(query[i:i+length]))
+			token := text[i : i+length]
+			qspace = append(qspace, token)
+			// LIMIT 10, 20 keeps both.
+			if toktype == TOKEN_WORD {
+				keep = isKeyword(keepLiterals, token)
+			} else if token != "," {
+				keep = false
+			}
 
 		case TOKEN_NUMBER, TOKEN_QUOTE:
-			qspace = append(qspace, "?")
+			if keep {
+				qspace = append(qspace, text[i:i+length])
+			} else if toktype == TOKEN_NUMBER {
+				qspace = append(dropSign(qspace), "?")
+			} else {
+				qspace = append(qspace, "?")
+			}
 
 		case TOKEN_WHITESPACE:
-			qspace = append(qspace, " ")
+			if len(qspace) == 0 || qspace[len(qspace)-1] != " " {
+				qspace = append(qspace, " ")
+			}
+
+		case TOKEN_COMMENT:
+			comment := query[i : i+length]
+			if keepComment(comment, qspace) {
+				qspace = append(qspace, text[i:i+length])
+			} else if len(qspace) > 0 && qspace[len(qspace)-1] != " " {
+				qspace = append(qspace, " ")
+			}
 
 		default:
-			log.Fatalf("scanToken returned invalid token type %d", toktype)
+			fatalf("scanToken returned invalid token type %d", toktype)
 		}
 
 		i += length
 	}
+	if stripComments && len(qspace) > 0 && qspace[len(qspace)-1] == " " {
+		// Probably where a trailing comment was.
+		qspace = qspace[:len(qspace)-1]
+	}
+	op := tokenPool.Get().(*[]string)
+	out := collapseLists(qspace, (*op)[:0], lists, rows)
+
+	tmp := condenseRoute(strings.Join(out, ""))
 
-	// Remove hostname from the route information if it's present
-	tmp := strings.Join(qspace, "")
+	// Don't let the pool hang on to the query.
+	for i := range qspace {
+		qspace[i] = ""
+	}
+	for i := range out {
+		out[i] = ""
+	}
+	*qp, *op = qspace[:0], out[:0]
+	tokenPool.Put(qp)
+	tokenPool.Put(op)
+	return strings.Replace(tmp, "?, ", "", -1)
+}
 
-	parts := strings.SplitN(tmp, " ", 5)
-	if len(parts) >= 5 && parts[1] == "/*" && parts[3] == "*/" {
-		if strings.Contains(parts[2], ":") {
-			tmp = parts[0] + " /* " + strings.SplitN(parts[2], ":", 2)[1] + " */ " + parts[4]
+// isKeyword looks a word up in a set of lower case keywords without making a
+// lower case copy of it.
+func isKeyword(set map[string]bool, word string) bool {
+	var buf [32]byte
+	if len(word) > len(buf) {
+		return false
+	}
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
 		}
+		buf[i] = c
 	}
+	return set[string(buf[:len(word)])]
+}
 
-	return strings.Replace(tmp, "?, ", "", -1)
+// collapseLists turns every IN list of nothing but placeholders into
+// IN (?+), and the same for the rows after VALUES, so the number of values
+// (or rows) doesn't make a new query. The new tokens are appended to out,
+// and if lists and rows aren't nil, the length of each IN list and how many
+// rows each VALUES had to them.
+func collapseLists(tokens, out []string, lists, rows *[]int) []string {
+	for i := 0; i < len(tokens); i++ {
+		out = append(out, tokens[i])
+		in := strings.EqualFold(tokens[i], "in")
+		if !in && !strings.EqualFold(tokens[i], "values") && !strings.EqualFold(tokens[i], "value") {
+			continue
+		}
+		j := skipSpaces(tokens, i+1)
+		n, end := placeholderList(tokens, j)
+		if end < 0 {
+			continue
+		}
+		if in {
+			if lists != nil {
+				*lists = append(*lists, n)
+			}
+		} else {
+			// VALUES (?, ?), (?, ?), ... as far as the rows are all
+			// placeholders.
+			n = 1
+			for {
+				k := skipSpaces(tokens, end+1)
+				if k >= len(tokens) || tokens[k] != "," {
+					break
+				}
+				_, next := placeholderList(tokens, skipSpaces(tokens, k+1))
+				if next < 0 {
+					break
+				}
+				n, end = n+1, next
+			}
+			if rows != nil {
+				*rows = append(*rows, n)
+			}
+		}
+		out = append(out, tokens[i+1:j]...)
+		out = append(out, "(", "?+", ")")
+		i = end
+	}
+	return out
+}
+
+func skipSpaces(tokens []string, i int) int {
+	for i < len(tokens) && tokens[i] == " " {
+		i++
+	}
+	return i
+}
+
+// placeholderList looks for a parenthesized list of placeholders, commas and
+// spaces at tokens[i]. Returns how many placeholders there are and where the
+// closing paren is, or -1 if it isn't one.
+func placeholderList(tokens []string, i int) (int, int) {
+	if i >= len(tokens) || tokens[i] != "(" {
+		return 0, -1
+	}
+	n := 0
+	for k := i + 1; k < len(tokens); k++ {
+		switch tokens[k] {
+		case "?":
+			n++
+		case ",", " ":
+		case ")":
+			if n == 0 {
+				return 0, -1
+			}
+			return n, k
+		default:
+			return 0, -1
+		}
+	}
+	return 0, -1
 }
 
 // parseFormat takes a string and parses it out into the given format slice
 // that we later use to build up a string. This might actually be an overcomplicated
 // solution?
 func parseFormat(formatstr string) {
+	format = nil
 	formatstr = strings.TrimSpace(formatstr)
 	if formatstr == "" {
 		formatstr = "#b:#k"
@@ -712,6 +2805,14 @@ func parseFormat(formatstr string) {
 				do_append = F_ROUTE
 			case "q":
 				do_append = F_QUERY
+			case "d":
+				do_append = F_DATABASE
+			case "t":
+				do_append = F_TABLE
+			case "c":
+				do_append = F_STATEMENT
+			case "u":
+				do_append = F_USER
 			default:
 				curstr += "#" + string(char)
 			}
@@ -722,16 +2823,15 @@ func parseFormat(formatstr string) {
 
 		if do_append != F_NONE {
 			if curstr != "" {
-				format = append(format, curstr, do_append)
+				format = append(format, formatOp{token: F_NONE, text: curstr})
 				curstr = ""
-			} else {
-				format = append(format, do_append)
 			}
+			format = append(format, formatOp{token: do_append})
 			do_append = F_NONE
 		}
 	}
 	if curstr != "" {
-		format = append(format, curstr)
+		format = append(format, formatOp{token: F_NONE, text: curstr})
 	}
 }
 
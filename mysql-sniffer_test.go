@@ -1,7 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/akrennmair/gopcap"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func cleanupHelper(t *testing.T, input, expected string) {
@@ -25,7 +44,130 @@ func TestSimple(t *testing.T) {
 
 func TestMultipleIn(t *testing.T) {
 	cleanupHelper(t, "select * from table where x in (1, 2, 'foo')",
-		"select * from table where x in (?)")
+		"select * from table where x in (?+)")
+	cleanupHelper(t, "select * from table where x IN (1,2,3,4,5) and y not in (?)",
+		"select * from table where x IN (?+) and y not in (?+)")
+	cleanupHelper(t, "select * from t where x in (select a from u) and f(1, 2)",
+		"select * from t where x in (select a from u) and f(?)")
+
+	if _, lists, _ := canonicalQuery([]byte("select 1 where a in (1,2,3) or b in ('x')")); len(lists) != 2 ||
+		lists[0] != 3 || lists[1] != 1 {
+		t.Errorf("Unexpected IN list lengths: %v", lists)
+	}
+
+	// With -in-lengths they're kept for the report.
+	inLengths = true
+	defer func() { inLengths = false }()
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1"}
+	for _, q := range []string{"select 1 where a in (1,2)", "select 1 where a in (1,2,3,4,5,6,7,8,9)",
+		"insert into t values (1, 'a')", "insert into t values (2, 'b'), (3, 'c'), (4, 'd')"} {
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03"+q)), time.Now())
+	}
+	if r := newReportRow("select ? where a in (?+)", qbuf["select ? where a in (?+)"], 1, 1); r.inMax != 9 || r.inAvg != 5 {
+		t.Errorf("Expected IN lists of 5 on average and 9 at most, got %+v", r)
+	}
+	if r := newReportRow("insert into t values (?+)", qbuf["insert into t values (?+)"], 1, 1); r.rowsMax != 3 || r.rowsAvg != 2 {
+		t.Errorf("Expected 2 rows on average and 3 at most, got %+v", r)
+	}
+}
+
+func TestValues(t *testing.T) {
+	cleanupHelper(t, "insert into t (a, b) values (1, 'x'), (2,'y') ,(3, 'z')",
+		"insert into t (a, b) values (?+)")
+	cleanupHelper(t, "INSERT INTO t VALUES (1)", "INSERT INTO t VALUES (?+)")
+	cleanupHelper(t, "insert into t values (1, now()) on duplicate key update a = values(a)",
+		"insert into t values (now()) on duplicate key update a = values(a)")
+	cleanupHelper(t, "insert into t values (1), (now())", "insert into t values (?+), (now())")
+
+	if _, _, rows := canonicalQuery([]byte("insert into t values (1,2),(3,4)")); len(rows) != 1 || rows[0] != 2 {
+		t.Errorf("Unexpected VALUES rows: %v", rows)
+	}
+}
+
+func TestKeepLiterals(t *testing.T) {
+	keepLiterals = parseKeywords("LIMIT, offset")
+	defer func() { keepLiterals = nil }()
+	cleanupHelper(t, "select * from t where a = 5 limit 10", "select * from t where a = ? limit 10")
+	cleanupHelper(t, "select * from t limit 10, 20", "select * from t limit 10, 20")
+	cleanupHelper(t, "select * from t LIMIT 10 OFFSET 100000", "select * from t LIMIT 10 OFFSET 100000")
+	cleanupHelper(t, "select * from t limit 10 for update", "select * from t limit 10 for update")
+	cleanupHelper(t, "select * from t where x in (1, 2) limit 3", "select * from t where x in (?+) limit 3")
+}
+
+func TestUnicode(t *testing.T) {
+	cleanupHelper(t, "select\u00a0naïve,\u3000名前 from t where b = 'é' and c = 1", "select naïve, 名前 from t where b = ? and c = ?")
+	cleanupHelper(t, "select 1\u00a0from t", "select ? from t")
+	cleanupHelper(t, "select \xe9 from t where a = 'caf\xe9'", "select \ufffd from t where a = ?")
+
+	if got := clip("héllo wörld", 7); got != "héllo w" {
+		t.Errorf("clip cut to %q", got)
+	}
+	if got := wrap("ééééé", 2); len(got) != 3 || got[2] != "é" {
+		t.Errorf("wrap gave %q", got)
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	cleanupHelper(t, "select * from t where a = -1.5 and b > 3.14 and c < 1e-6", "select * from t where a = ? and b > ? and c < ?")
+	cleanupHelper(t, "select -2 + .5 * 6.02E+23 / +7", "select ? + ? * ? / ?")
+	cleanupHelper(t, "select a-1 from t where b - 1 > (c)-2", "select a-? from t where b - ? > (c)-?")
+	cleanupHelper(t, "update t set x = x+1 where id in (-1,-2)", "update t set x = x+? where id in (?+)")
+	cleanupHelper(t, "select t1.c2 from t1", "select t1.c2 from t1")
+	cleanupHelper(t, "select * from t where id = 0xDEADBEEF or id = X'1f2e' or f = b'1010' or g = 0b11",
+		"select * from t where id = ? or id = ? or f = ? or g = ?")
+	cleanupHelper(t, "select x, b from t where b = 0", "select x, b from t where b = ?")
+}
+
+func TestQuotes(t *testing.T) {
+	cleanupHelper(t, "select * from t where a = 'it''s' and b = 1", "select * from t where a = ? and b = ?")
+	cleanupHelper(t, "select * from t where a = \"say \"\"hi\"\"\" and b = 1", "select * from t where a = ? and b = ?")
+	cleanupHelper(t, "select * from t where a = 'c:\\\\' and b = 'x'", "select * from t where a = ? and b = ?")
+	cleanupHelper(t, "select * from t where a = 'mixed \"\\'\" quotes' and b = 1", "select * from t where a = ? and b = ?")
+}
+
+func TestBackticks(t *testing.T) {
+	cleanupHelper(t, "select `order`, `col 2`, `a``b1` from `my-table3` where `1x` = 1",
+		"select `order`, `col 2`, `a``b1` from `my-table3` where `1x` = ?")
+	cleanupHelper(t, "select `x`-1 from t", "select `x`-? from t")
+}
+
+func TestStripComments(t *testing.T) {
+	cleanupHelper(t, "select 1 /* trace=42 */ from t", "select ? /* trace=? */ from t")
+
+	stripComments, keepHints = true, true
+	defer func() { stripComments, keepHints = false, false }()
+	cleanupHelper(t, "select 1 /* trace=abc123 */ from t -- at 12:00\nwhere a = 2 # why", "select ? from t where a = ?")
+	cleanupHelper(t, "select /*+ MAX_EXECUTION_TIME(1000) */ a/*x*/from t", "select /*+ MAX_EXECUTION_TIME(1000) */ a from t")
+	cleanupHelper(t, "select /* web:home */ a from t /*!40001 SQL_NO_CACHE */", "select /* home */ a from t /*!40001 SQL_NO_CACHE */")
+	cleanupHelper(t, "select 5--1", "select ?-?")
+
+	keepHints = false
+	cleanupHelper(t, "select /*+ BKA(t) */ /* web:home */ a from t", "select a from t")
+}
+
+func TestRoute(t *testing.T) {
+	for q, want := range map[string]string{
+		"SELECT /* web01:checkout */ a FROM t":           "checkout",
+		"SELECT\t/*\nhome\t*/ a":                         "home",
+		"select a from t where b = ? /* web02:cart */":   "cart",
+		"select a /* just a note */ from t /* n */":      "",
+		"select '/* x:y */' from t":                      "",
+		"select /*+ BKA(t) */ a from t /* web01:list */": "list",
+	} {
+		if route, start, _ := findRoute(q); route != want || (start < 0) != (want == "") {
+			t.Errorf("findRoute(%q) = %q, expected %q", q, route, want)
+		}
+	}
+	cleanupHelper(t, "select a from t where b = 1 /*\tweb02:cart */", "select a from t where b = ? /* cart */")
+
+	routePrefix = "route="
+	defer func() { routePrefix = "" }()
+	if route, _, _ := findRoute("select /* web01:checkout */ a from t /* route=web01:cart */"); route != "cart" {
+		t.Errorf("Expected the prefixed route, got %q", route)
+	}
+	cleanupHelper(t, "select a from t /*route=search*/", "select a from t /* route=search */")
 }
 
 func TestWhitespace(t *testing.T) {
@@ -35,8 +177,2768 @@ func TestWhitespace(t *testing.T) {
 
 func TestFailing(t *testing.T) {
 	cleanupHelper(t, "select * from s2compiled", "select * from s2compiled")
+	cleanupHelper(t, "select col_1, _x9 from table1 join 2fa_codes where 1e5abc = 1e5 and é2 = 2",
+		"select col_1, _x9 from table1 join 2fa_codes where 1e5abc = ? and é2 = ?")
 
 	// Should these be ??, as above
 	cleanupHelper(t, "select * from table where col=\"'\"", "select * from table where col=?")
 	cleanupHelper(t, "select * from table where col='\"'", "select * from table where col=?")
 }
+
+func TestClientList(t *testing.T) {
+	nets, err := parseClientList("10.4.0.0/16, 192.168.1.10")
+	if err != nil {
+		t.Fatalf("parseClientList: %s", err)
+	}
+	for ip, want := range map[string]bool{
+		"10.4.200.1":   true,
+		"10.5.0.1":     false,
+		"192.168.1.10": true,
+		"192.168.1.11": false,
+	} {
+		if got := matchesClient(nets, net.ParseIP(ip)); got != want {
+			t.Errorf("matchesClient(%s) = %t, expected %t", ip, got, want)
+		}
+	}
+
+	if _, err := parseClientList("10.4.0.0/16,bogus"); err == nil {
+		t.Errorf("Expected an error for a bogus address")
+	}
+}
+
+// ipv4Packet builds a bare IPv4 header (no options) around a payload.
+func ipv4Packet(proto byte, payload []byte) []byte {
+	hdr := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, proto, 0, 0,
+		10, 0, 0, 1, 10, 0, 0, 2}
+	total := len(hdr) + len(payload)
+	hdr[2], hdr[3] = byte(total>>8), byte(total)
+	return append(hdr, payload...)
+}
+
+func ethernetFrame(etype uint16, payload []byte) []byte {
+	hdr := make([]byte, 14)
+	hdr[12], hdr[13] = byte(etype>>8), byte(etype)
+	return append(hdr, payload...)
+}
+
+func TestDecap(t *testing.T) {
+	decap, vxlanPort = true, 4789
+	defer func() { decap = false }()
+
+	inner := ipv4Packet(6, make([]byte, 20))
+
+	udp := []byte{0x12, 0x34, 0x12, 0xb5, 0, 0, 0, 0} // dst port 4789
+	vxlan := append(udp, 0x08, 0, 0, 0, 0, 0, 1, 0)
+	frame := ethernetFrame(ETHERTYPE_IPV4, ipv4Packet(IPPROTO_UDP,
+		append(vxlan, ethernetFrame(ETHERTYPE_IPV4, inner)...)))
+	if ip := ethernetToIP(frame); len(ip) != len(inner) || ip[9] != 6 {
+		t.Errorf("VXLAN: got %v", ip)
+	}
+
+	gre := []byte{0x20, 0, 0x08, 0, 0, 0, 0, 42} // key present, IPv4
+	frame = ethernetFrame(ETHERTYPE_IPV4, ipv4Packet(IPPROTO_GRE, append(gre, inner...)))
+	if ip := ethernetToIP(frame); len(ip) != len(inner) || ip[9] != 6 {
+		t.Errorf("GRE: got %v", ip)
+	}
+
+	erspan2 := []byte{0x10, 0, 0x88, 0xbe, 0, 0, 0, 1, // seq present
+		0x10, 0, 0, 1, 0, 0, 0, 0}
+	frame = ethernetFrame(ETHERTYPE_IPV4, ipv4Packet(IPPROTO_GRE,
+		append(erspan2, ethernetFrame(ETHERTYPE_IPV4, inner)...)))
+	if ip := ethernetToIP(frame); len(ip) != len(inner) {
+		t.Errorf("ERSPAN II: got %v", ip)
+	}
+
+	erspan3 := []byte{0x10, 0, 0x22, 0xeb, 0, 0, 0, 1,
+		0x20, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0x01, // O set
+		0, 0, 0, 0, 0, 0, 0, 0}
+	frame = ethernetFrame(ETHERTYPE_IPV4, ipv4Packet(IPPROTO_GRE,
+		append(erspan3, ethernetFrame(ETHERTYPE_IPV4, inner)...)))
+	if ip := ethernetToIP(frame); len(ip) != len(inner) {
+		t.Errorf("ERSPAN III: got %v", ip)
+	}
+
+	vlan := []byte{0, 10, 0x08, 0x00}
+	frame = ethernetFrame(ETHERTYPE_VLAN, append(vlan, inner...))
+	if ip := ethernetToIP(frame); len(ip) != len(inner) {
+		t.Errorf("VLAN: got %v", ip)
+	}
+}
+
+func pcapngBlock(btype uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	blen := uint32(len(body) + 12)
+	out := make([]byte, 8, blen)
+	binary.LittleEndian.PutUint32(out[0:4], btype)
+	binary.LittleEndian.PutUint32(out[4:8], blen)
+	out = append(out, body...)
+	return binary.LittleEndian.AppendUint32(out, blen)
+}
+
+func TestPcapng(t *testing.T) {
+	port = 3306
+	tcp := []byte{0xc0, 0x00, 0x0c, 0xea, 0, 0, 0, 0, 0, 0, 0, 0, 0x50, 0, 0, 0, 0, 0, 0, 0}
+	frame := ethernetFrame(ETHERTYPE_IPV4, ipv4Packet(6, append(tcp, "\x01\x00\x00\x00\x0e"...)))
+
+	shb := []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	idbNull := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	idbNano := []byte{1, 0, 0, 0, 0, 0, 0, 0, PCAPNG_IF_TSRESOL, 0, 1, 0, 9, 0, 0, 0}
+	epb := func(ifid uint32) []byte {
+		body := make([]byte, 20)
+		binary.LittleEndian.PutUint32(body[0:4], ifid)
+		binary.LittleEndian.PutUint32(body[4:8], 0)
+		binary.LittleEndian.PutUint32(body[8:12], 1500000123)
+		binary.LittleEndian.PutUint32(body[12:16], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(body[16:20], uint32(len(frame)))
+		return append(body, frame...)
+	}
+
+	var file []byte
+	file = append(file, pcapngBlock(PCAPNG_SHB, shb)...)
+	file = append(file, pcapngBlock(PCAPNG_IDB, idbNull)...)
+	file = append(file, pcapngBlock(PCAPNG_IDB, idbNano)...)
+	file = append(file, pcapngBlock(PCAPNG_EPB, epb(0))...) // wrong link type
+	file = append(file, pcapngBlock(PCAPNG_EPB, epb(1))...)
+
+	path := filepath.Join(t.TempDir(), "test.pcapng")
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := openPcapng(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	pkt, rv := src.NextEx()
+	if pkt == nil || rv != 1 {
+		t.Fatalf("Expected a packet, got rv=%d", rv)
+	}
+	if pkt.Time.Unix() != 1 || pkt.Time.Nanosecond() != 500000123 {
+		t.Errorf("Bad timestamp %v", pkt.Time)
+	}
+	if len(pkt.Data) != len(frame) {
+		t.Errorf("Got %d bytes, expected %d", len(pkt.Data), len(frame))
+	}
+	if pkt, rv = src.NextEx(); pkt != nil || rv != -2 {
+		t.Errorf("Expected end of file, got rv=%d", rv)
+	}
+
+	// Interfaces cut short, with an option longer than they are, or with a
+	// resolution too fine to count in, stop the read rather than us.
+	for _, idb := range [][]byte{
+		{1, 0, 0, 0},
+		{1, 0, 0, 0, 0, 0, 0, 0, PCAPNG_IF_TSRESOL, 0, 12, 0, 9, 0, 0, 0},
+		{1, 0, 0, 0, 0, 0, 0, 0, PCAPNG_IF_TSRESOL, 0, 1, 0, 0xC0, 0, 0, 0},
+		{1, 0, 0, 0, 0, 0, 0, 0, PCAPNG_IF_TSRESOL, 0, 1, 0, 20, 0, 0, 0},
+	} {
+		bad := append(pcapngBlock(PCAPNG_SHB, shb), pcapngBlock(PCAPNG_IDB, idb)...)
+		bad = append(bad, pcapngBlock(PCAPNG_EPB, epb(0))...)
+		if err := os.WriteFile(path, bad, 0644); err != nil {
+			t.Fatal(err)
+		}
+		src, err := openPcapng(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt, rv = src.NextEx(); pkt != nil || rv != -2 || src.err == nil || src.err == io.EOF {
+			t.Errorf("Expected an error from a bad interface block, got rv=%d and %v", rv, src.err)
+		}
+		src.Close()
+	}
+}
+
+func TestPortFilter(t *testing.T) {
+	port, vxlanPort = 3306, 4789
+	defer func() { decap = false }()
+	base := "tcp port 3306 and ((((ip[2:2] - ((ip[0]&0xf)<<2)) - ((tcp[12]&0xf0)>>2)) != 0) or " +
+		"(tcp[tcpflags] & (tcp-fin|tcp-rst) != 0))"
+	for _, c := range []struct {
+		decap  bool
+		filter string
+		want   string
+	}{
+		{false, "", base},
+		{false, "host 10.0.0.1", "(" + base + ") and host 10.0.0.1"},
+		{true, "", "(" + base + ") or udp port 4789 or ip proto 47"},
+		{true, "not net 10.1.0.0/16", "((" + base + ") or udp port 4789 or ip proto 47) and not net 10.1.0.0/16"},
+	} {
+		decap = c.decap
+		if got := portFilter(c.filter); got != c.want {
+			t.Errorf("portFilter(%q) with decap=%t:\n got %s\nwant %s", c.filter, c.decap, got, c.want)
+		}
+	}
+}
+
+func TestPcapTimeout(t *testing.T) {
+	for _, c := range []struct {
+		bufsize, timeout int
+		lowLatency       bool
+		want             int
+		ok               bool
+	}{
+		{0, 0, false, 0, true},
+		{64, 100, false, 100, true},
+		{0, 0, true, 1, true},
+		{0, 100, true, 0, false},
+		{-1, 0, false, 0, false},
+		{0, -1, false, 0, false},
+	} {
+		got, err := pcapTimeout(c.bufsize, c.timeout, c.lowLatency)
+		if got != c.want || (err == nil) != c.ok {
+			t.Errorf("pcapTimeout(%d, %d, %t) = %d, %v", c.bufsize, c.timeout, c.lowLatency, got, err)
+		}
+	}
+}
+
+func TestLinkTypes(t *testing.T) {
+	inner := ipv4Packet(6, make([]byte, 20))
+	for _, c := range []struct {
+		linktype int
+		frame    []byte
+	}{
+		{pcap.LINKTYPE_ETHERNET, ethernetFrame(ETHERTYPE_IPV4, inner)},
+		{pcap.LINKTYPE_NULL, append([]byte{2, 0, 0, 0}, inner...)},
+		{pcap.LINKTYPE_LOOP, append([]byte{0, 0, 0, 2}, inner...)},
+		{pcap.LINKTYPE_LINUX_SLL, append(make([]byte, 14), append([]byte{8, 0}, inner...)...)},
+		{pcap.LINKTYPE_RAW, inner},
+	} {
+		if ip := linkToIP(c.linktype, c.frame); len(ip) != len(inner) {
+			t.Errorf("linktype %d: got %v", c.linktype, ip)
+		}
+	}
+
+	// IPv6 over loopback (AF_INET6 is 30 on macOS)
+	if ip := linkToIP(pcap.LINKTYPE_NULL, append([]byte{30, 0, 0, 0}, inner...)); ip != nil {
+		t.Errorf("Expected nil for non-IPv4 loopback, got %v", ip)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	// Every value must land in a bucket whose range contains it, and the
+	// buckets must be within ~3% of the value.
+	for _, v := range []uint64{0, 1, 31, 32, 33, 63, 64, 1000, 123456789, 1 << 40, 1<<64 - 1} {
+		i := histIndex(v)
+		if i < 0 || i >= HIST_BUCKETS {
+			t.Fatalf("histIndex(%d) = %d out of range", v, i)
+		}
+		lo, hi := histRange(i)
+		if v < lo || v > hi {
+			t.Errorf("Value %d not in bucket %d range [%d, %d]", v, i, lo, hi)
+		}
+		if float64(hi-lo) > float64(v)/HIST_SUB_BUCKETS {
+			t.Errorf("Bucket %d too wide for %d: [%d, %d]", i, v, lo, hi)
+		}
+	}
+
+	var h histogram
+	for _, v := range []uint64{5000000, 1000000, 3000000} {
+		h.Record(v)
+	}
+	if h.Count() != 3 || h.Min() != 1000000 || h.Max() != 5000000 || h.Mean() != 3000000 {
+		t.Errorf("Got count=%d min=%d max=%d mean=%d", h.Count(), h.Min(), h.Max(), h.Mean())
+	}
+	// population variance of 1, 3, 5 (ms) is 8/3 ms^2
+	if sd, v := calculateSpread(&h); v < 2.666 || v > 2.667 || sd < 1.632 || sd > 1.633 {
+		t.Errorf("Got stddev=%f variance=%f, expected 1.633 and 2.667", sd, v)
+	}
+
+	// 1, 3 and 5ms land in three powers of two, so that's the only rows
+	// there are buckets for, and a reset keeps those for next time.
+	inUse := func() int {
+		n := 0
+		for _, row := range h.rows {
+			if row != nil {
+				n++
+			}
+		}
+		return n
+	}
+	if inUse() != 3 {
+		t.Errorf("Expected 3 rows of buckets in use, got %d", inUse())
+	}
+	h.Reset()
+	if h.Count() != 0 || h.Quantile(0.5) != 0 || inUse() != 3 {
+		t.Errorf("Expected an empty histogram keeping its rows, got count=%d p50=%d rows=%d", h.Count(), h.Quantile(0.5), inUse())
+	}
+	h.Record(3000000)
+	if h.Count() != 1 || h.Quantile(0.5) != 3000000 {
+		t.Errorf("Expected just 3ms after the reset, got count=%d p50=%d", h.Count(), h.Quantile(0.5))
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h histogram
+	for v := uint64(1); v <= 1000; v++ {
+		h.Record(v * 1000)
+	}
+	for _, c := range []struct {
+		q    float64
+		want uint64
+	}{{0.50, 500000}, {0.95, 950000}, {0.99, 990000}, {1, 1000000}} {
+		got := h.Quantile(c.q)
+		if got < c.want*97/100 || got > c.want*103/100 {
+			t.Errorf("Quantile(%0.2f) = %d, expected about %d", c.q, got, c.want)
+		}
+	}
+}
+
+// mysqlPacket frames a payload as a MySQL packet.
+func mysqlPacket(seq byte, payload string) string {
+	n := len(payload)
+	return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}) + payload
+}
+
+func TestResponseParser(t *testing.T) {
+	coldef := "\x03def\x00\x00\x00\x01a\x00\x0c\x3f\x00\x01\x00\x00\x00\x03\x80\x00\x00\x00\x00"
+	eof := "\xfe\x00\x00\x02\x00"
+	okEOF := "\xfe\x00\x00\x02\x00\x00\x00"
+
+	for _, c := range []struct {
+		name  string
+		ptype int
+		data  string
+	}{
+		{"ok", COM_QUERY, mysqlPacket(1, "\x00\x01\x00\x02\x00\x00\x00")},
+		{"err", COM_QUERY, mysqlPacket(1, "\xff\x7a\x04#42S02Table doesn't exist")},
+		{"ping", 14, mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")},
+		{"classic eof", COM_QUERY, mysqlPacket(1, "\x02") + mysqlPacket(2, coldef) +
+			mysqlPacket(3, coldef) + mysqlPacket(4, eof) + mysqlPacket(5, "\x011\x012") +
+			mysqlPacket(6, "\x013\x014") + mysqlPacket(7, eof)},
+		{"classic eof, no rows", COM_QUERY, mysqlPacket(1, "\x01") + mysqlPacket(2, coldef) +
+			mysqlPacket(3, eof) + mysqlPacket(4, eof)},
+		{"deprecate eof", COM_QUERY, mysqlPacket(1, "\x01") + mysqlPacket(2, coldef) +
+			mysqlPacket(3, "\x011") + mysqlPacket(4, okEOF)},
+		{"deprecate eof, no rows", COM_QUERY, mysqlPacket(1, "\x01") + mysqlPacket(2, coldef) +
+			mysqlPacket(3, okEOF)},
+		{"multiple results", COM_QUERY, mysqlPacket(1, "\x01") + mysqlPacket(2, coldef) +
+			mysqlPacket(3, eof) + mysqlPacket(4, "\x011") + mysqlPacket(5, "\xfe\x00\x00\x0a\x00") +
+			mysqlPacket(6, "\x00\x00\x00\x02\x00\x00\x00")},
+		{"prepare, nothing to define", COM_STMT_PREPARE, mysqlPacket(1, prepareOK(0, 0))},
+		{"prepare, classic eof", COM_STMT_PREPARE, mysqlPacket(1, prepareOK(1, 2)) + mysqlPacket(2, coldef) +
+			mysqlPacket(3, coldef) + mysqlPacket(4, eof) + mysqlPacket(5, coldef)},
+		{"prepare, deprecate eof", COM_STMT_PREPARE, mysqlPacket(1, prepareOK(1, 2)) + mysqlPacket(2, coldef) +
+			mysqlPacket(3, coldef) + mysqlPacket(4, coldef)},
+		{"prepare, no metadata", COM_STMT_PREPARE, mysqlPacket(1, prepareOK(1, 2)+"\x00")},
+	} {
+		// Feed it a byte at a time, it must only finish on the last one.
+		var r responseParser
+		r.start(c.ptype)
+		for i := 0; i < len(c.data); i++ {
+			done, _ := r.feed([]byte{c.data[i]})
+			if done != (i == len(c.data)-1) {
+				t.Errorf("%s: done=%t at byte %d of %d", c.name, done, i+1, len(c.data))
+				break
+			}
+		}
+
+		// And all at once, with the start of the next response after it.
+		r.start(c.ptype)
+		if done, n := r.feed([]byte(c.data + "\x01\x00")); !done || n != len(c.data) {
+			t.Errorf("%s: done=%t after using %d of %d bytes", c.name, done, n, len(c.data))
+		}
+	}
+
+	// A prepare's last EOF, if there is one, doesn't get taken for the
+	// next response.
+	prepare := mysqlPacket(1, prepareOK(1, 0)) + mysqlPacket(2, coldef)
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	for _, next := range []string{mysqlPacket(3, eof) + ok, ok} {
+		var r responseParser
+		r.start(COM_STMT_PREPARE)
+		if done, n := r.feed([]byte(prepare + next)); !done || n != len(prepare) {
+			t.Errorf("Prepare: done=%t after using %d of %d bytes", done, n, len(prepare))
+		}
+		r.start(COM_STMT_EXECUTE)
+		if done, n := r.feed([]byte(next)); !done || n != len(next) {
+			t.Errorf("Execute after a prepare: done=%t after using %d of %d bytes", done, n, len(next))
+		}
+	}
+}
+
+// prepareOK is the start of a PREPARE_OK for a statement with the given
+// numbers of columns and parameters.
+func prepareOK(columns, params int) string {
+	return string([]byte{0, 1, 0, 0, 0, byte(columns), 0, byte(params), 0, 0, 0, 0})
+}
+
+func TestPipelining(t *testing.T) {
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1"}
+	at := func(ms int) time.Time { return time.Unix(1000, int64(ms)*1000000) }
+
+	// Two queries in one segment and the start of a third, then the rest
+	// of it along with the first answer.
+	third := mysqlPacket(0, "\x03select c")
+	processPacket(rs, true, []byte(mysqlPacket(0, "\x03select a")+mysqlPacket(0, "\x03select b")+third[:6]), at(0))
+	processPacket(rs, true, []byte(third[6:]), at(1))
+	processPacket(rs, false, []byte(ok), at(5))
+	if len(rs.pending) != 2 {
+		t.Fatalf("Expected 2 pending requests, got %d", len(rs.pending))
+	}
+	// The other two answers arrive together.
+	processPacket(rs, false, []byte(ok+ok), at(9))
+	if len(rs.pending) != 0 || stats.desyncs != 0 {
+		t.Fatalf("Got %d pending requests and %d desyncs", len(rs.pending), stats.desyncs)
+	}
+	// Timed from the capture timestamps, not when we got around to them.
+	for q, ms := range map[string]uint64{"select a": 5, "select b": 9, "select c": 8} {
+		if qd := qbuf[q]; qd == nil || qd.count != 1 || qd.times.Count() != 1 {
+			t.Errorf("Query %q wasn't timed: %+v", q, qd)
+		} else if qd.times.Max() != ms*1000000 {
+			t.Errorf("Query %q took %dns, expected %dms", q, qd.times.Max(), ms)
+		}
+	}
+}
+
+func TestMatchIgnore(t *testing.T) {
+	parseFormat("#s:#q")
+	qbuf = make(map[string]*queryData)
+	matchQuery = regexp.MustCompile(`(?i)\borders\b`)
+	defer func() { matchQuery = nil }()
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1"}
+	processPacket(rs, true, []byte(mysqlPacket(0, "\x03select 1")+mysqlPacket(0, "\x03SELECT * FROM orders WHERE id = 5")), time.Unix(1000, 0))
+	processPacket(rs, false, []byte(ok+ok), time.Unix(1001, 0))
+
+	// The other query still has to be answered, but isn't counted.
+	if len(qbuf) != 1 || len(rs.pending) != 0 {
+		t.Fatalf("Expected just the one query, got %d and %d pending", len(qbuf), len(rs.pending))
+	}
+	if c := qbuf["10.0.0.1:1234:SELECT * FROM orders WHERE id = ?"]; c == nil || c.times.Count() != 1 {
+		t.Errorf("The matching query wasn't timed: %+v", qbuf)
+	}
+
+	// And -ignore the other way around, along with it.
+	ignoreQuery = regexp.MustCompile(`(?i)^select \*`)
+	defer func() { ignoreQuery = nil }()
+	for q, want := range map[string]bool{"select * from orders": false, "select id from orders": true, "select 1": false} {
+		if got := queryWanted(COM_QUERY, []byte(q)); got != want {
+			t.Errorf("queryWanted(%q) = %t, expected %t", q, got, want)
+		}
+	}
+	matchQuery = nil
+	if queryWanted(COM_QUERY, []byte("select * from t")) || !queryWanted(COM_QUERY, []byte("show status")) {
+		t.Errorf("-ignore on its own got it wrong")
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.log")
+	slowlog, slowMs = openSlowLog(path), 100
+	defer func() { slowlog = nil }()
+	parseFormat("#q")
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", user: "app", schema: "shop"}
+	processPacket(rs, true, []byte(mysqlPacket(0, "\x03select 1")), time.Unix(1000, 0))
+	processPacket(rs, false, []byte(ok), time.Unix(1000, 5000000))
+	processPacket(rs, true, []byte(mysqlPacket(0, "\x03select * from t where a = 'x';")), time.Unix(1000, 0))
+	processPacket(rs, false, []byte(ok), time.Unix(1000, 512000000))
+	slowlog.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Time: 1970-01-01T00:16:40.000000Z\n" +
+		"# User@Host: app[app] @  [10.0.0.1]  Id: 0\n" +
+		"# Query_time: 0.512000  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0\n" +
+		"# Bytes_sent: 11  TTFB: 0.512000  Client: 10.0.0.1:1234\n" +
+		"use shop;\nSET timestamp=1000;\nselect * from t where a = 'x';\n"
+	if string(data) != want {
+		t.Errorf("Unexpected slow log:\n%s", data)
+	}
+}
+
+func TestOnly(t *testing.T) {
+	onlyClasses = parseKeywords("writes,DDL")
+	defer func() { onlyClasses = nil }()
+	for q, want := range map[string]bool{
+		"select 1": false, "insert into t values (1)": true, "DELETE FROM t": true,
+		"alter table t add c int": true, "show status": false,
+	} {
+		if got := queryWanted(COM_QUERY, []byte(q)); got != want {
+			t.Errorf("queryWanted(%q) = %t, expected %t", q, got, want)
+		}
+	}
+	if queryWanted(14, []byte("COM_PING")) {
+		t.Errorf("Expected other commands to be left out")
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	alertFactor, alertMinCount = 3, 10
+	baselines = make(map[string]*alertBaseline)
+	qbuf = map[string]*queryData{"select ?": {}}
+	defer func() { alertFactor = 0 }()
+	report := func(qps, p95 float64) reportRow {
+		rows := []reportRow{{query: "select ?", id: queryID("select ?"), count: 100, qps: qps, p95: p95}}
+		checkAlerts(rows)
+		return rows[0]
+	}
+	// Nothing until there's a baseline, however odd it looks.
+	for _, qps := range []float64{10, 100, 10} {
+		if r := report(qps, 1); r.alert != "" {
+			t.Fatalf("Alerted during warmup: %s", r.alert)
+		}
+	}
+	if r := report(12, 1.2); r.alert != "" {
+		t.Errorf("Alerted on a small change: %s", r.alert)
+	}
+	r := report(200, 1)
+	if !strings.Contains(r.alert, "qps 200.00/s") || strings.Contains(r.alert, "p95") {
+		t.Errorf("Expected a qps alert, got %q", r.alert)
+	}
+	if qbuf["select ?"].alert != r.alert {
+		t.Errorf("The alert wasn't kept for the API")
+	}
+	if r := report(25, 50); !strings.Contains(r.alert, "p95 50.00ms") {
+		t.Errorf("Expected a p95 alert, got %q", r.alert)
+	}
+
+	var out strings.Builder
+	log.SetOutput(&out)
+	printAlerts([]reportRow{r, {query: "select 1"}})
+	log.SetOutput(os.Stderr)
+	if strings.Count(out.String(), "ALERT "+r.id) != 1 {
+		t.Errorf("Unexpected alert lines: %q", out.String())
+	}
+
+	// Error rates don't need a baseline.
+	alertFactor, alertErrorRate = 0, 0.05
+	defer func() { alertErrorRate = 0 }()
+	rows := []reportRow{{query: "update ?", count: 100, errors: 5}, {query: "delete ?", count: 100, errors: 4}}
+	checkAlerts(rows)
+	if rows[0].alert != "5.0% errors" || rows[1].alert != "" {
+		t.Errorf("Unexpected error rate alerts: %q, %q", rows[0].alert, rows[1].alert)
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	for q, want := range map[string]string{
+		"select * from users where name = '' or 1=1 -- '":                        "tautology or 1=1, comment cutting off a quote",
+		"select * from users where id = 1 OR 'a'='a'":                            "tautology OR 'a'='a'",
+		"select a from t where id = 1 union all select null, null, null":         "UNION probe",
+		"select a from t where id=-1 union/**/select 1,2,3#":                     "UNION probe, inline comment as space",
+		"select a from t union select table_name from information_schema.tables": "UNION into system tables",
+		"select * from t where id = 1 and sleep(5)":                              "time delay",
+		"select load_file('/etc/passwd')":                                        "file access",
+		"select * from t where id = 1; drop table users":                         "stacked query",
+		"select a from t where a = 1 or b = 2":                                   "",
+		"select a from t union select b from u":                                  "",
+		"select 'it''s' from t where x = '--'":                                   "",
+		"select * from users where name = 'admin'-- ' and pass = 'x'":            "comment cutting off a quote",
+	} {
+		if got := strings.Join(suspicious(q), ", "); got != want {
+			t.Errorf("suspicious(%q) = %q, expected %q", q, got, want)
+		}
+	}
+
+	// Logged once per client and query each report, and summed up.
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	defer func(saved *slog.Logger) { logger = saved }(logger)
+	logger = slog.New(slog.NewTextHandler(&out, nil))
+	s := openSecurity()
+	rs := &source{src: "10.0.0.9:5555", srcip: "10.0.0.9"}
+	for _, q := range []string{"select * from t where id = 1 or 1=1", "select * from t where id = 2 or 2=2", "select 1"} {
+		s.Check(rs, []byte(q))
+	}
+	s.Write(nil, 10)
+	if n := strings.Count(out.String(), `msg="Suspicious query" client=10.0.0.9:5555`); n != 1 ||
+		!strings.Contains(out.String(), "2 suspicious queries from 1 clients") {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit = openAudit(path)
+	defer func() { audit = nil }()
+	parseFormat("#q")
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", user: "app", schema: "shop"}
+	for _, q := range []string{"select 1", "update t set a = 'x' where id = 7"} {
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03"+q)), time.Unix(1000, 0))
+		processPacket(rs, false, []byte(ok), time.Unix(1000, 2000000))
+	}
+	audit.Close()
+
+	// Carrying on after a restart.
+	audit = openAudit(path)
+	processPacket(rs, true, []byte(mysqlPacket(0, "\x0e")), time.Unix(1001, 0))
+	processPacket(rs, false, []byte(ok), time.Unix(1001, 1000000))
+	audit.Close()
+
+	if n, err := verifyAudit(path); n != 3 || err != nil {
+		t.Fatalf("verifyAudit = %d, %v", n, err)
+	}
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var e auditEntry
+	json.Unmarshal([]byte(lines[1]), &e)
+	if e.Seq != 1 || e.Client != "10.0.0.1" || e.Port != 1234 || e.User != "app" || e.Database != "shop" ||
+		e.Query != "update t set a = 'x' where id = 7" || e.Response != 11 || e.Duration != 2 {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+
+	// Any change breaks the chain from there.
+	tampered := strings.Replace(string(data), "id = 7", "id = 8", 1)
+	os.WriteFile(path, []byte(tampered), 0600)
+	if n, err := verifyAudit(path); n != 1 || err == nil || !strings.Contains(err.Error(), "entry 1 has been changed") {
+		t.Errorf("verifyAudit = %d, %v", n, err)
+	}
+	os.WriteFile(path, []byte(lines[0]+"\n"+lines[2]+"\n"), 0600)
+	if _, err := verifyAudit(path); err == nil {
+		t.Errorf("Expected a dropped entry to be noticed")
+	}
+}
+
+func TestCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.csv")
+	out := openCSV(path)
+	out.Write([]reportRow{{query: "select \"a\", b", ptype: 3, count: 10, qps: 1, avg: 1.5, bytes: 100, bytesPer: 10}}, 10)
+	out.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "time,interval,query,") {
+		t.Fatalf("Unexpected CSV: %q", data)
+	}
+	if !strings.Contains(lines[1], `,10,"select ""a"", b",3,10,1.00,0.00,0.000,1.500,`) {
+		t.Errorf("Unexpected row: %s", lines[1])
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	g := openGraphite(l.Addr().String(), "db.")
+	g.Write([]reportRow{{query: "select ?", id: queryID("select ?"), count: 4, qps: 0.4}}, 10)
+	g.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(conn)
+	want := "db.query." + queryID("select ?") + ".qps 0.4 "
+	if !strings.HasPrefix(string(data), "db.queries.count ") || !strings.Contains(string(data), want) {
+		t.Errorf("Unexpected metrics: %s", data)
+	}
+
+	// Carbon not answering mustn't hold up the report, we drop instead.
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g = openGraphite(hung.Addr().String(), "db.")
+	rows := make([]reportRow, 20000)
+	for i := range rows {
+		rows[i] = reportRow{query: "select ?", id: strconv.Itoa(i)}
+	}
+	for i := 0; i < GRAPHITE_QUEUE+5; i++ {
+		started := time.Now()
+		g.Write(rows, 10)
+		if took := time.Since(started); took > GRAPHITE_TIMEOUT/2 {
+			t.Errorf("Writing to a hung Graphite took %s", took)
+		}
+	}
+	if g.dropped == 0 {
+		t.Errorf("Expected reports to be dropped with Carbon hung")
+	}
+	hung.Close()
+	g.Close()
+}
+
+func TestOtel(t *testing.T) {
+	bodies := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies[r.URL.Path] = string(data)
+	}))
+	defer srv.Close()
+
+	var h histogram
+	h.Record(3000000)
+	if b := otelBuckets(&h); b[5] != "1" {
+		t.Errorf("3ms landed in the wrong bucket: %v", b)
+	}
+
+	o := openOtel(srv.URL, true)
+	rs := &source{src: "10.0.0.1:1234"}
+	o.Span(rs, &pendingRequest{sent: time.Unix(1, 0), ptype: COM_QUERY, query: "select ?",
+		qdata: &queryData{}}, time.Unix(2, 0))
+	o.Write(nil, 10)
+	o.Close()
+
+	if !strings.Contains(bodies["/v1/metrics"], `"name":"mysql.query.duration"`) {
+		t.Errorf("Unexpected metrics: %s", bodies["/v1/metrics"])
+	}
+	spans := bodies["/v1/traces"]
+	if !strings.Contains(spans, `"name":"SELECT"`) || !strings.Contains(spans, `"stringValue":"10.0.0.1"`) ||
+		!strings.Contains(spans, `"endTimeUnixNano":"2000000000"`) {
+		t.Errorf("Unexpected spans: %s", spans)
+	}
+
+	// A collector that hangs mustn't hold up the report, we drop instead.
+	release := make(chan bool)
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	o = openOtel(hung.URL, false)
+	started := time.Now()
+	for i := 0; i < OTEL_QUEUE+5; i++ {
+		o.Write(nil, 10)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Errorf("Writing to a hung collector took %s", took)
+	}
+	if o.unsent == 0 {
+		t.Errorf("Expected exports to be dropped with the collector hung")
+	}
+	close(release)
+	o.Close()
+	hung.Close()
+}
+
+func TestWebhook(t *testing.T) {
+	var bodies []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	w := openWebhook(srv.URL, "json", "", 100)
+	rs := &source{src: "10.0.0.1:1234", user: "app"}
+	for _, ms := range []uint64{50, 300, 150} {
+		w.Slow(rs, &pendingRequest{text: "select ?", qdata: &queryData{}}, ms*1000000)
+	}
+	w.Write([]reportRow{{query: "update ?", id: queryID("update ?"), alert: "10.0% errors"}, {query: "select ?"}}, 10)
+	w.Write([]reportRow{{query: "select ?"}}, 10)
+	w.Close()
+	if len(bodies) != 1 {
+		t.Fatalf("Expected one post, got %d", len(bodies))
+	}
+	text, _ := bodies[0]["text"].(string)
+	if !strings.Contains(text, "2 alerts") || !strings.Contains(text, "10.0% errors: update ?") ||
+		!strings.Contains(text, "2 queries over 100ms, the slowest took 300.00ms: select ?") {
+		t.Errorf("Unexpected text: %s", text)
+	}
+	if alerts, _ := bodies[0]["alerts"].([]interface{}); len(alerts) != 2 {
+		t.Errorf("Unexpected alerts: %v", bodies[0]["alerts"])
+	}
+
+	// PagerDuty gets an event per alert.
+	bodies = nil
+	w = openWebhook(srv.URL, "pagerduty", "KEY", 0)
+	w.Write([]reportRow{{query: "update ?", id: "ABC", alert: "p95 9.00ms is 3.0x the usual 3.00ms"}}, 10)
+	w.Close()
+	if len(bodies) != 1 || bodies[0]["routing_key"] != "KEY" || bodies[0]["dedup_key"] != "mysql-sniffer-query-ABC" {
+		t.Errorf("Unexpected PagerDuty events: %v", bodies)
+	}
+
+	// An endpoint that hangs mustn't hold up the report, we drop instead.
+	release := make(chan bool)
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	w = openWebhook(hung.URL, "pagerduty", "KEY", 0)
+	alerts := make([]reportRow, WEBHOOK_MAX_ALERTS)
+	for i := range alerts {
+		alerts[i] = reportRow{query: "update ?", id: strconv.Itoa(i), alert: "slow"}
+	}
+	started := time.Now()
+	for i := 0; i < 5; i++ {
+		w.Write(alerts, 10)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Errorf("Writing to a hung webhook took %s", took)
+	}
+	if w.dropped == 0 {
+		t.Errorf("Expected posts to be dropped with the endpoint hung")
+	}
+	close(release)
+	w.Close()
+	hung.Close()
+}
+
+func TestDigest(t *testing.T) {
+	qbuf = make(map[string]*queryData)
+	times.Reset()
+	digestFrom, digestTo = time.Unix(100, 0), time.Unix(110, 0)
+	update := "update t set a=? where name = 'ééééééééééééé'" // the profile cuts it at 40, mid é
+	for i, q := range []string{"select ?", update} {
+		c := &queryData{count: 10, bytes: 1000, example: q}
+		for j := 0; j < 10; j++ {
+			c.times.Record(uint64(i+1) * 2000000)
+			times.Record(uint64(i+1) * 2000000)
+		}
+		qbuf[q] = c
+	}
+
+	var out strings.Builder
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	printDigest(10)
+	log.SetOutput(os.Stderr)
+
+	report := out.String()
+	for _, want := range []string{
+		"# Overall: 20 total, 2 unique, 2.00 QPS",
+		"#    1 0x" + queryID(update),
+		"# Exec time     67    40ms     4ms     4ms",
+		"#   1ms  ################################################################",
+		update + "\\G",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Missing %q in digest:\n%s", want, report)
+		}
+	}
+	if strings.ToValidUTF8(report, "?") != report {
+		t.Errorf("Expected the digest to cut queries between characters:\n%s", report)
+	}
+}
+
+func TestElastic(t *testing.T) {
+	bodies := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies <- r.Method + " " + r.URL.Path + "\n" + string(data)
+		w.Write([]byte(`{"errors":false}`))
+	}))
+	defer srv.Close()
+
+	e := openElastic(srv.URL, "db")
+	if tmpl := <-bodies; !strings.HasPrefix(tmpl, "PUT /_index_template/db\n") ||
+		!strings.Contains(tmpl, `"index_patterns": ["db-*"]`) {
+		t.Errorf("Unexpected template request: %s", tmpl)
+	}
+
+	rs := &source{src: "10.0.0.1:1234"}
+	e.Event(rs, &pendingRequest{sent: time.Unix(86400, 0), ptype: COM_QUERY, query: "select ?",
+		bytes: 9, rbytes: 100, qdata: &queryData{}}, 2500000)
+	e.Close()
+
+	bulk := <-bodies
+	for _, want := range []string{"POST /_bulk\n", `{"index":{"_index":"db-1970.01.02"}}`,
+		`"client_ip":"10.0.0.1"`, `"duration_ms":2.5`, `"response_bytes":100`} {
+		if !strings.Contains(bulk, want) {
+			t.Errorf("Missing %s in bulk request: %s", want, bulk)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	qbuf = make(map[string]*queryData)
+	c := &queryData{count: 5, total: 7}
+	c.times.Record(2000000)
+	qbuf["select ?"] = c
+
+	// Stand in for the capture loop.
+	apiRequests = make(chan func())
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case f := <-apiRequests:
+				f()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	get := func(handler func(*http.Request) interface{}, url string) (int, string) {
+		w := httptest.NewRecorder()
+		apiHandler(handler)(w, httptest.NewRequest("GET", url, nil))
+		return w.Code, w.Body.String()
+	}
+	if code, body := get(apiTop, "/top?n=1&sort=avg"); code != 200 ||
+		!strings.Contains(body, `"query": "select ?"`) || !strings.Contains(body, `"avg_ms": 2`) {
+		t.Errorf("/top: %d %s", code, body)
+	}
+	if code, body := get(apiFingerprint, "/fingerprints/"+queryID("select ?")); code != 200 ||
+		!strings.Contains(body, `"total": 7`) {
+		t.Errorf("/fingerprints: %d %s", code, body)
+	}
+	if code, _ := get(apiFingerprint, "/fingerprints/nope"); code != 404 {
+		t.Errorf("Expected a 404 for an unknown fingerprint, got %d", code)
+	}
+	if code, body := get(apiSelf, "/self"); code != 200 ||
+		!strings.Contains(body, `"fingerprints": 1`) || !strings.Contains(body, `"heap_bytes"`) {
+		t.Errorf("/self: %d %s", code, body)
+	}
+}
+
+func TestTUIKeys(t *testing.T) {
+	self := &tuiState{sortby: "count", samples: make(map[string][]tuiSample),
+		rows: []reportRow{{query: "select ?"}, {query: "update ?"}}}
+	for _, k := range []string{"a", "/", "u", "p", "\x7f", "\r", "\x1b[B", "\r"} {
+		self.key([]byte(k))
+	}
+	if self.sortby != "avg" || self.filter != "u" || self.detail != "update ?" {
+		t.Errorf("Got sort=%s filter=%q detail=%q", self.sortby, self.filter, self.detail)
+	}
+	self.key([]byte("\x1b"))
+	if self.detail != "" {
+		t.Errorf("Escape didn't leave the detail view")
+	}
+
+	rs := &source{src: "10.0.0.1:1234"}
+	for i := 0; i < TUI_SAMPLES+5; i++ {
+		self.sample(rs, &pendingRequest{text: "select ?", qdata: &queryData{}}, time.Unix(int64(i), 0), 1)
+	}
+	if s := self.samples["select ?"]; len(s) != TUI_SAMPLES || s[len(s)-1].at.Unix() != TUI_SAMPLES+4 {
+		t.Errorf("Kept %d samples", len(s))
+	}
+}
+
+func TestPrintTable(t *testing.T) {
+	if !isWrite([]byte("  (INSERT into t values (1)")) || isWrite([]byte("select 1")) {
+		t.Errorf("isWrite got it wrong")
+	}
+
+	slowMs = 1
+	var out strings.Builder
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	printTable(tableColumns, []reportRow{{query: "select ?", count: 5, avg: 1.5}, {query: "update ?", count: 123456, write: true}})
+	log.SetOutput(os.Stderr)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got:\n%s", out.String())
+	}
+	if !strings.HasPrefix(lines[2], COLOR_RED) || !strings.HasPrefix(lines[3], COLOR_YELLOW) {
+		t.Errorf("Expected a red slow query and a yellow write: %q", lines[2:])
+	}
+
+	// Columns are sized to fit, so everything lines up on the query.
+	plain := strings.NewReplacer(COLOR_RED, "", COLOR_YELLOW, "", COLOR_DEFAULT, "")
+	col := strings.Index(plain.Replace(lines[1]), "qry")
+	for _, line := range lines[2:] {
+		if strings.Index(plain.Replace(line), "?")-7 != col {
+			t.Errorf("Misaligned: %q", line)
+		}
+	}
+	if !strings.HasPrefix(plain.Replace(lines[3]), " 123456  ") {
+		t.Errorf("Unexpected row: %q", lines[3])
+	}
+}
+
+func TestQueryID(t *testing.T) {
+	// Same as pt-query-digest would give for the same text.
+	if id := queryID("select ?"); id != "16219655761820A2" {
+		t.Errorf("Unexpected queryID: %s", id)
+	}
+	if queryID("select ?") == queryID("select ?, ?") {
+		t.Errorf("Different queries got the same ID")
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	fail := mysqlPacket(1, "\xff\x7a\x04#42S02Table doesn't exist")
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", synced: true}
+	at := func(ms int) time.Time { return time.Unix(1000, int64(ms)*1000000) }
+
+	// a is frequent and fast, b is slow, c fails.
+	for i := 0; i < 3; i++ {
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03select a")), at(0))
+		processPacket(rs, false, []byte(ok), at(1))
+	}
+	processPacket(rs, true, []byte(mysqlPacket(0, "\x03select b")), at(0))
+	processPacket(rs, false, []byte(ok), at(50))
+	for i := 0; i < 2; i++ {
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03select c")), at(0))
+		processPacket(rs, false, []byte(fail), at(2))
+	}
+
+	for sortby, want := range map[string]string{"count": "select a", "qps": "select a",
+		"avg": "select b", "p95": "select b", "errors": "select c"} {
+		if rows := buildReport(10, 10, sortby, 0); len(rows) != 3 || rows[0].query != want {
+			t.Errorf("Sorting by %s, expected %q first: %+v", sortby, want, rows)
+		}
+	}
+	if qbuf["select c"].errors != 2 || qbuf["select a"].errors != 0 {
+		t.Errorf("Errors miscounted: %d and %d", qbuf["select c"].errors, qbuf["select a"].errors)
+	}
+	if validSortKey("bogus") || !validSortKey("errors") {
+		t.Errorf("validSortKey got it wrong")
+	}
+}
+
+func TestMinThresholds(t *testing.T) {
+	qbuf = make(map[string]*queryData)
+	add := func(q string, count int, ms uint64, bytes uint64) {
+		c := &queryData{count: uint64(count), bytes: bytes}
+		for i := 0; i < count; i++ {
+			c.times.Record(ms * 1000000)
+		}
+		qbuf[q] = c
+	}
+	add("select often", 100, 1, 1000)
+	add("select slow", 2, 500, 100)
+	add("select big", 1, 1, 1000000)
+	defer func() { minCount, minAvgMs, minBytes = 0, 0, 0 }()
+
+	for _, c := range []struct {
+		count uint64
+		avg   float64
+		bytes uint64
+		want  int
+	}{{0, 0, 0, 3}, {2, 0, 0, 2}, {0, 100, 0, 1}, {0, 0, 1000, 2}, {2, 0, 1000, 1}} {
+		minCount, minAvgMs, minBytes = c.count, c.avg, c.bytes
+		if rows := buildReport(10, 10, "count", 0); len(rows) != c.want {
+			t.Errorf("With %+v expected %d rows, got %+v", c, c.want, rows)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	parseFormat("#u@#d:#q")
+	qbuf = make(map[string]*queryData)
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1"}
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	query := func(seq byte, payload string) {
+		processPacket(rs, true, []byte(mysqlPacket(seq, payload)), time.Now())
+		processPacket(rs, false, []byte(ok), time.Now())
+	}
+
+	// A handshake response asking for "shop", with a 20 byte auth response.
+	caps := "\x08\xa2\x00\x00" // CONNECT_WITH_DB, PROTOCOL_41, SECURE_CONNECTION
+	query(1, caps+"\x00\x00\x00\x01\x21"+strings.Repeat("\x00", 23)+"app\x00\x14"+
+		strings.Repeat("x", 20)+"shop\x00mysql_native_password\x00")
+	if rs.user != "app" || rs.schema != "shop" {
+		t.Fatalf("Expected app and shop from the handshake, got %q and %q", rs.user, rs.schema)
+	}
+	query(0, "\x03select 1")
+	query(0, "\x02billing")
+	query(0, "\x03select 1")
+	query(0, "\x03 USE `odd``name`;")
+	query(0, "\x11admin\x00\x02xxcrm\x00")
+	query(0, "\x03select 1")
+	for _, q := range []string{"app@shop:select ?", "app@billing:select ?", "admin@crm:select ?"} {
+		if qbuf[q] == nil {
+			t.Errorf("Missing %q in %v", q, qbuf)
+		}
+	}
+	if db, _ := useSchema([]byte("USE `odd``name`;")); db != "odd`name" {
+		t.Errorf("Unexpected database from USE: %q", db)
+	}
+	if _, ok := useSchema([]byte("user_count()")); ok {
+		t.Errorf("Took a query for USE")
+	}
+}
+
+func TestQueryTable(t *testing.T) {
+	for q, want := range map[string]string{
+		"select a from users where id = ?":              "users",
+		"SELECT * FROM `shop`.`orders` o JOIN items i":  "shop.orders",
+		"insert ignore into t (a) values (?)":           "t",
+		"update low_priority accounts set a = ?":        "accounts",
+		"delete from sessions where id = ?":             "sessions",
+		"select * from (select a from inner_t) x":       "inner_t",
+		"create table if not exists `my table` (a int)": "my table",
+		"select ?": "(none)",
+		"COM_PING": "(none)",
+		"select a from t where b in (select c from other)": "t",
+	} {
+		if got := queryTable(q); got != want {
+			t.Errorf("queryTable(%q) = %q, expected %q", q, got, want)
+		}
+	}
+}
+
+func TestQueryTables(t *testing.T) {
+	for q, want := range map[string]string{
+		"select a from users where id = ?":                           "users",
+		"SELECT * FROM `shop`.`orders` o JOIN items i ON i.o = o.id": "shop.orders items",
+		"select * from a, b as x, c where a.id = x.id":               "a b c",
+		"update a, b set a.x = b.x":                                  "a b",
+		"insert into t select * from u left join v using (id)":       "t u v",
+		"select a from t where b in (select c from t)":               "t",
+		"select ? from dual":                                         "",
+		"COM_PING":                                                   "",
+	} {
+		if got := strings.Join(queryTables(q), " "); got != want {
+			t.Errorf("queryTables(%q) = %q, expected %q", q, got, want)
+		}
+	}
+
+	// And the stats they're kept under.
+	parseFormat("#q")
+	qbuf, tbuf = make(map[string]*queryData), make(map[string]*queryData)
+	tableStats = true
+	defer func() { tableStats = false }()
+	rs := &source{src: "10.0.0.1:1234", synced: true}
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	for i, q := range []string{"select * from a join b", "select * from b", "select 1"} {
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03"+q)), time.Unix(1000, 0))
+		processPacket(rs, false, []byte(ok), time.Unix(1000, int64(i+1)*1000000))
+	}
+	rows := buildTableReport(10, 10, "count")
+	if len(rows) != 2 || rows[0].query != "b" || rows[0].count != 2 || rows[1].query != "a" {
+		t.Fatalf("Unexpected table report: %+v", rows)
+	}
+	if rows[0].max != 2 || rows[1].avg != 1 {
+		t.Errorf("Tables weren't timed: %+v", rows)
+	}
+}
+
+func TestStatementType(t *testing.T) {
+	for q, want := range map[string]string{
+		"SELECT 1": "SELECT", " (select a from t)": "SELECT", "replace into t": "INSERT",
+		"update t": "UPDATE", "delete from t": "DELETE", "ALTER TABLE t": "DDL",
+		"set names utf8": "OTHER", "": "OTHER",
+	} {
+		if got := statementType([]byte(q)); got != want {
+			t.Errorf("statementType(%q) = %s, expected %s", q, got, want)
+		}
+	}
+
+	parseFormat("#c")
+	qbuf = make(map[string]*queryData)
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1"}
+	for _, q := range []string{"select 1", "select 2", "select 3", "update t set a=1", "begin"} {
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03"+q)), time.Now())
+	}
+	if qbuf["SELECT"] == nil || qbuf["SELECT"].count != 3 || qbuf["UPDATE"] == nil {
+		t.Errorf("Unexpected grouping: %v", qbuf)
+	}
+	if reads, writes, other := workloadMix(); reads != 3 || writes != 1 || other != 1 {
+		t.Errorf("Expected 3 reads, 1 write and 1 other, got %d, %d and %d", reads, writes, other)
+	}
+}
+
+func TestNats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Just enough of a server: greet, refuse every message JetStream style,
+	// and answer the ping at the end.
+	got := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		var seen strings.Builder
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			seen.Write(buf[:n])
+			if strings.Contains(seen.String(), "PING\r\n") {
+				inbox := strings.Fields(seen.String()[strings.Index(seen.String(), "PUB "):])[2]
+				payload := `{"error":{"code":503,"description":"no stream"}}`
+				conn.Write([]byte("MSG " + inbox + " 1 " + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\nPONG\r\n"))
+				break
+			}
+		}
+		got <- seen.String()
+	}()
+
+	n := openNats("nats://user:secret@"+l.Addr().String(), "db.queries", true)
+	n.Event(&source{src: "10.0.0.1:1234"}, &pendingRequest{sent: time.Unix(86400, 0), ptype: COM_QUERY,
+		query: "select ?", qdata: &queryData{}}, 2500000)
+	n.Close()
+
+	sent := <-got
+	for _, want := range []string{`"user":"user"`, `"pass":"secret"`, "SUB _INBOX.", "PUB db.queries _INBOX.",
+		`"query":"select ?"`, `"duration_ms":2.5`} {
+		if !strings.Contains(sent, want) {
+			t.Errorf("Missing %s in what was sent: %s", want, sent)
+		}
+	}
+	if n.refused != 1 || n.lastErr != "no stream" {
+		t.Errorf("Expected the message to be refused, got %d: %q", n.refused, n.lastErr)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Read commands and answer each, failing the AUTH if it's wrong.
+	commands := make(chan []string, 100)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(commands)
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, n)
+			for i := range args {
+				r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				args[i] = strings.TrimSpace(arg)
+			}
+			switch {
+			case args[0] == "AUTH" && args[1] != "secret":
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+			case args[0] == "HINCRBYFLOAT" || args[0] == "ZINCRBY":
+				conn.Write([]byte("$1\r\n1\r\n"))
+			default:
+				conn.Write([]byte(":1\r\n"))
+			}
+			commands <- args
+		}
+	}()
+
+	rd := openRedis("redis://:secret@"+l.Addr().String()+"/2", "db:", 60)
+	cumulative = true
+	defer func() { cumulative = false }()
+	for _, n := range []uint64{4, 6, 3} { // the last after a reset
+		rd.Write([]reportRow{{query: "select ?", id: "ABC", count: n, avg: 2.5, bytes: 25 * n}}, 10)
+	}
+	rd.Close()
+
+	var got []string
+	for args := range commands {
+		got = append(got, strings.Join(args, " "))
+	}
+	all := strings.Join(got, "\n")
+	for _, want := range []string{"AUTH secret", "SELECT 2", "HINCRBY db:query:ABC count 4",
+		"HINCRBYFLOAT db:query:ABC time_ms 10.000", "HSET db:query:ABC query select ? type 0",
+		"ZINCRBY db:count 4 ABC", "ZINCRBY db:time 10.000 ABC", "EXPIRE db:query:ABC 60"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("Missing %q in:\n%s", want, all)
+		}
+	}
+	if !strings.Contains(all, "ZINCRBY db:count:") {
+		t.Errorf("No rolling bucket in:\n%s", all)
+	}
+	if !strings.Contains(all, "HINCRBY db:query:ABC count 2\n") || !strings.Contains(all, "HINCRBY db:query:ABC count 3\n") ||
+		strings.Contains(all, "18446744") {
+		t.Errorf("Expected -cumulative to send differences, starting over after a reset:\n%s", all)
+	}
+
+	// Redis not answering mustn't hold up the report, we drop instead.
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cumulative = false
+	rd = openRedis(hung.Addr().String(), "db:", 60)
+	for i := 0; i < REDIS_QUEUE+5; i++ {
+		started := time.Now()
+		rd.Write([]reportRow{{query: "select ?", id: "ABC", count: 1}}, 10)
+		if took := time.Since(started); took > REDIS_TIMEOUT/2 {
+			t.Errorf("Writing to a hung Redis took %s", took)
+		}
+	}
+	if rd.dropped == 0 {
+		t.Errorf("Expected reports to be dropped with Redis hung")
+	}
+	hung.Close()
+	rd.Close()
+}
+
+func TestSelectStar(t *testing.T) {
+	for q, want := range map[string]bool{
+		"select * from t": true, "SELECT DISTINCT * FROM t": true, "select t.* from t join u": true,
+		"select a, b.* from b": true, "select count(*) from t": false, "select a * b from t": false,
+		"select a.b * c from t": false, "insert into t select * from u": true, "update t set a = 1": false,
+		"select a from t where b in (select * from u)": true,
+	} {
+		if got := usesSelectStar(q); got != want {
+			t.Errorf("usesSelectStar(%q) = %t, expected %t", q, got, want)
+		}
+	}
+}
+
+func TestMissingWhere(t *testing.T) {
+	for q, want := range map[string]bool{
+		"DELETE FROM t": true, "delete from t where id = 1": false, "update t set a = 1": true,
+		"UPDATE t SET a = 1 WHERE b = 2": false, "delete from t limit 1000": false,
+		"update t set a = (select max(x) from u where y = 1)": true, "select * from t": false,
+		"update t /* where */ set a = 'where'": true, "insert into t values (1)": false,
+	} {
+		if got := missingWhere([]byte(q)); got != want {
+			t.Errorf("missingWhere(%q) = %t, expected %t", q, got, want)
+		}
+	}
+}
+
+func TestBigResponses(t *testing.T) {
+	big := openBigResponses(1000)
+	rs := &source{src: "10.0.0.1:1234"}
+	qdata := &queryData{}
+	for _, n := range []uint64{500, 1001, 5000, 1000} {
+		big.Query(rs, &pendingRequest{text: "select * from t", raw: "SELECT * FROM t", qdata: qdata, rbytes: n})
+	}
+	big.Query(rs, &pendingRequest{text: "select ?", rbytes: 1 << 20})
+	if big.count != 2 || big.biggest != 5000 || len(big.seen) != 1 {
+		t.Errorf("Expected 2 responses from 1 query, the biggest 5000 bytes, got %d from %d, %d bytes",
+			big.count, len(big.seen), big.biggest)
+	}
+	big.Write(nil, 1)
+	if big.count != 0 || len(big.seen) != 0 {
+		t.Errorf("Expected the report to start over")
+	}
+}
+
+func TestSample(t *testing.T) {
+	sampleRate = 0.25
+	defer func() { sampleRate = 1 }()
+	server := []byte{10, 0, 0, 1}
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		client := []byte{10, 1, byte(i >> 8), byte(i)}
+		src := net.IP(client).String() + ":" + strconv.Itoa(30000+i)
+		if sampleConnection(src, client, server) != sampleConnection(src, server, client) {
+			t.Fatalf("Expected requests and responses on %s to be sampled the same", src)
+		}
+		if sampleConnection(src, client, server) {
+			kept++
+		}
+	}
+	if kept < 2300 || kept > 2700 {
+		t.Errorf("Expected about a quarter of connections sampled, got %d of 10000", kept)
+	}
+	if r := newReportRow("select ?", &queryData{count: 10, total: 10, bytes: 100}, 1, 1); r.count != 40 || r.bytes != 400 || r.bytesPer != 10 {
+		t.Errorf("Expected counts scaled up by 4, got %d queries of %d bytes, %d per", r.count, r.bytes, r.bytesPer)
+	}
+}
+
+func TestMaxQueryLen(t *testing.T) {
+	maxQueryLen = 20
+	defer func() { maxQueryLen = 0 }()
+	q := "insert into blobs (data) values (?)"
+	if got, want := truncateQuery(q), "insert into blobs (d..."; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if got := truncateQuery("select ?"); got != "select ?" {
+		t.Errorf("Expected short queries left alone, got %q", got)
+	}
+	if got, want := truncateQuery(strings.Repeat("é", 25)), strings.Repeat("é", 20)+"..."; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if got, want := truncateExample(q, 1035), "insert into blobs (d... (1035 bytes)"; got != want {
+		t.Errorf("Expected examples to say how long they were, %q, got %q", want, got)
+	}
+
+	parseFormat("#q")
+	rs := &source{}
+	qdata := recordQuery(rs, queryText(rs, []byte("INSERT INTO blobs (data) VALUES ('"+strings.Repeat("x", 1000)+"')")), COM_QUERY, 1040)
+	defer delete(qbuf, "INSERT INTO blobs (d...")
+	if qdata.bytes != 1040 || qbuf["INSERT INTO blobs (d..."] != qdata {
+		t.Errorf("Expected the full bytes counted against the short text, got %d", qdata.bytes)
+	}
+
+	// However long the rest is, it's the same query.
+	other := recordQuery(rs, queryText(rs, []byte("INSERT INTO blobs (data, more, again) VALUES (1, 2, 3), (4, 5, 6)")),
+		COM_QUERY, 60)
+	if other != qdata || qdata.count != 2 {
+		t.Errorf("Expected queries the same up to -max-query-len counted together, got %d", qdata.count)
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	if uid, gid, err := lookupUser("root"); err != nil || uid != 0 || gid != 0 {
+		t.Errorf("Expected root to be 0:0, got %d:%d (%v)", uid, gid, err)
+	}
+	if _, _, err := lookupUser("root:no-such-group-here"); err == nil {
+		t.Errorf("Expected an unknown group to fail")
+	}
+	if _, _, err := lookupUser("no-such-user-here"); err == nil {
+		t.Errorf("Expected an unknown user to fail")
+	}
+}
+
+func TestMaxFingerprints(t *testing.T) {
+	maxFingerprints = 20
+	qbuf = make(map[string]*queryData)
+	defer func() { maxFingerprints, stats.evicted = 0, 0 }()
+	rs := &source{}
+	for i := 0; i < 100; i++ {
+		recordQuery(rs, "select "+strconv.Itoa(i), COM_QUERY, 10)
+		// One query that keeps coming back.
+		recordQuery(rs, "select ?", COM_QUERY, 10)
+	}
+	if len(qbuf) > 20 || stats.evicted == 0 {
+		t.Errorf("Expected at most 20 queries kept and some evicted, got %d and %d", len(qbuf), stats.evicted)
+	}
+	if qbuf["select ?"] == nil || qbuf["select 99"] == nil || qbuf["select 0"] != nil {
+		t.Errorf("Expected the least recently seen queries to go")
+	}
+	if uint64(len(qbuf))+stats.evicted != 101 {
+		t.Errorf("Expected every query kept or counted as evicted, got %d and %d", len(qbuf), stats.evicted)
+	}
+}
+
+// tcpFrame is an Ethernet frame from a client (10.0.0.1) port to the server
+// (10.0.0.2) on 3306, padded out to the minimum frame size.
+func tcpFrame(cport uint16, flags byte, payload []byte) *pcap.Packet {
+	tcp := []byte{byte(cport >> 8), byte(cport), 0x0c, 0xea, 0, 0, 0, 0, 0, 0, 0, 0, 0x50, flags, 0, 0, 0, 0, 0, 0}
+	frame := ethernetFrame(ETHERTYPE_IPV4, ipv4Packet(6, append(tcp, payload...)))
+	for len(frame) < 60 {
+		frame = append(frame, 0)
+	}
+	return &pcap.Packet{Type: pcap.LINKTYPE_ETHERNET, Data: frame, Caplen: uint32(len(frame)), Len: uint32(len(frame))}
+}
+
+func TestStreamCleanup(t *testing.T) {
+	port, streamTimeout = 3306, time.Hour
+	w := newWorker()
+	defer func() { streamTimeout = 0 }()
+	t0 := time.Unix(1700000000, 0)
+	send := func(cport uint16, flags byte, payload string, at time.Time) {
+		pkt := tcpFrame(cport, flags, []byte(payload))
+		pkt.Time = at
+		handlePacket(w, pkt)
+	}
+
+	send(40000, 0x18, mysqlPacket(0, "\x0eping"), t0)
+	if w.streams["10.0.0.1:40000"] == nil {
+		t.Fatalf("Expected the stream tracked, got %v", w.streams)
+	}
+	// A bare FIN, with padding that mustn't be taken for data.
+	send(40000, 0x11, "", t0.Add(time.Second))
+	if len(w.streams) != 0 || stats.closed != 1 {
+		t.Errorf("Expected the FIN to end the stream, got %d streams", len(w.streams))
+	}
+	send(40001, 0x04, "", t0.Add(time.Second))
+	if len(w.streams) != 0 {
+		t.Errorf("Expected an RST on an unknown stream left alone")
+	}
+
+	send(40002, 0x18, mysqlPacket(0, "\x0eping"), t0)
+	send(40003, 0x18, mysqlPacket(0, "\x0eping"), t0.Add(90*time.Minute))
+	send(40003, 0x18, mysqlPacket(0, "\x0eping"), t0.Add(2*time.Hour))
+	if w.streams["10.0.0.1:40002"] != nil || w.streams["10.0.0.1:40003"] == nil || stats.expired != 1 {
+		t.Errorf("Expected only the idle stream to expire, got %v", w.streams)
+	}
+}
+
+// A packet the snaplen cut short is counted as truncated and throws the
+// stream's buffers away, rather than parsing across the hole; the next
+// request picks it up again.
+func TestTruncated(t *testing.T) {
+	port = 3306
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	w := newWorker()
+	t0 := time.Unix(1700000000, 0)
+	ok := []byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+	before := stats.truncated
+	exchange := func(q string, at time.Time, snaplen int) {
+		query := tcpFrame(40000, 0x18, []byte(mysqlPacket(0, "\x03"+q)))
+		if snaplen > 0 {
+			query.Data, query.Caplen = query.Data[:snaplen], uint32(snaplen)
+		}
+		reply := replyFrame(40000, ok)
+		query.Time, reply.Time = at, at.Add(time.Millisecond)
+		handlePacket(w, query)
+		handlePacket(w, reply)
+	}
+
+	exchange("select 1", t0, 0)
+	exchange("select 2 from "+strings.Repeat("t", 100), t0.Add(time.Second), 64)
+	rs := w.streams["10.0.0.1:40000"]
+	if stats.truncated != before+1 || rs == nil || rs.synced || len(rs.pending) != 0 {
+		t.Fatalf("Expected the truncated query flagged and the stream reset, got %d", stats.truncated-before)
+	}
+	exchange("select 3", t0.Add(2*time.Second), 0)
+	if len(qbuf) != 1 || qbuf["select ?"] == nil || qbuf["select ?"].count != 2 || qbuf["select ?"].times.Count() != 2 {
+		t.Errorf("Expected only the whole queries counted and timed, got %v", qbuf)
+	}
+}
+
+// An excluded client's queries and answers are dropped before we track any
+// state for it.
+func TestExcludeClient(t *testing.T) {
+	port = 3306
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	w := newWorker()
+	var err error
+	if excludeClients, err = parseClientList("192.168.1.10, 10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { excludeClients = nil }()
+	ok := []byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+	exchange := func() {
+		handlePacket(w, tcpFrame(40000, 0x18, []byte(mysqlPacket(0, "\x03select 1"))))
+		handlePacket(w, replyFrame(40000, ok))
+	}
+
+	exchange()
+	if len(w.streams) != 0 || len(qbuf) != 0 {
+		t.Errorf("Expected the excluded client ignored, got %v and %v", w.streams, qbuf)
+	}
+	excludeClients, _ = parseClientList("10.0.1.0/24")
+	exchange()
+	if w.streams["10.0.0.1:40000"] == nil || qbuf["select ?"] == nil || qbuf["select ?"].count != 1 {
+		t.Errorf("Expected the client counted once it's not excluded, got %v and %v", w.streams, qbuf)
+	}
+}
+
+func TestMaxRequestBuffer(t *testing.T) {
+	maxRequestBuffer = 100
+	defer func() { maxRequestBuffer = 0 }()
+	rs := &source{src: "10.0.0.1:1234", synced: true}
+	before := stats.overflows
+
+	query := mysqlPacket(0, "\x03select 1")
+	processPacket(rs, true, []byte(query[:6]), time.Now())
+	if len(rs.reqbuffer) != 6 || stats.overflows != before {
+		t.Errorf("Expected a small partial request kept")
+	}
+	rs.reset()
+	rs.synced = true
+
+	big := mysqlPacket(0, "\x03select '"+strings.Repeat("x", 200)+"'")
+	processPacket(rs, true, []byte(big[:50]), time.Now())
+	if rs.reqbuffer != nil || rs.synced || stats.overflows != before+1 {
+		t.Errorf("Expected a request saying it's over the limit dropped, holding %d bytes", len(rs.reqbuffer))
+	}
+}
+
+func TestSystemd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "2000000")
+	defer func() { sdWatchdogEvery = 0 }()
+
+	read := func() string {
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(buf)
+		return string(buf[:n])
+	}
+	sdStart()
+	if got := read(); got != "READY=1" || sdWatchdogEvery != time.Second {
+		t.Errorf("Expected READY=1 and a watchdog every second, got %q and %s", got, sdWatchdogEvery)
+	}
+	sdWatchdog()
+	sdWatchdogLast = time.Now().Add(-2 * time.Second)
+	sdWatchdog()
+	if got := read(); got != "WATCHDOG=1" {
+		t.Errorf("Expected only one WATCHDOG=1 once it was due, got %q", got)
+	}
+	if sdListener() != nil {
+		t.Errorf("Expected no socket when systemd didn't pass us one")
+	}
+}
+
+func TestLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diag.log")
+	f, _ := os.Create(path)
+	defer func(saved *slog.Logger) { logger, logfile = saved, nil }(logger)
+	logfile = &logFile{path: path, file: f}
+	setupLogging("warn", "json")
+	logger.Info("not this")
+	logger.Warn("Failed to send", "addr", "graphite:2003")
+
+	data, _ := os.ReadFile(path)
+	var entry map[string]interface{}
+	if err := json.Unmarshal(data, &entry); err != nil || entry["level"] != "WARN" || entry["addr"] != "graphite:2003" {
+		t.Errorf("Expected one JSON warning, got %q", data)
+	}
+}
+
+// countingSource hands out n empty packets, then says it's done.
+type countingSource struct {
+	n int
+}
+
+func (self *countingSource) NextEx() (*pcap.Packet, int32) {
+	if self.n == 0 {
+		return nil, -2
+	}
+	self.n--
+	return &pcap.Packet{}, 1
+}
+
+func (self *countingSource) Getstats() (*pcap.Stat, error) { return &pcap.Stat{}, nil }
+func (self *countingSource) Close()                        {}
+
+func TestPacketQueue(t *testing.T) {
+	// Files wait for room.
+	q := startCapture(&countingSource{1000}, 10, true)
+	got := 0
+	for range q.packets {
+		got++
+	}
+	if got != 1000 || q.Dropped() != 0 {
+		t.Errorf("Expected all 1000 packets from a file, got %d and %d dropped", got, q.Dropped())
+	}
+
+	// Live captures don't.
+	q = startCapture(&countingSource{1000}, 10, false)
+	<-q.done
+	got = 0
+	for range q.packets {
+		got++
+	}
+	if got != 10 || q.Dropped() != 990 {
+		t.Errorf("Expected 10 packets queued and 990 dropped, got %d and %d", got, q.Dropped())
+	}
+	if !q.stop() {
+		t.Errorf("Expected a finished reader to stop straight away")
+	}
+}
+
+// replyFrame is tcpFrame the other way, from the server back to cport.
+func replyFrame(cport uint16, payload []byte) *pcap.Packet {
+	pkt := tcpFrame(cport, 0x18, payload)
+	ip := pkt.Data[14:]
+	for i := 12; i < 16; i++ {
+		ip[i], ip[i+4] = ip[i+4], ip[i]
+	}
+	ip[20], ip[21], ip[22], ip[23] = 0x0c, 0xea, byte(cport>>8), byte(cport)
+	return pkt
+}
+
+// What -w writes should read back with -r: the packets we parsed, and with
+// -w-queries only the ones carrying a query.
+func TestPacketDumper(t *testing.T) {
+	port = 3306
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	path := filepath.Join(t.TempDir(), "dump.pcap")
+	dumper = &packetDumper{path: path}
+	defer func() { dumper, dumpQueriesOnly = nil, false }()
+	w := newWorker()
+	t0 := time.Unix(1700000000, 123456000)
+	ok := []byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+	var sent []*pcap.Packet
+	exchange := func(cport uint16, q string, at time.Time) {
+		query := tcpFrame(cport, 0x18, []byte(mysqlPacket(0, "\x03"+q)))
+		reply := replyFrame(cport, ok)
+		query.Time, reply.Time = at, at.Add(time.Millisecond)
+		handlePacket(w, query)
+		handlePacket(w, reply)
+		sent = append(sent, query)
+		if !dumpQueriesOnly {
+			sent = append(sent, reply)
+		}
+	}
+	exchange(40000, "select 1", t0)
+	dumpQueriesOnly = true
+	exchange(40000, "select 2", t0.Add(time.Second))
+	exchange(40001, "select 3", t0.Add(2*time.Second))
+
+	// A pcap file holds one link type, so anything else is left out.
+	dumper.Write(&pcap.Packet{Type: pcap.LINKTYPE_RAW, Data: []byte{0x45}, Caplen: 1, Len: 1})
+	dumper.Close()
+
+	src := openOffline(path, "")
+	defer src.Close()
+	for i, expected := range sent {
+		pkt, rv := src.NextEx()
+		if pkt == nil || rv != 1 {
+			t.Fatalf("Expected %d packets, got %d", len(sent), i)
+		}
+		if string(pkt.Data) != string(expected.Data) || !pkt.Time.Equal(expected.Time) || pkt.Type != pcap.LINKTYPE_ETHERNET {
+			t.Errorf("Packet %d didn't come back as written: %v %v %x", i, pkt.Time, pkt.Type, pkt.Data)
+		}
+	}
+	if pkt, _ := src.NextEx(); pkt != nil {
+		t.Errorf("Expected only %d packets, got another: %x", len(sent), pkt.Data)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	port = 3306
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	querycount = 0
+	startWorkers(4)
+	defer func() { workers = nil }()
+
+	// Keep looking at everything while the workers are at it, like the API
+	// and reports do, so go test -race has something to go on.
+	done := make(chan bool)
+	looked := make(chan bool)
+	go func() {
+		defer close(looked)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			pause()
+			apiConnections(nil)
+			buildReport(1, 1, "count", 0)
+			resume()
+		}
+	}()
+
+	ok := []byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+	for i := 0; i < 400; i++ {
+		cport := uint16(40000 + i%50)
+		dispatch(tcpFrame(cport, 0x18, []byte(mysqlPacket(0, "\x03select "+strconv.Itoa(i)))))
+		dispatch(replyFrame(cport, ok))
+	}
+	stopWorkers()
+	close(done)
+	<-looked
+
+	c := qbuf["select ?"]
+	if querycount != 400 || c == nil || c.times.Count() != 400 {
+		t.Fatalf("Expected 400 queries all answered, got %d: %v", querycount, qbuf)
+	}
+	busy := 0
+	for _, w := range workers {
+		if len(w.streams) > 0 {
+			busy++
+		}
+	}
+	if streamCount() != 50 || busy < 2 {
+		t.Errorf("Expected 50 streams spread over the workers, got %d over %d", streamCount(), busy)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	registerHook("test-redact", func(query *string, attrs map[string]string) bool {
+		if strings.Contains(*query, "heartbeat") {
+			return false
+		}
+		*query = strings.Replace(*query, "secret_table", "t", -1)
+		return true
+	})
+	stripComments = true
+	defer func() { queryHooks, stripComments = nil, false }()
+	if err := setupHooks("nonesuch", ""); err == nil {
+		t.Errorf("Expected an unknown hook refused")
+	}
+	if err := setupHooks("comment-tags, test-redact", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := &source{src: "10.0.0.1:1234", synced: true}
+	processRequest(rs, COM_QUERY, []byte("select * from secret_table where id = 1 /*tenant='acme',route='api'*/"), time.Now())
+	processRequest(rs, COM_QUERY, []byte("select heartbeat from ops"), time.Now())
+	if len(qbuf) != 1 || qbuf["select * from t where id = ?"] == nil {
+		t.Errorf("Expected just the rewritten query counted, got %v", qbuf)
+	}
+	if len(rs.pending) != 2 {
+		t.Errorf("Expected the dropped query still waiting on its response, got %d", len(rs.pending))
+	}
+	event := queryEvent(rs, &rs.pending[0], 0)
+	if tags, _ := event["tags"].(map[string]string); len(tags) != 2 || tags["tenant"] != "acme" {
+		t.Errorf("Expected the comment's tags, got %v", event["tags"])
+	}
+}
+
+func TestCollector(t *testing.T) {
+	var a, b, all histogram
+	for i := uint64(1); i <= 100; i++ {
+		if i%3 == 0 {
+			a.Record(i * 1000)
+		} else {
+			b.Record(i * 1000)
+		}
+		all.Record(i * 1000)
+	}
+	a.Merge(&b)
+	d := a.Stddev() - all.Stddev()
+	if a.Count() != all.Count() || a.Quantile(0.5) != all.Quantile(0.5) ||
+		d*d > 1e-9 || a.Min() != all.Min() || a.Max() != all.Max() {
+		t.Errorf("Expected merged histograms to match, got %v stddev %f vs %f", a.Count(), a.Stddev(), all.Stddev())
+	}
+
+	collector = openCollector("127.0.0.1:0")
+	defer func() { collector = nil }()
+	agent := openAgent(collector.addr, "db1")
+	defer agent.Close()
+
+	qbuf = make(map[string]*queryData)
+	c := &queryData{ptype: COM_QUERY, count: 3, total: 3, bytes: 300, stype: "SELECT"}
+	c.times.Record(2000000)
+	c.times.Record(4000000)
+	c.times.Record(6000000)
+	qbuf["select ?"] = c
+	qbuf["idle"] = &queryData{total: 1}
+	times.Reset()
+	times.Merge(&c.times)
+	sampleRate = 0.5
+	agent.Write(nil, 10)
+	sampleRate = 1
+
+	// As if from a second host, into an empty collector.
+	qbuf = make(map[string]*queryData)
+	times.Reset()
+	querycount = 0
+	select {
+	case r := <-collector.reports:
+		collector.merge(r)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a report from the agent")
+	}
+	got := qbuf["select ?"]
+	if len(qbuf) != 1 || got == nil || got.count != 6 || got.bytes != 600 || got.stype != "SELECT" || querycount != 6 {
+		t.Fatalf("Expected the agent's query scaled up by its sample, got %v", qbuf)
+	}
+	if got.times.Count() != 6 || got.times.Max() != 6000000 || times.Count() != 6 {
+		t.Errorf("Expected the agent's latencies scaled up with its counts, got %d", got.times.Count())
+	}
+	if got.times.Quantile(0.5) != c.times.Quantile(0.5) || got.times.Quantile(0.99) != c.times.Quantile(0.99) ||
+		got.times.Mean() != c.times.Mean() {
+		t.Errorf("Expected scaling to leave the latencies alone, got p50 %d and mean %d", got.times.Quantile(0.5),
+			got.times.Mean())
+	}
+	if !collector.heard["db1"] {
+		t.Errorf("Expected to have heard from db1, got %v", collector.heard)
+	}
+}
+
+func pgMessage(mtype byte, payload string) string {
+	n := len(payload) + 4
+	return string([]byte{mtype, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}) + payload
+}
+
+func TestPostgres(t *testing.T) {
+	protocol = PROTO_POSTGRES
+	defer func() { protocol = PROTO_MYSQL }()
+	parseFormat("#u@#d #q")
+	qbuf = make(map[string]*queryData)
+	now := time.Now()
+	rs := &source{src: "10.0.0.1:1234"}
+	send := func(request bool, data string) {
+		now = now.Add(time.Millisecond)
+		processPacket(rs, request, []byte(data), now)
+	}
+
+	startup := "\x00\x03\x00\x00user\x00app\x00database\x00shop\x00\x00"
+	n := len(startup) + 4
+	send(true, string([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})+startup)
+	send(false, pgMessage('R', "\x00\x00\x00\x00")+pgMessage('Z', "I"))
+
+	// The simple protocol, split over two packets.
+	q := pgMessage('Q', "select 1\x00")
+	send(true, q[:7])
+	send(true, q[7:])
+	send(false, pgMessage('T', "...")+pgMessage('D', "..."))
+	send(false, pgMessage('C', "SELECT 1\x00")+pgMessage('Z', "I"))
+
+	// The extended protocol, and a failed Execute taking the next one with it.
+	parse := pgMessage('P', "\x00select * from t where id = $1\x00\x00\x00")
+	bind := pgMessage('B', "\x00\x00...")
+	exec := pgMessage('E', "\x00\x00\x00\x00\x00")
+	sync := pgMessage('S', "")
+	send(true, parse+bind+exec+sync)
+	send(false, pgMessage('1', "")+pgMessage('2', "")+pgMessage('D', "...")+pgMessage('C', "SELECT 1\x00")+pgMessage('Z', "I"))
+	send(true, bind+exec+bind+exec+sync)
+	send(false, pgMessage('2', "")+pgMessage('E', "SERROR\x00")+pgMessage('Z', "E"))
+
+	simple := qbuf["app@shop select ?"]
+	extended := qbuf["app@shop select * from t where id = $1"]
+	if simple == nil || simple.times.Count() != 1 || extended == nil {
+		t.Fatalf("Expected both queries counted, got %v", qbuf)
+	}
+	if extended.count != 3 || extended.times.Count() != 2 || extended.errors != 1 {
+		t.Errorf("Expected 3 executions, 2 answered and 1 failed, got %d, %d and %d",
+			extended.count, extended.times.Count(), extended.errors)
+	}
+	if len(rs.pending) != 0 || !rs.synced {
+		t.Errorf("Expected nothing left waiting, got %d", len(rs.pending))
+	}
+}
+
+func TestProxy(t *testing.T) {
+	proxyAware, proxyKeys = true, parseKeywords("client_ip,client")
+	stripComments = true
+	defer func() { proxyAware, stripComments = false, false }()
+	parseFormat("#i #q")
+	qbuf = make(map[string]*queryData)
+
+	for _, c := range []struct{ query, client string }{
+		{"select 1 /* client_ip='10.9.8.7:5555',route='x' */", "10.9.8.7:5555"},
+		{"/*client:10.9.8.6*/ select 1", "10.9.8.6"},
+		{"/* client=app1 */ select 1", ""},
+		{"/* user_ip=10.9.8.5 */ select 1", ""},
+		{"select 1", ""},
+	} {
+		if got := proxyClient([]byte(c.query)); got != c.client {
+			t.Errorf("Expected %q from %s, got %q", c.client, c.query, got)
+		}
+	}
+
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", synced: true}
+	processRequest(rs, COM_QUERY, []byte("select 1 /* client_ip='10.9.8.7:5555' */"), time.Now())
+	processRequest(rs, COM_QUERY, []byte("select 2"), time.Now())
+	if qbuf["10.9.8.7 select ?"] == nil || qbuf["10.0.0.1 select ?"] == nil {
+		t.Errorf("Expected one query each for the real client and the proxy, got %v", qbuf)
+	}
+	if event := queryEvent(rs, &rs.pending[0], 0); event["client_ip"] != "10.9.8.7" || event["client_port"] != 5555 {
+		t.Errorf("Expected the event from the real client, got %v:%v", event["client_ip"], event["client_port"])
+	}
+}
+
+// The hot path: a query and its answer on a connection we already know.
+func BenchmarkHandlePacket(b *testing.B) {
+	port = 3306
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	w := newWorker()
+	query := tcpFrame(40000, 0x18, []byte(mysqlPacket(0, "\x03SELECT name, email FROM users WHERE id = 42 AND status IN (1, 2, 3)")))
+	reply := replyFrame(40000, []byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")))
+	handlePacket(w, query)
+	handlePacket(w, reply)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handlePacket(w, query)
+		handlePacket(w, reply)
+	}
+}
+
+// Queries to canonicalize, from the simplest to the ones with the most to
+// do.
+var benchQueries = []struct{ name, query string }{
+	{"short", "select 1"},
+	{"where", "SELECT id, name, email FROM users WHERE id = 42 AND status = 'active'"},
+	{"join", "SELECT u.name, u.email FROM users u JOIN orders o ON o.user_id = u.id " +
+		"WHERE u.id = 42 AND o.status IN (1, 2, 3) AND o.note = 'it''s' LIMIT 10"},
+	{"in-list", "select * from orders where id in (" + strings.Repeat("123456, ", 199) + "123456)"},
+	{"values", "INSERT INTO order_items (order_id, sku, price) VALUES " +
+		strings.Repeat("(42, 'abc-123', 9.99), ", 49) + "(42, 'abc-123', 9.99)"},
+	{"comments", "/* app:checkout,line:42 */ select /*+ MAX_EXECUTION_TIME(100) */ a -- trailing\n" +
+		"from t where b = -1.5e3 # more\n and c = 0x1f"},
+}
+
+func BenchmarkCleanupQuery(b *testing.B) {
+	for _, q := range benchQueries {
+		query := []byte(q.query)
+		b.Run(q.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(query)))
+			for i := 0; i < b.N; i++ {
+				cleanupQuery(query)
+			}
+		})
+	}
+}
+
+func BenchmarkScanToken(b *testing.B) {
+	for _, q := range benchQueries {
+		query := []byte(q.query)
+		b.Run(q.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(query)))
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < len(query); {
+					n, _ := scanToken(query[j:])
+					j += n
+				}
+			}
+		})
+	}
+}
+
+// A segment with a few pipelined requests in it, carved up one at a time.
+func BenchmarkCarvePacket(b *testing.B) {
+	var segment []byte
+	for _, q := range benchQueries {
+		segment = append(segment, mysqlPacket(0, "\x03"+q.query)...)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(segment)))
+	for i := 0; i < b.N; i++ {
+		buf := segment
+		for {
+			if ptype, _ := carvePacket(&buf); ptype == -1 {
+				break
+			}
+		}
+	}
+}
+
+// replayPackets reads testdata/replay.pcapng: two dozen connections logging
+// in and sending a mix of selects (some with IN lists and result sets over
+// several segments), inserts, updates, errors and pings, then hanging up.
+func replayPackets(tb testing.TB) []*pcap.Packet {
+	port = 3306
+	src, err := openPcapng(filepath.Join("testdata", "replay.pcapng"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer src.Close()
+	var pkts []*pcap.Packet
+	for {
+		pkt, rv := src.NextEx()
+		if rv != 1 {
+			return pkts
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	pkts := replayPackets(t)
+	parseFormat("#u@#d #q")
+	qbuf = make(map[string]*queryData)
+	w := newWorker()
+	for _, pkt := range pkts {
+		handlePacket(w, pkt)
+	}
+
+	if len(pkts) != 1320 || len(w.streams) != 0 {
+		t.Errorf("Expected 1320 packets, all connections closed, got %d and %d", len(pkts), len(w.streams))
+	}
+	selects := qbuf["app@shop SELECT id, name, email, created_at FROM users WHERE id = ?"]
+	if selects == nil || selects.count == 0 || selects.times.Count() != selects.count {
+		t.Fatalf("Expected the selects all counted and answered, got %v", qbuf)
+	}
+	if failed := qbuf["app@shop select count(*) from nope where x = ?"]; failed == nil || failed.errors != failed.count {
+		t.Errorf("Expected every query on the missing table to fail, got %+v", failed)
+	}
+	for q, c := range qbuf {
+		if expectsResponse(c.ptype) && c.times.Count() != c.count {
+			t.Errorf("Expected all %d of %s answered, got %d", c.count, q, c.times.Count())
+		}
+	}
+}
+
+// -count stops the capture at the query that reaches it, and -T stops it
+// even when there's nothing to read.
+func TestCaptureLimits(t *testing.T) {
+	port = 3306
+	parseFormat("#q")
+	startWorkers(1)
+	defer func() { workers, quitting = nil, 0 }()
+	replay := func(maxcount int) {
+		resetAll()
+		src, err := openPcapng(filepath.Join("testdata", "replay.pcapng"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue := startCapture(src, 16, true)
+		captureLoop(queue.packets, nil, 0, maxcount, 10, func() {})
+		if queue.stop() {
+			src.Close()
+		}
+	}
+
+	replay(0)
+	all := querycount
+	if stopping() || all <= 5 {
+		t.Fatalf("Expected the whole file read with no limit, got %d queries", all)
+	}
+	replay(5)
+	if !stopping() || querycount != 5 {
+		t.Errorf("Expected to stop after 5 of %d queries, got %d", all, querycount)
+	}
+
+	quitting = 0
+	started := time.Now()
+	captureLoop(make(chan *pcap.Packet), nil, 200*time.Millisecond, 0, 10, func() {})
+	if took := time.Since(started); !stopping() || took < 200*time.Millisecond || took > 2*time.Second {
+		t.Errorf("Expected to stop after 200ms, took %v", took)
+	}
+}
+
+// End to end, from frames to counts, a connection at a time.
+func BenchmarkReplay(b *testing.B) {
+	pkts := replayPackets(b)
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	total := 0
+	for _, pkt := range pkts {
+		total += len(pkt.Data)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(total))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := newWorker()
+		for _, pkt := range pkts {
+			handlePacket(w, pkt)
+		}
+	}
+}
+
+func BenchmarkQueryText(b *testing.B) {
+	rs := &source{src: "10.0.0.1:40000", srcip: "10.0.0.1", user: "app", schema: "shop"}
+	query := []byte(benchQueries[1].query)
+	for _, f := range []string{"#q", "#s #u@#d #q", "#i|#c|#t|#q"} {
+		parseFormat(f)
+		b.Run(f, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				queryText(rs, query)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	parseFormat("#s ##x #Q#z")
+	expected := []formatOp{{F_SOURCE, ""}, {F_NONE, " #x "}, {F_QUERY, ""}, {F_NONE, "#z"}}
+	if len(format) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, format)
+	}
+	for i := range expected {
+		if format[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, format)
+		}
+	}
+	rs := &source{src: "10.0.0.1:40000", srcip: "10.0.0.1"}
+	if text := queryText(rs, []byte("select 1")); text != "10.0.0.1:40000 #x select ?#z" {
+		t.Errorf("Got %q", text)
+	}
+}
+
+func TestProcessList(t *testing.T) {
+	port = 3306
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	startWorkers(1)
+	defer func() { workers = nil }()
+	t0 := time.Unix(1700000000, 0)
+	send := func(pkt *pcap.Packet, at time.Time) {
+		pkt.Time = at
+		dispatch(pkt)
+	}
+
+	send(tcpFrame(40000, 0x18, []byte(mysqlPacket(0, "\x03select sleep(10)"))), t0)
+	send(tcpFrame(40001, 0x18, []byte(mysqlPacket(0, "\x03select 1"))), t0)
+	send(replyFrame(40001, []byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))), t0.Add(time.Second))
+
+	list := processList(t0.Add(5 * time.Second))
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 connections, got %v", list)
+	}
+	running, idle := list[0], list[1]
+	if running.Client != "10.0.0.1:40000" || running.Command != "Query" || running.Time != 5 ||
+		running.Info != "select sleep(?)" || running.Queries != 1 {
+		t.Errorf("Expected the sleep running for 5s first, got %+v", running)
+	}
+	if idle.Command != "Sleep" || idle.Time != 4 || idle.Info != "select ?" || idle.Bytes != 13+11 ||
+		idle.Connected != 5 {
+		t.Errorf("Expected the other asleep for 4s, got %+v", idle)
+	}
+
+	offline = true
+	defer func() { offline = false }()
+	if now := processNow(); !now.Equal(t0.Add(time.Second)) {
+		t.Errorf("Expected the newest packet's time reading a file, got %v", now)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	for q, expected := range map[string]int{
+		"/* app */ START TRANSACTION READ ONLY": TXN_BEGIN,
+		"begin":                                 TXN_BEGIN,
+		"COMMIT":                                TXN_COMMIT,
+		"ROLLBACK WORK":                         TXN_ROLLBACK,
+		"rollback to savepoint a":               TXN_NONE,
+		"set @@session.autocommit = OFF":        TXN_AUTOCOMMIT_OFF,
+		"SET autocommit=1":                      TXN_AUTOCOMMIT_ON,
+		"set names utf8mb4":                     TXN_NONE,
+		"create table t (a int)":                TXN_IMPLICIT,
+		"lock tables t write":                   TXN_IMPLICIT,
+		"select * from begin_log":               TXN_NONE,
+	} {
+		if got := txnStatement([]byte(q)); got != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, q, got)
+		}
+	}
+
+	port = 3306
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	transactionStats = true
+	resetTransactions()
+	startWorkers(1)
+	defer func() { transactionStats, workers = false, nil }()
+	w := workers[0]
+	t0 := time.Unix(1700000000, 0)
+	ok := []byte(mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+	query := func(cport uint16, q string, sent, answered time.Duration) {
+		pkt := tcpFrame(cport, 0x18, []byte(mysqlPacket(0, "\x03"+q)))
+		pkt.Time = t0.Add(sent)
+		handlePacket(w, pkt)
+		pkt = replyFrame(cport, ok)
+		pkt.Time = t0.Add(answered)
+		handlePacket(w, pkt)
+	}
+
+	query(40000, "BEGIN", 0, 0)
+	query(40000, "update t set a = 1", 0, 0)
+	query(40000, "insert into t values (1)", 0, 0)
+	query(40000, "COMMIT", 2*time.Second, 3*time.Second)
+
+	query(40001, "set autocommit=0", 0, 0)
+	query(40001, "select * from t for update", time.Second, time.Second)
+	query(40001, "rollback", 2*time.Second, 2*time.Second)
+
+	query(40002, "select 1", 0, 0)
+	query(40002, "begin", time.Second, time.Second)
+	if rs, _ := longestTransaction(); rs == nil || rs.src != "10.0.0.1:40002" {
+		t.Errorf("Expected the open transaction found")
+	}
+	fin := tcpFrame(40002, 0x11, nil)
+	fin.Time = t0.Add(4 * time.Second)
+	handlePacket(w, fin)
+
+	if txnStats.count != 3 || txnStats.rollbacks != 2 || txnStats.autocommit != 1 {
+		t.Errorf("Expected 3 transactions, 2 rolled back and 1 autocommit, got %+v", txnStats)
+	}
+	if max := txnStats.times.Max(); max != uint64(3*time.Second) {
+		t.Errorf("Expected the longest to take 3s, commit included, got %d", max)
+	}
+	if txnStats.statements.Max() != 2 || txnStats.statements.Min() != 0 {
+		t.Errorf("Expected 0 to 2 statements a transaction, got %d to %d",
+			txnStats.statements.Min(), txnStats.statements.Max())
+	}
+}
+
+func TestTimeseries(t *testing.T) {
+	qbuf = map[string]*queryData{
+		"select ?":         {count: 30, stype: "SELECT", bytes: 3000},
+		"update t set a=?": {count: 10, stype: "UPDATE", write: true, bytes: 500, errors: 2},
+	}
+	intervalcount = 40
+	times.Reset()
+	times.Record(uint64(2 * time.Millisecond))
+	defer times.Reset()
+
+	path := filepath.Join(t.TempDir(), "series.txt")
+	out := openTimeseries(path)
+	out.Write(nil, 10)
+	out.Write(nil, 10)
+	out.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !regexp.MustCompile(`^\d{4}-\d\d-\d\dT\S+Z interval=10 qps=4.00 reads=3.00 writes=1.00 `+
+		`p50=2.00 p95=2.00 p99=2.00 bytes=3500 errors=2$`).MatchString(lines[0]) {
+		t.Errorf("Unexpected time series: %q", data)
+	}
+
+	// From a file, by the capture's clock.
+	offline = true
+	digestFrom, digestTo = time.Unix(1700000000, 0), time.Unix(1700000020, 0)
+	defer func() { offline, digestFrom, digestTo = false, time.Time{}, time.Time{} }()
+	out = openTimeseries(path)
+	out.Write(nil, 2)
+	out.Close()
+	data, _ = os.ReadFile(path)
+	if !strings.HasPrefix(string(data), "2023-11-14T22:13:40Z interval=20 qps=2.00 reads=1.50 writes=0.50 ") {
+		t.Errorf("Expected the capture's time and span, got %q", data)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h histogram
+	if histogramLines(&h) != nil {
+		t.Errorf("Expected no lines for an empty histogram")
+	}
+	for i := 0; i < 30; i++ {
+		h.Record(uint64(300 * time.Microsecond))
+	}
+	for i := 0; i < 10; i++ {
+		h.Record(uint64(3 * time.Millisecond))
+	}
+	h.Record(uint64(500))
+
+	lines := histogramLines(&h)
+	expect := []string{"0 - 1us", "1us - 2us", "200us - 500us", "500us - 1ms", "2ms - 5ms"}
+	if len(lines) != 12 {
+		t.Fatalf("Expected 12 lines from 0 to 5ms, got %d: %q", len(lines), lines)
+	}
+	for _, prefix := range expect {
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(strings.TrimSpace(line), prefix+" ") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a %s line in %q", prefix, lines)
+		}
+	}
+	if !strings.Contains(lines[8], "|"+strings.Repeat("#", HIST_BAR_WIDTH)+"|") ||
+		!strings.HasSuffix(lines[8], "30  73.2%") {
+		t.Errorf("Unexpected 200us - 500us line: %q", lines[8])
+	}
+	if !strings.Contains(lines[11], "|"+strings.Repeat("#", 14)+" ") || !strings.HasSuffix(lines[11], "10  24.4%") {
+		t.Errorf("Unexpected 2ms - 5ms line: %q", lines[11])
+	}
+	if !strings.Contains(lines[9], "|"+strings.Repeat(" ", HIST_BAR_WIDTH)+"|") {
+		t.Errorf("Expected an empty bar for 500us - 1ms: %q", lines[9])
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	parseFormat("#q")
+	qbuf, cbuf = make(map[string]*queryData), make(map[string]*queryData)
+	clientStats = true
+	defer func() { clientStats, clientPorts = false, false }()
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	a1 := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", synced: true}
+	a2 := &source{src: "10.0.0.1:1235", srcip: "10.0.0.1", synced: true}
+	b := &source{src: "10.0.0.2:1234", srcip: "10.0.0.2", synced: true}
+	for i, rs := range []*source{a1, a2, b, a1} {
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03select 1")), time.Unix(1000, 0))
+		processPacket(rs, false, []byte(ok), time.Unix(1000, int64(i+1)*1000000))
+	}
+	rows := buildClientReport(10, 10, "count")
+	if len(rows) != 2 || rows[0].query != "10.0.0.1" || rows[0].count != 3 || rows[1].query != "10.0.0.2" {
+		t.Fatalf("Unexpected client report: %+v", rows)
+	}
+	if rows[0].max != 4 || rows[1].avg != 3 || rows[0].bytes != 3*rows[1].bytes {
+		t.Errorf("Clients weren't timed or counted: %+v", rows)
+	}
+	if rows = buildClientReport(10, 10, "avg"); rows[0].query != "10.0.0.2" {
+		t.Errorf("Expected the slower client first by avg: %+v", rows)
+	}
+
+	// By port, and forgetting whoever's gone quiet.
+	clientPorts = true
+	cbuf = make(map[string]*queryData)
+	processPacket(a1, true, []byte(mysqlPacket(0, "\x03select 1")), time.Unix(1001, 0))
+	processPacket(a1, false, []byte(ok), time.Unix(1001, 1000000))
+	processPacket(b, true, []byte(mysqlPacket(0, "\x03select 1")), time.Unix(1001, 0))
+	processPacket(b, false, []byte(ok), time.Unix(1001, 1000000))
+	resetInterval()
+	processPacket(b, true, []byte(mysqlPacket(0, "\x03select 1")), time.Unix(1002, 0))
+	processPacket(b, false, []byte(ok), time.Unix(1002, 1000000))
+	resetInterval()
+	if len(cbuf) != 1 || cbuf["10.0.0.2:1234"] == nil {
+		t.Errorf("Expected only the busy client to be kept: %v", cbuf)
+	}
+}
+
+// A report without -cumulative starts a new interval, but the lifetime
+// counters carry on: the OTLP and Redis deltas depend on both.
+func TestResetInterval(t *testing.T) {
+	parseFormat("#q")
+	resetAll()
+	clientStats = true
+	defer func() { clientStats = false }()
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", synced: true}
+	query := func(at int64) {
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03select 1")), time.Unix(at, 0))
+		processPacket(rs, false, []byte(ok), time.Unix(at, 2000000))
+	}
+	query(1000)
+	query(1001)
+
+	resetInterval()
+	if querycount != 2 || intervalcount != 0 || times.Count() != 0 || ttfbTimes.Count() != 0 {
+		t.Errorf("Expected only the lifetime query count to survive, got %d/%d/%d/%d",
+			querycount, intervalcount, times.Count(), ttfbTimes.Count())
+	}
+	if len(qbuf) != 1 || len(cbuf) != 1 {
+		t.Fatalf("Expected the query and client to be kept: %v %v", qbuf, cbuf)
+	}
+	for _, buf := range []map[string]*queryData{qbuf, cbuf} {
+		for key, c := range buf {
+			if c.count != 0 || c.bytes != 0 || c.times.Count() != 0 || c.ttfb.Count() != 0 {
+				t.Errorf("Expected %s's interval counters to be reset: %+v", key, c)
+			}
+			if c.total != 2 {
+				t.Errorf("Expected %s's total to be kept: %+v", key, c)
+			}
+		}
+	}
+
+	// The next interval counts from zero, and the totals from where they were.
+	query(1002)
+	rows := buildReport(10, 10, "count", 0)
+	if len(rows) != 1 || rows[0].count != 1 || querycount != 3 || intervalcount != 1 {
+		t.Errorf("Expected one query this interval and three in all: %+v (%d/%d)",
+			rows, querycount, intervalcount)
+	}
+	for _, c := range qbuf {
+		if c.count != 1 || c.total != 3 || c.times.Count() != 1 {
+			t.Errorf("Expected 1 of 3 queries this interval: %+v", c)
+		}
+	}
+	resetAll()
+}
+
+func TestUserStats(t *testing.T) {
+	parseFormat("#q")
+	qbuf, ubuf = make(map[string]*queryData), make(map[string]*queryData)
+	userStats = true
+	defer func() { userStats = false }()
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	fail := mysqlPacket(1, "\xff\x7a\x04#42000Syntax error")
+	app := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", user: "app", synced: true}
+	etl := &source{src: "10.0.0.2:1234", srcip: "10.0.0.2", user: "etl", synced: true}
+	old := &source{src: "10.0.0.3:1234", srcip: "10.0.0.3", synced: true}
+	for i, rs := range []*source{app, etl, app, old, app, etl} {
+		resp := ok
+		if rs == etl {
+			resp = fail
+		}
+		processPacket(rs, true, []byte(mysqlPacket(0, "\x03select 1")), time.Unix(1000, 0))
+		processPacket(rs, false, []byte(resp), time.Unix(1000, int64(i+1)*1000000))
+	}
+	rows := buildUserReport(10, 10, "count")
+	if len(rows) != 3 || rows[0].query != "app" || rows[0].count != 3 || rows[1].query != "etl" ||
+		rows[1].errors != 2 || rows[2].query != "(unknown)" {
+		t.Fatalf("Unexpected user report: %+v", rows)
+	}
+	if cell := userStatColumns[len(userStatColumns)-2].cell; cell(&rows[1]) != "100.0" || cell(&rows[0]) != "0.0" {
+		t.Errorf("Unexpected error rates: %s and %s", cell(&rows[1]), cell(&rows[0]))
+	}
+}
+
+func TestDatabaseStats(t *testing.T) {
+	parseFormat("#q")
+	qbuf, dbuf = make(map[string]*queryData), make(map[string]*queryData)
+	databaseStats = true
+	defer func() { databaseStats = false }()
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	rs := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", schema: "shop", synced: true}
+	for i, q := range []string{"\x03select 1", "\x03update t set a=1", "\x03select 2", "\x0e", "\x02crm",
+		"\x03insert into t values (1)", "\x03set names utf8"} {
+		processPacket(rs, true, []byte(mysqlPacket(0, q)), time.Unix(1000, 0))
+		processPacket(rs, false, []byte(ok), time.Unix(1000, int64(i+1)*1000000))
+	}
+	// The USE itself counts against the database it switches to.
+	rows := buildDatabaseReport(10, 10, "count")
+	if len(rows) != 2 || rows[0].query != "shop" || rows[0].count != 4 || rows[1].count != 3 || rows[1].query != "crm" {
+		t.Fatalf("Unexpected database report: %+v", rows)
+	}
+	if rows[0].reads != 2 || rows[0].writes != 1 || rows[1].reads != 0 || rows[1].writes != 1 {
+		t.Errorf("Unexpected read/write mix: %+v", rows)
+	}
+	reads := databaseStatColumns[len(databaseStatColumns)-3].cell
+	if got := reads(&rows[0]); got != "50.0" {
+		t.Errorf("Expected 50.0%% reads for shop, got %s", got)
+	}
+
+	resetInterval()
+	if c := dbuf["shop"]; c.count != 0 || c.reads != 0 || c.writes != 0 {
+		t.Errorf("Expected the mix to be reset: %+v", c)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	save := func(name string, rows []reportRow) *savedReport {
+		path := filepath.Join(dir, name)
+		out := &reportFile{path: path}
+		out.Write(rows, 10)
+		out.Close()
+		report, err := loadReport(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	row := func(q string, count uint64, avg float64) reportRow {
+		return reportRow{query: q, id: queryID(q), count: count, avg: avg}
+	}
+	before := save("before.json", []reportRow{row("select a", 100, 1), row("select b", 200, 2),
+		row("select gone", 50, 1), row("select rare", 2, 1)})
+	after := save("after.json", []reportRow{row("select a", 400, 1.1), row("select b", 210, 9),
+		row("select new", 30, 5), row("select rare", 200, 50)})
+	if len(before.Queries) != 4 || before.Queries[1].QPS != 20 || before.Seconds != 10 {
+		t.Fatalf("Unexpected saved report: %+v", before)
+	}
+	if _, err := reportFor(filepath.Join(dir, "missing.json"), nil); err == nil {
+		t.Errorf("Expected an error for a missing report")
+	}
+	if report, err := reportFor(filepath.Join(dir, "before.json"), nil); err != nil || len(report.Queries) != 4 {
+		t.Errorf("Expected reportFor to load a saved report, got %v", err)
+	}
+	if report, _ := isReportFile(filepath.Join("testdata", "replay.pcapng")); report {
+		t.Errorf("A capture isn't a saved report")
+	}
+
+	var out strings.Builder
+	log.SetOutput(&out)
+	printDiff(before, after, 15, 10)
+	log.SetOutput(os.Stderr)
+	text := out.String()
+	for _, want := range []string{
+		"1 new queries\n", "1 queries gone\n",
+		"Biggest changes in rate\n  qps before    qps after     change  query\n" +
+			"       10.00        40.00    +300.0%  select a\n       20.00        21.00      +5.0%  select b\n",
+		"Biggest changes in latency\n", "        2.00         9.00    +350.0%",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in the diff:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "rare") {
+		t.Errorf("Expected queries under -min-count to be left out:\n%s", text)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	alertFactor, alertMinCount = 3, 10
+	baselines = make(map[string]*alertBaseline)
+	qbuf = map[string]*queryData{"select ?": {}, "select new": {}}
+	defer func() { alertFactor, baselines, baselineKnown = 0, make(map[string]*alertBaseline), nil }()
+	report := func(q string, qps, p95 float64) reportRow {
+		rows := []reportRow{{query: q, id: queryID(q), count: 100, qps: qps, p95: p95}}
+		checkAlerts(rows)
+		return rows[0]
+	}
+	for i := 0; i < ALERT_WARMUP; i++ {
+		report("select ?", 10, 1)
+	}
+	path := filepath.Join(t.TempDir(), "baselines.json")
+	(&baselineFile{path: path}).Write(nil, 10)
+
+	// A new run picks up where that left off, and knows what's new.
+	baselines = make(map[string]*alertBaseline)
+	loadBaselines(path)
+	if b := baselines["select ?"]; b == nil || b.qps != 10 || b.reports != ALERT_WARMUP {
+		t.Fatalf("Baseline wasn't loaded: %+v", b)
+	}
+	r := report("select ?", 40, 1)
+	if r.isNew || r.score != 4 || !strings.Contains(r.alert, "qps 40.00/s is 4.0x") {
+		t.Errorf("Expected to be judged against the saved baseline from the start: %+v", r)
+	}
+	n := report("select new", 5, 1)
+	if !n.isNew || n.score != 0 || !strings.Contains(n.alert, "new query") {
+		t.Errorf("Expected a new query: %+v", n)
+	}
+	for i := 1; i < ALERT_WARMUP; i++ {
+		report("select new", 5, 1)
+	}
+	if n = report("select new", 5, 1); n.isNew || n.alert != "" {
+		t.Errorf("Expected the new query to have settled in: %+v", n)
+	}
+
+	var out strings.Builder
+	log.SetOutput(&out)
+	printAnomalies([]reportRow{{query: "select ?", count: 100, score: 4, qps: 40, p95: 1},
+		{query: "select fine", count: 100, score: 1.1}, {query: "select new", count: 100, isNew: true}}, 15)
+	log.SetOutput(os.Stderr)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || lines[0] != "2 new queries or over their baselines" ||
+		!strings.HasSuffix(lines[2], "select new") || !strings.HasPrefix(lines[3], "    4.0x      40.00") {
+		t.Errorf("Unexpected anomalies: %q", out.String())
+	}
+
+	// No file yet is no baselines yet.
+	loadBaselines(filepath.Join(t.TempDir(), "missing.json"))
+	if baselineKnown == nil || len(baselineKnown) != 0 {
+		t.Errorf("Expected an empty baseline for a missing file")
+	}
+}
+
+type fakeReplayConn struct {
+	mu    *sync.Mutex
+	ran   map[int][]string // by connection
+	conn  int
+	fails bool
+}
+
+func (self *fakeReplayConn) Exec(schema, query string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.ran[self.conn] = append(self.ran[self.conn], schema+" "+query)
+	if self.fails {
+		return errors.New("nope")
+	}
+	return nil
+}
+
+func (self *fakeReplayConn) Close() {}
+
+func TestReplayMode(t *testing.T) {
+	port = 3306
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	events := captureEvents(filepath.Join("testdata", "replay.pcapng"), "")
+	if onQuery != nil {
+		t.Errorf("Expected the query hook to be put back")
+	}
+	conns := make(map[int]bool)
+	for i, ev := range events {
+		if i > 0 && ev.at < events[i-1].at {
+			t.Fatalf("Events out of order at %d", i)
+		}
+		conns[ev.conn] = true
+	}
+	if len(events) == 0 || len(conns) != 24 || events[0].at != 0 {
+		t.Fatalf("Expected queries from 24 connections, got %d from %d", len(events), len(conns))
+	}
+
+	// Each connection's queries in order, on a connection of its own.
+	var mu sync.Mutex
+	ran := make(map[int][]string)
+	opened := 0
+	open := func() (replayConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		opened++
+		return &fakeReplayConn{mu: &mu, ran: ran, conn: opened}, nil
+	}
+	events = []replayEvent{{0, 0, "shop", "select 1"}, {time.Millisecond, 1, "", "select 2"},
+		{20 * time.Millisecond, 0, "crm", "select 3"}}
+	started := time.Now()
+	stats := replay(events, 1, open)
+	if time.Since(started) < 20*time.Millisecond {
+		t.Errorf("Expected the capture's pacing to be kept")
+	}
+	if stats.queries != 3 || stats.errors != 0 || stats.times.Count() != 3 {
+		t.Errorf("Unexpected replay: %+v", stats)
+	}
+	var together bool
+	for _, queries := range ran {
+		together = together || strings.Join(queries, ", ") == "shop select 1, crm select 3"
+	}
+	if len(ran) != 2 || !together {
+		t.Errorf("Expected the first connection's queries on one of their own, in order: %v", ran)
+	}
+
+	failing := func() (replayConn, error) {
+		return &fakeReplayConn{mu: &mu, ran: make(map[int][]string), fails: true}, nil
+	}
+	if stats = replay(events, 0, failing); stats.errors != 3 || stats.firstError != "nope" {
+		t.Errorf("Expected every query to fail: %+v", stats)
+	}
+	broken := func() (replayConn, error) { return nil, errors.New("refused") }
+	if stats = replay(events, 0, broken); stats.errors != 3 || stats.queries != 0 || stats.firstError != "refused" {
+		t.Errorf("Expected the queries on connections that couldn't open to count as errors: %+v", stats)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.bin")
+	recorder = openRecorder(path)
+	defer func() { recorder = nil }()
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	a := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", user: "app", schema: "shop", synced: true}
+	b := &source{src: "10.0.0.2:1234", srcip: "10.0.0.2", synced: true}
+	base := time.Unix(1000, 0)
+	for i, step := range []struct {
+		rs *source
+		q  string
+		at time.Duration
+	}{
+		{a, "\x03select 1", 0}, {b, "\x03select 2", 5 * time.Millisecond}, {a, "\x02crm", 6 * time.Millisecond},
+		{a, "\x03select 3", 7 * time.Millisecond}, {b, "\x0e", 8 * time.Millisecond},
+		{a, "\x03select 4", 3 * time.Millisecond}, // from another worker, a bit late
+	} {
+		processPacket(step.rs, true, []byte(mysqlPacket(0, step.q)), base.Add(step.at))
+		processPacket(step.rs, false, []byte(ok), base.Add(step.at+time.Duration(i+1)*time.Microsecond))
+	}
+	recorder.Write(nil, 10)
+	if !isEventFile(path) {
+		t.Fatalf("Expected a -record file after a report")
+	}
+	killed := filepath.Join(t.TempDir(), "killed.bin")
+	data, _ := os.ReadFile(path)
+	os.WriteFile(killed, data, 0644)
+	recorder.Close()
+
+	events, err := readEvents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ev := range events {
+		got = append(got, fmt.Sprintf("%s %d %s %s", ev.at, ev.conn, ev.schema, ev.query))
+	}
+	want := []string{"0s 1 shop select 1", "3ms 1 crm select 4", "5ms 2  select 2", "7ms 1 crm select 3"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("Unexpected events:\n%q\nexpected\n%q", got, want)
+	}
+	if isEventFile(filepath.Join("testdata", "replay.pcapng")) {
+		t.Errorf("A capture isn't a -record file")
+	}
+
+	// Killed before Close, we still have everything up to the last report.
+	if events, err = readEvents(killed); err != nil || len(events) != 4 {
+		t.Errorf("Expected 4 events from a file that was never closed, got %d and %v", len(events), err)
+	}
+}
+
+func TestExportSQL(t *testing.T) {
+	parseFormat("#q")
+	ok := mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	run := func(all bool) string {
+		path := filepath.Join(t.TempDir(), "sample.sql")
+		exporter = openExporter(path, all)
+		defer func() { exporter = nil }()
+		qbuf = make(map[string]*queryData)
+		a := &source{src: "10.0.0.1:1234", srcip: "10.0.0.1", schema: "shop", synced: true}
+		b := &source{src: "10.0.0.2:1234", srcip: "10.0.0.2", synced: true}
+		ts := time.Unix(1000, 0)
+		for _, step := range []struct {
+			rs *source
+			q  string
+		}{
+			{a, "\x03SELECT * FROM t WHERE id = 1"}, {a, "\x03SELECT * FROM t WHERE id = 2;"},
+			{b, "\x03select now()"}, {a, "\x02my`db"}, {a, "\x03SELECT * FROM t WHERE id = 3"},
+			{a, "\x16SELECT ?"}, {b, "\x03 ; "},
+			{a, "\x03SELECT 1 -- from the orm"}, {a, "\x03select 2 # it's"}, {a, "\x03select '-- not a comment'"},
+			{a, "\x03CREATE PROCEDURE p() BEGIN SELECT 1; SELECT ';;'; END;"},
+		} {
+			ts = ts.Add(time.Millisecond)
+			processPacket(step.rs, true, []byte(mysqlPacket(0, step.q)), ts)
+			processPacket(step.rs, false, []byte(ok), ts.Add(time.Microsecond))
+		}
+		exporter.Close()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// The ; can't go after a comment, and a body with its own ;s (and ;;s)
+	// needs another DELIMITER.
+	tail := "SELECT 1 -- from the orm\n;\nselect 2 # it's\n;\nselect '-- not a comment';\n" +
+		"DELIMITER $$\nCREATE PROCEDURE p() BEGIN SELECT 1; SELECT ';;'; END\n$$\nDELIMITER ;\n"
+	want := "USE `shop`;\nSELECT * FROM t WHERE id = 1;\nselect now();\nUSE `my``db`;\nSELECT * FROM t WHERE id = 3;\n" + tail
+	if got := run(false); got != want {
+		t.Errorf("Unexpected distinct export:\n%s\nexpected\n%s", got, want)
+	}
+	want = "USE `shop`;\nSELECT * FROM t WHERE id = 1;\nSELECT * FROM t WHERE id = 2;\nselect now();\n" +
+		"USE `my``db`;\nSELECT * FROM t WHERE id = 3;\n" + tail
+	if got := run(true); got != want {
+		t.Errorf("Unexpected export of everything:\n%s\nexpected\n%s", got, want)
+	}
+}
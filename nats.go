@@ -0,0 +1,312 @@
+/*
+ * nats.go
+ *
+ * Publishes every query we time to NATS as a JSON message (the same document
+ * -elastic indexes), so anything that wants a live feed can just subscribe.
+ * The protocol is simple text, so we speak it ourselves rather than pull in
+ * a client library.
+ *
+ * With -nats-jetstream every message asks for an ack, which is how we find
+ * out there's no stream on the subject or it's refusing messages. Without
+ * it, it's fire and forget.
+ *
+ * Like -elastic, messages go out from a goroutine and get dropped rather than
+ * hold up the capture when the server can't keep up. No TLS, so point it at
+ * a server (or leaf node) that doesn't insist on it.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NATS_PORT    = "4222"
+	NATS_TIMEOUT = 5 * time.Second
+	NATS_BATCH   = 256                    // messages per write
+	NATS_LINGER  = 100 * time.Millisecond // how long a message waits for the rest of its batch
+	NATS_QUEUE   = 64                     // batches waiting to be sent
+)
+
+type natsSink struct {
+	addr      string
+	subject   string
+	jetstream bool
+	hello     []byte // CONNECT, and SUB for the acks
+	inbox     string // where JetStream acks come back
+	batch     bytes.Buffer
+	count     int
+	first     time.Time // when the oldest message in the batch came in
+	queue     chan []byte
+	done      chan bool
+	pongs     chan bool
+	dropped   int
+
+	// Shared with the reader goroutine.
+	mu      sync.Mutex
+	conn    net.Conn
+	refused int
+	lastErr string
+}
+
+var nats *natsSink
+
+func openNats(addr, subject string, jetstream bool) *natsSink {
+	if !strings.Contains(addr, "://") {
+		addr = "nats://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "nats" || u.Host == "" {
+		fatalf("Bad -nats URL %s: expected nats://[user:pass@]host[:port]", addr)
+	}
+	if strings.ContainsAny(subject, " \t\r\n") || subject == "" {
+		fatalf("Bad -nats-subject %q", subject)
+	}
+
+	opts := map[string]interface{}{
+		"verbose": false, "pedantic": false, "name": "mysql-sniffer", "lang": "go",
+		"version": "1.0", "protocol": 1, "headers": true, "no_responders": true,
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts["user"], opts["pass"] = u.User.Username(), pass
+		} else {
+			opts["auth_token"] = u.User.Username()
+		}
+	}
+	connect, _ := json.Marshal(opts)
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	self := &natsSink{
+		addr:      u.Host,
+		subject:   subject,
+		jetstream: jetstream,
+		inbox:     "_INBOX." + hex.EncodeToString(id),
+		queue:     make(chan []byte, NATS_QUEUE),
+		done:      make(chan bool),
+		pongs:     make(chan bool, 1),
+	}
+	if u.Port() == "" {
+		self.addr = net.JoinHostPort(u.Hostname(), NATS_PORT)
+	}
+	self.hello = []byte("CONNECT " + string(connect) + "\r\n")
+	if jetstream {
+		self.hello = append(self.hello, "SUB "+self.inbox+" 1\r\n"...)
+	}
+
+	go self.sender()
+	return self
+}
+
+// Event publishes one completed query.
+func (self *natsSink) Event(rs *source, req *pendingRequest, reqtime uint64) {
+	if req.qdata == nil {
+		return
+	}
+	msg, _ := json.Marshal(queryEvent(rs, req, reqtime))
+	if self.jetstream {
+		fmt.Fprintf(&self.batch, "PUB %s %s %d\r\n", self.subject, self.inbox, len(msg))
+	} else {
+		fmt.Fprintf(&self.batch, "PUB %s %d\r\n", self.subject, len(msg))
+	}
+	self.batch.Write(msg)
+	self.batch.WriteString("\r\n")
+
+	if self.count == 0 {
+		self.first = time.Now()
+	}
+	self.count++
+	if self.count >= NATS_BATCH || time.Since(self.first) >= NATS_LINGER {
+		self.flush()
+	}
+}
+
+// flush hands the current batch to the sender.
+func (self *natsSink) flush() {
+	if self.count == 0 {
+		return
+	}
+	body := make([]byte, self.batch.Len())
+	copy(body, self.batch.Bytes())
+	self.batch.Reset()
+	select {
+	case self.queue <- body:
+	default:
+		self.dropped += self.count
+	}
+	self.count = 0
+}
+
+func (self *natsSink) sender() {
+	for body := range self.queue {
+		if err := self.send(body); err != nil {
+			logger.Warn("Failed to publish to NATS", "addr", self.addr, "err", err)
+		}
+	}
+
+	// Make sure the server has everything (and we've read the acks) before
+	// hanging up.
+	self.mu.Lock()
+	connected := self.conn != nil
+	self.mu.Unlock()
+	if connected && self.send([]byte("PING\r\n")) == nil {
+		select {
+		case <-self.pongs:
+		case <-time.After(NATS_TIMEOUT):
+		}
+	}
+	self.mu.Lock()
+	if self.conn != nil {
+		self.conn.Close()
+	}
+	self.mu.Unlock()
+	close(self.done)
+}
+
+// send writes to the server, connecting first if we need to. The batch is
+// lost if it fails, and we'll connect again next time.
+func (self *natsSink) send(body []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.conn == nil {
+		if err := self.dial(); err != nil {
+			return err
+		}
+	}
+	self.conn.SetWriteDeadline(time.Now().Add(NATS_TIMEOUT))
+	if _, err := self.conn.Write(body); err != nil {
+		self.conn.Close()
+		self.conn = nil
+		return err
+	}
+	return nil
+}
+
+// dial connects and says hello. Called with mu held.
+func (self *natsSink) dial() error {
+	conn, err := net.DialTimeout("tcp", self.addr, NATS_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(NATS_TIMEOUT))
+	info, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(info))
+	}
+	if strings.Contains(info, `"tls_required":true`) {
+		conn.Close()
+		return fmt.Errorf("server requires TLS")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	conn.SetWriteDeadline(time.Now().Add(NATS_TIMEOUT))
+	if _, err := conn.Write(self.hello); err != nil {
+		conn.Close()
+		return err
+	}
+	self.conn = conn
+	go self.reader(conn, r)
+	return nil
+}
+
+// reader handles what the server sends us: pings, errors and acks.
+func (self *natsSink) reader(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "PING":
+			self.mu.Lock()
+			conn.Write([]byte("PONG\r\n"))
+			self.mu.Unlock()
+		case "PONG":
+			select {
+			case self.pongs <- true:
+			default:
+			}
+		case "-ERR":
+			self.refuse(strings.Trim(strings.TrimSpace(line[4:]), "'"))
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply-to] <bytes>, and HMSG has the
+			// header length before the total.
+			n, _ := strconv.Atoi(f[len(f)-1])
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			payload = payload[:n]
+			if f[0] == "HMSG" {
+				// Only a status comes back this way, like 503 when
+				// nothing is listening on the subject.
+				if status := strings.Fields(string(payload)); len(status) > 1 && status[1] != "200" {
+					self.refuse(strings.Join(status[1:], " "))
+				}
+				continue
+			}
+			var ack struct {
+				Error *struct {
+					Description string `json:"description"`
+				} `json:"error"`
+			}
+			if json.Unmarshal(payload, &ack) == nil && ack.Error != nil {
+				self.refuse(ack.Error.Description)
+			}
+		}
+	}
+}
+
+func (self *natsSink) refuse(why string) {
+	self.mu.Lock()
+	self.refused++
+	self.lastErr = why
+	self.mu.Unlock()
+}
+
+// Write sends whatever's built up at every status report, and owns up to
+// anything that went wrong since the last one.
+func (self *natsSink) Write(rows []reportRow, elapsed float64) {
+	self.flush()
+	if self.dropped > 0 {
+		logger.Warn("Dropped NATS messages, the server isn't keeping up", "messages", self.dropped)
+		self.dropped = 0
+	}
+	self.mu.Lock()
+	if self.refused > 0 {
+		logger.Warn("NATS refused messages", "messages", self.refused, "last_error", self.lastErr)
+		self.refused = 0
+	}
+	self.mu.Unlock()
+}
+
+// Close sends anything left and waits for it to go out.
+func (self *natsSink) Close() {
+	self.flush()
+	close(self.queue)
+	<-self.done
+}
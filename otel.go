@@ -0,0 +1,262 @@
+/*
+ * otel.go
+ *
+ * Exports to an OpenTelemetry collector using OTLP/HTTP with JSON bodies, so
+ * we don't need to drag in the whole OTel SDK (and protobufs) for two POSTs.
+ *
+ * Every status report becomes a set of histogram metrics: one for all
+ * queries plus one per query, with delta temporality unless we're running
+ * -cumulative. With -otlp-spans every query we time also becomes a client
+ * span, batched up and sent along with the report.
+ *
+ * Like -elastic, the requests are sent from a goroutine so a slow or absent
+ * collector can't hold up the capture. If it falls OTEL_QUEUE requests
+ * behind, the rest are dropped and we say so.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OTEL_TIMEOUT   = 5 * time.Second
+	OTEL_MAX_SPANS = 8192 // per report, past this we drop them
+	OTEL_QUEUE     = 16   // requests waiting to be sent
+
+	OTEL_TEMPORALITY_DELTA      = 1
+	OTEL_TEMPORALITY_CUMULATIVE = 2
+	OTEL_SPAN_KIND_CLIENT       = 3
+)
+
+// Histogram bucket boundaries we export, in milliseconds.
+var otelBounds = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type otelSink struct {
+	endpoint string
+	spans    bool
+	client   *http.Client
+	resource map[string]interface{}
+	batch    []map[string]interface{}
+	dropped  int // spans over OTEL_MAX_SPANS
+	queue    chan otelRequest
+	done     chan bool
+	unsent   int // requests the sender was too far behind for
+}
+
+type otelRequest struct {
+	path string
+	body []byte
+}
+
+var otel *otelSink
+
+func openOtel(endpoint string, spans bool) *otelSink {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		fatalf("Bad -otlp endpoint %s: expected an http(s) URL", endpoint)
+	}
+	self := &otelSink{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		spans:    spans,
+		client:   &http.Client{Timeout: OTEL_TIMEOUT},
+		resource: map[string]interface{}{
+			"attributes": []interface{}{otelAttr("service.name", "mysql-sniffer")},
+		},
+		queue: make(chan otelRequest, OTEL_QUEUE),
+		done:  make(chan bool),
+	}
+	go self.sender()
+	return self
+}
+
+// otelAttr builds an OTLP KeyValue. JSON encoded OTLP wants 64 bit integers
+// as strings.
+func otelAttr(key string, value interface{}) map[string]interface{} {
+	var v map[string]interface{}
+	switch value.(type) {
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value.(int))}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return map[string]interface{}{"key": key, "value": v}
+}
+
+func otelTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otelBuckets folds our histogram into the coarser exported buckets.
+func otelBuckets(h *histogram) []string {
+	counts := make([]uint64, len(otelBounds)+1)
+	h.each(func(i int, c uint64) {
+		lo, hi := histRange(i)
+		ms := float64(lo+(hi-lo)/2) / 1000000
+		j := 0
+		for j < len(otelBounds) && ms > otelBounds[j] {
+			j++
+		}
+		counts[j] += c
+	})
+	out := make([]string, len(counts))
+	for i, c := range counts {
+		out[i] = strconv.FormatUint(c, 10)
+	}
+	return out
+}
+
+func otelDataPoint(h *histogram, from, to time.Time, attrs []interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"attributes":        attrs,
+		"startTimeUnixNano": otelTime(from),
+		"timeUnixNano":      otelTime(to),
+		"count":             strconv.FormatUint(h.Count(), 10),
+		"sum":               float64(h.sum) / 1000000,
+		"min":               float64(h.Min()) / 1000000,
+		"max":               float64(h.Max()) / 1000000,
+		"bucketCounts":      otelBuckets(h),
+		"explicitBounds":    otelBounds,
+	}
+}
+
+// Span records one timed query, if we're doing spans.
+func (self *otelSink) Span(rs *source, req *pendingRequest, end time.Time) {
+	if !self.spans || req.qdata == nil {
+		return
+	}
+	if len(self.batch) >= OTEL_MAX_SPANS {
+		self.dropped++
+		return
+	}
+
+	id := make([]byte, 24)
+	rand.Read(id)
+	name := "mysql"
+	if fields := strings.Fields(req.query); len(fields) > 0 {
+		name = strings.ToUpper(fields[0])
+	}
+	host, pnum := splitClient(rs.sender(req))
+
+	self.batch = append(self.batch, map[string]interface{}{
+		"traceId":           hex.EncodeToString(id[:16]),
+		"spanId":            hex.EncodeToString(id[16:]),
+		"name":              name,
+		"kind":              OTEL_SPAN_KIND_CLIENT,
+		"startTimeUnixNano": otelTime(req.sent),
+		"endTimeUnixNano":   otelTime(end),
+		"attributes": []interface{}{
+			otelAttr("db.system", "mysql"),
+			otelAttr("db.statement", req.query),
+			otelAttr("db.mysql.command", req.ptype),
+			otelAttr("client.address", host),
+			otelAttr("client.port", pnum),
+			otelAttr("server.port", int(port)),
+		},
+	})
+}
+
+func (self *otelSink) Write(rows []reportRow, elapsed float64) {
+	if self.unsent > 0 {
+		logger.Warn("Dropped exports, the collector isn't keeping up", "url", self.endpoint, "requests", self.unsent)
+		self.unsent = 0
+	}
+
+	now := time.Now()
+	from := time.Unix(intervalStart, 0)
+	temporality := OTEL_TEMPORALITY_DELTA
+	if cumulative {
+		from = time.Unix(start, 0)
+		temporality = OTEL_TEMPORALITY_CUMULATIVE
+	}
+
+	points := []interface{}{otelDataPoint(&times, from, now, []interface{}{})}
+	for _, r := range rows {
+		if c, ok := qbuf[r.query]; ok {
+			points = append(points, otelDataPoint(&c.times, from, now, []interface{}{
+				otelAttr("db.system", "mysql"),
+				otelAttr("db.query.fingerprint", r.query),
+				otelAttr("db.query.id", r.id),
+			}))
+		}
+	}
+	self.post("/v1/metrics", map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": self.resource,
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "mysql-sniffer"},
+				"metrics": []interface{}{map[string]interface{}{
+					"name":        "mysql.query.duration",
+					"description": "Time from a request to the end of its response",
+					"unit":        "ms",
+					"histogram": map[string]interface{}{
+						"aggregationTemporality": temporality,
+						"dataPoints":             points,
+					},
+				}},
+			}},
+		}},
+	})
+
+	if len(self.batch) == 0 {
+		return
+	}
+	if self.dropped > 0 {
+		logger.Warn("Dropped spans over the limit per report", "spans", self.dropped, "limit", OTEL_MAX_SPANS)
+	}
+	self.post("/v1/traces", map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": self.resource,
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "mysql-sniffer"},
+				"spans": self.batch,
+			}},
+		}},
+	})
+	self.batch, self.dropped = nil, 0
+}
+
+// post hands one export request to the sender, or drops it if it's too
+// far behind.
+func (self *otelSink) post(path string, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		fatalf("Failed to encode OTLP request: %s", err.Error())
+	}
+	select {
+	case self.queue <- otelRequest{path, data}:
+	default:
+		self.unsent++
+	}
+}
+
+// sender makes the requests. Failures are logged and the data dropped; the
+// collector being down shouldn't take us with it.
+func (self *otelSink) sender() {
+	for req := range self.queue {
+		resp, err := self.client.Post(self.endpoint+req.path, "application/json", bytes.NewReader(req.body))
+		if err != nil {
+			logger.Warn("Failed to export", "url", self.endpoint+req.path, "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			logger.Warn("Failed to export", "url", self.endpoint+req.path, "status", resp.Status)
+		}
+	}
+	close(self.done)
+}
+
+// Close waits for anything queued to go out.
+func (self *otelSink) Close() {
+	close(self.queue)
+	<-self.done
+}
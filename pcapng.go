@@ -0,0 +1,243 @@
+/*
+ * pcapng.go
+ *
+ * A reader for pcapng files, which is what Wireshark and dumpcap write by
+ * default. libpcap can read simple ones, but gives up on files that mix link
+ * types across interfaces and mangles non-microsecond timestamps, so we walk
+ * the blocks ourselves.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/akrennmair/gopcap"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	PCAPNG_SHB        = 0x0A0D0D0A // section header
+	PCAPNG_IDB        = 0x00000001 // interface description
+	PCAPNG_OPB        = 0x00000002 // obsolete packet block
+	PCAPNG_SPB        = 0x00000003 // simple packet block
+	PCAPNG_EPB        = 0x00000006 // enhanced packet block
+	PCAPNG_BYTEORDER  = 0x1A2B3C4D
+	PCAPNG_IF_TSRESOL = 9
+	PCAPNG_MAX_BLOCK  = 16 << 20
+)
+
+type pcapngInterface struct {
+	linktype int
+	snaplen  uint32
+	units    uint64 // timestamp ticks per second
+}
+
+type pcapngSource struct {
+	file   *os.File
+	r      *bufio.Reader
+	order  binary.ByteOrder
+	ifaces []pcapngInterface
+	err    error
+}
+
+func openPcapng(path string) (*pcapngSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapngSource{file: f, r: bufio.NewReaderSize(f, 1<<20)}, nil
+}
+
+// NextEx returns our packets in file order, with a result of 1 like pcap. At
+// the end of the file (or on a broken one) it returns nil and -2.
+func (self *pcapngSource) NextEx() (*pcap.Packet, int32) {
+	for self.err == nil {
+		btype, body, err := self.readBlock()
+		if err != nil {
+			if err != io.EOF {
+				logger.Warn("Stopped reading pcapng file", "err", err)
+			}
+			self.err = err
+			break
+		}
+
+		var pkt *pcap.Packet
+		switch btype {
+		case PCAPNG_SHB:
+			// A new section starts from scratch, interfaces included.
+			self.ifaces = nil
+		case PCAPNG_IDB:
+			if err = self.addInterface(body); err != nil {
+				logger.Warn("Stopped reading pcapng file", "err", err)
+				self.err = err
+			}
+		case PCAPNG_EPB, PCAPNG_OPB:
+			pkt = self.parsePacket(btype, body)
+		case PCAPNG_SPB:
+			pkt = self.parseSimplePacket(body)
+		}
+		// There's no BPF filter on this path, so do its job here.
+		if pkt != nil && matchesPort(pkt.Type, pkt.Data) {
+			return pkt, 1
+		}
+	}
+	return nil, -2
+}
+
+// readBlock reads one block and returns its type and body (without the
+// leading type/length and trailing length).
+func (self *pcapngSource) readBlock() (uint32, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(self.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated block header")
+		}
+		return 0, nil, err
+	}
+
+	// The section header type reads the same either way round; its byte
+	// order magic tells us how to read everything else in the section.
+	if binary.LittleEndian.Uint32(hdr[0:4]) == PCAPNG_SHB {
+		magic, err := self.r.Peek(4)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == PCAPNG_BYTEORDER:
+			self.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == PCAPNG_BYTEORDER:
+			self.order = binary.BigEndian
+		default:
+			return 0, nil, errors.New("bad section byte order magic")
+		}
+	} else if self.order == nil {
+		return 0, nil, errors.New("not a pcapng file")
+	}
+
+	btype := self.order.Uint32(hdr[0:4])
+	blen := self.order.Uint32(hdr[4:8])
+	if blen < 12 || blen%4 != 0 || blen > PCAPNG_MAX_BLOCK {
+		return 0, nil, fmt.Errorf("bad block length %d", blen)
+	}
+
+	buf := make([]byte, blen-8)
+	if _, err := io.ReadFull(self.r, buf); err != nil {
+		return 0, nil, errors.New("truncated block")
+	}
+	return btype, buf[:len(buf)-4], nil
+}
+
+func (self *pcapngSource) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return errors.New("truncated interface description block")
+	}
+	ifc := pcapngInterface{
+		linktype: int(self.order.Uint16(body[0:2])),
+		snaplen:  self.order.Uint32(body[4:8]),
+		units:    1000000,
+	}
+
+	// Options are (code, length, value padded to 4 bytes) until opt_endofopt.
+	for opts := body[8:]; len(opts) >= 4; {
+		code := self.order.Uint16(opts[0:2])
+		olen := int(self.order.Uint16(opts[2:4]))
+		if code == 0 {
+			break
+		}
+		if 4+(olen+3)&^3 > len(opts) {
+			return fmt.Errorf("interface description option %d runs past the end of its block", code)
+		}
+		if code == PCAPNG_IF_TSRESOL && olen >= 1 {
+			// Units of 2^-n or 10^-n seconds, and n has to fit in a uint64.
+			res, base, most := int(opts[4]&0x7F), uint64(10), 19
+			if opts[4]&0x80 != 0 {
+				base, most = 2, 63
+			}
+			if res > most {
+				return fmt.Errorf("interface timestamp resolution %d^-%d is too fine", base, res)
+			}
+			ifc.units = 1
+			for i := 0; i < res; i++ {
+				ifc.units *= base
+			}
+		}
+		opts = opts[4+(olen+3)&^3:]
+	}
+	self.ifaces = append(self.ifaces, ifc)
+	return nil
+}
+
+func (self *pcapngSource) parsePacket(btype uint32, body []byte) *pcap.Packet {
+	if len(body) < 20 {
+		return nil
+	}
+
+	var ifid uint32
+	if btype == PCAPNG_OPB {
+		ifid = uint32(self.order.Uint16(body[0:2]))
+	} else {
+		ifid = self.order.Uint32(body[0:4])
+	}
+	if int(ifid) >= len(self.ifaces) {
+		return nil
+	}
+	ifc := self.ifaces[ifid]
+
+	ts := uint64(self.order.Uint32(body[4:8]))<<32 | uint64(self.order.Uint32(body[8:12]))
+	caplen := self.order.Uint32(body[12:16])
+	wirelen := self.order.Uint32(body[16:20])
+	if uint32(len(body)-20) < caplen {
+		return nil
+	}
+	return ifc.packet(ts, caplen, wirelen, body[20:20+caplen])
+}
+
+// Simple packet blocks always belong to the first interface and carry no
+// timestamp at all.
+func (self *pcapngSource) parseSimplePacket(body []byte) *pcap.Packet {
+	if len(body) < 4 || len(self.ifaces) == 0 {
+		return nil
+	}
+	ifc := self.ifaces[0]
+	wirelen := self.order.Uint32(body[0:4])
+	caplen := wirelen
+	if ifc.snaplen != 0 && caplen > ifc.snaplen {
+		caplen = ifc.snaplen
+	}
+	if uint32(len(body)-4) < caplen {
+		caplen = uint32(len(body) - 4)
+	}
+	return ifc.packet(0, caplen, wirelen, body[4:4+caplen])
+}
+
+func (self *pcapngInterface) packet(ts uint64, caplen, wirelen uint32, data []byte) *pcap.Packet {
+	// Keep the multiplication from overflowing for silly resolutions.
+	sec, frac := ts/self.units, ts%self.units
+	var nsec uint64
+	if self.units <= 1000000000 {
+		nsec = frac * 1000000000 / self.units
+	} else {
+		nsec = frac / (self.units / 1000000000)
+	}
+
+	return &pcap.Packet{
+		Time:   time.Unix(int64(sec), int64(nsec)),
+		Caplen: caplen,
+		Len:    wirelen,
+		Data:   data,
+		Type:   self.linktype,
+	}
+}
+
+func (self *pcapngSource) Getstats() (*pcap.Stat, error) {
+	return nil, errors.New("not supported for files")
+}
+
+func (self *pcapngSource) Close() {
+	self.file.Close()
+}
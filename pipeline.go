@@ -0,0 +1,104 @@
+/*
+ * pipeline.go
+ *
+ * Capture runs on a goroutine of its own, handing packets to the main loop
+ * through a bounded queue, so a slow report or a burst of heavy queries
+ * doesn't stop us reading and have the kernel drop packets behind our back.
+ * If the queue fills up anyway, we drop the packet ourselves and count it,
+ * which is no worse than the kernel doing it and at least we know.
+ *
+ * Reading a file never drops anything: the reader just waits its turn.
+ *
+ * From there the main loop parses them itself, or with -workers hands them
+ * out to goroutines that do (see workers.go).
+ */
+
+package main
+
+import (
+	"github.com/akrennmair/gopcap"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CAPTURE_TICK = 100 * time.Millisecond // how often the main loop looks up when it's quiet
+	CAPTURE_WAIT = time.Second            // how long we'll wait for the reader to notice we're done
+)
+
+type packetQueue struct {
+	src     packetSource
+	block   bool // wait for room rather than drop
+	packets chan *pcap.Packet
+	quit    chan bool
+	done    chan bool
+	dropped uint64 // atomic
+}
+
+var queue *packetQueue
+
+// startCapture starts reading packets from src. The channel is closed when
+// the source runs out.
+func startCapture(src packetSource, size int, block bool) *packetQueue {
+	self := &packetQueue{
+		src:     src,
+		block:   block,
+		packets: make(chan *pcap.Packet, size),
+		quit:    make(chan bool),
+		done:    make(chan bool),
+	}
+	go self.reader()
+	return self
+}
+
+func (self *packetQueue) reader() {
+	defer close(self.done)
+	defer close(self.packets)
+	for {
+		pkt, rv := self.src.NextEx()
+		if rv < 0 {
+			return
+		}
+		select {
+		case <-self.quit:
+			return
+		default:
+		}
+		if pkt == nil {
+			continue
+		}
+		if self.block {
+			select {
+			case self.packets <- pkt:
+			case <-self.quit:
+				return
+			}
+			continue
+		}
+		select {
+		case self.packets <- pkt:
+		default:
+			atomic.AddUint64(&self.dropped, 1)
+		}
+	}
+}
+
+// Dropped is how many packets we've had no room for.
+func (self *packetQueue) Dropped() uint64 {
+	if self == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&self.dropped)
+}
+
+// stop asks the reader to finish, and says whether it did. If it's stuck
+// waiting on a quiet interface it isn't safe to close the capture under it.
+func (self *packetQueue) stop() bool {
+	close(self.quit)
+	select {
+	case <-self.done:
+		return true
+	case <-time.After(CAPTURE_WAIT):
+		return false
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * postgres.go
+ *
+ * -protocol postgres reads the PostgreSQL wire protocol instead, and hands
+ * what it finds to the same fingerprinting and counting as MySQL, dressed
+ * up as MySQL commands:
+ *
+ *     Query (simple protocol)      COM_QUERY, done at ReadyForQuery
+ *     Execute (extended protocol)  COM_STMT_EXECUTE with the text of the
+ *                                  statement it runs, done at its
+ *                                  CommandComplete (or error)
+ *     Sync                         PG_SYNC, not counted, done at
+ *                                  ReadyForQuery
+ *
+ * Parse and Bind only tell us which statement an Execute runs, so we keep
+ * track of each connection's statements and portals. After an error the
+ * server ignores everything up to the next Sync, so any Executes queued
+ * before it are never answered and we stop waiting on them.
+ *
+ * The user and database come from the startup message. As with MySQL,
+ * connections using SSL are a lost cause, and so are statements prepared
+ * before we started watching.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	PROTO_MYSQL = iota
+	PROTO_POSTGRES
+)
+
+const (
+	PG_PROTOCOL_3  = 196608
+	PG_MAX_MESSAGE = 1 << 30
+
+	// No MySQL client sends a COM_SLEEP, so it can stand in for a Sync.
+	PG_SYNC = 0
+)
+
+// Response parser states, carrying on from response.go's.
+const (
+	RESP_PG_READY    = RESP_ROWS + 1 + iota // waiting for ReadyForQuery
+	RESP_PG_COMPLETE                        // waiting for the end of an Execute
+)
+
+var protocol int = PROTO_MYSQL
+
+// What a connection has prepared, by name. "" is the unnamed one.
+type pgSession struct {
+	statements map[string]string
+	portals    map[string]string
+}
+
+// sqlCommand says whether a request is SQL text: COM_QUERY, and with
+// Postgres the statement behind an Execute.
+func sqlCommand(ptype int) bool {
+	return ptype == COM_QUERY || (protocol == PROTO_POSTGRES && ptype == COM_STMT_EXECUTE)
+}
+
+// processPgRequests carves the complete messages off a connection's request
+// buffer. It says whether it counted a query.
+func processPgRequests(rs *source, ts time.Time) (counted bool) {
+	for len(rs.reqbuffer) > 0 {
+		// Startup, SSL and cancel requests have no type, just a length, and
+		// lengths start with a 0 where types are letters.
+		buf := rs.reqbuffer
+		hdr := 5
+		if buf[0] == 0 {
+			hdr = 4
+		}
+		if len(buf) < hdr {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(buf[hdr-4 : hdr]))
+		if size < 4 || size > PG_MAX_MESSAGE || (hdr == 5 && !pgClientMessage(buf[0])) {
+			// Not a message; we're out of step.
+			rs.reset()
+			return
+		}
+		if maxRequestBuffer > 0 && size > maxRequestBuffer {
+			stateMu.Lock()
+			stats.overflows++
+			stateMu.Unlock()
+			rs.reset()
+			return
+		}
+		if len(buf) < hdr-4+size {
+			return
+		}
+		mtype, p := buf[0], buf[hdr:hdr-4+size]
+		rs.reqbuffer = buf[hdr-4+size:]
+
+		if hdr == 4 {
+			pgStartup(rs, p)
+			continue
+		}
+		if rs.pg == nil {
+			rs.pg = &pgSession{statements: make(map[string]string), portals: make(map[string]string)}
+		}
+		switch mtype {
+		case 'Q':
+			if processRequest(rs, COM_QUERY, bytes.TrimRight(p, "\x00"), ts) {
+				counted = true
+			}
+		case 'P':
+			name, rest := pgString(p)
+			query, _ := pgString(rest)
+			rs.pg.statements[name] = query
+		case 'B':
+			portal, rest := pgString(p)
+			name, _ := pgString(rest)
+			rs.pg.portals[portal] = rs.pg.statements[name]
+		case 'E':
+			portal, _ := pgString(p)
+			if processRequest(rs, COM_STMT_EXECUTE, []byte(rs.pg.portals[portal]), ts) {
+				counted = true
+			}
+		case 'C':
+			if len(p) > 0 {
+				name, _ := pgString(p[1:])
+				if p[0] == 'S' {
+					delete(rs.pg.statements, name)
+				} else {
+					delete(rs.pg.portals, name)
+				}
+			}
+		case 'S':
+			processRequest(rs, PG_SYNC, nil, ts)
+		}
+	}
+	return
+}
+
+// pgClientMessage says whether a byte is a message type a client sends.
+func pgClientMessage(mtype byte) bool {
+	switch mtype {
+	case 'Q', 'P', 'B', 'E', 'D', 'C', 'S', 'H', 'X', 'F', 'd', 'c', 'f', 'p':
+		return true
+	}
+	return false
+}
+
+// pgStartup picks the user and database out of a StartupMessage, which is
+// the protocol version and then name/value pairs.
+func pgStartup(rs *source, p []byte) {
+	if len(p) < 4 || binary.BigEndian.Uint32(p) != PG_PROTOCOL_3 {
+		// SSL or GSS encryption, or a cancel.
+		return
+	}
+	p = p[4:]
+	db := ""
+	for len(p) > 0 && p[0] != 0 {
+		var name, value string
+		name, p = pgString(p)
+		value, p = pgString(p)
+		switch name {
+		case "user":
+			rs.user = value
+		case "database":
+			db = value
+		}
+	}
+	// The database defaults to the user's name.
+	rs.schema = db
+	if db == "" {
+		rs.schema = rs.user
+	}
+}
+
+// pgString reads a NUL terminated string, returning what's after it.
+func pgString(p []byte) (string, []byte) {
+	if i := bytes.IndexByte(p, 0); i >= 0 {
+		return string(p[:i]), p[i+1:]
+	}
+	return string(p), nil
+}
+
+// pgSkipToSync drops the requests the server will skip after an error.
+func pgSkipToSync(pending []pendingRequest) []pendingRequest {
+	for len(pending) > 0 && pending[0].ptype != PG_SYNC {
+		pending = pending[1:]
+	}
+	return pending
+}
+
+// pgFeed is feed for Postgres responses: a type byte and a length for each
+// message, and we only care about the types.
+func (self *responseParser) pgFeed(data []byte) (bool, int) {
+	self.first = false
+	total := len(data)
+	for {
+		if self.skip > 0 {
+			n := self.skip
+			if n > len(data) {
+				n = len(data)
+			}
+			self.skip -= n
+			data = data[n:]
+			if self.skip > 0 {
+				return false, total
+			}
+		}
+		if self.last {
+			failed := self.failed
+			self.reset()
+			self.failed = failed
+			return true, total - len(data)
+		}
+
+		for len(self.hdr) < 5 {
+			if len(data) == 0 {
+				return false, total
+			}
+			n := 5 - len(self.hdr)
+			if n > len(data) {
+				n = len(data)
+			}
+			self.hdr = append(self.hdr, data[:n]...)
+			data = data[n:]
+		}
+		self.skip = int(binary.BigEndian.Uint32(self.hdr[1:5])) - 4
+		if self.skip < 0 {
+			self.skip = 0
+		}
+		self.last = self.pgMessage(self.hdr[0])
+		self.hdr = self.hdr[:0]
+	}
+}
+
+// pgMessage says whether a message ends the response we're waiting on.
+func (self *responseParser) pgMessage(mtype byte) bool {
+	switch mtype {
+	case 'E':
+		self.failed = true
+		return self.state == RESP_PG_COMPLETE
+	case 'C', 's', 'I':
+		return self.state == RESP_PG_COMPLETE
+	case 'Z':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+/*
+ * privileges.go
+ *
+ * Capturing needs root (or CAP_NET_RAW), but once the capture is open we
+ * don't, and a packet parser is the last thing that should keep running as
+ * root. -run-as switches to another user (and its group, or the one given)
+ * as soon as the capture and the listeners are set up. Everything opened
+ * before then stays open; anything opened after, like -write files and
+ * -log after a SIGHUP, needs to be writable by that user.
+ */
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// lookupUser turns "user" or "user:group" into ids.
+func lookupUser(spec string) (uid, gid int, err error) {
+	name, group, _ := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidstr := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidstr = g.Gid
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(gidstr); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges becomes the -run-as user for good.
+func dropPrivileges(spec string) {
+	uid, gid, err := lookupUser(spec)
+	if err != nil {
+		fatalf("Bad -run-as %s: %s", spec, err.Error())
+	}
+	becomeUser(uid, gid)
+	if os.Geteuid() != uid {
+		fatalf("Still running as user %d after switching to %d", os.Geteuid(), uid)
+	}
+	logger.Info("Dropped privileges", "user", spec, "uid", uid, "gid", gid)
+}
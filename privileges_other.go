@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"runtime"
+)
+
+func becomeUser(uid, gid int) {
+	fatalf("-run-as isn't supported on %s", runtime.GOOS)
+}
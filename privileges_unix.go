@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+)
+
+// becomeUser switches to uid and gid. The group goes first, since we can't
+// change it once we're not root.
+func becomeUser(uid, gid int) {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		fatalf("Failed to drop supplementary groups: %s", err.Error())
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		fatalf("Failed to switch to group %d: %s", gid, err.Error())
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		fatalf("Failed to switch to user %d: %s", uid, err.Error())
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * processlist.go
+ *
+ * SHOW PROCESSLIST from the wire: every connection we're following, who it
+ * is, what it's doing and for how long. A connection waiting on an answer
+ * is running a Query, for as long as it's been waiting; anything else is a
+ * Sleep since its last packet. Info is the query (as counted, so cleaned up
+ * unless the format says otherwise) it's running or ran last.
+ *
+ * It's in the status report with -processlist, at /processlist with -http,
+ * and behind p in the TUI. Reading a file, times are by the capture's clock
+ * rather than ours.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+type connInfo struct {
+	Client    string  `json:"client"`
+	User      string  `json:"user"`
+	Database  string  `json:"database"`
+	Command   string  `json:"command"` // Query or Sleep
+	Time      float64 `json:"time"`    // seconds doing it
+	Queries   uint64  `json:"queries"`
+	Bytes     uint64  `json:"bytes"` // both ways
+	Info      string  `json:"info"`
+	Connected float64 `json:"connected"` // seconds since we first saw it
+}
+
+var processListReport bool
+var offline bool // reading a file, with -r
+
+// processNow is the time to measure the process list against: now, or
+// reading a file, the newest packet.
+func processNow() time.Time {
+	if !offline {
+		return time.Now()
+	}
+	var now time.Time
+	eachStream(func(rs *source) {
+		if rs.last.After(now) {
+			now = rs.last
+		}
+	})
+	return now
+}
+
+// processList is every connection, the longest running queries first and
+// then the longest asleep. Call it paused.
+func processList(now time.Time) []connInfo {
+	list := make([]connInfo, 0, streamCount())
+	eachStream(func(rs *source) {
+		c := connInfo{Client: rs.src, User: rs.user, Database: rs.schema, Command: "Sleep",
+			Time: now.Sub(rs.last).Seconds(), Queries: rs.queries, Bytes: rs.bytes,
+			Info: rs.lastQuery, Connected: now.Sub(rs.since).Seconds()}
+		if len(rs.pending) > 0 {
+			c.Command, c.Time = "Query", now.Sub(rs.pending[0].sent).Seconds()
+			if rs.pending[0].text != "" {
+				c.Info = rs.pending[0].text
+			}
+		}
+		if c.Time < 0 {
+			c.Time = 0
+		}
+		list = append(list, c)
+	})
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Command != b.Command {
+			return a.Command == "Query"
+		}
+		if a.Time != b.Time {
+			return a.Time > b.Time
+		}
+		return a.Client < b.Client
+	})
+	return list
+}
+
+// processLines lays out the process list to fit width, a line each.
+func processLines(list []connInfo, width int) []string {
+	lines := []string{fmt.Sprintf("%-21s %-12s %-12s %-5s %8s %8s %10s  %s",
+		"client", "user", "database", "cmd", "time", "queries", "bytes", "info")}
+	for _, c := range list {
+		lines = append(lines, clip(fmt.Sprintf("%-21s %-12s %-12s %-5s %8.1f %8d %10d  %s",
+			c.Client, clip(c.User, 12), clip(c.Database, 12), c.Command, c.Time, c.Queries, c.Bytes,
+			c.Info), width))
+	}
+	return lines
+}
+
+// printProcessList is the -processlist part of the status report.
+func printProcessList(displaycount int) {
+	list := processList(processNow())
+	running := 0
+	for _, c := range list {
+		if c.Command == "Query" {
+			running++
+		}
+	}
+	log.Printf(" ")
+	log.Printf("%d connections, %d running a query", len(list), running)
+	if len(list) > displaycount {
+		list = list[:displaycount]
+	}
+	width := termWidth
+	if width <= 0 {
+		width = 1 << 20
+	}
+	for _, line := range processLines(list, width) {
+		log.Printf("%s", line)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * proxy.go
+ *
+ * Behind ProxySQL or Vitess every query comes from the proxy, over a
+ * handful of connections it shares out between all its clients, so #s, #i,
+ * -security and the rest all blame the proxy. Both pass SQL comments
+ * through, so if the application (or a proxy query rule) says who it is in
+ * one, -proxy takes its word for it. Any of -proxy-keys will do, as
+ * key=value or key:value, quoted or not, in any C style comment, so
+ * sqlcommenter's client_ip='10.1.2.3:51234' works.
+ *
+ * Queries without one stay with the connection's other end, as do commands
+ * that aren't SQL (pings, prepared statement executions).
+ */
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var proxyAware bool
+var proxyKeys map[string]bool // lower case
+
+var proxyComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+var proxyAttr = regexp.MustCompile(`([A-Za-z_][\w.-]*)\s*[=:]\s*['"]?([0-9A-Fa-f.:\[\]]+)`)
+
+// proxyClient finds the client a query says it's from, or "".
+func proxyClient(query []byte) string {
+	if !bytes.Contains(query, []byte("/*")) {
+		return ""
+	}
+	for _, comment := range proxyComment.FindAll(query, -1) {
+		for _, m := range proxyAttr.FindAllSubmatch(comment, -1) {
+			if !proxyKeys[strings.ToLower(string(m[1]))] {
+				continue
+			}
+			client := strings.TrimRight(string(m[2]), ":")
+			if net.ParseIP(strings.Trim(hostOf(client), "[]")) != nil {
+				return client
+			}
+		}
+	}
+	return ""
+}
+
+// hostOf strips the port, if there is one, off an address.
+func hostOf(addr string) string {
+	host, _ := splitClient(addr)
+	return host
+}
+
+// splitClient splits a client address into host and port, which is 0 if
+// a proxy didn't tell us.
+func splitClient(addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	pnum, _ := strconv.Atoi(port)
+	return host, pnum
+}
+
+// client is who the request we're on came from: the other end of the
+// connection, or with -proxy whoever the query says.
+func (self *source) client() string {
+	if self.proxied != "" {
+		return self.proxied
+	}
+	return self.src
+}
+
+func (self *source) clientIP() string {
+	if self.proxied != "" {
+		return hostOf(self.proxied)
+	}
+	return self.srcip
+}
+
+// sender is client for a request that's been queued up.
+func (self *source) sender(req *pendingRequest) string {
+	if req.client != "" {
+		return req.client
+	}
+	return self.src
+}
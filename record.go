@@ -0,0 +1,238 @@
+/*
+ * record.go
+ *
+ * -record keeps every query (COM_QUERY) we see in a file for replay: what
+ * it said, when, on which connection and in which database, and nothing
+ * else, so it's a small fraction of the capture it came from. It works
+ * sniffing live or reading a file with -r, and `mysql-sniffer replay` takes
+ * it in place of a capture.
+ *
+ * The file is gzipped, starting with a line of magic, then records that
+ * each start with a byte saying what they are. Numbers are varints and
+ * strings a uvarint length and the bytes:
+ *
+ *     T  the first query's time, in Unix nanoseconds (signed)
+ *     C  a new connection: its number (from 1), client and user
+ *     D  a new database name: its number (from 1) and name
+ *     Q  a query: nanoseconds since the last (signed, since with more than
+ *        one worker they can arrive a little out of order), connection,
+ *        database (0 for none) and text
+ *
+ * Connections and databases are numbered the first time a query needs
+ * them, so their names are only written once. Readers should skip nothing:
+ * a record type they don't know means a newer file.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const RECORD_MAGIC = "mysql-sniffer events 1\n"
+
+// Nothing MySQL will take is longer (max_allowed_packet).
+const RECORD_MAX_STRING = 1 << 30
+
+type eventRecorder struct {
+	path  string
+	file  *os.File
+	gz    *gzip.Writer
+	out   *bufio.Writer
+	last  time.Time // the last query's
+	conns uint64
+	dbs   map[string]uint64
+	buf   []byte
+}
+
+var recorder *eventRecorder
+
+func openRecorder(path string) *eventRecorder {
+	if protocol == PROTO_POSTGRES {
+		fatalf("-record only knows MySQL queries")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		fatalf("Failed to create %s: %s", path, err.Error())
+	}
+	self := &eventRecorder{path: path, file: f, dbs: make(map[string]uint64)}
+	self.gz = gzip.NewWriter(f)
+	self.out = bufio.NewWriter(self.gz)
+	self.out.WriteString(RECORD_MAGIC)
+	return self
+}
+
+// Record adds a query to the file. Call it with the state locked.
+func (self *eventRecorder) Record(rs *source, query []byte, ts time.Time) {
+	b := self.buf[:0]
+	if rs.recordID == 0 {
+		self.conns++
+		rs.recordID = self.conns
+		b = append(b, 'C')
+		b = binary.AppendUvarint(b, rs.recordID)
+		b = appendRecordString(b, rs.client())
+		b = appendRecordString(b, rs.user)
+	}
+	var db uint64
+	if rs.schema != "" {
+		var ok bool
+		if db, ok = self.dbs[rs.schema]; !ok {
+			db = uint64(len(self.dbs) + 1)
+			self.dbs[rs.schema] = db
+			b = append(b, 'D')
+			b = binary.AppendUvarint(b, db)
+			b = appendRecordString(b, rs.schema)
+		}
+	}
+	if self.last.IsZero() {
+		b = append(b, 'T')
+		b = binary.AppendVarint(b, ts.UnixNano())
+		self.last = ts
+	}
+	b = append(b, 'Q')
+	b = binary.AppendVarint(b, int64(ts.Sub(self.last)))
+	b = binary.AppendUvarint(b, rs.recordID)
+	b = binary.AppendUvarint(b, db)
+	b = appendRecordString(b, string(query))
+	self.last = ts
+	self.buf = b
+
+	if _, err := self.out.Write(b); err != nil {
+		fatalf("Failed to write to %s: %s", self.path, err.Error())
+	}
+}
+
+func appendRecordString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Write gets what we've recorded so far onto the disk after each report,
+// so not much goes missing if we're killed.
+func (self *eventRecorder) Write(rows []reportRow, elapsed float64) {
+	err := self.out.Flush()
+	if err == nil {
+		err = self.gz.Flush()
+	}
+	if err != nil {
+		fatalf("Failed to write to %s: %s", self.path, err.Error())
+	}
+}
+
+func (self *eventRecorder) Close() {
+	self.out.Flush()
+	self.gz.Close()
+	self.file.Close()
+}
+
+// isEventFile says whether path is a -record file rather than a capture.
+func isEventFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return false
+	}
+	magic := make([]byte, len(RECORD_MAGIC))
+	_, err = io.ReadFull(gz, magic)
+	return err == nil && string(magic) == RECORD_MAGIC
+}
+
+// readEvents reads a -record file back for replay, in the order the queries
+// were sent.
+func readEvents(path string) ([]replayEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	in := bufio.NewReader(gz)
+	magic := make([]byte, len(RECORD_MAGIC))
+	if _, err = io.ReadFull(in, magic); err != nil || string(magic) != RECORD_MAGIC {
+		return nil, fmt.Errorf("%s isn't a -record file", path)
+	}
+
+	var events []replayEvent
+	var at time.Duration
+	dbs := map[uint64]string{0: ""}
+	for {
+		kind, err := in.ReadByte()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			break // no gzip trailer if we were killed
+		}
+		if err != nil {
+			return events, err
+		}
+		switch kind {
+		case 'T':
+			_, err = binary.ReadVarint(in)
+		case 'C':
+			if _, err = binary.ReadUvarint(in); err == nil {
+				if _, err = readRecordString(in); err == nil {
+					_, err = readRecordString(in)
+				}
+			}
+		case 'D':
+			var id uint64
+			if id, err = binary.ReadUvarint(in); err == nil {
+				dbs[id], err = readRecordString(in)
+			}
+		case 'Q':
+			var delta int64
+			var conn, db uint64
+			var query string
+			if delta, err = binary.ReadVarint(in); err == nil {
+				if conn, err = binary.ReadUvarint(in); err == nil {
+					if db, err = binary.ReadUvarint(in); err == nil {
+						query, err = readRecordString(in)
+					}
+				}
+			}
+			if err == nil {
+				at += time.Duration(delta)
+				events = append(events, replayEvent{at, int(conn), dbs[db], query})
+			}
+		default:
+			return events, fmt.Errorf("%s has a record of an unknown type %q, from a newer version?", path, kind)
+		}
+		if err != nil {
+			// Killed halfway through a record, most likely.
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return events, err
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at < events[j].at })
+	return events, nil
+}
+
+func readRecordString(in *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(in)
+	if err != nil {
+		return "", err
+	}
+	if n > RECORD_MAX_STRING {
+		return "", fmt.Errorf("a %d byte string, the file's corrupt", n)
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(in, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,297 @@
+/*
+ * redis.go
+ *
+ * Adds each status report into Redis, so a fleet of sniffers can share one
+ * cheap central store for dashboards to read. Everything we write is a
+ * counter that gets added to, never overwritten, so any number of sniffers
+ * can write to the same keys:
+ *
+ *     <prefix>:query:<id>         hash: count, time_ms, bytes, errors, plus
+ *                                 the query text and command type
+ *     <prefix>:count              sorted set of query ids by count
+ *     <prefix>:time               ... and by total time (ms)
+ *     <prefix>:count:<minute>     the same two, per minute (unix time of
+ *     <prefix>:time:<minute>      the start of it), for rolling windows
+ *
+ * The last hour is a ZUNIONSTORE of the last 60 minutes away. Everything
+ * expires after -redis-ttl without an update.
+ *
+ * Like Graphite, if Redis goes away we log it and try again next report,
+ * and the talking to it happens in a goroutine so a slow Redis can't hold up
+ * the capture. Reports that pile up past REDIS_QUEUE behind it are dropped.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_PORT    = "6379"
+	REDIS_TIMEOUT = 5 * time.Second
+	REDIS_BUCKET  = 60 // seconds in each rolling bucket
+	REDIS_QUEUE   = 4  // reports waiting to be sent
+)
+
+type redisSink struct {
+	addr   string
+	auth   []string // AUTH arguments, if any
+	db     string
+	prefix string
+	ttl    int
+	conn   net.Conn // the sender's, like reader
+	reader *bufio.Reader
+
+	queue   chan redisPipeline
+	done    chan bool
+	dropped int
+
+	// With -cumulative the rows are totals, so remember what we've already
+	// added.
+	sent map[string]redisCounts
+}
+
+type redisPipeline struct {
+	data     []byte
+	commands int
+}
+
+type redisCounts struct {
+	count, bytes, errors uint64
+	timeMs               float64
+}
+
+func openRedis(addr, prefix string, ttl int) *redisSink {
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		fatalf("Bad -redis URL %s: expected redis://[[user]:pass@]host[:port][/db]", addr)
+	}
+	self := &redisSink{
+		addr:   u.Host,
+		db:     strings.Trim(u.Path, "/"),
+		prefix: strings.TrimSuffix(prefix, ":"),
+		ttl:    ttl,
+		sent:   make(map[string]redisCounts),
+		queue:  make(chan redisPipeline, REDIS_QUEUE),
+		done:   make(chan bool),
+	}
+	if u.Port() == "" {
+		self.addr = net.JoinHostPort(u.Hostname(), REDIS_PORT)
+	}
+	if self.db != "" {
+		if _, err := strconv.Atoi(self.db); err != nil {
+			fatalf("Bad -redis database %s: expected a number", self.db)
+		}
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			if u.User.Username() != "" {
+				self.auth = []string{u.User.Username(), pass}
+			} else {
+				self.auth = []string{pass}
+			}
+		} else {
+			self.auth = []string{u.User.Username()}
+		}
+	}
+	go self.sender()
+	return self
+}
+
+// redisCommand appends a command to a pipeline.
+func redisCommand(buf *bytes.Buffer, args ...string) {
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+func (self *redisSink) Write(rows []reportRow, elapsed float64) {
+	if self.dropped > 0 {
+		logger.Warn("Dropped reports, Redis isn't keeping up", "addr", self.addr, "reports", self.dropped)
+		self.dropped = 0
+	}
+
+	var buf bytes.Buffer
+	commands := 0
+	cmd := func(args ...string) {
+		redisCommand(&buf, args...)
+		commands++
+	}
+
+	bucket := strconv.FormatInt(time.Now().Unix()/REDIS_BUCKET*REDIS_BUCKET, 10)
+	ttl := strconv.Itoa(self.ttl)
+	touched := make(map[string]bool)
+	for _, r := range rows {
+		add := redisCounts{r.count, r.bytes, r.errors, r.avg * float64(r.count)}
+		if cumulative {
+			last := self.sent[r.id]
+			self.sent[r.id] = add
+			if add.count < last.count || add.bytes < last.bytes || add.errors < last.errors {
+				// Counting started over (a reset, or the query was evicted
+				// and came back), so it's all new.
+				last = redisCounts{}
+			}
+			add = redisCounts{add.count - last.count, add.bytes - last.bytes,
+				add.errors - last.errors, add.timeMs - last.timeMs}
+		}
+		if add.count == 0 {
+			continue
+		}
+
+		key := self.prefix + ":query:" + r.id
+		count := strconv.FormatUint(add.count, 10)
+		timeMs := strconv.FormatFloat(add.timeMs, 'f', 3, 64)
+		cmd("HINCRBY", key, "count", count)
+		cmd("HINCRBYFLOAT", key, "time_ms", timeMs)
+		cmd("HINCRBY", key, "bytes", strconv.FormatUint(add.bytes, 10))
+		cmd("HINCRBY", key, "errors", strconv.FormatUint(add.errors, 10))
+		cmd("HSET", key, "query", r.query, "type", strconv.Itoa(r.ptype))
+		cmd("EXPIRE", key, ttl)
+		for _, set := range []string{"count", "time"} {
+			score := count
+			if set == "time" {
+				score = timeMs
+			}
+			cmd("ZINCRBY", self.prefix+":"+set, score, r.id)
+			cmd("ZINCRBY", self.prefix+":"+set+":"+bucket, score, r.id)
+			touched[set] = true
+		}
+	}
+	for set := range touched {
+		cmd("EXPIRE", self.prefix+":"+set, ttl)
+		cmd("EXPIRE", self.prefix+":"+set+":"+bucket, ttl)
+	}
+	if commands == 0 {
+		return
+	}
+
+	select {
+	case self.queue <- redisPipeline{buf.Bytes(), commands}:
+	default:
+		self.dropped++
+	}
+}
+
+// sender writes the reports' pipelines to Redis.
+func (self *redisSink) sender() {
+	for p := range self.queue {
+		if err := self.send(p.data, p.commands); err != nil {
+			logger.Warn("Failed to write to Redis", "addr", self.addr, "err", err)
+			if self.conn != nil {
+				self.conn.Close()
+				self.conn = nil
+			}
+		}
+	}
+	if self.conn != nil {
+		self.conn.Close()
+	}
+	close(self.done)
+}
+
+// send writes a pipeline of commands and reads back all the replies,
+// connecting first if we have to.
+func (self *redisSink) send(pipeline []byte, commands int) error {
+	if self.conn == nil {
+		conn, err := net.DialTimeout("tcp", self.addr, REDIS_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		self.conn, self.reader = conn, bufio.NewReader(conn)
+
+		var hello bytes.Buffer
+		n := 0
+		if len(self.auth) > 0 {
+			redisCommand(&hello, append([]string{"AUTH"}, self.auth...)...)
+			n++
+		}
+		if self.db != "" {
+			redisCommand(&hello, "SELECT", self.db)
+			n++
+		}
+		if n > 0 {
+			if err := self.send(hello.Bytes(), n); err != nil {
+				return err
+			}
+		}
+	}
+
+	self.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+	if _, err := self.conn.Write(pipeline); err != nil {
+		return err
+	}
+	// Read every reply even after an error, so the next pipeline doesn't get
+	// this one's leftovers.
+	var first error
+	for i := 0; i < commands; i++ {
+		if err := self.reply(); err != nil {
+			if _, ok := err.(redisError); !ok {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+type redisError string
+
+func (self redisError) Error() string {
+	return string(self)
+}
+
+// reply reads (and throws away) one reply, returning an error reply as a
+// redisError.
+func (self *redisSink) reply() error {
+	line, err := self.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		_, err := io.CopyN(io.Discard, self.reader, int64(n+2))
+		return err
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		for i := 0; i < n; i++ {
+			if err := self.reply(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected reply %q", line)
+}
+
+// Close waits for anything queued to go out.
+func (self *redisSink) Close() {
+	close(self.queue)
+	<-self.done
+}
@@ -0,0 +1,218 @@
+/*
+ * replay.go
+ *
+ *     mysql-sniffer replay -dsn 'user:pass@tcp(test-db:3306)/' [-speed 1] capture
+ *
+ * runs the queries in a capture (or a -record file, see record.go) against
+ * another server, to load test a new MySQL version or config with real
+ * traffic. Each connection in the capture gets one of its own on the target
+ * and runs its queries in the same order, in the database it was using, so
+ * session state (SET, temporary tables, transactions) mostly carries over.
+ *
+ * -speed 1 keeps the capture's pacing, 2 goes twice as fast and so on, and
+ * 0 runs each connection's queries back to back as fast as the target will
+ * take them. A connection that falls behind just runs late; it never skips.
+ *
+ * Only text queries (COM_QUERY) are replayed. Prepared statements' values
+ * aren't in the capture in a form we can use, and logins use the -dsn's
+ * account, whoever they were. Writes are replayed like everything else, so
+ * point it at something you don't mind changing. Talking to the target needs
+ * github.com/go-sql-driver/mysql, built with `go build -tags replay`.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type replayEvent struct {
+	at     time.Duration // since the first query in the capture
+	conn   int           // which captured connection, numbered from 0
+	schema string
+	query  string
+}
+
+// One connection to the replay target.
+type replayConn interface {
+	Exec(schema, query string) error
+	Close()
+}
+
+// How a replay went.
+type replayStats struct {
+	sync.Mutex
+	queries, errors uint64
+	times           histogram
+	firstError      string
+}
+
+// captureEvents reads the queries out of a capture file, in the order they
+// were sent.
+func captureEvents(path, lfilter string) []replayEvent {
+	var events []replayEvent
+	var first time.Time
+	conns := make(map[*source]int)
+	onQuery = func(rs *source, query []byte, ts time.Time) {
+		if first.IsZero() {
+			first = ts
+		}
+		conn, ok := conns[rs]
+		if !ok {
+			conn = len(conns)
+			conns[rs] = conn
+		}
+		events = append(events, replayEvent{ts.Sub(first), conn, rs.schema, string(query)})
+	}
+	defer func() { onQuery = nil }()
+
+	src := openOffline(path, lfilter)
+	defer src.Close()
+	w := newWorker()
+	for {
+		pkt, rv := src.NextEx()
+		if rv < 0 {
+			break
+		}
+		if pkt != nil {
+			handlePacket(w, pkt)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at < events[j].at })
+	return events
+}
+
+// replay runs events against the target, each captured connection on its
+// own connection from open, at speed times the original pace (0 for flat
+// out).
+func replay(events []replayEvent, speed float64, open func() (replayConn, error)) *replayStats {
+	stats := &replayStats{}
+	var wg sync.WaitGroup
+	queues := make(map[int]chan replayEvent)
+
+	// Room for everything, so one slow connection doesn't hold the rest up.
+	counts := make(map[int]int)
+	for _, ev := range events {
+		counts[ev.conn]++
+	}
+
+	start := time.Now()
+	for _, ev := range events {
+		queue, ok := queues[ev.conn]
+		if !ok {
+			queue = make(chan replayEvent, counts[ev.conn])
+			queues[ev.conn] = queue
+			wg.Add(1)
+			go replayConnection(queue, open, stats, &wg)
+		}
+		if speed > 0 {
+			if wait := time.Duration(float64(ev.at)/speed) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		queue <- ev
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return stats
+}
+
+// replayConnection runs one captured connection's queries, in order.
+func replayConnection(queue chan replayEvent, open func() (replayConn, error), stats *replayStats,
+	wg *sync.WaitGroup) {
+	defer wg.Done()
+	conn, err := open()
+	if err != nil {
+		// Every query it should have run fails.
+		for range queue {
+			stats.failed(err)
+		}
+		return
+	}
+	defer conn.Close()
+	for ev := range queue {
+		sent := time.Now()
+		err := conn.Exec(ev.schema, ev.query)
+		took := time.Since(sent)
+		stats.Lock()
+		stats.queries++
+		stats.times.Record(uint64(took))
+		stats.Unlock()
+		if err != nil {
+			stats.failed(err)
+		}
+	}
+}
+
+func (self *replayStats) failed(err error) {
+	self.Lock()
+	defer self.Unlock()
+	self.errors++
+	if self.firstError == "" {
+		self.firstError = err.Error()
+	}
+}
+
+// runReplay is mysql-sniffer replay.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	dsn := flags.String("dsn", "", "Server to replay against, as user:password@tcp(host:port)/[database]")
+	speed := flags.Float64("speed", 1, "How many times the capture's pace to go at (0 for as fast as possible)")
+	lport := flags.Int("P", 3306, "MySQL port in the capture")
+	lfilter := flags.String("F", "", "extra tcpdump filter rule")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay -dsn DSN [options] capture|recording\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *dsn == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *speed < 0 {
+		fatalf("-speed can't be negative")
+	}
+	log.SetPrefix("")
+	log.SetFlags(0)
+
+	open, err := openReplayTarget(*dsn)
+	if err != nil {
+		// Not the DSN, it has the password in it.
+		fatalf("Failed to connect to the -dsn server: %s", err.Error())
+	}
+	port, offline = uint16(*lport), true
+	parseFormat("#q")
+	var events []replayEvent
+	if isEventFile(flags.Arg(0)) {
+		events, err = readEvents(flags.Arg(0))
+		if err != nil {
+			fatalf("Failed to read %s: %s", flags.Arg(0), err.Error())
+		}
+	} else {
+		events = captureEvents(flags.Arg(0), *lfilter)
+	}
+	if len(events) == 0 {
+		fatalf("No queries in %s", flags.Arg(0))
+	}
+	span := events[len(events)-1].at
+	logger.Info("Replaying", "queries", len(events), "captured_over", span.String(), "speed", *speed)
+
+	started := time.Now()
+	stats := replay(events, *speed, open)
+	took := time.Since(started).Seconds()
+	p50, p95, p99 := calculatePercentiles(&stats.times)
+	log.Printf("Replayed %d queries in %.1fs, %.2f per second, %d errors", stats.queries, took,
+		float64(stats.queries)/took, stats.errors)
+	log.Printf("%0.2fms p50 / %0.2fms p95 / %0.2fms p99", p50, p95, p99)
+	if stats.firstError != "" {
+		log.Printf("First error: %s", stats.firstError)
+	}
+}
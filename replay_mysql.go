@@ -0,0 +1,67 @@
+//go:build replay
+// +build replay
+
+/*
+ * replay_mysql.go
+ *
+ * The replay target, through database/sql and
+ * github.com/go-sql-driver/mysql. Only built with `go build -tags replay`.
+ * Each replay connection pins a connection from the pool, so everything a
+ * captured connection did happens on the same one.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/go-sql-driver/mysql"
+	"strings"
+)
+
+type mysqlReplayConn struct {
+	conn   *sql.Conn
+	schema string // what we last switched to
+}
+
+func openReplayTarget(dsn string) (func() (replayConn, error), error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return func() (replayConn, error) {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return &mysqlReplayConn{conn: conn}, nil
+	}, nil
+}
+
+// Exec runs a query in schema, reading and throwing away any rows so the
+// server does all the work it did the first time.
+func (self *mysqlReplayConn) Exec(schema, query string) error {
+	ctx := context.Background()
+	if schema != "" && schema != self.schema {
+		if _, err := self.conn.ExecContext(ctx, "USE `"+strings.ReplaceAll(schema, "`", "``")+"`"); err != nil {
+			return err
+		}
+		self.schema = schema
+	}
+	rows, err := self.conn.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+func (self *mysqlReplayConn) Close() {
+	self.conn.Close()
+}
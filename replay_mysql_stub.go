@@ -0,0 +1,12 @@
+//go:build !replay
+// +build !replay
+
+package main
+
+import (
+	"errors"
+)
+
+func openReplayTarget(dsn string) (func() (replayConn, error), error) {
+	return nil, errors.New("not built with replay support (use -tags replay)")
+}
@@ -0,0 +1,318 @@
+/*
+ * response.go
+ *
+ * Just enough of a MySQL response parser to know when the server is done
+ * answering a command. For a result set that's the EOF (or, with
+ * CLIENT_DEPRECATE_EOF, the OK) packet after the last row, which can be a
+ * long time after the first byte shows up.
+ *
+ * COM_STMT_PREPARE is answered by a PREPARE_OK saying how many parameters
+ * and columns the statement has, followed by a definition of each, the
+ * parameters and columns each closed by an EOF unless CLIENT_DEPRECATE_EOF.
+ * We don't always see the handshake to know which, but a definition never
+ * starts with 0xFE, so the EOF between the two is easy to spot. The response
+ * ends with the last definition, and if an EOF follows after all, the next
+ * response skips it.
+ *
+ * We only ever look at the first few bytes of each packet and skip over the
+ * rest, so big result sets don't get buffered.
+ */
+
+package main
+
+const (
+	RESP_IDLE         = iota // nothing outstanding
+	RESP_FIRST               // waiting for the first packet of a result
+	RESP_COLUMNS             // reading column definitions
+	RESP_COLUMNS_DONE        // after the column definitions, maybe an EOF
+	RESP_ROWS                // reading rows until the terminator
+	RESP_PREPARE_DEFS        // reading a prepared statement's definitions
+
+	// Enough of the payload to read an OK packet's status flags: header,
+	// two length encoded integers, and the flags themselves.
+	RESP_PREFIX = 1 + 9 + 9 + 2
+
+	SERVER_MORE_RESULTS_EXISTS = 0x0008
+)
+
+type responseParser struct {
+	state     int
+	resultset bool   // whether this command can answer with a result set
+	prepare   bool   // answering COM_STMT_PREPARE
+	columns   uint64 // column definitions left to read
+	params    uint64 // ... and parameter definitions, for a prepare
+	strayEOF  bool   // the last response was a prepare, maybe with an EOF to come
+	skip      int    // payload bytes of the current packet left to skip
+	hdr       []byte // current packet header and the start of its payload
+	first     bool   // nothing has been fed since start
+	last      bool   // the current packet ends the response
+	failed    bool   // the response was an error
+}
+
+// expectsResponse says whether the server answers a command at all.
+func expectsResponse(ptype int) bool {
+	switch ptype {
+	case COM_QUIT, COM_STMT_SEND_LONG_DATA, COM_STMT_CLOSE:
+		return false
+	}
+	return true
+}
+
+// start gets ready for the response to a command of type ptype.
+func (self *responseParser) start(ptype int) {
+	strayEOF := self.strayEOF
+	self.reset()
+	self.strayEOF = strayEOF
+	if !expectsResponse(ptype) {
+		return
+	}
+	self.first = true
+	if protocol == PROTO_POSTGRES {
+		self.state = RESP_PG_READY
+		if ptype == COM_STMT_EXECUTE {
+			self.state = RESP_PG_COMPLETE
+		}
+		return
+	}
+	switch ptype {
+	case COM_STMT_FETCH:
+		self.state = RESP_ROWS
+	default:
+		self.state = RESP_FIRST
+		self.resultset = ptype == COM_QUERY || ptype == COM_PROCESS_INFO ||
+			ptype == COM_STMT_EXECUTE
+		self.prepare = ptype == COM_STMT_PREPARE
+	}
+}
+
+func (self *responseParser) reset() {
+	*self = responseParser{hdr: self.hdr[:0]}
+}
+
+// feed pushes response bytes through the parser and returns true once the
+// response is complete, along with how many bytes it used. Anything after the
+// end of the response is left for the caller.
+func (self *responseParser) feed(data []byte) (bool, int) {
+	if protocol == PROTO_POSTGRES {
+		return self.pgFeed(data)
+	}
+	self.first = false
+	total := len(data)
+	for {
+		if self.skip > 0 {
+			n := self.skip
+			if n > len(data) {
+				n = len(data)
+			}
+			self.skip -= n
+			data = data[n:]
+			if self.skip > 0 {
+				return false, total
+			}
+		}
+		if self.last {
+			// Hang on to failed for the caller until the next start, and
+			// strayEOF for the next response.
+			failed, strayEOF := self.failed, self.strayEOF
+			self.reset()
+			self.failed, self.strayEOF = failed, strayEOF
+			return true, total - len(data)
+		}
+
+		// Gather the packet header and enough of the payload to tell what
+		// kind of packet it is.
+		need := 4
+		if len(self.hdr) >= 4 {
+			need += self.prefixLen()
+		}
+		for len(self.hdr) < need {
+			if len(data) == 0 {
+				return false, total
+			}
+			n := need - len(self.hdr)
+			if n > len(data) {
+				n = len(data)
+			}
+			self.hdr = append(self.hdr, data[:n]...)
+			data = data[n:]
+			if len(self.hdr) == 4 {
+				need += self.prefixLen()
+			}
+		}
+
+		plen := self.payloadLen()
+		self.skip = plen - (len(self.hdr) - 4)
+		self.last = self.packet(plen, self.hdr[4:])
+		self.hdr = self.hdr[:0]
+	}
+}
+
+func (self *responseParser) payloadLen() int {
+	return int(self.hdr[0]) | int(self.hdr[1])<<8 | int(self.hdr[2])<<16
+}
+
+func (self *responseParser) prefixLen() int {
+	if plen := self.payloadLen(); plen < RESP_PREFIX {
+		return plen
+	}
+	return RESP_PREFIX
+}
+
+// packet moves the state machine along by one packet, given its length and
+// the start of its payload. Returns true at the end of the response.
+func (self *responseParser) packet(plen int, p []byte) bool {
+	if len(p) == 0 {
+		return false
+	}
+
+	switch self.state {
+	case RESP_FIRST:
+		if self.strayEOF {
+			self.strayEOF = false
+			if p[0] == 0xFE && plen < 7 {
+				return false // the EOF after the last prepare's definitions
+			}
+		}
+		switch p[0] {
+		case 0x00: // OK
+			if self.prepare {
+				return self.prepared(plen, p)
+			}
+			return self.finished(okStatus(p))
+		case 0xFF: // ERR
+			self.failed = true
+			return true
+		case 0xFB: // LOCAL INFILE request, we don't follow those
+			return true
+		}
+		if !self.resultset {
+			return true
+		}
+		self.columns, _ = lenencInt(p)
+		if self.columns == 0 {
+			return true
+		}
+		self.state = RESP_COLUMNS
+
+	case RESP_COLUMNS:
+		self.columns--
+		if self.columns == 0 {
+			self.state = RESP_COLUMNS_DONE
+		}
+
+	case RESP_COLUMNS_DONE:
+		// Without CLIENT_DEPRECATE_EOF there's an EOF between the column
+		// definitions and the rows. It's always exactly 5 bytes, which is
+		// shorter than an OK packet can be, so this can't be the end.
+		self.state = RESP_ROWS
+		if p[0] == 0xFE && plen < 7 {
+			return false
+		}
+		return self.row(plen, p)
+
+	case RESP_ROWS:
+		return self.row(plen, p)
+
+	case RESP_PREPARE_DEFS:
+		if p[0] == 0xFE && plen < 7 {
+			return false // the EOF between the parameters and the columns
+		}
+		if self.params > 0 {
+			self.params--
+		} else {
+			self.columns--
+		}
+		if self.params == 0 && self.columns == 0 {
+			self.strayEOF = true
+			return true
+		}
+	}
+	return false
+}
+
+// prepared reads a PREPARE_OK: status, statement id, columns, parameters,
+// a filler byte and the warnings, and from MySQL 8 maybe whether the
+// definitions are coming at all.
+func (self *responseParser) prepared(plen int, p []byte) bool {
+	if len(p) < 9 {
+		return true
+	}
+	self.columns = uint64(p[5]) | uint64(p[6])<<8
+	self.params = uint64(p[7]) | uint64(p[8])<<8
+	if self.columns == 0 && self.params == 0 || plen >= 13 && len(p) >= 13 && p[12] == 0 {
+		return true
+	}
+	self.state = RESP_PREPARE_DEFS
+	return false
+}
+
+// row handles a packet in the rows section, which is either a row or the
+// terminator (EOF or OK with a 0xFE header). A row can only start with 0xFE
+// if it's at least 16MB long.
+func (self *responseParser) row(plen int, p []byte) bool {
+	switch {
+	case p[0] == 0xFF:
+		self.failed = true
+		return true
+	case p[0] == 0xFE && plen < 0xFFFFFF:
+		if plen < 7 {
+			// EOF: header, warnings, status flags
+			if len(p) < 5 {
+				return true
+			}
+			return self.finished(uint16(p[3]) | uint16(p[4])<<8)
+		}
+		return self.finished(okStatus(p))
+	}
+	return false
+}
+
+// finished is called at the end of a result. Stored procedures and multi
+// statements can have more coming.
+func (self *responseParser) finished(status uint16) bool {
+	if status&SERVER_MORE_RESULTS_EXISTS != 0 {
+		self.state = RESP_FIRST
+		return false
+	}
+	return true
+}
+
+// okStatus pulls the status flags out of an OK packet.
+func okStatus(p []byte) uint16 {
+	pos := 1
+	for i := 0; i < 2 && pos < len(p); i++ {
+		_, n := lenencInt(p[pos:])
+		pos += n
+	}
+	if pos+2 > len(p) {
+		return 0
+	}
+	return uint16(p[pos]) | uint16(p[pos+1])<<8
+}
+
+// lenencInt decodes a MySQL length encoded integer, returning the value and
+// the number of bytes it took up.
+func lenencInt(p []byte) (uint64, int) {
+	if len(p) == 0 {
+		return 0, 0
+	}
+	size := 0
+	switch p[0] {
+	case 0xFC:
+		size = 2
+	case 0xFD:
+		size = 3
+	case 0xFE:
+		size = 8
+	default:
+		return uint64(p[0]), 1
+	}
+	if len(p) < size+1 {
+		return 0, len(p)
+	}
+	var v uint64
+	for i := size; i > 0; i-- {
+		v = v<<8 | uint64(p[i])
+	}
+	return v, size + 1
+}
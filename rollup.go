@@ -0,0 +1,136 @@
+/*
+ * rollup.go
+ *
+ * Rolling the report up by who sent the queries, or where to, rather than
+ * what they said, for when the question is who's hammering the database.
+ * Each is sorted by -sort like the rest, so -sort bytes or -sort avg rank
+ * them by traffic or by how long they're kept waiting.
+ *
+ * -client-stats counts by client IP, since most clients open a new
+ * connection (and port) for every few queries. -client-stats-ports counts
+ * each IP:port on its own, for long lived pools. With -proxy it's the client
+ * the query says it's from. Anyone quiet for a whole interval is forgotten.
+ *
+ * -user-stats counts by the account the connection logged in as, which is
+ * usually one per service. Connections that were already open when we
+ * started are (unknown), since we never saw them log in.
+ *
+ * -database-stats counts by the database the connection is using, from its
+ * handshake and any USE (COM_INIT_DB) since, along with how many statements
+ * read and how many wrote, for servers hosting lots of schemas. Queries
+ * naming another database's tables still count against the one in use.
+ */
+
+package main
+
+import "fmt"
+
+var clientStats bool
+var clientPorts bool
+var cbuf map[string]*queryData = make(map[string]*queryData) // per client, with -client-stats
+
+var userStats bool
+var ubuf map[string]*queryData = make(map[string]*queryData) // per user, with -user-stats
+
+var databaseStats bool
+var dbuf map[string]*queryData = make(map[string]*queryData) // per database, with -database-stats
+
+var clientStatColumns = rollupColumns("client")
+var userStatColumns = rollupColumns("user", tableColumn{"err", "[%]", func(r *reportRow) string {
+	return percentOf(r.errors, r.count)
+}})
+var databaseStatColumns = rollupColumns("database", tableColumn{"reads", "[%]", func(r *reportRow) string {
+	return percentOf(r.reads, r.count)
+}}, tableColumn{"writes", "[%]", func(r *reportRow) string {
+	return percentOf(r.writes, r.count)
+}})
+
+// rollupColumns are the -tables columns, with any extra ones, for something
+// other than tables.
+func rollupColumns(name string, extra ...tableColumn) []tableColumn {
+	columns := append([]tableColumn{}, tableStatColumns[:len(tableStatColumns)-1]...)
+	columns = append(columns, extra...)
+	return append(columns, tableColumn{name, "", func(r *reportRow) string { return r.query }})
+}
+
+// recordClient counts a query against whoever sent it.
+func recordClient(rs *source, plen uint64) *queryData {
+	client := rs.clientIP()
+	if clientPorts {
+		client = rs.client()
+	}
+	return recordRollup(cbuf, client, plen)
+}
+
+// forgetIdleClients drops the clients we've heard nothing from this
+// interval, so a day of short connections with -client-stats-ports doesn't
+// pile up.
+func forgetIdleClients() {
+	for client, c := range cbuf {
+		if c.count == 0 {
+			delete(cbuf, client)
+		}
+	}
+}
+
+func buildClientReport(elapsed, lifetime float64, sortby string) []reportRow {
+	return buildRollupReport(cbuf, elapsed, lifetime, sortby)
+}
+
+// printClients is the -client-stats part of the status report.
+func printClients(rows []reportRow, displaycount int) {
+	printRollup(clientStatColumns, rows, displaycount)
+}
+
+func userName(rs *source) string {
+	if rs.user == "" {
+		return "(unknown)"
+	}
+	return rs.user
+}
+
+func buildUserReport(elapsed, lifetime float64, sortby string) []reportRow {
+	return buildRollupReport(ubuf, elapsed, lifetime, sortby)
+}
+
+// printUsers is the -user-stats part of the status report.
+func printUsers(rows []reportRow, displaycount int) {
+	printRollup(userStatColumns, rows, displaycount)
+}
+
+// recordDatabase counts a query against the database it's run in, and as a
+// read or a write if it's either.
+func recordDatabase(rs *source, ptype int, query []byte, plen uint64) *queryData {
+	name := rs.schema
+	if name == "" {
+		name = "(none)"
+	}
+	c := recordRollup(dbuf, name, plen)
+	if sqlCommand(ptype) {
+		switch statementType(query) {
+		case "SELECT":
+			c.reads++
+		case "OTHER":
+		default:
+			c.writes++
+		}
+	}
+	return c
+}
+
+func buildDatabaseReport(elapsed, lifetime float64, sortby string) []reportRow {
+	return buildRollupReport(dbuf, elapsed, lifetime, sortby)
+}
+
+// printDatabases is the -database-stats part of the status report.
+func printDatabases(rows []reportRow, displaycount int) {
+	printRollup(databaseStatColumns, rows, displaycount)
+}
+
+// percentOf is n as a percentage of total, for a column.
+func percentOf(n, total uint64) string {
+	if total == 0 {
+		return "0.0"
+	}
+	return fmt.Sprintf("%.1f", float64(n)/float64(total)*100)
+}
@@ -0,0 +1,90 @@
+/*
+ * route.go
+ *
+ * Finds the route comment applications put in their queries to say where
+ * they came from, for the #r format token. It's a block comment holding
+ * hostname:route (like web01:checkout), traditionally right after the first
+ * word, as in "SELECT <comment> a FROM ...". The hostname is dropped so
+ * routes from every host get condensed. The comment can be anywhere in the
+ * query, but without a hostname it only counts right after the first word,
+ * or any comment would do. With -route-prefix only comments starting with
+ * the prefix count (say route=, for a comment holding route=checkout), and
+ * those can be anywhere.
+ *
+ * Optimizer hints and executable comments are never routes.
+ */
+
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+var routePrefix string
+
+// findRoute looks for the route comment in a query. Returns the route and
+// where the comment starts and ends, or a start of -1 if there isn't one.
+func findRoute(query string) (string, int, int) {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			// Skip over quoted things, /* in a string isn't a comment.
+			for i++; i < len(query) && query[i] != c; i++ {
+				if query[i] == '\\' && c != '`' {
+					i++
+				}
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return "", -1, -1
+			}
+			end += i + 4
+			if route, ok := routeComment(query[i:end], afterFirstWord(query[:i])); ok {
+				return route, i, end
+			}
+			i = end - 1
+		}
+	}
+	return "", -1, -1
+}
+
+// routeComment picks the route out of a /* comment */, if it's one. first
+// says whether it comes right after the first word of the query.
+func routeComment(comment string, first bool) (string, bool) {
+	if !strings.HasPrefix(comment, "/*") || !strings.HasSuffix(comment, "*/") || len(comment) < 4 ||
+		strings.HasPrefix(comment, "/*!") || strings.HasPrefix(comment, "/*+") {
+		return "", false
+	}
+	body := strings.TrimSpace(comment[2 : len(comment)-2])
+	if routePrefix != "" {
+		if !strings.HasPrefix(body, routePrefix) {
+			return "", false
+		}
+		body = strings.TrimSpace(body[len(routePrefix):])
+	} else if body == "" || strings.IndexFunc(body, unicode.IsSpace) >= 0 ||
+		(!first && !strings.Contains(body, ":")) {
+		return "", false
+	}
+	if i := strings.IndexByte(body, ':'); i >= 0 {
+		body = body[i+1:]
+	}
+	return body, true
+}
+
+// afterFirstWord says whether what comes before a comment is just one word.
+func afterFirstWord(before string) bool {
+	before = strings.TrimSpace(before)
+	return before != "" && strings.IndexFunc(before, unicode.IsSpace) < 0
+}
+
+// condenseRoute rewrites the route comment in a cleaned up query without
+// the hostname, and with its spacing tidied up.
+func condenseRoute(q string) string {
+	route, start, end := findRoute(q)
+	if start < 0 {
+		return q
+	}
+	return q[:start] + "/* " + routePrefix + route + " */" + q[end:]
+}
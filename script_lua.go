@@ -0,0 +1,141 @@
+//go:build lua
+// +build lua
+
+/*
+ * script_lua.go
+ *
+ * -script runs every query past a Lua script, for the one-off analysis
+ * that isn't worth a compiled hook (see hooks.go) or a rebuild. Only built
+ * with `go build -tags lua`, since it needs github.com/yuin/gopher-lua.
+ *
+ * The script defines query(q), where q is a table with the query text and
+ * client, user, database and command. It can change q.query, add anything
+ * else to q to tag the query, and return false to drop it. It can also call
+ * count(name[, n]) to keep its own counters, which show up in the report:
+ *
+ *     function query(q)
+ *         local tenant = q.query:match("tenant_id = (%d+)")
+ *         if tenant then
+ *             q.tenant = tenant
+ *             count("tenant " .. tenant)
+ *         end
+ *     end
+ *
+ * There's one Lua state, so with -workers the script runs one query at a
+ * time.
+ */
+
+package main
+
+import (
+	"fmt"
+	lua "github.com/yuin/gopher-lua"
+	"log"
+	"sort"
+	"sync"
+)
+
+type luaScript struct {
+	path string
+
+	mu      sync.Mutex
+	state   *lua.LState
+	fn      lua.LValue
+	counts  map[string]float64
+	errors  int
+	lastErr error
+}
+
+func openScript(path string) (*luaScript, error) {
+	self := &luaScript{
+		path:   path,
+		state:  lua.NewState(),
+		counts: make(map[string]float64),
+	}
+	self.state.SetGlobal("count", self.state.NewFunction(self.count))
+	if err := self.state.DoFile(path); err != nil {
+		self.state.Close()
+		return nil, err
+	}
+	self.fn = self.state.GetGlobal("query")
+	if self.fn.Type() != lua.LTFunction {
+		self.state.Close()
+		return nil, fmt.Errorf("%s doesn't define query(q)", path)
+	}
+	return self, nil
+}
+
+// count(name[, n]) adds to one of the script's counters.
+func (self *luaScript) count(L *lua.LState) int {
+	self.counts[L.CheckString(1)] += float64(L.OptNumber(2, 1))
+	return 0
+}
+
+func (self *luaScript) hook(query *string, attrs map[string]string) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	L := self.state
+	q := L.NewTable()
+	q.RawSetString("query", lua.LString(*query))
+	for k, v := range attrs {
+		q.RawSetString(k, lua.LString(v))
+	}
+	if err := L.CallByParam(lua.P{Fn: self.fn, NRet: 1, Protect: true}, q); err != nil {
+		// A broken script shouldn't lose us the query.
+		self.errors++
+		self.lastErr = err
+		return true
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	if ret == lua.LFalse {
+		return false
+	}
+
+	q.ForEach(func(k, v lua.LValue) {
+		key, ok := k.(lua.LString)
+		if !ok || v == lua.LNil {
+			return
+		}
+		switch {
+		case key == "query":
+			*query = v.String()
+		case !hookInputs[string(key)]:
+			attrs[string(key)] = v.String()
+		}
+	})
+	return true
+}
+
+// Write prints the script's counters, and owns up to any errors.
+func (self *luaScript) Write(rows []reportRow, elapsed float64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.errors > 0 {
+		logger.Warn("Script failed", "script", self.path, "queries", self.errors, "last_error", self.lastErr)
+		self.errors = 0
+	}
+	if len(self.counts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(self.counts))
+	for name := range self.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("%sScript counters:%s", COLOR_WHITE, COLOR_DEFAULT)
+	for _, name := range names {
+		log.Printf("    %12.0f  %s", self.counts[name], name)
+	}
+	if !cumulative {
+		self.counts = make(map[string]float64)
+	}
+}
+
+func (self *luaScript) Close() {
+	self.mu.Lock()
+	self.state.Close()
+	self.mu.Unlock()
+}
@@ -0,0 +1,31 @@
+//go:build !lua
+// +build !lua
+
+/*
+ * script_lua_stub.go
+ *
+ * -script without -tags lua: openScript says how to get it, and the rest
+ * is never called.
+ */
+
+package main
+
+import (
+	"errors"
+)
+
+type luaScript struct{}
+
+func openScript(path string) (*luaScript, error) {
+	return nil, errors.New("not built with Lua support (use -tags lua)")
+}
+
+func (self *luaScript) hook(query *string, attrs map[string]string) bool {
+	return true
+}
+
+func (self *luaScript) Write(rows []reportRow, elapsed float64) {
+}
+
+func (self *luaScript) Close() {
+}
@@ -0,0 +1,85 @@
+//go:build lua
+// +build lua
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lua")
+	os.WriteFile(path, []byte(`
+function query(q)
+    if q.query:find("heartbeat") then
+        return false
+    end
+    q.query = q.query:gsub("secret_table", "t")
+    local tenant = q.query:match("tenant_id = (%d+)")
+    if tenant then
+        q.tenant = tenant
+        count("tenant " .. tenant)
+        count("rows", 2)
+    end
+    if q.query:find("boom") then
+        error("boom")
+    end
+end
+`), 0644)
+	if _, err := openScript(filepath.Join(t.TempDir(), "nonesuch.lua")); err == nil {
+		t.Errorf("Expected a missing script refused")
+	}
+	script, err := openScript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	query, attrs := "select heartbeat from ops", map[string]string{"client": "10.0.0.1"}
+	if script.hook(&query, attrs) {
+		t.Errorf("Expected the heartbeat dropped")
+	}
+	query = "select * from secret_table where tenant_id = 7"
+	if !script.hook(&query, attrs) || query != "select * from t where tenant_id = 7" {
+		t.Errorf("Expected the query rewritten, got %q", query)
+	}
+	if attrs["tenant"] != "7" || attrs["client"] != "10.0.0.1" {
+		t.Errorf("Expected the query tagged, got %v", attrs)
+	}
+	query = "select * from t where tenant_id = 7"
+	script.hook(&query, map[string]string{})
+	if script.counts["tenant 7"] != 2 || script.counts["rows"] != 4 {
+		t.Errorf("Expected the script's counters, got %v", script.counts)
+	}
+
+	// A script error keeps the query, and is counted.
+	query = "select boom"
+	if !script.hook(&query, map[string]string{}) || script.errors != 1 {
+		t.Errorf("Expected the query kept after an error, got %q and %d errors", query, script.errors)
+	}
+	script.Write(nil, 10)
+	if script.errors != 0 || len(script.counts) != 0 {
+		t.Errorf("Expected the counters reset by the report, got %v", script.counts)
+	}
+
+	// And through the packet path, like a compiled hook.
+	parseFormat("#q")
+	qbuf = make(map[string]*queryData)
+	queryHooks = append(queryHooks, script.hook)
+	defer func() { queryHooks = nil }()
+	rs := &source{src: "10.0.0.1:1234", synced: true}
+	processRequest(rs, COM_QUERY, []byte("select * from secret_table where id = 1"), time.Now())
+	processRequest(rs, COM_QUERY, []byte("select heartbeat from ops"), time.Now())
+	if len(qbuf) != 1 || qbuf["select * from t where id = ?"] == nil {
+		t.Errorf("Expected just the rewritten query counted, got %v", qbuf)
+	}
+	for q := range qbuf {
+		if strings.Contains(q, "heartbeat") {
+			t.Errorf("Expected the heartbeat dropped, got %v", qbuf)
+		}
+	}
+}
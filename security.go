@@ -0,0 +1,134 @@
+/*
+ * security.go
+ *
+ * -security: look at every query as the client sent it for the usual signs
+ * of SQL injection, and log the ones that have them along with who sent
+ * them. These are heuristics, not a WAF. Applications do legitimately UNION
+ * and SLEEP now and then, so expect to tune with -exclude-client, but an
+ * ORM never sends OR 1=1.
+ *
+ * Each client gets logged once per query and report, so a scanner hammering
+ * away shows up as a few lines and a count in the report rather than a
+ * flood.
+ */
+
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+)
+
+type securityCheck struct {
+	why   string
+	match func(query string) bool
+}
+
+var securityChecks = []securityCheck{
+	// UNION SELECT NULL, NULL, ... and UNION SELECT 1, 2, 3 are how column
+	// counts get probed.
+	{"UNION probe", regexp.MustCompile(`(?i)\bunion(\s|/\*.*?\*/)+(all(\s|/\*.*?\*/)+)?select(\s|/\*.*?\*/)+(null|\d+)\s*(,\s*(null|\d+)\s*)+($|--|#|/\*|\bfrom\s+dual\b)`).MatchString},
+	{"UNION into system tables", regexp.MustCompile(`(?i)\bunion\b.*\bselect\b.*(\binformation_schema\b|\bmysql\.user\b|@@version\b|\bversion\s*\(\s*\))`).MatchString},
+	{"time delay", regexp.MustCompile(`(?i)\b(sleep|benchmark)\s*\(`).MatchString},
+	{"file access", regexp.MustCompile(`(?i)\bload_file\s*\(|\binto\s+(out|dump)file\b`).MatchString},
+	{"inline comment as space", regexp.MustCompile(`\w/\*\*/\w|/\*\*/(?i:select|union|or|and)\b`).MatchString},
+	{"comment cutting off a quote", commentedQuote},
+	{"stacked query", regexp.MustCompile(`(?i);\s*(drop|truncate|delete|update|insert|select|shutdown|grant|create)\b`).MatchString},
+}
+
+// Tautologies like OR 1=1 and OR 'a'='a' need the two sides compared, which
+// regexp can't do by itself.
+var tautology = regexp.MustCompile(`(?i)(\bor\b|\|\|)\s*('[^']*'|"[^"]*"|\d+)\s*=\s*('[^']*'|"[^"]*"|\d+)`)
+
+// commentedQuote spots the admin'-- trick: a comment that hides a quote
+// from the rest of the query.
+func commentedQuote(query string) bool {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			for i++; i < len(query) && query[i] != c; i++ {
+				if query[i] == '\\' && c != '`' {
+					i++
+				}
+			}
+		case c == '#' || (c == '-' && strings.HasPrefix(query[i:], "--") &&
+			(i+2 == len(query) || query[i+2] == ' ' || query[i+2] == '\t' || query[i+2] == '\n')):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			return strings.ContainsAny(query[i:i+end], `'"`)
+		}
+	}
+	return false
+}
+
+type securityMonitor struct {
+	seen    map[string]bool // client and query, this report
+	hits    int
+	clients map[string]bool
+}
+
+var security *securityMonitor
+
+func openSecurity() *securityMonitor {
+	self := &securityMonitor{}
+	self.reset()
+	return self
+}
+
+func (self *securityMonitor) reset() {
+	self.seen = make(map[string]bool)
+	self.clients = make(map[string]bool)
+	self.hits = 0
+}
+
+// suspicious lists what looks wrong with a query, if anything.
+func suspicious(query string) []string {
+	var why []string
+	for _, m := range tautology.FindAllStringSubmatch(query, -1) {
+		if m[2] == m[3] || strings.Trim(m[2], `'"`) == strings.Trim(m[3], `'"`) {
+			why = append(why, "tautology "+strings.TrimSpace(m[0]))
+			break
+		}
+	}
+	for _, c := range securityChecks {
+		if c.match(query) {
+			why = append(why, c.why)
+		}
+	}
+	return why
+}
+
+// Check looks at one query from a client.
+func (self *securityMonitor) Check(rs *source, query []byte) {
+	why := suspicious(string(query))
+	if len(why) == 0 {
+		return
+	}
+	self.hits++
+	self.clients[rs.clientIP()] = true
+	key := rs.clientIP() + "\x00" + cleanupQuery(query)
+	if self.seen[key] {
+		return
+	}
+	self.seen[key] = true
+	user := rs.user
+	if user == "" {
+		user = "(unknown)"
+	}
+	logger.Warn("Suspicious query", "client", rs.client(), "user", user, "why", strings.Join(why, ", "),
+		"query", validUTF8(clip(string(query), 1024)))
+}
+
+// Write sums up the report's worth.
+func (self *securityMonitor) Write(rows []reportRow, elapsed float64) {
+	if self.hits > 0 {
+		log.Printf("%s%d suspicious queries from %d clients%s", COLOR_RED, self.hits, len(self.clients), COLOR_DEFAULT)
+	}
+	self.reset()
+}
+
+func (self *securityMonitor) Close() {
+}
@@ -0,0 +1,139 @@
+/*
+ * session.go
+ *
+ * Keeps track of who each connection is logged in as and the database it's
+ * using, for the #u and #d format tokens. The user comes from the handshake
+ * or COM_CHANGE_USER. Clients pick a database in the handshake, with
+ * COM_INIT_DB, with COM_CHANGE_USER, or with a USE statement, and we watch
+ * for all of them.
+ *
+ * We take the client's word for it: if the server refuses the change we're
+ * wrong until the next one. We can't see inside TLS either, so encrypted
+ * connections never get a user or database, and neither do connections that
+ * were already open when we started.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// Capability flags we need to find our way through a handshake response.
+const (
+	CLIENT_CONNECT_WITH_DB                = 0x00000008
+	CLIENT_PROTOCOL_41                    = 0x00000200
+	CLIENT_SECURE_CONNECTION              = 0x00008000
+	CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA = 0x00200000
+)
+
+// trackSession looks at the next packet in a request buffer, before it gets
+// carved up, for anything that changes the connection's user or database.
+func trackSession(rs *source, buf []byte) {
+	if len(buf) < 5 {
+		return
+	}
+	size := int(buf[0]) | int(buf[1])<<8 | int(buf[2])<<16
+	if size == 0 || len(buf) < size+4 {
+		return
+	}
+	seq, p := buf[3], buf[4:size+4]
+
+	switch {
+	case seq == 1:
+		// Commands always start at 0, so this is the handshake response.
+		if user, db, ok := handshakeResponse(p); ok {
+			rs.user, rs.schema = user, db
+		}
+	case seq != 0:
+	case p[0] == COM_INIT_DB:
+		rs.schema = string(p[1:])
+	case p[0] == COM_CHANGE_USER:
+		rs.user, rs.schema = changeUser(p[1:])
+	case p[0] == COM_QUERY:
+		if db, ok := useSchema(p[1:]); ok {
+			rs.schema = db
+		}
+	}
+}
+
+// handshakeResponse digs the user and database (if the client asked for
+// one) out of a HandshakeResponse41.
+func handshakeResponse(p []byte) (user, db string, ok bool) {
+	if len(p) < 33 {
+		return "", "", false
+	}
+	caps := binary.LittleEndian.Uint32(p)
+	if caps&CLIENT_PROTOCOL_41 == 0 {
+		return "", "", false
+	}
+	// Capabilities, max packet size, character set and filler, then the
+	// user name.
+	p = p[32:]
+	i := bytes.IndexByte(p, 0)
+	if i < 0 {
+		return "", "", false
+	}
+	user, p = string(p[:i]), p[i+1:]
+	if caps&CLIENT_CONNECT_WITH_DB == 0 {
+		return user, "", true
+	}
+
+	switch {
+	case caps&CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA != 0:
+		n, size := lenencInt(p)
+		if uint64(len(p)-size) < n {
+			return user, "", true
+		}
+		p = p[uint64(size)+n:]
+	case caps&CLIENT_SECURE_CONNECTION != 0:
+		if len(p) < 1 || len(p) < 1+int(p[0]) {
+			return user, "", true
+		}
+		p = p[1+int(p[0]):]
+	default:
+		if i = bytes.IndexByte(p, 0); i < 0 {
+			return user, "", true
+		}
+		p = p[i+1:]
+	}
+	return user, cstring(p), true
+}
+
+// changeUser gets the user and database from a COM_CHANGE_USER: the user
+// name, the length prefixed auth response, then the database.
+func changeUser(p []byte) (user, db string) {
+	i := bytes.IndexByte(p, 0)
+	if i < 0 || len(p) < i+2 {
+		return cstring(p), ""
+	}
+	user, p = string(p[:i]), p[i+1:]
+	if len(p) < 1+int(p[0]) {
+		return user, ""
+	}
+	return user, cstring(p[1+int(p[0]):])
+}
+
+// useSchema recognizes a USE statement and returns the database it names.
+func useSchema(q []byte) (string, bool) {
+	// Every query comes through here, so look before copying anything.
+	q = bytes.TrimLeft(q, " \t\r\n")
+	if len(q) < 4 || !bytes.EqualFold(q[:3], []byte("use")) || bytes.IndexByte([]byte(" \t\r\n`"), q[3]) < 0 {
+		return "", false
+	}
+	db := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(string(q[3:])), ";"))
+	if len(db) >= 2 && db[0] == '`' && db[len(db)-1] == '`' {
+		db = strings.Replace(db[1:len(db)-1], "``", "`", -1)
+	}
+	return db, db != ""
+}
+
+// cstring reads a NUL terminated string, or to the end if there's no NUL.
+func cstring(p []byte) string {
+	if i := bytes.IndexByte(p, 0); i >= 0 {
+		p = p[:i]
+	}
+	return string(p)
+}
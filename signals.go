@@ -0,0 +1,63 @@
+/*
+ * signals.go
+ *
+ * SIGINT and SIGTERM (or -T and -count running out) stop the capture at
+ * the next packet (or poll timeout) so we can print a final report with
+ * every query in it and let the sinks send what they've got, rather than
+ * losing the last interval. A second signal gives up and exits on the spot,
+ * for when the capture isn't coming back.
+ *
+ * SIGUSR1 asks for a report right now, and SIGUSR2 throws away everything
+ * we've counted and starts again, for lining things up with an incident
+ * without a restart. Windows has neither (see signals_other.go).
+ */
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+var quitting int32
+var reportRequested, resetRequested int32
+
+func watchSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	if reportSignal != nil {
+		signal.Notify(sigs, reportSignal, resetSignal)
+	}
+	go func() {
+		for sig := range sigs {
+			switch {
+			case sig == reportSignal:
+				atomic.StoreInt32(&reportRequested, 1)
+			case sig == resetSignal:
+				atomic.StoreInt32(&resetRequested, 1)
+			case stopping():
+				os.Exit(1)
+			default:
+				stop()
+				logger.Info("Stopping after the final report, interrupt again to quit now")
+			}
+		}
+	}()
+}
+
+// requested says whether a signal asked for something since we last
+// looked, and clears it.
+func requested(flag *int32) bool {
+	return atomic.SwapInt32(flag, 0) != 0
+}
+
+// stop asks the capture loop to wrap up.
+func stop() {
+	atomic.StoreInt32(&quitting, 1)
+}
+
+func stopping() bool {
+	return atomic.LoadInt32(&quitting) != 0
+}
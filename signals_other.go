@@ -0,0 +1,16 @@
+//go:build !unix
+
+/*
+ * signals_other.go
+ *
+ * There's no SIGUSR1 or SIGUSR2 outside unix, so there the only reports
+ * are the timed ones, and only a restart resets the counters.
+ */
+
+package main
+
+import (
+	"os"
+)
+
+var reportSignal, resetSignal os.Signal
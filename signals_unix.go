@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// What asks for a report right now, and what resets the counters.
+var reportSignal, resetSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
@@ -0,0 +1,76 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignals(t *testing.T) {
+	defer func() { quitting = 0 }()
+	watchSignals()
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	for i := 0; i < 100 && !stopping(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !stopping() {
+		t.Errorf("Expected SIGTERM to stop the capture")
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	for i := 0; i < 100 && (atomic.LoadInt32(&reportRequested) == 0 || atomic.LoadInt32(&resetRequested) == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !requested(&reportRequested) || !requested(&resetRequested) {
+		t.Errorf("Expected SIGUSR1 and SIGUSR2 to ask for a report and a reset")
+	}
+	if requested(&reportRequested) {
+		t.Errorf("Expected a request to be handled once")
+	}
+
+	qbuf = map[string]*queryData{"select ?": {count: 5, total: 5}}
+	querycount = 5
+	resetAll()
+	if len(qbuf) != 0 || querycount != 0 || intervalcount != 0 {
+		t.Errorf("Expected everything forgotten after a reset")
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sniffer.log")
+	defer log.SetOutput(os.Stderr)
+	openLog(path)
+	log.Printf("before")
+	os.Rename(path, path+".1")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Printf("after")
+
+	old, _ := os.ReadFile(path + ".1")
+	cur, _ := os.ReadFile(path)
+	if !strings.Contains(string(old), "before") || strings.Contains(string(old), "after") ||
+		!strings.Contains(string(cur), "after") {
+		t.Errorf("Expected SIGHUP to move the log to a new file, got %q then %q", old, cur)
+	}
+
+	pidfile := filepath.Join(dir, "sniffer.pid")
+	writePidfile(pidfile)
+	if data, _ := os.ReadFile(pidfile); strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Expected our pid in the pidfile, got %q", data)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * slowlog.go
+ *
+ * A slow query log from the wire, for servers where turning on the real one
+ * isn't an option. Every query that takes -slow-ms or longer is written out
+ * as soon as its response is in, with its full text as the client sent it,
+ * in the same format as MySQL's slow log so pt-query-digest and friends can
+ * read it.
+ *
+ * We can't see locks, how many rows were looked at or the thread id, so
+ * those are zero. The client's address and port go on a line of their own.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type slowLogger struct {
+	file *os.File
+}
+
+var slowlog *slowLogger
+
+// openSlowLog appends to the file, or uses stdout for "-".
+func openSlowLog(path string) *slowLogger {
+	self := &slowLogger{file: os.Stdout}
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fatalf("Failed to open %s: %s", path, err.Error())
+		}
+		self.file = f
+	}
+	return self
+}
+
+// Query logs one completed query if it was slow enough.
+func (self *slowLogger) Query(rs *source, req *pendingRequest, reqtime uint64) {
+	if req.raw == "" || req.qdata == nil || float64(reqtime)/1000000 < slowMs {
+		return
+	}
+	host := hostOf(rs.sender(req))
+	user := rs.user
+	if user == "" {
+		user = "unknown"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Time: %s\n", req.sent.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	fmt.Fprintf(&b, "# User@Host: %s[%s] @  [%s]  Id: 0\n", user, user, host)
+	fmt.Fprintf(&b, "# Query_time: %0.6f  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0\n",
+		float64(reqtime)/1000000000)
+	fmt.Fprintf(&b, "# Bytes_sent: %d  TTFB: %0.6f  Client: %s\n", req.rbytes, float64(req.ttfb)/1000000000, rs.sender(req))
+	if rs.schema != "" {
+		fmt.Fprintf(&b, "use %s;\n", rs.schema)
+	}
+	fmt.Fprintf(&b, "SET timestamp=%d;\n", req.sent.Unix())
+	b.WriteString(strings.TrimRight(req.raw, "; \t\r\n"))
+	b.WriteString(";\n")
+
+	if _, err := self.file.WriteString(b.String()); err != nil {
+		logger.Warn("Failed to write to the slow log", "err", err)
+	}
+}
+
+func (self *slowLogger) Write(rows []reportRow, elapsed float64) {
+}
+
+func (self *slowLogger) Close() {
+	if self.file != os.Stdout {
+		self.file.Close()
+	}
+}
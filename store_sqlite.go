@@ -0,0 +1,103 @@
+//go:build sqlite
+// +build sqlite
+
+/*
+ * store_sqlite.go
+ *
+ * Keeps every status report in a SQLite database, one row per query per
+ * interval, so there's some history to look back on without standing up a
+ * metrics stack. Only built with `go build -tags sqlite` since the driver
+ * needs cgo.
+ *
+ * Something like this answers "what did it look like last Tuesday":
+ *
+ *     SELECT datetime(time, 'unixepoch'), count, avg_ms, p99_ms
+ *       FROM query_stats WHERE query_id = '...' ORDER BY time;
+ */
+
+package main
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"time"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS query_stats (
+	time         INTEGER NOT NULL,
+	interval     REAL NOT NULL,
+	query_id     TEXT NOT NULL,
+	query        TEXT NOT NULL,
+	type         INTEGER NOT NULL,
+	count        INTEGER NOT NULL,
+	qps          REAL NOT NULL,
+	lifetime_qps REAL NOT NULL,
+	min_ms       REAL NOT NULL,
+	avg_ms       REAL NOT NULL,
+	max_ms       REAL NOT NULL,
+	stddev_ms    REAL NOT NULL,
+	p50_ms       REAL NOT NULL,
+	p95_ms       REAL NOT NULL,
+	p99_ms       REAL NOT NULL,
+	ttfb_ms      REAL NOT NULL,
+	bytes        INTEGER NOT NULL,
+	bytes_per    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS query_stats_id_time ON query_stats (query_id, time);
+CREATE INDEX IF NOT EXISTS query_stats_time ON query_stats (time);
+`
+
+type sqliteStore struct {
+	path string
+	db   *sql.DB
+}
+
+func openStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{path: path, db: db}, nil
+}
+
+// Write adds one interval's rows in a single transaction. A failure is
+// logged and that interval skipped; a full disk shouldn't stop the sniffing.
+func (self *sqliteStore) Write(rows []reportRow, elapsed float64) {
+	tx, err := self.db.Begin()
+	if err != nil {
+		logger.Warn("Failed to write to the store", "path", self.path, "err", err)
+		return
+	}
+	stmt, err := tx.Prepare(`INSERT INTO query_stats VALUES
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		logger.Warn("Failed to write to the store", "path", self.path, "err", err)
+		return
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for _, r := range rows {
+		_, err = stmt.Exec(now, elapsed, r.id, r.query, r.ptype,
+			int64(r.count), r.qps, r.lifeqps, r.min, r.avg, r.max, r.stddev,
+			r.p50, r.p95, r.p99, r.ttfb, int64(r.bytes), int64(r.bytesPer))
+		if err != nil {
+			tx.Rollback()
+			logger.Warn("Failed to write to the store", "path", self.path, "err", err)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		logger.Warn("Failed to write to the store", "path", self.path, "err", err)
+	}
+}
+
+func (self *sqliteStore) Close() {
+	self.db.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !sqlite
+// +build !sqlite
+
+package main
+
+import (
+	"errors"
+)
+
+type sqliteStore struct{}
+
+func openStore(path string) (*sqliteStore, error) {
+	return nil, errors.New("not built with SQLite support (use -tags sqlite)")
+}
+
+func (self *sqliteStore) Write(rows []reportRow, elapsed float64) {
+}
+
+func (self *sqliteStore) Close() {
+}
@@ -0,0 +1,90 @@
+/*
+ * systemd.go
+ *
+ * Enough of systemd's protocols to run as a Type=notify service without
+ * libsystemd: we say READY=1 once the capture is going, keep the watchdog
+ * fed from the capture loop (so a wedged loop gets us restarted), put the
+ * query rate in the status line and say STOPPING=1 on the way out.
+ *
+ * The -http listener can also come from socket activation, in which case
+ * the socket systemd hands us is used whatever -http says.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const SD_LISTEN_FDS_START = 3
+
+var sdWatchdogEvery time.Duration // zero when there's no watchdog
+var sdWatchdogLast time.Time
+
+// sdNotify sends a state change to systemd, if it's listening.
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	if path[0] == '@' {
+		// Abstract namespace.
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// sdStart tells systemd we're up and works out how often it wants to hear
+// from us.
+func sdStart() {
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		pid := os.Getenv("WATCHDOG_PID")
+		if pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			sdWatchdogEvery = time.Duration(usec) * time.Microsecond / 2
+		}
+	}
+	sdNotify("READY=1")
+	sdWatchdogLast = time.Now()
+}
+
+// sdWatchdog pets the watchdog if it's time. The capture loop calls it
+// between packets.
+func sdWatchdog() {
+	if sdWatchdogEvery == 0 {
+		return
+	}
+	if now := time.Now(); now.Sub(sdWatchdogLast) >= sdWatchdogEvery {
+		sdNotify("WATCHDOG=1")
+		sdWatchdogLast = now
+	}
+}
+
+// sdStatus puts a line of how we're doing in systemctl status.
+func sdStatus(elapsed float64) {
+	sdNotify(fmt.Sprintf("STATUS=%d queries, %0.2f per second, %d connections",
+		scaled(uint64(querycount)), float64(scaled(uint64(intervalcount)))/elapsed, streamCount()))
+}
+
+// sdListener returns the socket systemd passed us, if it did.
+func sdListener() net.Listener {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || n < 1 {
+		return nil
+	}
+	ln, err := net.FileListener(os.NewFile(SD_LISTEN_FDS_START, "systemd"))
+	if err != nil {
+		return nil
+	}
+	return ln
+}
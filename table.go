@@ -0,0 +1,140 @@
+/*
+ * table.go
+ *
+ * Picks tables out of queries. queryTable finds the main one for the #t
+ * format token, so the report can be rolled up per table. "Main" is the first
+ * one after FROM, INTO, UPDATE or TABLE, which is the right answer for the
+ * simple statements that make up most traffic. Joins and subqueries get
+ * counted against whichever table comes first.
+ *
+ * queryTables finds all of them, joins and subqueries included, for the
+ * per-table stats from -tables. It's still just looking at the words after
+ * those keywords, so the odd function like EXTRACT(YEAR FROM d) will turn up
+ * a table that isn't one.
+ */
+
+package main
+
+import "strings"
+
+// Words that can sit between the keyword and the table name.
+var tableSkipWords = map[string]bool{
+	"low_priority": true, "high_priority": true, "delayed": true, "quick": true,
+	"ignore": true, "if": true, "not": true, "exists": true, "only": true,
+}
+
+// queryTable returns the main table of a cleaned up query, with any database
+// in front of it, or (none) if it doesn't have one.
+func queryTable(query string) string {
+	tokens := tableTokens(query)
+	for i := 0; i < len(tokens); i++ {
+		switch strings.ToLower(tokens[i]) {
+		case "from", "into", "update", "table":
+		default:
+			continue
+		}
+		// FROM (SELECT ...) and the like have no name, keep looking.
+		if name, _ := tableName(tokens, i+1); name != "" {
+			return name
+		}
+	}
+	return "(none)"
+}
+
+// queryTables returns every table a cleaned up query uses, once each.
+func queryTables(query string) []string {
+	var tables []string
+	seen := make(map[string]bool)
+	tokens := tableTokens(query)
+	for i := 0; i < len(tokens); i++ {
+		keyword := strings.ToLower(tokens[i])
+		switch keyword {
+		case "from", "join", "straight_join", "into", "update", "table":
+		default:
+			continue
+		}
+		for j := i + 1; ; {
+			name, next := tableName(tokens, j)
+			if name == "" || strings.EqualFold(name, "dual") {
+				break
+			}
+			if !seen[name] {
+				seen[name] = true
+				tables = append(tables, name)
+			}
+			if keyword != "from" && keyword != "update" {
+				break
+			}
+
+			// The old style FROM a, b AS x, c join, or a multi table UPDATE.
+			if next < len(tokens) && strings.EqualFold(tokens[next], "as") {
+				next++
+			}
+			if next+1 < len(tokens) && isIdentifier(tokens[next]) && tokens[next+1] == "," {
+				next++
+			}
+			if next >= len(tokens) || tokens[next] != "," {
+				break
+			}
+			j = next + 1
+		}
+	}
+	return tables
+}
+
+// tableName reads the table name starting at tokens[i], returning it (with
+// any database in front) and where it ends, or "" if there isn't one there.
+func tableName(tokens []string, i int) (string, int) {
+	for i < len(tokens) && tableSkipWords[strings.ToLower(tokens[i])] {
+		i++
+	}
+	if i >= len(tokens) || !isIdentifier(tokens[i]) {
+		return "", i
+	}
+	name := tokens[i]
+	if i+2 < len(tokens) && tokens[i+1] == "." && isIdentifier(tokens[i+2]) {
+		return name + "." + tokens[i+2], i + 3
+	}
+	return name, i + 1
+}
+
+// tableTokens splits a query into identifiers (unquoting `backticked` ones)
+// and single punctuation characters, dropping whitespace.
+func tableTokens(query string) []string {
+	var tokens []string
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '`':
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			tokens = append(tokens, query[i+1:i+1+end])
+			i += end + 2
+		case isIdentChar(c):
+			j := i
+			for j < len(query) && isIdentChar(query[j]) {
+				j++
+			}
+			tokens = append(tokens, query[i:j])
+			i = j
+		case c == ' ' || (c >= 9 && c <= 13):
+			i++
+		default:
+			tokens = append(tokens, query[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+// isIdentChar says whether c can be part of an unquoted identifier. MySQL
+// allows most of Unicode, so any byte of a UTF-8 sequence counts.
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c >= 0x80
+}
+
+func isIdentifier(token string) bool {
+	return token != "" && token != "?" && (len(token) > 1 || isIdentChar(token[0]))
+}
@@ -0,0 +1,76 @@
+/*
+ * timeseries.go
+ *
+ * -timeseries writes one line per status report with the interval's totals,
+ * so a long run can be grepped, or plotted with gnuplot or a spreadsheet,
+ * without a metrics system:
+ *
+ *     2024-05-01T12:00:10Z interval=10 qps=1523.40 reads=1201.10 writes=310.20 p50=0.41 p95=2.87 p99=9.10 bytes=18230412 errors=3
+ *
+ * qps, reads and writes are per second, latencies in ms and bytes the total
+ * both ways. Fields only ever get added at the end.
+ *
+ * Reading a file with -r, lines are stamped with the capture's clock, when
+ * the last packet so far was seen, and the rates are over the capture time
+ * the interval covered, so a capture plots like it was sniffed live.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+type timeseriesSink struct {
+	path string
+	file *os.File
+}
+
+// openTimeseries creates the file, or uses stdout for "-".
+func openTimeseries(path string) *timeseriesSink {
+	if cumulative {
+		fatalf("-timeseries is per interval, it can't be -cumulative")
+	}
+	self := &timeseriesSink{path: path, file: os.Stdout}
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fatalf("Failed to create %s: %s", path, err.Error())
+		}
+		self.file = f
+	}
+	return self
+}
+
+func (self *timeseriesSink) Write(rows []reportRow, elapsed float64) {
+	reads, writes, _ := workloadMix()
+	var bytes, errors uint64
+	for _, c := range qbuf {
+		bytes += c.bytes
+		errors += c.errors
+	}
+	p50, p95, p99 := calculatePercentiles(&times)
+	at := time.Now()
+	if offline {
+		if at = digestTo; at.IsZero() {
+			at = processNow()
+		}
+		if span := digestTo.Sub(digestFrom).Seconds(); span >= 1 {
+			elapsed = span
+		}
+	}
+	_, err := fmt.Fprintf(self.file, "%s interval=%.0f qps=%.2f reads=%.2f writes=%.2f p50=%.2f p95=%.2f p99=%.2f bytes=%d errors=%d\n",
+		at.UTC().Format(time.RFC3339), elapsed, float64(scaled(uint64(intervalcount)))/elapsed,
+		float64(reads)/elapsed, float64(writes)/elapsed, p50, p95, p99, scaled(bytes), scaled(errors))
+	if err != nil {
+		fatalf("Failed to write to %s: %s", self.path, err.Error())
+	}
+}
+
+func (self *timeseriesSink) Close() {
+	if self.file != os.Stdout {
+		self.file.Close()
+	}
+}
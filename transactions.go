@@ -0,0 +1,233 @@
+/*
+ * transactions.go
+ *
+ * With -transactions we follow each connection in and out of transactions
+ * and report how many there were, how long they took, how many statements
+ * they ran and how many were rolled back. Long transactions hold locks and
+ * undo, and a replica applies each one in a lump, so they're what to look
+ * at when replication lags.
+ *
+ * A transaction starts with BEGIN or START TRANSACTION, or after SET
+ * autocommit=0 with the first statement, and lasts until the answer to its
+ * COMMIT or ROLLBACK (ROLLBACK TO SAVEPOINT doesn't count), so the commit
+ * itself is included. DDL, LOCK TABLES, another BEGIN and turning autocommit
+ * back on commit implicitly, and hanging up rolls back. Statements outside
+ * a transaction are autocommitted, and counted as that.
+ *
+ * Anything already open when we started watching is a loss: we don't know
+ * when it began, so its COMMIT is ignored. Prepared statements are counted
+ * as statements, but we can't see what they say, so a prepared BEGIN or
+ * COMMIT goes unnoticed.
+ */
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"time"
+)
+
+// What a statement does to the transaction we're in.
+const (
+	TXN_NONE     = iota // an ordinary statement
+	TXN_BEGIN           // starts one, committing any that's open
+	TXN_COMMIT          // ends one
+	TXN_ROLLBACK        // ... the other way
+	TXN_IMPLICIT        // commits any that's open and isn't part of one
+	TXN_AUTOCOMMIT_ON
+	TXN_AUTOCOMMIT_OFF
+)
+
+type transaction struct {
+	start      time.Time
+	statements uint64
+	rollback   bool
+}
+
+var transactionStats bool
+
+// Transactions finished this interval.
+var txnStats struct {
+	count      uint64
+	rollbacks  uint64
+	autocommit uint64 // statements outside a transaction
+	times      histogram
+	statements histogram
+}
+
+var setAutocommit = regexp.MustCompile(`(?i)^set\s+(?:(?:session|local)\s+|@@(?:session\.|local\.)?)?autocommit\s*[=:]+\s*['"]?(\w+)`)
+
+// txnStatement works out what a query does to the transaction we're in.
+func txnStatement(query []byte) int {
+	query = skipComments(query)
+	word, rest := firstWord(query)
+	switch {
+	case bytes.EqualFold(word, []byte("begin")):
+		return TXN_BEGIN
+	case bytes.EqualFold(word, []byte("start")):
+		if next, _ := firstWord(rest); bytes.EqualFold(next, []byte("transaction")) {
+			return TXN_BEGIN
+		}
+	case bytes.EqualFold(word, []byte("commit")):
+		return TXN_COMMIT
+	case bytes.EqualFold(word, []byte("rollback")):
+		// ROLLBACK [WORK] TO [SAVEPOINT] x stays in the transaction.
+		next, after := firstWord(rest)
+		if bytes.EqualFold(next, []byte("work")) {
+			next, _ = firstWord(after)
+		}
+		if !bytes.EqualFold(next, []byte("to")) {
+			return TXN_ROLLBACK
+		}
+	case bytes.EqualFold(word, []byte("lock")):
+		if next, _ := firstWord(rest); bytes.EqualFold(next, []byte("tables")) || bytes.EqualFold(next, []byte("table")) {
+			return TXN_IMPLICIT
+		}
+	case bytes.EqualFold(word, []byte("set")):
+		if m := setAutocommit.FindSubmatch(query); m != nil {
+			switch string(bytes.ToLower(m[1])) {
+			case "1", "on", "true":
+				return TXN_AUTOCOMMIT_ON
+			case "0", "off", "false":
+				return TXN_AUTOCOMMIT_OFF
+			}
+		}
+	default:
+		if statementType(word) == "DDL" {
+			return TXN_IMPLICIT
+		}
+	}
+	return TXN_NONE
+}
+
+// skipComments skips any whitespace and /* comments */ at the start of a
+// query.
+func skipComments(query []byte) []byte {
+	for {
+		query = bytes.TrimLeft(query, " \t\r\n")
+		if !bytes.HasPrefix(query, []byte("/*")) {
+			return query
+		}
+		end := bytes.Index(query[2:], []byte("*/"))
+		if end < 0 {
+			return nil
+		}
+		query = query[end+4:]
+	}
+}
+
+// firstWord splits off the first word of a query.
+func firstWord(query []byte) ([]byte, []byte) {
+	query = bytes.TrimLeft(query, " \t\r\n")
+	i := 0
+	for i < len(query) && isIdentChar(query[i]) {
+		i++
+	}
+	return query[:i], query[i:]
+}
+
+// trackTransaction follows a request in and out of transactions, leaving a
+// COMMIT or ROLLBACK's transaction on the request to be finished when it's
+// answered. Call it with the state locked.
+func trackTransaction(rs *source, req *pendingRequest, pdata []byte, ts time.Time) {
+	action := TXN_NONE
+	switch {
+	case sqlCommand(req.ptype):
+		action = txnStatement(pdata)
+	case req.ptype == COM_STMT_EXECUTE:
+	case req.ptype == COM_CHANGE_USER || req.ptype == COM_RESET_CONNECTION:
+		action = TXN_ROLLBACK
+	default:
+		// Pings, COM_INIT_DB and the like aren't statements.
+		return
+	}
+
+	switch action {
+	case TXN_NONE:
+		if rs.txn == nil && rs.manual {
+			rs.txn = &transaction{start: ts}
+		}
+		if rs.txn != nil {
+			rs.txn.statements++
+		} else {
+			txnStats.autocommit++
+		}
+	case TXN_BEGIN:
+		endTransaction(rs.txn, ts)
+		rs.txn = &transaction{start: ts}
+	case TXN_COMMIT, TXN_ROLLBACK:
+		if rs.txn != nil {
+			rs.txn.rollback = action == TXN_ROLLBACK
+			req.txn, rs.txn = rs.txn, nil
+		}
+	case TXN_IMPLICIT, TXN_AUTOCOMMIT_ON, TXN_AUTOCOMMIT_OFF:
+		endTransaction(rs.txn, ts)
+		rs.txn = nil
+		if action != TXN_IMPLICIT {
+			rs.manual = action == TXN_AUTOCOMMIT_OFF
+		}
+	}
+	if req.ptype == COM_CHANGE_USER || req.ptype == COM_RESET_CONNECTION {
+		rs.manual = false
+	}
+}
+
+// endTransaction counts a transaction that ended at ts, if there was one.
+// Call it with the state locked.
+func endTransaction(txn *transaction, ts time.Time) {
+	if txn == nil {
+		return
+	}
+	txnStats.count++
+	if txn.rollback {
+		txnStats.rollbacks++
+	}
+	txnStats.times.Record(latency(txn.start, ts))
+	txnStats.statements.Record(txn.statements)
+}
+
+func resetTransactions() {
+	txnStats.count, txnStats.rollbacks, txnStats.autocommit = 0, 0, 0
+	txnStats.times.Reset()
+	txnStats.statements.Reset()
+}
+
+// longestTransaction finds the transaction that's been open longest. Call
+// it paused.
+func longestTransaction() (*source, *transaction) {
+	var longest *source
+	eachStream(func(rs *source) {
+		if rs.txn != nil && (longest == nil || rs.txn.start.Before(longest.txn.start)) {
+			longest = rs
+		}
+	})
+	if longest == nil {
+		return nil, nil
+	}
+	return longest, longest.txn
+}
+
+// printTransactions is the -transactions part of the status report.
+func printTransactions(elapsed float64) {
+	log.Printf(" ")
+	rate := 0.0
+	if txnStats.count > 0 {
+		rate = float64(txnStats.rollbacks) / float64(txnStats.count) * 100
+	}
+	log.Printf("%d transactions, %0.2f per second, %0.1f%% rolled back / %d statements autocommitted",
+		txnStats.count, float64(txnStats.count)/elapsed, rate, txnStats.autocommit)
+	if txnStats.count > 0 {
+		min, avg, max := calculateTimes(&txnStats.times)
+		p50, p95, p99 := calculatePercentiles(&txnStats.times)
+		log.Printf("%0.2fms min / %0.2fms avg / %0.2fms max / %0.2fms p50 / %0.2fms p95 / %0.2fms p99 transaction times",
+			min, avg, max, p50, p95, p99)
+		s := &txnStats.statements
+		log.Printf("%0.1f avg / %d max / %d p95 statements per transaction", s.mean, s.Max(), s.Quantile(0.95))
+	}
+	if rs, txn := longestTransaction(); txn != nil {
+		log.Printf("Open longest: %0.1fs and %d statements so far, on %s", processNow().Sub(txn.start).Seconds(),
+			txn.statements, rs.src)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+ * tui.go
+ *
+ * A full screen, top-like view of the queries going by. It redraws every
+ * second from the same numbers as the status report, so the interval
+ * resets still apply (run with -cumulative to watch totals instead).
+ *
+ * Keys:
+ *     c a m 9 s b e  sort by count, avg, max, p99, stddev, bytes or errors
+ *     /              filter on the query text (enter to apply, esc to clear)
+ *     space          pause the display (capture carries on)
+ *     up/down, j/k   move the selection
+ *     enter          show the recent samples for the selected query
+ *     p              show the connections instead, see processlist.go
+ *     esc            back to the list
+ *     q              quit
+ *
+ * There's no curses here, just ANSI escapes and a raw mode terminal (see
+ * tui_unix.go).
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	TUI_SAMPLES = 50 // recent samples kept per query
+	TUI_REFRESH = time.Second
+)
+
+type tuiSample struct {
+	at      time.Time
+	client  string
+	latency uint64
+	ttfb    uint64
+	bytes   uint64
+}
+
+type tuiState struct {
+	saved    termState
+	keys     chan []byte
+	sortby   string
+	filter   string
+	editing  bool   // typing in a filter
+	input    string // the filter being typed
+	paused   bool
+	selected int
+	detail   string      // the query being looked at, if any
+	procs    bool        // looking at the process list
+	rows     []reportRow // what's on screen
+	samples  map[string][]tuiSample
+	drawn    time.Time
+}
+
+var tui *tuiState
+
+// startTUI puts the terminal in raw mode on the alternate screen and starts
+// reading keys.
+func startTUI(sortby string) {
+	self := &tuiState{
+		keys:    make(chan []byte, 16),
+		sortby:  sortby,
+		samples: make(map[string][]tuiSample),
+	}
+	var err error
+	if self.saved, err = makeRaw(os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "-tui needs a terminal: %s\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+
+	go func() {
+		for {
+			buf := make([]byte, 16)
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				return
+			}
+			self.keys <- buf[:n]
+		}
+	}()
+	tui = self
+}
+
+// stop puts the terminal back how we found it.
+func (self *tuiState) stop() {
+	os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+	restoreTerm(os.Stdin, &self.saved)
+}
+
+// sample remembers one timed query for the detail view.
+func (self *tuiState) sample(rs *source, req *pendingRequest, ts time.Time, reqtime uint64) {
+	if req.qdata == nil {
+		return
+	}
+	s := self.samples[req.text]
+	if len(s) >= TUI_SAMPLES {
+		s = s[1:]
+	}
+	self.samples[req.text] = append(s, tuiSample{ts, rs.sender(req), reqtime, req.ttfb, req.rbytes})
+}
+
+// service handles any keys that came in and redraws if it's time. The
+// capture loop calls it paused, every tick.
+func (self *tuiState) service() {
+	changed := false
+	for done := false; !done; {
+		select {
+		case key := <-self.keys:
+			self.key(key)
+			changed = true
+		default:
+			done = true
+		}
+	}
+	if changed || time.Since(self.drawn) >= TUI_REFRESH {
+		self.draw()
+	}
+}
+
+func (self *tuiState) key(key []byte) {
+	k := string(key)
+	if self.editing {
+		switch {
+		case k == "\r" || k == "\n":
+			self.filter, self.editing, self.selected = self.input, false, 0
+		case k == "\x1b":
+			self.filter, self.input, self.editing = "", "", false
+		case k == "\x7f" || k == "\b":
+			if len(self.input) > 0 {
+				_, size := utf8.DecodeLastRuneInString(self.input)
+				self.input = self.input[:len(self.input)-size]
+			}
+		case k[0] >= ' ' && utf8.ValidString(k):
+			self.input += k
+		}
+		return
+	}
+
+	switch k {
+	case "q", "\x03":
+		stop()
+	case "c":
+		self.sortby = "count"
+	case "a":
+		self.sortby = "avg"
+	case "m":
+		self.sortby = "max"
+	case "9":
+		self.sortby = "p99"
+	case "s":
+		self.sortby = "stddev"
+	case "b":
+		self.sortby = "maxbytes"
+	case "e":
+		self.sortby = "errors"
+	case "/":
+		self.editing, self.input = true, self.filter
+	case " ":
+		self.paused = !self.paused
+	case "j", "\x1b[B":
+		if self.selected < len(self.rows)-1 {
+			self.selected++
+		}
+	case "k", "\x1b[A":
+		if self.selected > 0 {
+			self.selected--
+		}
+	case "\r", "\n":
+		if self.detail == "" && self.selected < len(self.rows) {
+			self.detail = self.rows[self.selected].query
+		}
+	case "p":
+		self.procs = !self.procs
+	case "\x1b", "\x7f":
+		self.detail, self.procs = "", false
+	}
+}
+
+// clip cuts s down to width characters, never in the middle of one.
+func clip(s string, width int) string {
+	if len(s) <= width {
+		return s
+	}
+	n := 0
+	for i := range s {
+		if n == width {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
+
+func (self *tuiState) draw() {
+	self.drawn = time.Now()
+	height, width := termSize(os.Stdout)
+	lifetime := elapsedSince(start)
+	elapsed := lifetime
+	if !cumulative {
+		elapsed = elapsedSince(intervalStart)
+	}
+
+	if !self.paused {
+		self.rows = self.rows[:0]
+		filter := strings.ToLower(self.filter)
+		for _, r := range buildReport(elapsed, lifetime, self.sortby, 0) {
+			if filter == "" || strings.Contains(strings.ToLower(r.query), filter) {
+				self.rows = append(self.rows, r)
+			}
+		}
+	}
+	if self.selected >= len(self.rows) {
+		self.selected = len(self.rows) - 1
+	}
+	if self.selected < 0 {
+		self.selected = 0
+	}
+
+	var lines []string
+	count, rate := intervalcount, float64(intervalcount)/elapsed
+	if cumulative {
+		count, rate = querycount, float64(querycount)/lifetime
+	}
+	status := fmt.Sprintf("mysql-sniffer: %d queries, %.2f/s, %d unique, sorted by %s",
+		count, rate, len(qbuf), self.sortby)
+	if self.filter != "" {
+		status += ", filter: " + self.filter
+	}
+	if self.paused {
+		status += " [paused]"
+	}
+	lines = append(lines, status)
+	if self.editing {
+		lines = append(lines, "filter: "+self.input+"_")
+	} else {
+		lines = append(lines, "c/a/m/9/s/b/e sort  / filter  space pause  enter details  p connections  q quit")
+	}
+	lines = append(lines, "")
+
+	if self.procs {
+		lines = append(lines, processLines(processList(processNow()), width)...)
+	} else if self.detail != "" {
+		lines = append(lines, self.detailLines(elapsed, lifetime, width)...)
+	} else {
+		lines = append(lines, fmt.Sprintf("%8s %9s %8s %8s %8s %10s  %s",
+			"count", "qps", "avg ms", "p99 ms", "max ms", "bytes", "query"))
+		// Scroll to keep the selection on screen.
+		first := 0
+		if visible := height - len(lines); self.selected >= visible {
+			first = self.selected - visible + 1
+		}
+		for i := first; i < len(self.rows) && len(lines) < height; i++ {
+			r := self.rows[i]
+			line := clip(fmt.Sprintf("%8d %9.2f %8.2f %8.2f %8.2f %10d  %s",
+				r.count, r.qps, r.avg, r.p99, r.max, r.bytes, r.query), width)
+			if i == self.selected {
+				line = "\x1b[7m" + line + "\x1b[0m"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	os.Stdout.WriteString("\x1b[H\x1b[2J" + strings.Join(lines, "\r\n"))
+}
+
+func (self *tuiState) detailLines(elapsed, lifetime float64, width int) []string {
+	lines := append(wrap(self.detail, width), "")
+	if c, ok := qbuf[self.detail]; ok {
+		r := newReportRow(self.detail, c, elapsed, lifetime)
+		lines = append(lines,
+			fmt.Sprintf("id %s, count %d (%d total), %.2f/s, %d bytes", r.id, r.count, c.total, r.qps, r.bytes),
+			fmt.Sprintf("min %.2fms  avg %.2fms  max %.2fms  stddev %.2fms  ttfb %.2fms",
+				r.min, r.avg, r.max, r.stddev, r.ttfb),
+			fmt.Sprintf("p50 %.2fms  p95 %.2fms  p99 %.2fms", r.p50, r.p95, r.p99),
+			"")
+	}
+
+	lines = append(lines, fmt.Sprintf("%-15s %-21s %10s %10s %10s", "time", "client", "ms", "ttfb ms", "bytes"))
+	samples := self.samples[self.detail]
+	for i := len(samples) - 1; i >= 0; i-- {
+		s := samples[i]
+		lines = append(lines, fmt.Sprintf("%-15s %-21s %10.2f %10.2f %10d", s.at.Format("15:04:05.000000"),
+			s.client, float64(s.latency)/1000000, float64(s.ttfb)/1000000, s.bytes))
+	}
+	return lines
+}
+
+// wrap breaks s into lines of at most width characters.
+func wrap(s string, width int) []string {
+	var out []string
+	for utf8.RuneCountInString(s) > width {
+		line := clip(s, width)
+		out = append(out, line)
+		s = s[len(line):]
+	}
+	return append(out, s)
+}
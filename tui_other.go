@@ -0,0 +1,34 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+/*
+ * tui_other.go
+ *
+ * No raw mode or window size where tui_unix.go doesn't build, so -tui
+ * refuses to start and the status report goes without colours.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+type termState struct{}
+
+func makeRaw(f *os.File) (termState, error) {
+	return termState{}, errors.New("only supported on Linux and the BSDs")
+}
+
+func restoreTerm(f *os.File, saved *termState) {
+}
+
+func termSize(f *os.File) (int, int) {
+	return 24, 80
+}
+
+// Without a way to ask, we don't assume a terminal and leave out colours.
+func isTerminal(f *os.File) bool {
+	return false
+}
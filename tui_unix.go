@@ -0,0 +1,60 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+/*
+ * tui_unix.go
+ *
+ * The terminal handling for -tui and the status report's colours and
+ * widths: raw mode and the window size, straight through ioctl. The
+ * requests are named differently on Linux and the BSDs, see tui_term_*.go.
+ */
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+type termState = syscall.Termios
+
+// makeRaw puts f in raw mode (no echo, no line editing, no signals from
+// ^C) and returns how it was, for restoreTerm.
+func makeRaw(f *os.File) (termState, error) {
+	var saved termState
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlGetTermios,
+		uintptr(unsafe.Pointer(&saved))); errno != 0 {
+		return saved, errno
+	}
+	raw := saved
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlSetTermios, uintptr(unsafe.Pointer(&raw)))
+	return saved, nil
+}
+
+func restoreTerm(f *os.File, saved *termState) {
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlSetTermios, uintptr(unsafe.Pointer(saved)))
+}
+
+// termSize returns the terminal's rows and columns.
+func termSize(f *os.File) (int, int) {
+	var ws [4]uint16
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGWINSZ,
+		uintptr(unsafe.Pointer(&ws)))
+	if ws[0] == 0 || ws[1] == 0 {
+		return 24, 80
+	}
+	return int(ws[0]), int(ws[1])
+}
+
+// isTerminal says whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlGetTermios,
+		uintptr(unsafe.Pointer(&t)))
+	return errno == 0
+}
@@ -0,0 +1,215 @@
+/*
+ * webhook.go
+ *
+ * Sends alerts to a webhook so the sniffer can page someone when it runs as
+ * a service: the rows over their baseline or error rate (see alert.go) and
+ * any queries that took longer than -webhook-slow-ms, plus whatever else
+ * gets handed to Add (like -no-where-alert). Everything from one
+ * report goes out together, so a bad minute is one message rather than
+ * thousands.
+ *
+ * Like -elastic, the posts go out from a goroutine, so a slow endpoint
+ * can't hold up the capture; if it falls WEBHOOK_QUEUE posts behind, the
+ * rest are dropped and we say so.
+ *
+ * The default body is JSON with a "text" summary, which is what Slack's
+ * incoming webhooks want, and the alerts themselves for anything else. With
+ * -webhook-format pagerduty each alert is an Events API v2 event instead,
+ * keyed on the query so repeats roll up into one incident.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	WEBHOOK_TIMEOUT    = 10 * time.Second
+	WEBHOOK_MAX_ALERTS = 20 // per report, the rest are just counted
+	WEBHOOK_QUEUE      = 64 // posts waiting to be sent
+	PAGERDUTY_URL      = "https://events.pagerduty.com/v2/enqueue"
+)
+
+type webhookAlert struct {
+	Kind    string `json:"kind"` // "slow", "query" for alert.go's, or whoever called Add
+	ID      string `json:"query_id"`
+	Query   string `json:"query"`
+	Message string `json:"message"`
+	Client  string `json:"client,omitempty"`
+	User    string `json:"user,omitempty"`
+}
+
+type webhookSink struct {
+	url     string
+	format  string
+	key     string // PagerDuty routing key
+	slowMs  float64
+	host    string
+	client  *http.Client
+	slow    map[string]*webhookAlert // this report's slow queries, by query
+	slowest map[string]uint64
+	counts  map[string]int
+	added   []webhookAlert
+	queue   chan []byte
+	done    chan bool
+	dropped int
+}
+
+var webhook *webhookSink
+
+func openWebhook(url, format, key string, slowMs float64) *webhookSink {
+	switch format {
+	case "json":
+	case "pagerduty":
+		if key == "" {
+			fatalf("-webhook-format pagerduty needs a -webhook-key")
+		}
+		if url == "" {
+			url = PAGERDUTY_URL
+		}
+	default:
+		fatalf("Unknown -webhook-format %s, expected json or pagerduty", format)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		fatalf("Bad -webhook URL %s: expected an http(s) URL", url)
+	}
+	host, _ := os.Hostname()
+	self := &webhookSink{
+		url:    url,
+		format: format,
+		key:    key,
+		slowMs: slowMs,
+		host:   host,
+		client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		queue:  make(chan []byte, WEBHOOK_QUEUE),
+		done:   make(chan bool),
+	}
+	self.reset()
+	go self.sender()
+	return self
+}
+
+func (self *webhookSink) reset() {
+	self.slow = make(map[string]*webhookAlert)
+	self.slowest = make(map[string]uint64)
+	self.counts = make(map[string]int)
+	self.added = nil
+}
+
+// Add queues an alert to go out with the next report.
+func (self *webhookSink) Add(alert webhookAlert) {
+	self.added = append(self.added, alert)
+}
+
+// Slow notes a query if it was over -webhook-slow-ms, keeping the slowest
+// of each until the next report.
+func (self *webhookSink) Slow(rs *source, req *pendingRequest, reqtime uint64) {
+	if self.slowMs <= 0 || req.qdata == nil || float64(reqtime)/1000000 < self.slowMs {
+		return
+	}
+	self.counts[req.text]++
+	if reqtime <= self.slowest[req.text] {
+		return
+	}
+	self.slowest[req.text] = reqtime
+	self.slow[req.text] = &webhookAlert{Kind: "slow", ID: queryID(req.text), Query: req.text,
+		Client: rs.sender(req), User: rs.user}
+}
+
+// Write sends whatever alerts came up in this report.
+func (self *webhookSink) Write(rows []reportRow, elapsed float64) {
+	if self.dropped > 0 {
+		logger.Warn("Dropped webhook posts, the endpoint isn't keeping up", "url", self.url, "posts", self.dropped)
+		self.dropped = 0
+	}
+	var alerts []webhookAlert
+	for _, r := range rows {
+		if r.alert != "" {
+			alerts = append(alerts, webhookAlert{Kind: "query", ID: r.id, Query: r.query, Message: r.alert})
+		}
+	}
+	for q, a := range self.slow {
+		a.Message = fmt.Sprintf("%d queries over %gms, the slowest took %0.2fms", self.counts[q],
+			self.slowMs, float64(self.slowest[q])/1000000)
+		alerts = append(alerts, *a)
+	}
+	alerts = append(alerts, self.added...)
+	self.reset()
+	if len(alerts) == 0 {
+		return
+	}
+	more := 0
+	if len(alerts) > WEBHOOK_MAX_ALERTS {
+		alerts, more = alerts[:WEBHOOK_MAX_ALERTS], len(alerts)-WEBHOOK_MAX_ALERTS
+	}
+
+	if self.format == "pagerduty" {
+		for _, a := range alerts {
+			self.post(map[string]interface{}{
+				"routing_key":  self.key,
+				"event_action": "trigger",
+				"dedup_key":    "mysql-sniffer-" + a.Kind + "-" + a.ID,
+				"payload": map[string]interface{}{
+					"summary":        clip(a.Message+": "+a.Query, 1024),
+					"source":         self.host,
+					"severity":       "warning",
+					"component":      "mysql",
+					"custom_details": a,
+				},
+			})
+		}
+		return
+	}
+
+	lines := []string{fmt.Sprintf("mysql-sniffer on %s: %d alerts", self.host, len(alerts)+more)}
+	for _, a := range alerts {
+		lines = append(lines, fmt.Sprintf("%s %s: %s", a.ID, a.Message, clip(a.Query, 200)))
+	}
+	if more > 0 {
+		lines = append(lines, fmt.Sprintf("...and %d more", more))
+	}
+	self.post(map[string]interface{}{
+		"text":   strings.Join(lines, "\n"),
+		"host":   self.host,
+		"alerts": alerts,
+		"more":   more,
+	})
+}
+
+// post hands one request to the sender, or drops it if it's too far behind.
+func (self *webhookSink) post(body interface{}) {
+	data, _ := json.Marshal(body)
+	select {
+	case self.queue <- data:
+	default:
+		self.dropped++
+	}
+}
+
+func (self *webhookSink) sender() {
+	for data := range self.queue {
+		resp, err := self.client.Post(self.url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			logger.Warn("Failed to send alerts", "url", self.url, "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			logger.Warn("Failed to send alerts", "url", self.url, "status", resp.Status)
+		}
+	}
+	close(self.done)
+}
+
+// Close waits for anything queued to go out.
+func (self *webhookSink) Close() {
+	close(self.queue)
+	<-self.done
+}
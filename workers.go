@@ -0,0 +1,154 @@
+/*
+ * workers.go
+ *
+ * With -workers N, packets get parsed on N goroutines instead of the main
+ * loop. Every connection belongs to one worker, picked by hashing its
+ * addresses and ports (the same both ways, so requests and responses land
+ * together), and that worker owns its streams: nobody else touches them
+ * while it's handling a packet.
+ *
+ * The counting is shared, so qbuf, tbuf, the histograms, stats and the
+ * sinks all sit behind stateMu. The expensive part of a request (cleaning
+ * up and fingerprinting the query) only needs the request itself, so that's
+ * done before taking the lock; see processRequest.
+ *
+ * Anything from outside the packet path (reports, the API, signals, the
+ * TUI) calls pause first, which waits for every worker to finish its
+ * packet and then takes stateMu, so it can look at everything as if it
+ * were still all on one goroutine. Locks are always taken in that order,
+ * workers then state, so nobody deadlocks.
+ *
+ * One worker (the default) just runs on the main loop, as before.
+ */
+
+package main
+
+import (
+	"github.com/akrennmair/gopcap"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const WORKER_QUEUE = 1024 // packets waiting on each worker
+
+type worker struct {
+	mu        sync.Mutex // held while handling a packet
+	streams   map[string]*source
+	lastSweep time.Time
+	packets   chan *pcap.Packet
+	done      chan bool
+}
+
+var workers []*worker
+var stateMu sync.Mutex
+
+func newWorker() *worker {
+	return &worker{streams: make(map[string]*source)}
+}
+
+// startWorkers sets up n workers, starting goroutines for them if there's
+// more than one.
+func startWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	workers = make([]*worker, n)
+	for i := range workers {
+		workers[i] = newWorker()
+		if n > 1 {
+			workers[i].packets = make(chan *pcap.Packet, WORKER_QUEUE)
+			workers[i].done = make(chan bool)
+			go workers[i].run()
+		}
+	}
+}
+
+func (self *worker) run() {
+	for pkt := range self.packets {
+		self.handle(pkt)
+	}
+	close(self.done)
+}
+
+func (self *worker) handle(pkt *pcap.Packet) {
+	self.mu.Lock()
+	handlePacket(self, pkt)
+	self.mu.Unlock()
+}
+
+// stopWorkers waits for the workers to get through what they've been given.
+func stopWorkers() {
+	for _, w := range workers {
+		if w.packets != nil {
+			close(w.packets)
+			<-w.done
+		}
+	}
+}
+
+// dispatch hands a packet to the worker for its connection.
+func dispatch(pkt *pcap.Packet) {
+	if len(workers) == 1 {
+		workers[0].handle(pkt)
+		return
+	}
+	workers[packetWorker(pkt)].packets <- pkt
+}
+
+// packetWorker picks the worker for a packet. Adding up both ends makes it
+// the same whichever way the packet is going; anything we can't read goes
+// to the first worker, which will throw it away.
+func packetWorker(pkt *pcap.Packet) int {
+	ip := linkToIP(pkt.Type, pkt.Data)
+	if len(ip) < 20 {
+		return 0
+	}
+	pos := int(ip[0]&0x0F) * 4
+	if len(ip) < pos+4 {
+		return 0
+	}
+	var ends [6]byte
+	for i := 0; i < 4; i++ {
+		ends[i] = ip[12+i] + ip[16+i]
+	}
+	p := (uint16(ip[pos])<<8 | uint16(ip[pos+1])) + (uint16(ip[pos+2])<<8 | uint16(ip[pos+3]))
+	ends[4], ends[5] = byte(p>>8), byte(p)
+	h := fnv.New32a()
+	h.Write(ends[:])
+	return int(h.Sum32() % uint32(len(workers)))
+}
+
+// pause stops the world: no worker is in the middle of a packet and we hold
+// the state, until resume.
+func pause() {
+	for _, w := range workers {
+		w.mu.Lock()
+	}
+	stateMu.Lock()
+}
+
+func resume() {
+	stateMu.Unlock()
+	for i := len(workers) - 1; i >= 0; i-- {
+		workers[i].mu.Unlock()
+	}
+}
+
+// streamCount is how many connections we're following. Call it paused.
+func streamCount() int {
+	n := 0
+	for _, w := range workers {
+		n += len(w.streams)
+	}
+	return n
+}
+
+// eachStream calls fn for every connection we're following. Call it paused.
+func eachStream(fn func(rs *source)) {
+	for _, w := range workers {
+		for _, rs := range w.streams {
+			fn(rs)
+		}
+	}
+}